@@ -0,0 +1,197 @@
+// Package breaker implements a circuit breaker, which stops calling the cache
+// engine after consecutive failures and probes it again after a while.
+package breaker
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultThreshold   = 5
+	defaultOpenTimeout = 10 * time.Second
+	defaultProbes      = 1
+	defaultName        = "default"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// metrics holds a map of each breaker by its name.
+var metrics = expvar.NewMap("cache_breaker")
+
+type State int
+
+const (
+	// Closed lets every call go through.
+	Closed State = iota
+	// Open rejects every call until OpenTimeout passed.
+	Open
+	// HalfOpen lets a few probing calls go through, it turns to Closed if
+	// they all succeed, or back to Open if any fails.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type Config struct {
+	// Threshold is the number of consecutive failures to open the breaker.
+	Threshold int
+	// OpenTimeout is how long to stay open before probing.
+	OpenTimeout time.Duration
+	// Probes is the number of successful probes to close the breaker.
+	Probes int
+	// Name identifies the metrics of the breaker, "default" by default.
+	Name string
+}
+
+// Stats is reported through the health endpoint.
+type Stats struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+type Breaker struct {
+	config  Config
+	logger  *zap.Logger
+	metrics *expvar.Map
+
+	mu        sync.Mutex
+	state     State
+	failures  int // consecutive failures while closed
+	openedAt  time.Time
+	probing   int // in-flight probes while half-open
+	successes int // successful probes while half-open
+	// generation is increased whenever the state changes, so that the probes
+	// finished after that are ignored.
+	generation int
+}
+
+func New(config Config, logger *zap.Logger) *Breaker {
+	if config.Threshold <= 0 {
+		config.Threshold = defaultThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = defaultOpenTimeout
+	}
+	if config.Probes <= 0 {
+		config.Probes = defaultProbes
+	}
+	if config.Name == "" {
+		config.Name = defaultName
+	}
+	b := &Breaker{config: config, logger: logger, metrics: new(expvar.Map).Init()}
+	b.metrics.Set("state", expvar.Func(func() interface{} {
+		return b.State().String()
+	}))
+	metrics.Set(config.Name, b.metrics)
+	return b
+}
+
+// Allow reports whether a call is able to go through. If so, done must be
+// called with whether the call failed.
+func (b *Breaker) Allow() (done func(failed bool), ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			b.metrics.Add("rejected", 1)
+			return nil, false
+		}
+		b.setState(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.probing+b.successes >= b.config.Probes {
+			b.metrics.Add("rejected", 1)
+			return nil, false
+		}
+		b.probing++
+		generation := b.generation
+		return func(failed bool) { b.probed(generation, failed) }, true
+	}
+	return b.called, true
+}
+
+func (b *Breaker) called(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.metrics.Add("failures", 1)
+	b.failures++
+	if b.state == Closed && b.failures >= b.config.Threshold {
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) probed(generation int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.generation != generation {
+		return
+	}
+	b.probing--
+	if failed {
+		b.metrics.Add("failures", 1)
+		b.setState(Open)
+		return
+	}
+	b.successes++
+	if b.successes >= b.config.Probes {
+		b.setState(Closed)
+	}
+}
+
+// setState should be called with lock held.
+func (b *Breaker) setState(state State) {
+	b.logger.Warn("cache circuit breaker state changed", zap.String("breaker", b.config.Name),
+		zap.Stringer("from", b.state), zap.Stringer("to", state), zap.Int("failures", b.failures))
+	b.state = state
+	b.generation++
+	b.probing, b.successes = 0, 0
+	switch state {
+	case Open:
+		b.openedAt = time.Now()
+		b.metrics.Add("opened", 1)
+	case Closed:
+		b.failures = 0
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := Stats{State: b.state.String(), Failures: b.failures}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
@@ -0,0 +1,62 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func call(b *Breaker, failed bool) bool {
+	done, ok := b.Allow()
+	if ok {
+		done(failed)
+	}
+	return ok
+}
+
+func TestBreaker(t *testing.T) {
+	b := New(Config{Threshold: 3, OpenTimeout: 20 * time.Millisecond, Probes: 2}, zap.NewNop())
+
+	call(b, true)
+	call(b, true)
+	call(b, false) // a success resets the consecutive failures
+	call(b, true)
+	call(b, true)
+	assert.Equal(t, Closed, b.State())
+	call(b, true)
+	assert.Equal(t, Open, b.State())
+	assert.False(t, call(b, false), "open breaker rejects calls")
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, call(b, true), "probe after open timeout")
+	assert.Equal(t, Open, b.State(), "failed probe opens the breaker again")
+	assert.False(t, call(b, false))
+
+	time.Sleep(30 * time.Millisecond)
+	done1, ok := b.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, HalfOpen, b.State())
+	done2, ok := b.Allow()
+	assert.True(t, ok)
+	_, ok = b.Allow()
+	assert.False(t, ok, "only limited probes in flight")
+	done1(false)
+	assert.Equal(t, HalfOpen, b.State())
+	done2(false)
+	assert.Equal(t, Closed, b.State())
+	assert.Equal(t, "closed", b.Stats().State)
+}
+
+func TestBreaker_stale_probe(t *testing.T) {
+	b := New(Config{Threshold: 1, OpenTimeout: 10 * time.Millisecond, Probes: 2}, zap.NewNop())
+	call(b, true)
+	time.Sleep(20 * time.Millisecond)
+
+	stale, _ := b.Allow()
+	call(b, true) // the other probe fails
+	assert.Equal(t, Open, b.State())
+	stale(false)
+	assert.Equal(t, Open, b.State(), "probe of the previous half-open state is ignored")
+}
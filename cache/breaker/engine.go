@@ -0,0 +1,245 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"goshorturl/cache/cacher"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnsupported is returned by the optional interfaces which the wrapped
+// engine does not implement.
+var ErrUnsupported = errors.New("unsupported by the cache engine")
+
+// maxPending bounds the invalidations queued while the engine is not
+// reachable, the whole engine is flushed instead once exceeded if it is a
+// cacher.Flusher, otherwise the entries are left to expire by their TTL.
+const maxPending = 100000
+
+// Wrap returns an engine which calls engine only if the breaker allows,
+// otherwise it fails fast with ErrOpen. The deletions and sets rejected or
+// failed are queued as invalidations, and replayed before any other call
+// once the breaker allows again, so that the deleted or flagged links are
+// not redirected by the stale entries. The queue is kept in process, i.e. it
+// is lost if the replica exits before the engine recovers.
+//
+// The returned engine also forwards the optional cacher.Counter,
+// cacher.Flusher, cacher.Notifier and cacher.Pinger of engine.
+func Wrap(engine cacher.Engine, b *Breaker) cacher.Engine {
+	return &guarded{engine: engine, breaker: b, pending: make(map[string]struct{})}
+}
+
+type guarded struct {
+	engine  cacher.Engine
+	breaker *Breaker
+
+	// queued is the number of pending ids plus one if overflowed, which is
+	// checked without lock in the hot path.
+	queued     int64
+	mu         sync.Mutex
+	pending    map[string]struct{}
+	overflowed bool
+}
+
+// failed reports whether err means the engine is unhealthy, a missing entry
+// is a normal result.
+func failed(err error) bool {
+	return err != nil &&
+		!errors.Is(err, cacher.ErrEntryNotFound) &&
+		!errors.Is(err, cacher.ErrSerializeFailed)
+}
+
+func (g *guarded) call(f func() error) error {
+	done, ok := g.breaker.Allow()
+	if !ok {
+		return ErrOpen
+	}
+	if err := g.replay(); err != nil {
+		done(true)
+		return err
+	}
+	err := f()
+	done(failed(err))
+	return err
+}
+
+// queue queues the deletion of id to be replayed.
+func (g *guarded) queue(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.overflowed {
+		return
+	}
+	if _, ok := g.pending[id]; ok {
+		return
+	}
+	if len(g.pending) >= maxPending {
+		g.pending = make(map[string]struct{})
+		g.overflowed = true
+		atomic.StoreInt64(&g.queued, 1)
+		g.breaker.metrics.Add("invalidationsOverflowed", 1)
+		return
+	}
+	g.pending[id] = struct{}{}
+	atomic.AddInt64(&g.queued, 1)
+	g.breaker.metrics.Add("invalidationsQueued", 1)
+}
+
+// replay deletes the entries and the counters of the queued ids, or flushes
+// the engine if overflowed. It returns the first failure, and the ids not
+// deleted yet are kept queued.
+func (g *guarded) replay() error {
+	if atomic.LoadInt64(&g.queued) == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.overflowed {
+		if flusher, ok := g.engine.(cacher.Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				return err
+			}
+		}
+		g.overflowed = false
+		atomic.AddInt64(&g.queued, -1)
+	}
+	counter, _ := g.engine.(cacher.Counter)
+	for id := range g.pending {
+		if err := g.engine.Delete(id); failed(err) {
+			return err
+		}
+		if counter != nil {
+			if err := counter.DeleteCounter(id); failed(err) {
+				return err
+			}
+		}
+		delete(g.pending, id)
+		atomic.AddInt64(&g.queued, -1)
+		g.breaker.metrics.Add("invalidationsReplayed", 1)
+	}
+	return nil
+}
+
+func (g *guarded) Get(id string) (entry *cacher.Entry, found bool, err error) {
+	err = g.call(func() error {
+		entry, found, err = g.engine.Get(id)
+		return err
+	})
+	return entry, found, err
+}
+
+func (g *guarded) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	err := g.call(func() error {
+		return g.engine.Set(id, entry, expiration)
+	})
+	if failed(err) {
+		// the existent entry may be outdated, e.g. of a recycled id
+		g.queue(id)
+	}
+	return err
+}
+
+func (g *guarded) Delete(id string) error {
+	err := g.call(func() error {
+		return g.engine.Delete(id)
+	})
+	if failed(err) {
+		g.queue(id)
+	}
+	return err
+}
+
+func (g *guarded) Check(id string, lease time.Duration) (lock cacher.Lock, err error) {
+	err = g.call(func() error {
+		lock, err = g.engine.Check(id, lease)
+		return err
+	})
+	return lock, err
+}
+
+// SetCounter does nothing if the engine does not implement cacher.Counter.
+func (g *guarded) SetCounter(id string, n int64, expiration time.Duration) error {
+	counter, ok := g.engine.(cacher.Counter)
+	if !ok {
+		return nil
+	}
+	return g.call(func() error {
+		return counter.SetCounter(id, n, expiration)
+	})
+}
+
+// Decr reports the counter is not found if the engine does not implement
+// cacher.Counter.
+func (g *guarded) Decr(id string) (n int64, found bool, err error) {
+	counter, ok := g.engine.(cacher.Counter)
+	if !ok {
+		return 0, false, nil
+	}
+	err = g.call(func() error {
+		n, found, err = counter.Decr(id)
+		return err
+	})
+	return n, found, err
+}
+
+// DeleteCounter does nothing if the engine does not implement
+// cacher.Counter. The failed deletion is queued as well, the counter is
+// restored from the database once deleted by the replay.
+func (g *guarded) DeleteCounter(id string) error {
+	counter, ok := g.engine.(cacher.Counter)
+	if !ok {
+		return nil
+	}
+	err := g.call(func() error {
+		return counter.DeleteCounter(id)
+	})
+	if failed(err) {
+		g.queue(id)
+	}
+	return err
+}
+
+// Flush does nothing if the engine does not implement cacher.Flusher.
+func (g *guarded) Flush() error {
+	flusher, ok := g.engine.(cacher.Flusher)
+	if !ok {
+		return nil
+	}
+	return g.call(flusher.Flush)
+}
+
+// Publish fails with ErrUnsupported if the engine does not implement
+// cacher.Notifier.
+func (g *guarded) Publish(channel, message string) error {
+	notifier, ok := g.engine.(cacher.Notifier)
+	if !ok {
+		return ErrUnsupported
+	}
+	return g.call(func() error {
+		return notifier.Publish(channel, message)
+	})
+}
+
+// Subscribe subscribes regardless of the breaker since it blocks, and the
+// subscriber resubscribes by itself once broken. It fails with
+// ErrUnsupported if the engine does not implement cacher.Notifier.
+func (g *guarded) Subscribe(ctx context.Context, channel string, handler func(message string)) error {
+	notifier, ok := g.engine.(cacher.Notifier)
+	if !ok {
+		return ErrUnsupported
+	}
+	return notifier.Subscribe(ctx, channel, handler)
+}
+
+// Ping pings the engine regardless of the breaker, so that the health checks
+// report the real state of the engine.
+func (g *guarded) Ping() error {
+	if pinger, ok := g.engine.(cacher.Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
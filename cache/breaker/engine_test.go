@@ -0,0 +1,124 @@
+package breaker
+
+import (
+	"errors"
+	"expvar"
+	"goshorturl/cache/cacher"
+	"goshorturl/cache/inmemory"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var errDown = errors.New("engine is down")
+
+// flakyEngine fails every call while down.
+type flakyEngine struct {
+	cacher.Engine
+	down bool
+}
+
+func (f *flakyEngine) Get(id string) (*cacher.Entry, bool, error) {
+	if f.down {
+		return nil, false, errDown
+	}
+	return f.Engine.Get(id)
+}
+
+func (f *flakyEngine) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	if f.down {
+		return errDown
+	}
+	return f.Engine.Set(id, entry, expiration)
+}
+
+func (f *flakyEngine) Delete(id string) error {
+	if f.down {
+		return errDown
+	}
+	return f.Engine.Delete(id)
+}
+
+func TestWrap_replays_invalidations(t *testing.T) {
+	engine := &flakyEngine{Engine: inmemory.New(time.Hour, time.Hour)}
+	b := New(Config{Threshold: 1, OpenTimeout: 10 * time.Millisecond, Name: "replay"}, zap.NewNop())
+	g := Wrap(engine, b)
+	assert.NoError(t, g.Set("deleted", &cacher.Entry{Url: "https://example.com"}, time.Hour))
+	assert.NoError(t, g.Set("recycled", &cacher.Entry{Url: "https://example.com/old"}, time.Hour))
+
+	engine.down = true
+	assert.Error(t, g.Delete("deleted"))
+	assert.Equal(t, Open, b.State())
+	assert.Equal(t, ErrOpen, g.Set("recycled", &cacher.Entry{Url: "https://example.com/new"}, time.Hour))
+
+	engine.down = false
+	time.Sleep(20 * time.Millisecond)
+	_, found, _ := g.Get("deleted")
+	assert.False(t, found, "should not be served from the stale entry")
+	_, found, _ = g.Get("recycled")
+	assert.False(t, found, "should not be served from the stale entry")
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestWrap_replay_fails(t *testing.T) {
+	engine := &flakyEngine{Engine: inmemory.New(time.Hour, time.Hour)}
+	b := New(Config{Threshold: 1, OpenTimeout: 10 * time.Millisecond, Name: "replay_fails"}, zap.NewNop())
+	g := Wrap(engine, b)
+	assert.NoError(t, g.Set("a", &cacher.Entry{}, time.Hour))
+
+	engine.down = true
+	assert.Error(t, g.Delete("a"))
+	time.Sleep(20 * time.Millisecond)
+	_, _, err := g.Get("b")
+	assert.Error(t, err, "the probe fails by the replay")
+	assert.Equal(t, Open, b.State())
+
+	engine.down = false
+	time.Sleep(20 * time.Millisecond)
+	_, found, err := g.Get("a")
+	assert.Equal(t, cacher.ErrEntryNotFound, err)
+	assert.False(t, found, "should be kept queued until deleted")
+}
+
+func TestNew_metrics_of_each_breaker(t *testing.T) {
+	opened := New(Config{Threshold: 1, Name: "opened"}, zap.NewNop())
+	New(Config{Threshold: 1, Name: "closed"}, zap.NewNop())
+	call(opened, true)
+
+	state := func(name string) string {
+		return metrics.Get(name).(*expvar.Map).Get("state").String()
+	}
+	assert.Equal(t, `"open"`, state("opened"))
+	assert.Equal(t, `"closed"`, state("closed"))
+}
+
+func TestWrap_flushes_on_overflow(t *testing.T) {
+	engine := inmemory.NewBounded(inmemory.Config{DefaultExp: time.Hour})
+	b := New(Config{Threshold: 1, OpenTimeout: 500 * time.Millisecond, Name: "overflow"}, zap.NewNop())
+	g := Wrap(engine, b)
+	assert.NoError(t, g.Set("a", &cacher.Entry{Url: "https://example.com"}, time.Hour))
+
+	call(b, true)
+	for i := 0; i <= maxPending; i++ {
+		g.Delete(strconv.Itoa(i))
+	}
+	assert.Equal(t, Open, b.State())
+	time.Sleep(600 * time.Millisecond)
+	_, found, _ := g.Get("a")
+	assert.False(t, found, "should be flushed since the invalidations are dropped")
+}
+
+func TestWrap_optional_interfaces(t *testing.T) {
+	b := New(Config{Threshold: 1, Name: "optional"}, zap.NewNop())
+	g := Wrap(inmemory.NewBounded(inmemory.Config{DefaultExp: time.Hour}), b)
+	assert.NoError(t, g.Set("a", &cacher.Entry{}, time.Hour))
+	assert.NoError(t, g.(cacher.Flusher).Flush())
+	_, found, _ := g.Get("a")
+	assert.False(t, found)
+
+	assert.Equal(t, ErrUnsupported, g.(cacher.Notifier).Publish("channel", "message"))
+	assert.NoError(t, Wrap(inmemory.New(time.Hour, time.Hour), b).(cacher.Flusher).Flush(), "should do nothing")
+}
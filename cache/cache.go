@@ -2,24 +2,64 @@ package cache
 
 import (
 	"context"
+	"errors"
+	"goshorturl/cache/breaker"
 	"goshorturl/cache/cacher"
 	"goshorturl/cache/inmemory"
 	"goshorturl/cache/redis"
+	"goshorturl/cache/tiered"
+	"goshorturl/health"
+	"goshorturl/models"
 	"goshorturl/repository"
+	"math"
+	"math/rand"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 const (
-	defaultClearInterval = 24 * time.Hour
-	defaultExp           = 1 * time.Hour
-	validEntryExp        = 24 * time.Hour
-	emptyEntryExp        = 1 * time.Hour
+	defaultClearInterval  = 24 * time.Hour
+	defaultExp            = 1 * time.Hour
+	defaultRefreshTimeout = 30 * time.Second
+	defaultLockLease      = 10 * time.Second
+	defaultDBConcurrency  = 50
+	defaultDBQueueTimeout = 1 * time.Second
+
+	// markerID never collides with the ids, see idgenerator.Validate()
+	markerID         = "warmup:marker"
+	markerExpiration = 365 * 24 * time.Hour
 )
 
+// TTL controls how long each type of entry lives in the cache.
+type TTL struct {
+	// Valid is the soft TTL of an entry which points to an existent URL.
+	Valid time.Duration
+	// Empty is the soft TTL of an entry which records a not found result
+	// or an error.
+	Empty time.Duration
+	// Stale is how long an entry still can be served after its soft TTL,
+	// while a single background goroutine is refreshing it.
+	Stale time.Duration
+	// Beta tunes the XFetch probabilistic early expiration. Greater than 1
+	// favors earlier recomputation, 0 disables it.
+	Beta float64
+}
+
+var defaultTTL = TTL{
+	Valid: 24 * time.Hour,
+	Empty: 1 * time.Hour,
+	Stale: 1 * time.Hour,
+	Beta:  1,
+}
+
 type cacheOptions struct {
-	engine cacher.Engine
+	engine  cacher.Engine
+	ttl     TTL
+	logger  *zap.Logger
+	breaker *breaker.Breaker
+	limiter *limiter
+	health  *health.Registry
 }
 
 type Option struct {
@@ -40,33 +80,135 @@ func UseRedis(host string, port int) Option {
 		}}
 }
 
+// UseEngine uses the given engine, e.g. a Redis engine created by
+// redis.NewWithConfig().
+func UseEngine(engine cacher.Engine) Option {
+	return Option{
+		func(c *cacheOptions) {
+			c.engine = engine
+		}}
+}
+
+// UseBoundedInMemoryCache uses an in-memory cache which is bounded by the
+// number of entries and by the bytes taken.
+func UseBoundedInMemoryCache(config inmemory.Config) Option {
+	return Option{
+		func(c *cacheOptions) {
+			if config.DefaultExp <= 0 {
+				config.DefaultExp = defaultExp
+			}
+			c.engine = inmemory.NewBounded(config)
+		}}
+}
+
+// UseTiered composes the engine of local in front of the engine of remote, e.g.
+//
+//	UseTiered(UseBoundedInMemoryCache(config), UseRedis(host, port), 5*time.Second)
+func UseTiered(local, remote Option, localTTL time.Duration) Option {
+	return Option{
+		func(c *cacheOptions) {
+			l, r := *c, *c
+			local.f(&l)
+			remote.f(&r)
+			c.engine = tiered.New(l.engine, r.engine, localTTL, c.logger)
+		}}
+}
+
+// UseCircuitBreaker guards the engine by b. While the breaker is open, the
+// cache is bypassed and the records are read from database directly.
+func UseCircuitBreaker(b *breaker.Breaker) Option {
+	return Option{
+		func(c *cacheOptions) {
+			c.breaker = b
+		}}
+}
+
+// UseDBConcurrencyLimit limits the concurrent reads from database which
+// bypass the cache, a read waits at most wait for its turn, otherwise it
+// fails with repository.ErrBusy.
+func UseDBConcurrencyLimit(limit int, wait time.Duration) Option {
+	return Option{
+		func(c *cacheOptions) {
+			c.limiter = newLimiter(limit, wait)
+		}}
+}
+
+// UseHealthChecks registers the check of the engine into registry. The cache
+// is not critical, since it is able to be bypassed.
+func UseHealthChecks(registry *health.Registry) Option {
+	return Option{
+		func(c *cacheOptions) {
+			c.health = registry
+		}}
+}
+
+// UseTTL overrides the default TTLs of cached entries.
+func UseTTL(ttl TTL) Option {
+	return Option{
+		func(c *cacheOptions) {
+			c.ttl = ttl
+		}}
+}
+
 func New(db repository.Repository, logger *zap.Logger, options ...Option) repository.Repository {
-	opts := cacheOptions{}
+	opts := cacheOptions{ttl: defaultTTL, logger: logger}
 	UseInMemoryCache().f(&opts)
+	UseDBConcurrencyLimit(defaultDBConcurrency, defaultDBQueueTimeout).f(&opts)
 
 	for _, option := range options {
 		option.f(&opts)
 	}
+	if opts.breaker != nil {
+		opts.engine = breaker.Wrap(opts.engine, opts.breaker)
+		if opts.health != nil {
+			opts.health.Register("cacheBreaker", false, func(ctx context.Context) (interface{}, error) {
+				stats := opts.breaker.Stats()
+				if stats.State != breaker.Closed.String() {
+					return stats, breaker.ErrOpen
+				}
+				return stats, nil
+			})
+		}
+	}
+	if opts.health != nil {
+		engine := opts.engine
+		opts.health.Register("cache", false, func(ctx context.Context) (interface{}, error) {
+			if pinger, ok := engine.(cacher.Pinger); ok {
+				return nil, pinger.Ping()
+			}
+			return nil, nil
+		})
+	}
 
 	return &cacheLogic{
-		db:     db,
-		logger: logger,
-		cache:  opts.engine,
+		db:      db,
+		logger:  logger,
+		cache:   opts.engine,
+		ttl:     opts.ttl,
+		limiter: opts.limiter,
 	}
 }
 
 type cacheLogic struct {
-	db     repository.Repository
-	logger *zap.Logger
-	cache  cacher.Engine
+	db      repository.Repository
+	logger  *zap.Logger
+	cache   cacher.Engine
+	ttl     TTL
+	limiter *limiter
 }
 
 // Get caches the result which retrieved from database and return it.
-func (r *cacheLogic) Get(ctx context.Context, id string) (string, error) {
+//
+// A stale entry is still returned while a single background goroutine is
+// refreshing it, see shouldRefresh() for when an entry turns out to be stale.
+func (r *cacheLogic) Get(ctx context.Context, id string) (*models.Url, error) {
 	cached, found, err := r.cache.Get(id)
-	if err != nil && err != cacher.ErrEntryNotFound {
-		r.logger.Warn("cache error", zap.Error(err))
-		return "", err
+	if errors.Is(err, cacher.ErrSerializeFailed) {
+		// the entry is going to be overwritten by the recomputation
+		r.logger.Warn("undecodable cached entry", zap.Error(err), zap.String("id", id))
+	} else if err != nil && err != cacher.ErrEntryNotFound {
+		r.logger.Warn("cache error, bypass it", zap.Error(err), zap.String("id", id))
+		return r.getBypassed(ctx, id)
 	}
 
 	if found {
@@ -75,33 +217,274 @@ func (r *cacheLogic) Get(ctx context.Context, id string) (string, error) {
 			zap.String("id", id),
 			zap.String("url", cached.Url),
 			zap.Error(cached.Err))
-		return cached.Url, cached.Err
+		if r.shouldRefresh(cached, time.Now()) {
+			r.refreshInBackground(id)
+		}
+		return entry2url(id, cached)
 	}
 
 	r.logger.Debug("cache missed", zap.String("id", id))
 
 	// TODO: use bloomfilter to filter out the non-existed key to reduce the
 	// caching load
-	checked, err := r.cache.Check(id)
+	lock, err := r.cache.Check(id, defaultLockLease)
 	if err != nil {
-		r.logger.Warn("cache check id error", zap.Error(err), zap.String("id", id))
+		r.logger.Warn("cache check id error, bypass it", zap.Error(err), zap.String("id", id))
+		return r.getBypassed(ctx, id)
 	}
-	if checked {
-		defer r.cache.Uncheck(id)
+	if lock != nil {
+		defer r.hold(id, lock)()
 		// To avoid cache stampede, Check() ensures that only one goroutine
 		// able to trigger cache recomputation until that process finished.
 		r.logger.Debug("recompute cache", zap.String("id", id))
-		url, err := r.db.Get(ctx, id)
-		exp := validEntryExp
-		if err != nil {
-			exp = emptyEntryExp
-		}
-		r.cache.Set(id, &cacher.Entry{Url: url, Err: err}, exp)
-		return url, err
+		start := time.Now()
+		link, err := r.db.Get(ctx, id)
+		r.setRecomputed(id, link, err, time.Since(start))
+		return link, err
 	}
 	// In case of cache stampede, this implementation choose to guarantee
 	// the availability, so just return record not found
-	return "", repository.ErrRecordNotFound
+	return nil, repository.ErrRecordNotFound
+}
+
+// getBypassed reads the record from database directly while the cache is
+// unavailable, the concurrent reads are limited to protect the database.
+func (r *cacheLogic) getBypassed(ctx context.Context, id string) (*models.Url, error) {
+	metrics.Add("bypassed", 1)
+	release, err := r.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return r.db.Get(ctx, id)
+}
+
+// shouldRefresh implements the XFetch algorithm, it reports true if the
+// entry is stale, or probabilistically when the entry is about to be stale.
+// The more time the last recomputation took, the earlier it reports true.
+//
+// ref: https://cseweb.ucsd.edu/~avattani/papers/cache_stampede.pdf
+func (r *cacheLogic) shouldRefresh(entry *cacher.Entry, now time.Time) bool {
+	if entry.RefreshAt.IsZero() {
+		return false
+	}
+	// 1-rand.Float64() is in (0, 1], so the logarithm is always finite
+	gap := time.Duration(float64(entry.Delta) * r.ttl.Beta * -math.Log(1-rand.Float64()))
+	return !now.Add(gap).Before(entry.RefreshAt)
+}
+
+// refreshInBackground recomputes the entry without blocking the caller.
+//
+// Check() ensures that only one goroutine is refreshing the given id, the
+// others keep serving the stale entry.
+func (r *cacheLogic) refreshInBackground(id string) {
+	lock, err := r.cache.Check(id, defaultLockLease)
+	if err != nil {
+		r.logger.Warn("cache check id error", zap.Error(err), zap.String("id", id))
+	}
+	if lock == nil {
+		return
+	}
+	go func() {
+		defer r.hold(id, lock)()
+		// do not use the context of request, it may be canceled as soon as
+		// the request finished
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRefreshTimeout)
+		defer cancel()
+
+		r.logger.Debug("refresh stale cache", zap.String("id", id))
+		start := time.Now()
+		link, err := r.db.Get(ctx, id)
+		if err != nil && err != repository.ErrRecordNotFound && err != repository.ErrGone {
+			// keep serving the stale entry rather than replacing it by an error
+			r.logger.Warn("refresh cache error", zap.Error(err), zap.String("id", id))
+			return
+		}
+		r.setRecomputed(id, link, err, time.Since(start))
+	}()
+}
+
+// hold keeps renewing the lease of lock in background until the returned
+// function is called, which releases the lock.
+func (r *cacheLogic) hold(id string, lock cacher.Lock) (release func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(defaultLockLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := lock.Renew(defaultLockLease); err != nil {
+					r.logger.Warn("renew lock error", zap.Error(err), zap.String("id", id))
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := lock.Release(); err != nil {
+			// the lease has expired, the result may be overwritten by the
+			// new holder
+			r.logger.Warn("release lock error", zap.Error(err), zap.String("id", id))
+		}
+	}
+}
+
+// setRecomputed caches the result retrieved from database. The entry lives
+// for its soft TTL plus the stale window, but never longer than the link.
+func (r *cacheLogic) setRecomputed(id string, link *models.Url, err error, delta time.Duration) {
+	if err == nil && link.FlaggedAt != nil {
+		// the flagged links are always read from database, so that they are
+		// enabled again as soon as they are unflagged
+		return
+	}
+	now := time.Now()
+	entry := &cacher.Entry{Err: err, Delta: delta}
+	soft := r.ttl.Empty
+	if err == nil {
+		entry.Url = link.Url
+		entry.MaxClicks = maxClicks(link)
+		entry.Protected = protected(link)
+		entry.Rules = cachedRules(link.Rules)
+		entry.Variants = cachedVariants(link.Variants)
+		entry.Passthrough = link.Passthrough
+		entry.Interstitial = link.Interstitial
+		entry.CreatedAt = link.CreatedAt
+		soft = r.ttl.Valid
+	}
+	entry.RefreshAt = now.Add(soft)
+
+	exp := soft + r.ttl.Stale
+	if err == nil && link.ExpiredAt != nil {
+		entry.ExpiredAt = *link.ExpiredAt
+		if untilExpired := link.ExpiredAt.Sub(now); untilExpired < exp {
+			exp = untilExpired
+		}
+	}
+	if exp <= 0 {
+		return
+	}
+	if err := r.cache.Set(id, entry, exp); err != nil {
+		r.logger.Warn("set cache fail", zap.Error(err), zap.String("id", id))
+	}
+}
+
+// setUploaded caches the uploaded link until its real expiration, so that
+// concurrent readers never miss it. It will be refreshed after its soft TTL.
+// The link never expires lives as long as a recomputed one.
+func (r *cacheLogic) setUploaded(link *models.Url) error {
+	exp := r.ttl.Valid + r.ttl.Stale
+	entry := &cacher.Entry{
+		Url:          link.Url,
+		RefreshAt:    time.Now().Add(r.ttl.Valid),
+		MaxClicks:    maxClicks(link),
+		Protected:    protected(link),
+		Rules:        cachedRules(link.Rules),
+		Variants:     cachedVariants(link.Variants),
+		Passthrough:  link.Passthrough,
+		Interstitial: link.Interstitial,
+		CreatedAt:    link.CreatedAt,
+	}
+	if link.ExpiredAt != nil {
+		entry.ExpiredAt = *link.ExpiredAt
+		exp = time.Until(entry.ExpiredAt)
+	}
+	if exp <= 0 {
+		// expired already, the entry of the previous link is not kept either
+		if err := r.cache.Delete(link.Key()); err != nil && !errors.Is(err, cacher.ErrEntryNotFound) {
+			return err
+		}
+		return nil
+	}
+	if err := r.cache.Set(link.Key(), entry, exp); err != nil {
+		return err
+	}
+	if link.RemainingClicks != nil {
+		return r.setCounter(link.Key(), *link.RemainingClicks, exp)
+	}
+	return nil
+}
+
+// setCounter sets the counter of the remaining clicks if the engine is able
+// to count.
+func (r *cacheLogic) setCounter(id string, n int64, expiration time.Duration) error {
+	if counter, ok := r.cache.(cacher.Counter); ok {
+		return counter.SetCounter(id, n, expiration)
+	}
+	return nil
+}
+
+// deleteCounter deletes the counter along with the entry, so that the id
+// reused later does not start from the remaining clicks of the old link.
+func (r *cacheLogic) deleteCounter(id string) {
+	if counter, ok := r.cache.(cacher.Counter); ok {
+		if err := counter.DeleteCounter(id); err != nil {
+			r.logger.Warn("delete counter fail", zap.Error(err), zap.String("id", id))
+		}
+	}
+}
+
+func maxClicks(link *models.Url) int64 {
+	if link.MaxClicks == nil {
+		return 0
+	}
+	return *link.MaxClicks
+}
+
+// protected reports whether the link requires a password, the link either
+// retrieved by Get() or carrying the hash, e.g. uploaded or warmed up.
+func protected(link *models.Url) bool {
+	return link.Protected || link.PasswordHash != ""
+}
+
+func cachedRules(rules models.TargetRules) []cacher.Rule {
+	var cached []cacher.Rule
+	for _, rule := range rules {
+		cached = append(cached, cacher.Rule(rule))
+	}
+	return cached
+}
+
+func cachedVariants(variants models.Variants) []cacher.Variant {
+	var cached []cacher.Variant
+	for _, v := range variants {
+		cached = append(cached, cacher.Variant(v))
+	}
+	return cached
+}
+
+func entry2url(key string, entry *cacher.Entry) (*models.Url, error) {
+	if entry.Err != nil {
+		return nil, entry.Err
+	}
+	domain, id := models.SplitKey(key)
+	link := &models.Url{Domain: domain, Id: id, Url: entry.Url, Protected: entry.Protected}
+	if !entry.ExpiredAt.IsZero() {
+		expiredAt := entry.ExpiredAt
+		link.ExpiredAt = &expiredAt
+	}
+	for _, rule := range entry.Rules {
+		link.Rules = append(link.Rules, models.TargetRule(rule))
+	}
+	for _, v := range entry.Variants {
+		link.Variants = append(link.Variants, models.Variant(v))
+	}
+	link.Passthrough = entry.Passthrough
+	link.Interstitial = entry.Interstitial
+	link.CreatedAt = entry.CreatedAt
+	if entry.MaxClicks > 0 {
+		// the remaining clicks are unknown until consumed
+		maxClicks := entry.MaxClicks
+		link.MaxClicks = &maxClicks
+	}
+	return link, nil
 }
 
 // Delete deletes the record from storage and cache.
@@ -117,40 +500,221 @@ func (r *cacheLogic) Delete(ctx context.Context, id string) error {
 	if err := r.cache.Delete(id); err != nil {
 		r.logger.Warn("delete cache fail", zap.Error(err), zap.String("id", id))
 	}
+	r.deleteCounter(id)
 	return nil
 }
 
 // Create adds an entry to cache if that entry is successfully inserted into storage.
-func (r *cacheLogic) Create(ctx context.Context, id, url string, expiredAt time.Time) error {
-	err := r.db.Create(ctx, id, url, expiredAt)
+func (r *cacheLogic) Create(ctx context.Context, link *models.Url) error {
+	err := r.db.Create(ctx, link)
 	if err != nil {
 		return err
 	}
-	exp := time.Until(expiredAt)
-	r.logger.Debug("create cache", zap.String("id", id), zap.String("url", url), zap.Error(err), zap.Any("exp", exp))
+	r.logger.Debug("create cache", zap.String("id", link.Id), zap.String("url", link.Url))
 
-	if err := r.cache.Set(id, &cacher.Entry{Url: url, Err: err}, exp); err != nil {
-		r.logger.Warn("create cache fail", zap.Error(err), zap.String("id", id))
+	if err := r.setUploaded(link); err != nil {
+		r.logger.Warn("create cache fail", zap.Error(err), zap.String("id", link.Id))
 	}
 	return nil
 }
 
 // Update adds an entry to cache if that entry is successfully updated into storage.
-func (r *cacheLogic) Update(ctx context.Context, id, url string, expiredAt time.Time) error {
-	err := r.db.Update(ctx, id, url, expiredAt)
+func (r *cacheLogic) Update(ctx context.Context, link *models.Url) error {
+	err := r.db.Update(ctx, link)
 	if err != nil {
 		return err
 	}
-	exp := time.Until(expiredAt)
-	r.logger.Debug("update cache", zap.String("id", id), zap.String("url", url), zap.Error(err), zap.Any("exp", exp))
+	r.logger.Debug("update cache", zap.String("id", link.Id), zap.String("url", link.Url))
 
-	if err := r.cache.Set(id, &cacher.Entry{Url: url, Err: err}, exp); err != nil {
-		r.logger.Warn("update cache fail", zap.Error(err), zap.String("id", id), zap.String("url", url))
+	if err := r.setUploaded(link); err != nil {
+		r.logger.Warn("update cache fail", zap.Error(err), zap.String("id", link.Id), zap.String("url", link.Url))
 	}
 	return nil
 }
 
+// PasswordHash just wraps the db.PasswordHash(), the hash never goes through
+// the cache engine.
+func (r *cacheLogic) PasswordHash(ctx context.Context, id string) (string, error) {
+	return r.db.PasswordHash(ctx, id)
+}
+
+// GetMetadata just wraps the db.GetMetadata(), the descriptive fields are
+// not kept in the cache entries.
+func (r *cacheLogic) GetMetadata(ctx context.Context, id string) (*models.Url, error) {
+	return r.db.GetMetadata(ctx, id)
+}
+
+// UpdateMetadata just wraps the db.UpdateMetadata(), the cached entry stays
+// valid since the redirects never use the descriptive fields.
+func (r *cacheLogic) UpdateMetadata(ctx context.Context, id string, update repository.MetadataUpdate) error {
+	return r.db.UpdateMetadata(ctx, id, update)
+}
+
+// Consume decrements the counter in cache in front of the database, so that
+// the redirects of an exhausted link are rejected without touching the
+// database. The database is still authoritative, and the missing counter is
+// restored from it.
+func (r *cacheLogic) Consume(ctx context.Context, id string) (int64, error) {
+	counter, _ := r.cache.(cacher.Counter)
+	counted := false
+	if counter != nil {
+		n, found, err := counter.Decr(id)
+		if err != nil {
+			r.logger.Warn("decrement counter error", zap.Error(err), zap.String("id", id))
+		} else if found && n < 0 {
+			return 0, repository.ErrGone
+		}
+		counted = found
+	}
+
+	remaining, err := r.db.Consume(ctx, id)
+	if err == repository.ErrGone {
+		// the counter may be missing or ahead of the database
+		if err := r.setCounter(id, 0, r.ttl.Empty+r.ttl.Stale); err != nil {
+			r.logger.Warn("set counter fail", zap.Error(err), zap.String("id", id))
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !counted {
+		if err := r.setCounter(id, remaining, r.ttl.Valid+r.ttl.Stale); err != nil {
+			r.logger.Warn("set counter fail", zap.Error(err), zap.String("id", id))
+		}
+	}
+	if remaining == 0 {
+		// the following reads find the link gone without consuming
+		r.setRecomputed(id, nil, repository.ErrGone, 0)
+	}
+	return remaining, nil
+}
+
 // SelectDeletedAndExpired just wraps the db.SelectDeletedAndExpired().
 func (r *cacheLogic) SelectDeletedAndExpired(ctx context.Context, limit int) ([]string, error) {
 	return r.db.SelectDeletedAndExpired(ctx, limit)
 }
+
+// AddClicks just wraps the db.AddClicks().
+func (r *cacheLogic) AddClicks(ctx context.Context, clicks map[string]int64, accessedAt time.Time) error {
+	return r.db.AddClicks(ctx, clicks, accessedAt)
+}
+
+// AddVariantClicks just wraps the db.AddVariantClicks().
+func (r *cacheLogic) AddVariantClicks(ctx context.Context, clicks []*models.VariantStat) error {
+	return r.db.AddVariantClicks(ctx, clicks)
+}
+
+// ListVariantStats just wraps the db.ListVariantStats().
+func (r *cacheLogic) ListVariantStats(ctx context.Context, id string) ([]*models.VariantStat, error) {
+	return r.db.ListVariantStats(ctx, id)
+}
+
+// SelectPopular just wraps the db.SelectPopular().
+func (r *cacheLogic) SelectPopular(ctx context.Context, orderBy string, offset, limit int) ([]*models.Url, error) {
+	return r.db.SelectPopular(ctx, orderBy, offset, limit)
+}
+
+// Prime caches the link as if it was just retrieved from database, it is
+// used to warm up the cache.
+func (r *cacheLogic) Prime(link *models.Url) {
+	r.setRecomputed(link.Key(), link, nil, 0)
+}
+
+// Mark leaves a marker in the cache after warming up, the marker disappears
+// if the cache is flushed or failed over to an empty replica.
+func (r *cacheLogic) Mark() error {
+	return r.cache.Set(markerID, &cacher.Entry{}, markerExpiration)
+}
+
+// Marked reports whether the marker left by Mark() still exists.
+func (r *cacheLogic) Marked() (bool, error) {
+	_, found, err := r.cache.Get(markerID)
+	if err == cacher.ErrEntryNotFound {
+		return false, nil
+	}
+	return found, err
+}
+
+// Ping just wraps the db.Ping().
+func (r *cacheLogic) Ping(ctx context.Context) error {
+	return r.db.Ping(ctx)
+}
+
+// SelectPurgeable just wraps the db.SelectPurgeable().
+func (r *cacheLogic) SelectPurgeable(ctx context.Context, before time.Time, after string, limit int) ([]string, error) {
+	return r.db.SelectPurgeable(ctx, before, after, limit)
+}
+
+// Purge just wraps the db.Purge(), the purged records have been deleted or
+// expired already, so their entries never point to a live link.
+func (r *cacheLogic) Purge(ctx context.Context, ids []string, before time.Time, archive bool) (int64, error) {
+	return r.db.Purge(ctx, ids, before, archive)
+}
+
+// SelectLive just wraps the db.SelectLive().
+func (r *cacheLogic) SelectLive(ctx context.Context, after string, limit int) ([]*models.Url, error) {
+	return r.db.SelectLive(ctx, after, limit)
+}
+
+// Flag flags the link in storage, and then deletes its entry, so that the
+// following reads find it flagged in database.
+func (r *cacheLogic) Flag(ctx context.Context, id string, reason string) error {
+	if err := r.db.Flag(ctx, id, reason); err != nil {
+		return err
+	}
+	if err := r.cache.Delete(id); err != nil {
+		r.logger.Warn("delete cache fail", zap.Error(err), zap.String("id", id))
+	}
+	r.deleteCounter(id)
+	return nil
+}
+
+// ListLinks just wraps the db.ListLinks().
+func (r *cacheLogic) ListLinks(ctx context.Context, query repository.LinkQuery) ([]*models.Url, error) {
+	return r.db.ListLinks(ctx, query)
+}
+
+// SelectExpiring just wraps the db.SelectExpiring().
+func (r *cacheLogic) SelectExpiring(ctx context.Context, from, to time.Time, after string, limit int) ([]*models.Url, error) {
+	return r.db.SelectExpiring(ctx, from, to, after, limit)
+}
+
+// CreateWebhook just wraps the db.CreateWebhook().
+func (r *cacheLogic) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	return r.db.CreateWebhook(ctx, webhook)
+}
+
+// ListWebhooks just wraps the db.ListWebhooks().
+func (r *cacheLogic) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	return r.db.ListWebhooks(ctx)
+}
+
+// DeleteWebhook just wraps the db.DeleteWebhook().
+func (r *cacheLogic) DeleteWebhook(ctx context.Context, id uint) error {
+	return r.db.DeleteWebhook(ctx, id)
+}
+
+// EnqueueDeliveries just wraps the db.EnqueueDeliveries().
+func (r *cacheLogic) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) (int64, error) {
+	return r.db.EnqueueDeliveries(ctx, deliveries)
+}
+
+// ClaimDeliveries just wraps the db.ClaimDeliveries().
+func (r *cacheLogic) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*models.WebhookDelivery, error) {
+	return r.db.ClaimDeliveries(ctx, now, lease, limit)
+}
+
+// UpdateDelivery just wraps the db.UpdateDelivery().
+func (r *cacheLogic) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	return r.db.UpdateDelivery(ctx, delivery)
+}
+
+// ListDeliveries just wraps the db.ListDeliveries().
+func (r *cacheLogic) ListDeliveries(ctx context.Context, webhookID uint, limit int) ([]*models.WebhookDelivery, error) {
+	return r.db.ListDeliveries(ctx, webhookID, limit)
+}
+
+// RelayOutbox just wraps the db.RelayOutbox().
+func (r *cacheLogic) RelayOutbox(ctx context.Context, limit int, relay func(events []*models.OutboxEvent) error) (int, error) {
+	return r.db.RelayOutbox(ctx, limit, relay)
+}
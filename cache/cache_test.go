@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"goshorturl/cache/breaker"
+	"goshorturl/cache/cacher"
+	"goshorturl/models"
 	"goshorturl/repository"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/rShetty/asyncwait"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
 )
@@ -24,22 +28,46 @@ var (
 
 type dbRecorder struct {
 	repository.UnimplementedRepository
-	errorMode   bool
-	mutex       sync.Mutex
-	getCount    int
-	deleteCount int
-	createCount int
-	updateCount int
+	errorMode    bool
+	mutex        sync.Mutex
+	getCount     int
+	deleteCount  int
+	createCount  int
+	updateCount  int
+	consumeCount int
+	remaining    int64
+	flagReason   string
 }
 
-func (d *dbRecorder) Get(ctx context.Context, id string) (string, error) {
+func (d *dbRecorder) Get(ctx context.Context, id string) (*models.Url, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	if d.errorMode {
-		return "", errStorageInternalError
+		return nil, errStorageInternalError
 	}
 	d.getCount++
-	return exampleURL, nil
+	expiredAt := time.Now().Add(24 * time.Hour)
+	link := &models.Url{Id: id, Url: exampleURL, ExpiredAt: &expiredAt, FlagReason: d.flagReason}
+	if d.flagReason != "" {
+		link.FlaggedAt = &expiredAt
+	}
+	return link, nil
+}
+
+func (d *dbRecorder) Flag(ctx context.Context, id string, reason string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.errorMode {
+		return errStorageInternalError
+	}
+	d.flagReason = reason
+	return nil
+}
+
+func (d *dbRecorder) getCountSafe() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.getCount
 }
 func (d *dbRecorder) Delete(ctx context.Context, id string) error {
 	d.mutex.Lock()
@@ -51,26 +79,50 @@ func (d *dbRecorder) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
-func (d *dbRecorder) Create(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (d *dbRecorder) Create(ctx context.Context, link *models.Url) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	if d.errorMode {
 		return errStorageInternalError
 	}
 	d.createCount++
+	link.RemainingClicks = link.MaxClicks
 	return nil
 }
 
-func (d *dbRecorder) Update(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (d *dbRecorder) Update(ctx context.Context, link *models.Url) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	if d.errorMode {
 		return errStorageInternalError
 	}
 	d.updateCount++
+	link.RemainingClicks = link.MaxClicks
 	return nil
 }
 
+func (d *dbRecorder) Consume(ctx context.Context, id string) (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.errorMode {
+		return 0, errStorageInternalError
+	}
+	d.consumeCount++
+	if d.remaining <= 0 {
+		return 0, repository.ErrGone
+	}
+	d.remaining--
+	return d.remaining, nil
+}
+
+func newLink(expiredAt time.Time) *models.Url {
+	link := &models.Url{Id: exampleID, Url: exampleURL}
+	if !expiredAt.IsZero() {
+		link.ExpiredAt = &expiredAt
+	}
+	return link
+}
+
 // enableError enables the error mode that will cause every operation to return errStorageInternalError.
 func (d *dbRecorder) enableError() {
 	d.errorMode = true
@@ -131,53 +183,340 @@ func (suite *cacheTestSuite) Test_Delete_hit_database() {
 }
 
 func (suite *cacheTestSuite) Test_Create_cache_the_entry() {
-	err := suite.cache.Create(suite.ctx, exampleID, exampleURL, time.Now().Add(24*time.Hour))
+	err := suite.cache.Create(suite.ctx, newLink(time.Now().Add(24*time.Hour)))
 	suite.NoError(err)
 	suite.Equal(1, suite.dbRecorder.createCount, "should create OK")
 
 	got, err := suite.cache.Get(suite.ctx, exampleID)
-	suite.Equal(exampleURL, got, "should retrieve the original URL")
 	suite.NoError(err)
+	suite.Equal(exampleURL, got.Url, "should retrieve the original URL")
+	suite.Equal(0, suite.dbRecorder.getCount, "should retrieve from cache instead storage")
+}
+
+func (suite *cacheTestSuite) Test_Create_cache_the_entry_never_expires() {
+	err := suite.cache.Create(suite.ctx, newLink(time.Time{}))
+	suite.NoError(err)
+
+	got, err := suite.cache.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(exampleURL, got.Url)
+	suite.Nil(got.ExpiredAt, "should never expire")
 	suite.Equal(0, suite.dbRecorder.getCount, "should retrieve from cache instead storage")
 }
 
+func (suite *cacheTestSuite) Test_Create_cache_the_entry_with_rules() {
+	link := newLink(time.Time{})
+	link.Rules = models.TargetRules{{Platform: "ios", Url: "https://apps.apple.com"}}
+	err := suite.cache.Create(suite.ctx, link)
+	suite.NoError(err)
+
+	got, err := suite.cache.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(link.Rules, got.Rules, "should cache the rules alongside the URL")
+	suite.Equal(0, suite.dbRecorder.getCount)
+}
+
+func (suite *cacheTestSuite) Test_Create_cache_the_entry_with_variants() {
+	link := newLink(time.Time{})
+	link.Variants = models.Variants{
+		{Name: "a", Url: "https://example.com/a", Weight: 50},
+		{Name: "b", Url: "https://example.com/b", Weight: 50},
+	}
+	err := suite.cache.Create(suite.ctx, link)
+	suite.NoError(err)
+
+	got, err := suite.cache.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(link.Variants, got.Variants, "should cache the variants alongside the URL")
+	suite.Equal(0, suite.dbRecorder.getCount)
+}
+
 func (suite *cacheTestSuite) Test_Create_cache_the_entry_fail() {
 	suite.dbRecorder.enableError()
 
-	err := suite.cache.Create(suite.ctx, exampleID, exampleURL, time.Now().Add(24*time.Hour))
+	err := suite.cache.Create(suite.ctx, newLink(time.Now().Add(24*time.Hour)))
 	suite.Equal(errStorageInternalError, err)
 	suite.Equal(0, suite.dbRecorder.createCount, "should not create anything")
 
 	got, err := suite.cache.Get(suite.ctx, exampleID)
-	suite.Equal("", got, "should got nothing")
+	suite.Nil(got, "should got nothing")
 	suite.Equal(errStorageInternalError, err)
 	suite.Equal(0, suite.dbRecorder.getCount, "should not retrieve anything")
 }
 
 func (suite *cacheTestSuite) Test_Update_cache_the_entry() {
-	err := suite.cache.Update(suite.ctx, exampleID, exampleURL, time.Now().Add(24*time.Hour))
+	err := suite.cache.Update(suite.ctx, newLink(time.Now().Add(24*time.Hour)))
 	suite.NoError(err)
 	suite.Equal(1, suite.dbRecorder.updateCount, "should update OK")
 
 	got, err := suite.cache.Get(suite.ctx, exampleID)
-	suite.Equal(exampleURL, got, "should retrieve the original URL")
 	suite.NoError(err)
+	suite.Equal(exampleURL, got.Url, "should retrieve the original URL")
 	suite.Equal(0, suite.dbRecorder.getCount, "should retrieve from cache instead storage")
 }
 
+// expiringEngine rejects the non-positive expirations like Redis does.
+type expiringEngine struct {
+	cacher.Engine
+	rejected int
+}
+
+func (e *expiringEngine) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	if expiration <= 0 {
+		e.rejected++
+		return errors.New("invalid expire time")
+	}
+	return e.Engine.Set(id, entry, expiration)
+}
+
+func (suite *cacheTestSuite) Test_Update_cache_the_entry_expiring() {
+	engine := &expiringEngine{Engine: suite.cache.(*cacheLogic).cache}
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(engine))
+	suite.NoError(c.Create(suite.ctx, newLink(time.Now().Add(24*time.Hour))))
+
+	suite.NoError(c.Update(suite.ctx, newLink(time.Now().Add(-time.Millisecond))))
+	suite.Equal(0, engine.rejected, "should not set the expired entry")
+	_, found, _ := engine.Get(exampleID)
+	suite.False(found, "should not keep the entry of the previous link")
+
+	suite.NoError(c.Update(suite.ctx, newLink(time.Now().Add(500*time.Millisecond))))
+	suite.Equal(0, engine.rejected)
+	got, err := c.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(exampleURL, got.Url, "should cache the link expiring within a second")
+}
+
 func (suite *cacheTestSuite) Test_Update_cache_the_entry_fail() {
 	suite.dbRecorder.enableError()
 
-	err := suite.cache.Update(suite.ctx, exampleID, exampleURL, time.Now().Add(24*time.Hour))
+	err := suite.cache.Update(suite.ctx, newLink(time.Now().Add(24*time.Hour)))
 	suite.Equal(errStorageInternalError, err)
 	suite.Equal(0, suite.dbRecorder.updateCount, "should not update anything")
 
 	got, err := suite.cache.Get(suite.ctx, exampleID)
-	suite.Equal("", got, "should got nothing")
+	suite.Nil(got, "should got nothing")
 	suite.Equal(errStorageInternalError, err)
 	suite.Equal(0, suite.dbRecorder.getCount, "should not retrieve anything")
 }
 
+func (suite *cacheTestSuite) Test_Flag_never_cache_the_flagged_link() {
+	_, err := suite.cache.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.NoError(suite.cache.Flag(suite.ctx, exampleID, "phishing"))
+
+	for i := 0; i < 2; i++ {
+		got, err := suite.cache.Get(suite.ctx, exampleID)
+		suite.NoError(err)
+		suite.NotNil(got.FlaggedAt, "should not serve the cached entry")
+	}
+	suite.Equal(3, suite.dbRecorder.getCount, "should read the flagged link from database")
+
+	suite.NoError(suite.cache.Flag(suite.ctx, exampleID, ""))
+	for i := 0; i < 2; i++ {
+		got, err := suite.cache.Get(suite.ctx, exampleID)
+		suite.NoError(err)
+		suite.Nil(got.FlaggedAt)
+	}
+	suite.Equal(4, suite.dbRecorder.getCount, "should cache the unflagged link again")
+}
+
+func (suite *cacheTestSuite) Test_Get_serve_stale_entry_while_only_one_goroutine_refreshing_it() {
+	stale := &cacher.Entry{
+		Url:       exampleURL,
+		ExpiredAt: time.Now().Add(24 * time.Hour),
+		RefreshAt: time.Now().Add(-time.Second),
+	}
+	err := suite.cache.(*cacheLogic).cache.Set(exampleID, stale, time.Hour)
+	suite.NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(suite.numG)
+	for i := 0; i < suite.numG; i++ {
+		go func() {
+			defer wg.Done()
+			got, err := suite.cache.Get(suite.ctx, exampleID)
+			suite.NoError(err)
+			suite.Equal(exampleURL, got.Url, "should serve the stale entry")
+		}()
+	}
+	wg.Wait()
+
+	refreshed := asyncwait.NewAsyncWait(1000, 10).Check(func() bool {
+		return suite.dbRecorder.getCountSafe() > 0
+	})
+	suite.True(refreshed, "should refresh in background")
+	suite.Equal(1, suite.dbRecorder.getCountSafe(), "only one goroutine should hit database")
+}
+
+func (suite *cacheTestSuite) Test_shouldRefresh() {
+	c := &cacheLogic{ttl: TTL{Beta: 1}}
+	now := time.Now()
+
+	suite.False(c.shouldRefresh(&cacher.Entry{}, now), "entry without soft TTL never refreshes")
+	suite.False(c.shouldRefresh(&cacher.Entry{RefreshAt: now.Add(time.Hour)}, now), "fresh entry")
+	suite.True(c.shouldRefresh(&cacher.Entry{RefreshAt: now}, now), "stale entry")
+	suite.True(c.shouldRefresh(&cacher.Entry{
+		RefreshAt: now.Add(time.Millisecond),
+		Delta:     time.Hour,
+	}, now), "expensive recomputation should refresh early")
+}
+
+// brokenEngine fails every call, e.g. Redis is down.
+type brokenEngine struct {
+	mutex sync.Mutex
+	calls int
+}
+
+func (b *brokenEngine) fail() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls++
+	return errors.New("connection refused")
+}
+
+func (b *brokenEngine) Get(id string) (*cacher.Entry, bool, error) { return nil, false, b.fail() }
+
+func (b *brokenEngine) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	return b.fail()
+}
+
+func (b *brokenEngine) Delete(id string) error { return b.fail() }
+
+func (b *brokenEngine) Check(id string, lease time.Duration) (cacher.Lock, error) {
+	return nil, b.fail()
+}
+
+func (suite *cacheTestSuite) Test_Get_bypass_broken_cache() {
+	engine := &brokenEngine{}
+	b := breaker.New(breaker.Config{Threshold: 3, OpenTimeout: time.Hour}, zap.NewNop())
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(engine), UseCircuitBreaker(b))
+
+	for i := 0; i < 10; i++ {
+		link, err := c.Get(suite.ctx, exampleID)
+		suite.NoError(err)
+		suite.Equal(exampleURL, link.Url)
+	}
+	suite.Equal(10, suite.dbRecorder.getCountSafe())
+	suite.Equal(breaker.Open, b.State())
+	suite.Equal(3, engine.calls, "the broken cache should not be called after the breaker opened")
+}
+
+func (suite *cacheTestSuite) Test_Get_bypassed_reads_are_limited() {
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(&brokenEngine{}), UseDBConcurrencyLimit(1, 0))
+	release, err := c.(*cacheLogic).limiter.acquire(suite.ctx)
+	suite.NoError(err)
+	defer release()
+
+	_, err = c.Get(suite.ctx, exampleID)
+	suite.Equal(repository.ErrBusy, err)
+	suite.Equal(0, suite.dbRecorder.getCountSafe())
+}
+
+// countingEngine counts in memory like the Redis engine does.
+type countingEngine struct {
+	cacher.Engine
+	mutex    sync.Mutex
+	counters map[string]int64
+}
+
+func (e *countingEngine) SetCounter(id string, n int64, expiration time.Duration) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.counters[id] = n
+	return nil
+}
+
+func (e *countingEngine) Decr(id string) (int64, bool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	n, found := e.counters[id]
+	if !found {
+		return 0, false, nil
+	}
+	if n <= 0 {
+		return -1, true, nil
+	}
+	e.counters[id] = n - 1
+	return n - 1, true, nil
+}
+
+func (e *countingEngine) DeleteCounter(id string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.counters, id)
+	return nil
+}
+
+func (suite *cacheTestSuite) Test_Consume_gone_once_exhausted() {
+	suite.dbRecorder.remaining = 2
+	link := newLink(time.Time{})
+	maxClicks := int64(2)
+	link.MaxClicks = &maxClicks
+	suite.NoError(suite.cache.Create(suite.ctx, link))
+
+	got, err := suite.cache.Get(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(int64(2), *got.MaxClicks, "should know the link is limited")
+
+	remaining, err := suite.cache.Consume(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(int64(1), remaining)
+	remaining, err = suite.cache.Consume(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(int64(0), remaining)
+
+	_, err = suite.cache.Get(suite.ctx, exampleID)
+	suite.Equal(repository.ErrGone, err, "should cache the exhausted link as gone")
+	suite.Equal(0, suite.dbRecorder.getCount)
+}
+
+func (suite *cacheTestSuite) Test_Consume_rejected_by_counter() {
+	engine := &countingEngine{Engine: suite.cache.(*cacheLogic).cache, counters: map[string]int64{}}
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(engine))
+	suite.dbRecorder.remaining = 1
+	link := newLink(time.Time{})
+	maxClicks := int64(1)
+	link.MaxClicks = &maxClicks
+	suite.NoError(c.Create(suite.ctx, link))
+	suite.Equal(int64(1), engine.counters[exampleID], "should start counting from max clicks")
+
+	_, err := c.Consume(suite.ctx, exampleID)
+	suite.NoError(err)
+	for i := 0; i < 10; i++ {
+		_, err = c.Consume(suite.ctx, exampleID)
+		suite.Equal(repository.ErrGone, err)
+	}
+	suite.Equal(1, suite.dbRecorder.consumeCount, "should reject by counter without touching database")
+}
+
+func (suite *cacheTestSuite) Test_Consume_restore_missing_counter() {
+	engine := &countingEngine{Engine: suite.cache.(*cacheLogic).cache, counters: map[string]int64{}}
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(engine))
+	suite.dbRecorder.remaining = 5
+
+	remaining, err := c.Consume(suite.ctx, exampleID)
+	suite.NoError(err)
+	suite.Equal(int64(4), remaining)
+	suite.Equal(int64(4), engine.counters[exampleID], "should restore the counter from database")
+}
+
+func (suite *cacheTestSuite) Test_Delete_and_Flag_delete_the_counter() {
+	engine := &countingEngine{Engine: suite.cache.(*cacheLogic).cache, counters: map[string]int64{}}
+	c := New(&suite.dbRecorder, zap.NewNop(), UseEngine(engine))
+	link := newLink(time.Time{})
+	maxClicks := int64(1)
+	link.MaxClicks = &maxClicks
+
+	suite.NoError(c.Create(suite.ctx, link))
+	suite.Contains(engine.counters, exampleID)
+	suite.NoError(c.Delete(suite.ctx, exampleID))
+	suite.NotContains(engine.counters, exampleID, "should not be left for the reused id")
+
+	suite.NoError(c.Create(suite.ctx, link))
+	suite.NoError(c.Flag(suite.ctx, exampleID, "phishing"))
+	suite.NotContains(engine.counters, exampleID)
+}
+
 func Test_cacheTestSuite(t *testing.T) {
 	suite.Run(t, new(cacheTestSuite))
 }
@@ -1,6 +1,7 @@
 package cacher
 
 import (
+	"context"
 	"errors"
 	"time"
 )
@@ -9,29 +10,125 @@ var (
 	ErrEntryNotFound   = errors.New("entry not found")
 	ErrSerializeFailed = errors.New("serialize failed")
 	ErrUnexpectedError = errors.New("unexpected error")
+	ErrLockNotHeld     = errors.New("lock not held")
 )
 
+// Entry keeps only the fields of a link needed by the redirects and the
+// preview page rendered in their place, the descriptive ones such as the
+// title and tags are read from the database.
 type Entry struct {
 	Url string
 	Err error
+	// ExpiredAt is the real expiration time of the link, zero if it never
+	// expires.
+	ExpiredAt time.Time
+	// RefreshAt is the soft expiration time, the entry is considered stale
+	// after it but still can be served while being recomputed.
+	RefreshAt time.Time
+	// Delta is the time spent on the last recomputation.
+	Delta time.Duration
+	// MaxClicks is the clicks limit of the link, zero if unlimited. The
+	// remaining clicks are not cached in the entry, see Counter.
+	MaxClicks int64
+	// Protected reports whether the link requires a password, the hash
+	// itself is never cached.
+	Protected bool
+	// Rules are the targeting rules of the link in order.
+	Rules []Rule
+	// Variants are the weighted destinations of the link split for A/B
+	// testing in order.
+	Variants []Variant
+	// Passthrough is the passthrough mode of the query, see
+	// models.Url.Passthrough.
+	Passthrough string
+	// Interstitial reports whether the preview page is rendered before
+	// redirecting.
+	Interstitial bool
+	// CreatedAt is shown in the preview page, which is served from the
+	// cache like the redirects.
+	CreatedAt time.Time
 }
 
+// Rule redirects the requests matching its non-empty conditions to Url.
+type Rule struct {
+	Platform string
+	Language string
+	Country  string
+	Url      string
+}
+
+// Variant receives its share of Weight of the traffic.
+type Variant struct {
+	Name   string
+	Url    string
+	Weight int64
+}
+
+// Engine caches the entries by the keys of the links, i.e. models.Key(), so
+// that the same id on different domains never shares an entry.
 type Engine interface {
 	Get(id string) (*Entry, bool, error)
 	Set(id string, entry *Entry, expiration time.Duration) error
 	Delete(id string) error
 
-	// Check is used for multiple goroutines try to get the access permission
-	// for given id.
+	// Check is used for multiple goroutines (even across replicas) try to
+	// get the access permission for given id.
 	//
-	// Return `true` means current goroutine get the permission, and has
-	// responsibility to call Uncheck().
+	// Return a non-nil Lock means current goroutine get the permission, and
+	// has responsibility to release it. The permission is returned
+	// automatically after lease unless it is renewed, so that a crashed
+	// holder is not able to block the id forever.
 	//
-	// Return `false` means that an another goroutine has already took the
+	// Return a nil Lock means that an another goroutine has already took the
 	// permission away.
 	//
 	// This method is goroutine-safe.
-	Check(id string) (bool, error)
-	// Uncheck will return the permission for given id.
-	Uncheck(id string) error
+	Check(id string, lease time.Duration) (Lock, error)
+}
+
+// Lock is the permission got by Engine.Check(). It is owned by a unique
+// token, so a holder whose lease has expired is not able to release or renew
+// the permission which is taken by another.
+type Lock interface {
+	// Renew extends the lease to lease from now, it returns ErrLockNotHeld if
+	// the lease has already expired.
+	Renew(lease time.Duration) error
+	// Release returns the permission, it returns ErrLockNotHeld if the lease
+	// has already expired.
+	Release() error
+}
+
+// Notifier is implemented by the engines which are able to broadcast
+// messages to every replica of this service, e.g. Redis pub/sub.
+type Notifier interface {
+	Publish(channel, message string) error
+	// Subscribe calls handler for every message received from channel.
+	//
+	// It blocks until ctx is done or the subscription is broken.
+	Subscribe(ctx context.Context, channel string, handler func(message string)) error
+}
+
+// Pinger is implemented by the engines which depend on a remote server.
+type Pinger interface {
+	Ping() error
+}
+
+// Flusher is implemented by the engines which are able to remove all
+// entries at once.
+type Flusher interface {
+	Flush() error
+}
+
+// Counter is implemented by the engines which are able to count atomically
+// across replicas, e.g. Redis.
+type Counter interface {
+	// SetCounter sets the counter of id to n.
+	SetCounter(id string, n int64, expiration time.Duration) error
+	// Decr decrements the counter of id unless it has already reached zero,
+	// and returns the decremented value, or -1 if it had reached zero. It
+	// reports false if the counter does not exist.
+	Decr(id string) (n int64, found bool, err error)
+	// DeleteCounter deletes the counter of id, it is not an error if the
+	// counter does not exist.
+	DeleteCounter(id string) error
 }
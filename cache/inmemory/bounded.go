@@ -0,0 +1,218 @@
+package inmemory
+
+import (
+	"expvar"
+	"goshorturl/cache/cacher"
+	"goshorturl/pkg/multicas"
+	"sync"
+	"time"
+)
+
+// entryOverhead approximates the bytes taken by an entry besides its strings,
+// e.g. the time fields, pointers and the bookkeeping of map and policy.
+const entryOverhead = 128
+
+// ruleOverhead approximates the string headers of a targeting rule.
+const ruleOverhead = 64
+
+// variantOverhead approximates the string headers and weight of a variant.
+const variantOverhead = 40
+
+var metrics = expvar.NewMap("cache_inmemory")
+
+// Config configures the bounded in-memory cache.
+type Config struct {
+	// MaxEntries limits the number of entries, 0 means no limit.
+	MaxEntries int
+	// MaxBytes limits the approximate bytes taken by entries, 0 means no limit.
+	MaxBytes int64
+	// Policy is one of LRU, LFU and TinyLFU, use LRU by default.
+	Policy string
+	// DefaultExp is used if an entry is set without a positive expiration.
+	DefaultExp time.Duration
+}
+
+// Stats records the usage of the bounded in-memory cache.
+type Stats struct {
+	Entries     int
+	Bytes       int64
+	Evictions   int64 // removed to make room for the others
+	Rejections  int64 // not admitted by the policy
+	Expirations int64
+}
+
+type boundedEntry struct {
+	entry    cacher.Entry
+	expireAt time.Time
+	size     int64
+}
+
+// NewBounded returns an in-memory cache which is bounded by the number of
+// entries and by the bytes taken, the entries are evicted by the given policy
+// when any limit exceeded.
+func NewBounded(config Config) cacher.Engine {
+	return &bounded{
+		config: config,
+		policy: newPolicy(config.Policy, config.MaxEntries),
+		items:  make(map[string]*boundedEntry),
+		mcas:   multicas.NewMultiCAS(),
+	}
+}
+
+type bounded struct {
+	mu     sync.Mutex
+	config Config
+	policy policy
+	items  map[string]*boundedEntry
+	bytes  int64
+	stats  Stats
+	mcas   multicas.MultiCAS
+}
+
+func (b *bounded) Get(id string) (*cacher.Entry, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.policy.access(id)
+	be, ok := b.items[id]
+	if !ok {
+		return nil, false, cacher.ErrEntryNotFound
+	}
+	if time.Now().After(be.expireAt) {
+		b.remove(id)
+		b.record(&b.stats.Expirations, "expirations")
+		return nil, false, cacher.ErrEntryNotFound
+	}
+	entry := be.entry
+	return &entry, true, nil
+}
+
+func (b *bounded) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	if expiration <= 0 {
+		expiration = b.config.DefaultExp
+	}
+	be := &boundedEntry{
+		entry:    *entry,
+		expireAt: time.Now().Add(expiration),
+		size:     sizeOf(id, entry),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.MaxBytes > 0 && be.size > b.config.MaxBytes {
+		b.remove(id)
+		b.record(&b.stats.Rejections, "rejections")
+		return nil
+	}
+
+	b.policy.access(id)
+	_, updated := b.items[id]
+	if updated {
+		b.bytes -= b.items[id].size
+		delete(b.items, id)
+	}
+	// tracked reports whether id is still in the policy
+	tracked := updated
+	for b.overflow(be.size) {
+		victim, ok := b.policy.victim()
+		if !ok {
+			break
+		}
+		if victim == id {
+			// the existent entry is the least worth one, step it aside to
+			// make room by the others
+			b.policy.remove(id)
+			tracked = false
+			continue
+		}
+		// an update is never rejected, otherwise the key would be dropped
+		if !updated && !b.policy.admit(id, victim) {
+			b.record(&b.stats.Rejections, "rejections")
+			return nil
+		}
+		b.remove(victim)
+		b.record(&b.stats.Evictions, "evictions")
+	}
+
+	b.items[id] = be
+	b.bytes += be.size
+	if !tracked {
+		b.policy.add(id)
+	}
+	return nil
+}
+
+func (b *bounded) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(id)
+	return nil
+}
+
+// Flush removes all entries.
+func (b *bounded) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id := range b.items {
+		b.remove(id)
+	}
+	return nil
+}
+
+func (b *bounded) Check(id string, lease time.Duration) (cacher.Lock, error) {
+	return check(b.mcas, id, lease)
+}
+
+// Stats returns a snapshot of the usage.
+func (b *bounded) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Entries = len(b.items)
+	stats.Bytes = b.bytes
+	return stats
+}
+
+// overflow reports whether any limit exceeds after adding size bytes, should
+// be called with b.mu held.
+func (b *bounded) overflow(size int64) bool {
+	if b.config.MaxEntries > 0 && len(b.items)+1 > b.config.MaxEntries {
+		return true
+	}
+	return b.config.MaxBytes > 0 && b.bytes+size > b.config.MaxBytes
+}
+
+// remove should be called with b.mu held.
+func (b *bounded) remove(id string) {
+	be, ok := b.items[id]
+	if !ok {
+		return
+	}
+	delete(b.items, id)
+	b.bytes -= be.size
+	b.policy.remove(id)
+}
+
+// record should be called with b.mu held.
+func (b *bounded) record(counter *int64, name string) {
+	*counter++
+	metrics.Add(name, 1)
+}
+
+func sizeOf(id string, entry *cacher.Entry) int64 {
+	size := int64(entryOverhead + len(id) + len(entry.Url) + len(entry.Passthrough))
+	if entry.Err != nil {
+		size += int64(len(entry.Err.Error()))
+	}
+	for _, rule := range entry.Rules {
+		size += int64(ruleOverhead + len(rule.Platform) + len(rule.Language) + len(rule.Country) + len(rule.Url))
+	}
+	for _, v := range entry.Variants {
+		size += int64(variantOverhead + len(v.Name) + len(v.Url))
+	}
+	return size
+}
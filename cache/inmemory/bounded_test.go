@@ -0,0 +1,187 @@
+package inmemory
+
+import (
+	"fmt"
+	"goshorturl/cache/cacher"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBounded(config Config) *bounded {
+	config.DefaultExp = time.Hour
+	return NewBounded(config).(*bounded)
+}
+
+func set(t *testing.T, b *bounded, ids ...string) {
+	for _, id := range ids {
+		assert.NoError(t, b.Set(id, &cacher.Entry{Url: "http://example.com/" + id}, time.Hour))
+	}
+}
+
+func get(b *bounded, ids ...string) {
+	for _, id := range ids {
+		b.Get(id)
+	}
+}
+
+func cached(b *bounded, id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.items[id]
+	return ok
+}
+
+func TestBounded_eviction_policies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		access  func(b *bounded)
+		evicted string
+	}{
+		{
+			"lru evicts the least recently used",
+			LRU,
+			func(b *bounded) { get(b, "a", "a", "a", "b") },
+			"c",
+		},
+		{
+			"lfu evicts the least frequently used",
+			LFU,
+			func(b *bounded) { get(b, "a", "a", "b", "b", "c") },
+			"c",
+		},
+		{
+			"lfu evicts the least recently used among the same frequency",
+			LFU,
+			func(b *bounded) { get(b, "c", "b", "a") },
+			"c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBounded(Config{MaxEntries: 3, Policy: tt.policy})
+			set(t, b, "a", "b", "c")
+			tt.access(b)
+			set(t, b, "d")
+
+			assert.Equal(t, 3, b.Stats().Entries)
+			assert.Equal(t, int64(1), b.Stats().Evictions)
+			assert.False(t, cached(b, tt.evicted))
+			assert.True(t, cached(b, "d"))
+		})
+	}
+}
+
+func TestBounded_tinylfu_admission(t *testing.T) {
+	b := newTestBounded(Config{MaxEntries: 2, Policy: TinyLFU})
+	set(t, b, "a", "b")
+	get(b, "a", "a", "b", "b")
+
+	set(t, b, "c")
+	assert.False(t, cached(b, "c"), "one-hit wonder should not be admitted")
+	assert.Equal(t, int64(1), b.Stats().Rejections)
+
+	get(b, "c", "c", "c", "c")
+	set(t, b, "c")
+	assert.True(t, cached(b, "c"), "frequently accessed one should be admitted")
+	assert.Equal(t, int64(1), b.Stats().Evictions)
+}
+
+func TestBounded_byte_budget(t *testing.T) {
+	size := sizeOf("a", &cacher.Entry{Url: "http://example.com/a"})
+	b := newTestBounded(Config{MaxBytes: 2 * size})
+	set(t, b, "a", "b", "c")
+
+	stats := b.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 2*size, stats.Bytes)
+	assert.False(t, cached(b, "a"))
+
+	huge := &cacher.Entry{Url: strings.Repeat("x", int(2*size))}
+	assert.NoError(t, b.Set("d", huge, time.Hour))
+	assert.False(t, cached(b, "d"), "entry larger than budget should be rejected")
+	assert.Equal(t, 2, b.Stats().Entries)
+}
+
+func TestBounded_update_existent_entry(t *testing.T) {
+	b := newTestBounded(Config{MaxEntries: 2})
+	set(t, b, "a", "b")
+	assert.NoError(t, b.Set("a", &cacher.Entry{Url: "http://example.com/updated"}, time.Hour))
+
+	entry, found, err := b.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://example.com/updated", entry.Url)
+	assert.Equal(t, 2, b.Stats().Entries)
+	assert.Equal(t, int64(0), b.Stats().Evictions)
+}
+
+// strictLFU evicts like LFU but never admits a new key.
+type strictLFU struct {
+	*lfu
+}
+
+func (strictLFU) admit(candidate, victim string) bool {
+	return false
+}
+
+func TestBounded_update_when_full(t *testing.T) {
+	size := sizeOf("a", &cacher.Entry{Url: "http://example.com/a"})
+	for _, policy := range []string{LRU, LFU, TinyLFU, "strict"} {
+		t.Run(policy, func(t *testing.T) {
+			b := newTestBounded(Config{MaxBytes: 2 * size, Policy: policy})
+			if policy == "strict" {
+				b.policy = strictLFU{newLFU()}
+			}
+			set(t, b, "a", "b")
+			get(b, "b", "b", "b")
+
+			// larger, so that both of them are not able to fit in
+			bigger := &cacher.Entry{Url: "http://example.com/a/bigger"}
+			assert.NoError(t, b.Set("a", bigger, time.Hour))
+			entry, found, err := b.Get("a")
+			assert.NoError(t, err)
+			assert.True(t, found, "an update should never drop the key")
+			assert.Equal(t, bigger.Url, entry.Url)
+			assert.False(t, cached(b, "b"))
+			assert.Equal(t, int64(0), b.Stats().Rejections)
+		})
+	}
+}
+
+func TestBounded_expiration(t *testing.T) {
+	b := newTestBounded(Config{MaxEntries: 10})
+	assert.NoError(t, b.Set("a", &cacher.Entry{}, 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+
+	_, found, err := b.Get("a")
+	assert.False(t, found)
+	assert.Equal(t, cacher.ErrEntryNotFound, err)
+	assert.Equal(t, int64(1), b.Stats().Expirations)
+	assert.Equal(t, 0, b.Stats().Entries)
+}
+
+func TestBounded_Check(t *testing.T) {
+	b := newTestBounded(Config{MaxEntries: 10})
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprint(i)
+		lock, _ := b.Check(id, time.Minute)
+		assert.NotNil(t, lock)
+		other, _ := b.Check(id, time.Minute)
+		assert.Nil(t, other, "only one can get the permission")
+		assert.NoError(t, lock.Release())
+	}
+
+	t.Run("expired lease", func(t *testing.T) {
+		lock, _ := b.Check("id", 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		other, _ := b.Check("id", time.Minute)
+		assert.NotNil(t, other, "the permission is returned after lease")
+		assert.Equal(t, cacher.ErrLockNotHeld, lock.Renew(time.Minute))
+		assert.Equal(t, cacher.ErrLockNotHeld, lock.Release())
+		assert.NoError(t, other.Release())
+	})
+}
@@ -43,11 +43,6 @@ func (i *inMemory) Delete(id string) error {
 	return nil
 }
 
-func (i *inMemory) Check(id string) (bool, error) {
-	return i.mcas.Set(id), nil
-}
-
-func (i *inMemory) Uncheck(id string) error {
-	i.mcas.Unset(id)
-	return nil
+func (i *inMemory) Check(id string, lease time.Duration) (cacher.Lock, error) {
+	return check(i.mcas, id, lease)
 }
@@ -0,0 +1,36 @@
+package inmemory
+
+import (
+	"goshorturl/cache/cacher"
+	"goshorturl/pkg/multicas"
+	"time"
+)
+
+// lock is the permission held in a multicas by token.
+type lock struct {
+	mcas  multicas.MultiCAS
+	id    string
+	token uint64
+}
+
+func check(mcas multicas.MultiCAS, id string, lease time.Duration) (cacher.Lock, error) {
+	token, ok := mcas.SetWithTTL(id, lease)
+	if !ok {
+		return nil, nil
+	}
+	return &lock{mcas, id, token}, nil
+}
+
+func (l *lock) Renew(lease time.Duration) error {
+	if !l.mcas.Renew(l.id, l.token, lease) {
+		return cacher.ErrLockNotHeld
+	}
+	return nil
+}
+
+func (l *lock) Release() error {
+	if !l.mcas.UnsetWithToken(l.id, l.token) {
+		return cacher.ErrLockNotHeld
+	}
+	return nil
+}
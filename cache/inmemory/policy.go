@@ -0,0 +1,260 @@
+package inmemory
+
+import (
+	"container/heap"
+	"container/list"
+	"hash/fnv"
+)
+
+const (
+	LRU     = "lru"
+	LFU     = "lfu"
+	TinyLFU = "tinylfu"
+)
+
+// policy decides which key should be evicted when the cache is full.
+//
+// The methods are called with the lock of cache held, so the implementations
+// need not be goroutine-safe.
+type policy interface {
+	// access records an access of key, no matter it is cached or not.
+	access(key string)
+	// add starts tracking key.
+	add(key string)
+	// remove stops tracking key.
+	remove(key string)
+	// victim returns the key which should be evicted next.
+	victim() (string, bool)
+	// admit reports whether candidate is worth to replace victim.
+	admit(candidate, victim string) bool
+}
+
+func newPolicy(name string, capacity int) policy {
+	switch name {
+	case LFU:
+		return newLFU()
+	case TinyLFU:
+		return newTinyLFU(capacity)
+	default:
+		return newLRU()
+	}
+}
+
+type lru struct {
+	ll    *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) access(key string) {
+	if ele, ok := l.items[key]; ok {
+		l.ll.MoveToFront(ele)
+	}
+}
+
+func (l *lru) add(key string) {
+	l.items[key] = l.ll.PushFront(key)
+}
+
+func (l *lru) remove(key string) {
+	if ele, ok := l.items[key]; ok {
+		l.ll.Remove(ele)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) victim() (string, bool) {
+	ele := l.ll.Back()
+	if ele == nil {
+		return "", false
+	}
+	return ele.Value.(string), true
+}
+
+func (l *lru) admit(candidate, victim string) bool {
+	return true
+}
+
+type lfuItem struct {
+	key   string
+	freq  uint64
+	tick  uint64 // to evict the least recently used one among the same frequency
+	index int
+}
+
+// lfuHeap is a min-heap ordered by frequency then by recency.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].tick < h[j].tick
+	}
+	return h[i].freq < h[j].freq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type lfu struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	tick  uint64
+}
+
+func newLFU() *lfu {
+	return &lfu{items: make(map[string]*lfuItem)}
+}
+
+func (l *lfu) access(key string) {
+	if item, ok := l.items[key]; ok {
+		l.tick++
+		item.freq++
+		item.tick = l.tick
+		heap.Fix(&l.heap, item.index)
+	}
+}
+
+func (l *lfu) add(key string) {
+	l.tick++
+	item := &lfuItem{key: key, freq: 1, tick: l.tick}
+	heap.Push(&l.heap, item)
+	l.items[key] = item
+}
+
+func (l *lfu) remove(key string) {
+	if item, ok := l.items[key]; ok {
+		heap.Remove(&l.heap, item.index)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfu) victim() (string, bool) {
+	if len(l.heap) == 0 {
+		return "", false
+	}
+	return l.heap[0].key, true
+}
+
+func (l *lfu) admit(candidate, victim string) bool {
+	return true
+}
+
+// tinyLFU evicts the least recently used key, but only admits a new key if
+// it is estimated to be accessed more frequently than the victim.
+//
+// ref: https://arxiv.org/abs/1512.00727
+type tinyLFU struct {
+	*lru
+	sketch *countMinSketch
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	return &tinyLFU{
+		lru:    newLRU(),
+		sketch: newCountMinSketch(capacity),
+	}
+}
+
+func (t *tinyLFU) access(key string) {
+	t.sketch.increment(key)
+	t.lru.access(key)
+}
+
+func (t *tinyLFU) admit(candidate, victim string) bool {
+	return t.sketch.estimate(candidate) > t.sketch.estimate(victim)
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+	sketchMinWidth   = 64
+)
+
+// countMinSketch estimates the access frequency of keys with saturating
+// counters, which are halved periodically to forget the stale history.
+type countMinSketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := sketchMinWidth
+	for width < capacity {
+		width <<= 1
+	}
+	s := &countMinSketch{
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// derive the hashes by double hashing: h1 + i*h2
+	h1, h2 := sum, (sum>>32)|1
+	var indexes [sketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return indexes
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < sketchMaxCounter {
+			s.rows[i][index]++
+		}
+	}
+	if s.additions++; s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(sketchMaxCounter)
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < min {
+			min = s.rows[i][index]
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"goshorturl/repository"
+	"time"
+)
+
+var metrics = expvar.NewMap("cache_bypass")
+
+// limiter is a semaphore which bounds the concurrent reads from database.
+type limiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func newLimiter(limit int, wait time.Duration) *limiter {
+	return &limiter{slots: make(chan struct{}, limit), wait: wait}
+}
+
+// acquire waits for a slot until the wait time passed or ctx is done, the
+// returned function releases the slot.
+func (l *limiter) acquire(ctx context.Context) (release func(), err error) {
+	release = func() {
+		metrics.Add("db_inflight", -1)
+		<-l.slots
+	}
+	// take a free slot first, the timer may fire at once if wait is zero
+	select {
+	case l.slots <- struct{}{}:
+		metrics.Add("db_inflight", 1)
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		metrics.Add("db_inflight", 1)
+		return release, nil
+	case <-timer.C:
+		metrics.Add("db_rejected", 1)
+		return nil, repository.ErrBusy
+	case <-ctx.Done():
+		metrics.Add("db_rejected", 1)
+		return nil, ctx.Err()
+	}
+}
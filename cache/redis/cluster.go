@@ -0,0 +1,237 @@
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	numSlots        = 16384
+	maxRedirections = 5
+)
+
+var errNoNode = errors.New("no reachable cluster node")
+
+// cluster routes commands by the hash slot of key, and follows the MOVED and
+// ASK redirections when the slots are migrating.
+type cluster struct {
+	config  Config
+	options []redigo.DialOption
+
+	mu    sync.RWMutex
+	slots [numSlots]string // address of the master serving each slot
+	pools map[string]*redigo.Pool
+}
+
+func newCluster(config Config, tlsConfig *tls.Config) *cluster {
+	return &cluster{
+		config:  config,
+		options: config.dialOptions(tlsConfig),
+		pools:   make(map[string]*redigo.Pool),
+	}
+}
+
+func (c *cluster) exec(key string, f func(c redigo.Conn) (interface{}, error)) (interface{}, error) {
+	addr, err := c.addrOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	asking := false
+	for i := 0; ; i++ {
+		conn := c.poolOf(addr).Get()
+		if asking {
+			conn.Do("ASKING")
+		}
+		reply, err := f(conn)
+		conn.Close()
+
+		redirect, target, ok := parseRedirection(err)
+		if !ok || i >= maxRedirections {
+			return reply, err
+		}
+		if redirect == "MOVED" {
+			// the slot map is outdated
+			c.refresh()
+		}
+		addr, asking = target, redirect == "ASK"
+	}
+}
+
+func (c *cluster) dial() (redigo.Conn, error) {
+	// a message published to any node is broadcast across the cluster
+	for _, addr := range c.seeds() {
+		conn, err := redigo.Dial("tcp", addr, withOptions(c.options, redigo.DialReadTimeout(0))...)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errNoNode
+}
+
+func (c *cluster) addrOf(key string) (string, error) {
+	slot := hashSlot(key)
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+
+	c.refresh()
+	c.mu.RLock()
+	addr = c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	// the slot is not covered yet, let any node redirect us
+	seeds := c.seeds()
+	if len(seeds) == 0 {
+		return "", errNoNode
+	}
+	return seeds[rand.Intn(len(seeds))], nil
+}
+
+func (c *cluster) poolOf(addr string) *redigo.Pool {
+	c.mu.RLock()
+	pool, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok := c.pools[addr]; ok {
+		return pool
+	}
+	pool = c.config.newPool(func(extra ...redigo.DialOption) (redigo.Conn, error) {
+		return redigo.Dial("tcp", addr, withOptions(c.options, extra...)...)
+	}, periodicPing)
+	c.pools[addr] = pool
+	return pool
+}
+
+// seeds returns the known nodes, including the configured ones.
+func (c *cluster) seeds() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seeds := append([]string{}, c.config.ClusterAddrs...)
+	for addr := range c.pools {
+		seeds = append(seeds, addr)
+	}
+	return seeds
+}
+
+// refresh reloads the slot map by CLUSTER SLOTS from the first reachable node.
+func (c *cluster) refresh() {
+	for _, addr := range c.seeds() {
+		conn := c.poolOf(addr).Get()
+		reply, err := redigo.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		slots, err := parseSlots(reply)
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return
+	}
+}
+
+// parseSlots parses the reply of CLUSTER SLOTS, each slot range is an array
+// of [start, end, [host, port, id], ...replicas], e.g.
+//
+//	[[0, 5460, ["127.0.0.1", 30001, "09dbe9"]], ...]
+func parseSlots(reply []interface{}) (slots [numSlots]string, err error) {
+	for _, r := range reply {
+		values, err := redigo.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			return slots, errors.New("unexpected slot range")
+		}
+		start, err := redigo.Int(values[0], nil)
+		if err != nil {
+			return slots, err
+		}
+		end, err := redigo.Int(values[1], nil)
+		if err != nil {
+			return slots, err
+		}
+		master, err := redigo.Values(values[2], nil)
+		if err != nil || len(master) < 2 {
+			return slots, errors.New("unexpected master node")
+		}
+		host, err := redigo.String(master[0], nil)
+		if err != nil {
+			return slots, err
+		}
+		port, err := redigo.Int(master[1], nil)
+		if err != nil {
+			return slots, err
+		}
+		if start < 0 || end >= numSlots || start > end {
+			return slots, errors.New("unexpected slot range")
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// parseRedirection parses the errors like "MOVED 3999 127.0.0.1:6381" and
+// "ASK 3999 127.0.0.1:6381".
+func parseRedirection(err error) (redirect, addr string, ok bool) {
+	redisErr, isRedisErr := err.(redigo.Error)
+	if !isRedisErr {
+		return "", "", false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+// hashSlot returns the slot of key, only the hash tag is hashed if key
+// contains a non-empty one, e.g. "{user1000}.following".
+//
+// ref: https://redis.io/topics/cluster-spec#keys-distribution-model
+func hashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % numSlots
+}
+
+// crc16 implements the CRC16-XMODEM used by Redis Cluster.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
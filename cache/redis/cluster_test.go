@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739}, // the check value of CRC16-XMODEM is 0x31C3
+		{"foo", 12182},
+		{"{user1000}.following", hashSlot("user1000")},
+		{"{user1000}.followers", hashSlot("user1000")},
+		{"foo{}{bar}", hashSlot("foo{}{bar}")}, // empty hash tag hashes the whole key
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.slot, hashSlot(tt.key))
+		})
+	}
+	assert.NotEqual(t, hashSlot("foo{}{bar}"), hashSlot("bar"))
+}
+
+func Test_parseRedirection(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		redirect string
+		addr     string
+		ok       bool
+	}{
+		{"moved", redigo.Error("MOVED 3999 127.0.0.1:6381"), "MOVED", "127.0.0.1:6381", true},
+		{"ask", redigo.Error("ASK 3999 127.0.0.1:6381"), "ASK", "127.0.0.1:6381", true},
+		{"other redis error", redigo.Error("ERR unknown command"), "", "", false},
+		{"not redis error", errors.New("MOVED 3999 127.0.0.1:6381"), "", "", false},
+		{"nil", nil, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirect, addr, ok := parseRedirection(tt.err)
+			assert.Equal(t, tt.redirect, redirect)
+			assert.Equal(t, tt.addr, addr)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func Test_parseSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(6379), []byte("id1")}},
+		[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(6379), []byte("id2")},
+			[]interface{}{[]byte("10.0.0.3"), int64(6379), []byte("id3")}},
+	}
+	slots, err := parseSlots(reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", slots[0])
+	assert.Equal(t, "10.0.0.1:6379", slots[8191])
+	assert.Equal(t, "10.0.0.2:6379", slots[8192])
+	assert.Equal(t, "10.0.0.2:6379", slots[16383])
+
+	_, err = parseSlots([]interface{}{[]interface{}{int64(0)}})
+	assert.Error(t, err)
+}
+
+func TestConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"standalone", Config{Host: "localhost", Port: 6379}, false},
+		{"standalone without port", Config{Host: "localhost"}, true},
+		{"sentinel", Config{SentinelAddrs: []string{"localhost:26379"}, SentinelMaster: "mymaster"}, false},
+		{"sentinel without master", Config{SentinelAddrs: []string{"localhost:26379"}}, true},
+		{"cluster", Config{ClusterAddrs: []string{"localhost:30001"}}, false},
+		{"cluster with DB", Config{ClusterAddrs: []string{"localhost:30001"}, DB: 1}, true},
+		{"sentinel and cluster", Config{
+			SentinelAddrs:  []string{"localhost:26379"},
+			SentinelMaster: "mymaster",
+			ClusterAddrs:   []string{"localhost:30001"},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
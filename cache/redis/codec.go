@@ -0,0 +1,456 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"goshorturl/cache/cacher"
+	"goshorturl/pkg/msgpack"
+	"goshorturl/repository"
+	"time"
+)
+
+// The encoded entry is wrapped by an envelope:
+//
+//	+-------+---------+--------+---------+
+//	| magic | version | format | payload |
+//	+-------+---------+--------+---------+
+//
+// The first byte of a gob stream is either less than 0x80 or greater than
+// 0xf7, so the magic distinguishes the legacy gob entries written without
+// envelope.
+const (
+	envelopeMagic   = 0xce
+	envelopeVersion = 1
+	envelopeHeader  = 3
+)
+
+const (
+	FormatGob     byte = 1
+	FormatJSON    byte = 2
+	FormatMsgpack byte = 3
+)
+
+// Error codes are encoded instead of error messages.
+const (
+	errCodeNone     = 0
+	errCodeNotFound = 1
+	errCodeOther    = 2
+	errCodeGone     = 3
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	ErrUnsupportedFormat  = errors.New("unsupported format")
+)
+
+// Codec encodes an entry into the payload of envelope, and vice versa.
+type Codec interface {
+	Format() byte
+	Encode(entry *cacher.Entry) ([]byte, error)
+	Decode(payload []byte) (*cacher.Entry, error)
+}
+
+var codecs = map[byte]Codec{
+	FormatGob:     gobCodec{},
+	FormatJSON:    jsonCodec{},
+	FormatMsgpack: msgpackCodec{},
+}
+
+// CodecOf returns the codec of format name, i.e. "gob", "json" or "msgpack".
+func CodecOf(name string) (Codec, error) {
+	switch name {
+	case "gob":
+		return gobCodec{}, nil
+	case "json":
+		return jsonCodec{}, nil
+	case "msgpack":
+		return msgpackCodec{}, nil
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// serialize wraps the payload of codec by envelope, except the gob entries,
+// which are written as the legacy ones so that the replicas of the previous
+// versions are able to read them during a rolling deployment.
+func serialize(codec Codec, entry *cacher.Entry) ([]byte, error) {
+	payload, err := codec.Encode(entry)
+	if err != nil || codec.Format() == FormatGob {
+		return payload, err
+	}
+	return append([]byte{envelopeMagic, envelopeVersion, codec.Format()}, payload...), nil
+}
+
+// deserialize decodes data by the codec recorded in envelope, data without
+// envelope is regarded as a legacy gob entry.
+func deserialize(data []byte) (*cacher.Entry, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		return gobCodec{}.Decode(data)
+	}
+	if len(data) < envelopeHeader {
+		return nil, ErrUnsupportedFormat
+	}
+	if data[1] != envelopeVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	codec, ok := codecs[data[2]]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	return codec.Decode(data[envelopeHeader:])
+}
+
+func errCodeOf(err error) int {
+	switch err {
+	case nil:
+		return errCodeNone
+	case repository.ErrRecordNotFound:
+		return errCodeNotFound
+	case repository.ErrGone:
+		return errCodeGone
+	}
+	return errCodeOther
+}
+
+func errOf(code int, message string) error {
+	switch code {
+	case errCodeNone:
+		return nil
+	case errCodeNotFound:
+		return repository.ErrRecordNotFound
+	case errCodeGone:
+		return repository.ErrGone
+	}
+	if message == "" {
+		message = "unknown cached error"
+	}
+	return errors.New(message)
+}
+
+// errMessage keeps the message of unknown errors for troubleshooting.
+func errMessage(err error) string {
+	if errCodeOf(err) != errCodeOther {
+		return ""
+	}
+	return err.Error()
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// gobCodec is compatible with the entries of the previous versions, which
+// compared error messages to restore the errors and only decode the Url and
+// Errmsg fields.
+type gobCodec struct{}
+
+type gobEntry struct {
+	Url          string
+	Errmsg       string
+	ExpiredAt    time.Time
+	RefreshAt    time.Time
+	Delta        time.Duration
+	MaxClicks    int64
+	Protected    bool
+	Rules        []cacher.Rule
+	Variants     []cacher.Variant
+	Passthrough  string
+	Interstitial bool
+	CreatedAt    time.Time
+}
+
+func (gobCodec) Format() byte { return FormatGob }
+
+func (gobCodec) Encode(entry *cacher.Entry) ([]byte, error) {
+	s := gobEntry{
+		Url:          entry.Url,
+		ExpiredAt:    entry.ExpiredAt,
+		RefreshAt:    entry.RefreshAt,
+		Delta:        entry.Delta,
+		MaxClicks:    entry.MaxClicks,
+		Protected:    entry.Protected,
+		Rules:        entry.Rules,
+		Variants:     entry.Variants,
+		Passthrough:  entry.Passthrough,
+		Interstitial: entry.Interstitial,
+		CreatedAt:    entry.CreatedAt,
+	}
+	if entry.Err != nil {
+		s.Errmsg = entry.Err.Error()
+	}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(s)
+	return buffer.Bytes(), err
+}
+
+func (gobCodec) Decode(payload []byte) (*cacher.Entry, error) {
+	var s gobEntry
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&s); err != nil {
+		return nil, err
+	}
+	entry := &cacher.Entry{
+		Url:          s.Url,
+		ExpiredAt:    s.ExpiredAt,
+		RefreshAt:    s.RefreshAt,
+		Delta:        s.Delta,
+		MaxClicks:    s.MaxClicks,
+		Protected:    s.Protected,
+		Rules:        s.Rules,
+		Variants:     s.Variants,
+		Passthrough:  s.Passthrough,
+		Interstitial: s.Interstitial,
+		CreatedAt:    s.CreatedAt,
+	}
+	switch s.Errmsg {
+	case "":
+	case repository.ErrRecordNotFound.Error():
+		entry.Err = repository.ErrRecordNotFound
+	case repository.ErrGone.Error():
+		entry.Err = repository.ErrGone
+	default:
+		entry.Err = errors.New(s.Errmsg)
+	}
+	return entry, nil
+}
+
+// jsonCodec is readable by other languages, the times are in unix milliseconds.
+type jsonCodec struct{}
+
+type jsonEntry struct {
+	Url          string        `json:"url,omitempty"`
+	ErrCode      int           `json:"errCode,omitempty"`
+	ErrMsg       string        `json:"errMsg,omitempty"`
+	ExpiredAt    int64         `json:"expiredAt,omitempty"`
+	RefreshAt    int64         `json:"refreshAt,omitempty"`
+	Delta        int64         `json:"delta,omitempty"` // in nanoseconds
+	MaxClicks    int64         `json:"maxClicks,omitempty"`
+	Protected    bool          `json:"protected,omitempty"`
+	Rules        []jsonRule    `json:"rules,omitempty"`
+	Variants     []jsonVariant `json:"variants,omitempty"`
+	Passthrough  string        `json:"passthrough,omitempty"`
+	Interstitial bool          `json:"interstitial,omitempty"`
+	CreatedAt    int64         `json:"createdAt,omitempty"`
+}
+
+type jsonRule struct {
+	Platform string `json:"platform,omitempty"`
+	Language string `json:"language,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Url      string `json:"url"`
+}
+
+type jsonVariant struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Weight int64  `json:"weight"`
+}
+
+func (jsonCodec) Format() byte { return FormatJSON }
+
+func (jsonCodec) Encode(entry *cacher.Entry) ([]byte, error) {
+	var rules []jsonRule
+	for _, rule := range entry.Rules {
+		rules = append(rules, jsonRule(rule))
+	}
+	var variants []jsonVariant
+	for _, v := range entry.Variants {
+		variants = append(variants, jsonVariant(v))
+	}
+	return json.Marshal(jsonEntry{
+		Url:          entry.Url,
+		ErrCode:      errCodeOf(entry.Err),
+		ErrMsg:       errMessage(entry.Err),
+		ExpiredAt:    unixMilli(entry.ExpiredAt),
+		RefreshAt:    unixMilli(entry.RefreshAt),
+		Delta:        int64(entry.Delta),
+		MaxClicks:    entry.MaxClicks,
+		Protected:    entry.Protected,
+		Rules:        rules,
+		Variants:     variants,
+		Passthrough:  entry.Passthrough,
+		Interstitial: entry.Interstitial,
+		CreatedAt:    unixMilli(entry.CreatedAt),
+	})
+}
+
+func (jsonCodec) Decode(payload []byte) (*cacher.Entry, error) {
+	var s jsonEntry
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, err
+	}
+	var rules []cacher.Rule
+	for _, rule := range s.Rules {
+		rules = append(rules, cacher.Rule(rule))
+	}
+	var variants []cacher.Variant
+	for _, v := range s.Variants {
+		variants = append(variants, cacher.Variant(v))
+	}
+	return &cacher.Entry{
+		Url:          s.Url,
+		Err:          errOf(s.ErrCode, s.ErrMsg),
+		ExpiredAt:    fromUnixMilli(s.ExpiredAt),
+		RefreshAt:    fromUnixMilli(s.RefreshAt),
+		Delta:        time.Duration(s.Delta),
+		MaxClicks:    s.MaxClicks,
+		Protected:    s.Protected,
+		Rules:        rules,
+		Variants:     variants,
+		Passthrough:  s.Passthrough,
+		Interstitial: s.Interstitial,
+		CreatedAt:    fromUnixMilli(s.CreatedAt),
+	}, nil
+}
+
+// msgpackCodec encodes the fields into a MessagePack array in order. New
+// fields should only be appended, so that the older versions are able to
+// skip them and the newer versions regard the missing ones as zero values.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Format() byte { return FormatMsgpack }
+
+func (msgpackCodec) Encode(entry *cacher.Entry) ([]byte, error) {
+	var w msgpack.Writer
+	w.WriteArrayHeader(13)
+	w.WriteString(entry.Url)
+	w.WriteInt(int64(errCodeOf(entry.Err)))
+	w.WriteString(errMessage(entry.Err))
+	w.WriteInt(unixMilli(entry.ExpiredAt))
+	w.WriteInt(unixMilli(entry.RefreshAt))
+	w.WriteInt(int64(entry.Delta))
+	w.WriteInt(entry.MaxClicks)
+	w.WriteBool(entry.Protected)
+	// each rule is an array of its fields in order
+	w.WriteArrayHeader(len(entry.Rules))
+	for _, rule := range entry.Rules {
+		w.WriteArrayHeader(4)
+		w.WriteString(rule.Platform)
+		w.WriteString(rule.Language)
+		w.WriteString(rule.Country)
+		w.WriteString(rule.Url)
+	}
+	// so is each variant
+	w.WriteArrayHeader(len(entry.Variants))
+	for _, v := range entry.Variants {
+		w.WriteArrayHeader(3)
+		w.WriteString(v.Name)
+		w.WriteString(v.Url)
+		w.WriteInt(v.Weight)
+	}
+	w.WriteString(entry.Passthrough)
+	w.WriteBool(entry.Interstitial)
+	w.WriteInt(unixMilli(entry.CreatedAt))
+	return w.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(payload []byte) (*cacher.Entry, error) {
+	r := msgpack.NewReader(payload)
+	n, err := r.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		entry   cacher.Entry
+		errCode int64
+		errMsg  string
+		ms      int64
+		delta   int64
+	)
+	fields := []func() error{
+		func() (err error) { entry.Url, err = r.ReadString(); return },
+		func() (err error) { errCode, err = r.ReadInt(); return },
+		func() (err error) { errMsg, err = r.ReadString(); return },
+		func() (err error) { ms, err = r.ReadInt(); entry.ExpiredAt = fromUnixMilli(ms); return },
+		func() (err error) { ms, err = r.ReadInt(); entry.RefreshAt = fromUnixMilli(ms); return },
+		func() (err error) { delta, err = r.ReadInt(); entry.Delta = time.Duration(delta); return },
+		func() (err error) { entry.MaxClicks, err = r.ReadInt(); return },
+		func() (err error) { entry.Protected, err = r.ReadBool(); return },
+		func() (err error) { entry.Rules, err = readRules(r); return },
+		func() (err error) { entry.Variants, err = readVariants(r); return },
+		func() (err error) { entry.Passthrough, err = r.ReadString(); return },
+		func() (err error) { entry.Interstitial, err = r.ReadBool(); return },
+		func() (err error) { ms, err = r.ReadInt(); entry.CreatedAt = fromUnixMilli(ms); return },
+	}
+	for i := 0; i < n; i++ {
+		if i >= len(fields) {
+			// unknown fields appended by a newer version
+			err = r.Skip()
+		} else {
+			err = fields[i]()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry.Err = errOf(int(errCode), errMsg)
+	return &entry, nil
+}
+
+func readRules(r *msgpack.Reader) ([]cacher.Rule, error) {
+	n, err := r.ReadArrayHeader()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	rules := make([]cacher.Rule, n)
+	for i := range rules {
+		m, err := r.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		fields := []*string{&rules[i].Platform, &rules[i].Language, &rules[i].Country, &rules[i].Url}
+		for j := 0; j < m; j++ {
+			if j >= len(fields) {
+				err = r.Skip()
+			} else {
+				*fields[j], err = r.ReadString()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rules, nil
+}
+
+func readVariants(r *msgpack.Reader) ([]cacher.Variant, error) {
+	n, err := r.ReadArrayHeader()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	variants := make([]cacher.Variant, n)
+	for i := range variants {
+		m, err := r.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		v := &variants[i]
+		fields := []func() error{
+			func() (err error) { v.Name, err = r.ReadString(); return },
+			func() (err error) { v.Url, err = r.ReadString(); return },
+			func() (err error) { v.Weight, err = r.ReadInt(); return },
+		}
+		for j := 0; j < m; j++ {
+			if j >= len(fields) {
+				err = r.Skip()
+			} else {
+				err = fields[j]()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return variants, nil
+}
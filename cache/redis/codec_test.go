@@ -0,0 +1,178 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"goshorturl/cache/cacher"
+	"goshorturl/pkg/msgpack"
+	"goshorturl/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEntries() map[string]*cacher.Entry {
+	now := time.Unix(1600000000, 123000000)
+	return map[string]*cacher.Entry{
+		"url": {
+			Url:       "https://www.google.com",
+			ExpiredAt: now.Add(time.Hour),
+			RefreshAt: now,
+			Delta:     15 * time.Millisecond,
+		},
+		"limited": {
+			Url:       "https://www.google.com",
+			RefreshAt: now,
+			MaxClicks: 100,
+			Protected: true,
+		},
+		"targeted": {
+			Url: "https://www.google.com",
+			Rules: []cacher.Rule{
+				{Platform: "ios", Url: "https://apps.apple.com"},
+				{Language: "zh", Country: "TW", Url: "https://www.google.com.tw"},
+			},
+		},
+		"split": {
+			Url: "https://example.com/a",
+			Variants: []cacher.Variant{
+				{Name: "a", Url: "https://example.com/a", Weight: 90},
+				{Name: "b", Url: "https://example.com/b", Weight: 10},
+			},
+		},
+		"passthrough": {
+			Url:         "https://example.com/docs/{path}?ref={ref}",
+			Passthrough: "merge",
+		},
+		"interstitial": {
+			Url:          "https://example.com",
+			Interstitial: true,
+			CreatedAt:    now,
+		},
+		"not found": {Err: repository.ErrRecordNotFound, ExpiredAt: now},
+		"gone":      {Err: repository.ErrGone},
+		"other err": {Err: errors.New("connection refused")},
+		"empty":     {},
+	}
+}
+
+func Test_codecs_roundtrip(t *testing.T) {
+	for _, codec := range codecs {
+		for name, entry := range testEntries() {
+			t.Run(fmt.Sprintf("%d/%s", codec.Format(), name), func(t *testing.T) {
+				data, err := serialize(codec, entry)
+				assert.NoError(t, err)
+				if codec.Format() != FormatGob {
+					assert.Equal(t, codec.Format(), data[2])
+				}
+
+				got, err := deserialize(data)
+				assert.NoError(t, err)
+				assert.Equal(t, entry.Url, got.Url)
+				assert.True(t, entry.ExpiredAt.Equal(got.ExpiredAt))
+				assert.True(t, entry.RefreshAt.Equal(got.RefreshAt))
+				assert.Equal(t, entry.Delta, got.Delta)
+				assert.Equal(t, entry.MaxClicks, got.MaxClicks)
+				assert.Equal(t, entry.Protected, got.Protected)
+				assert.Equal(t, entry.Rules, got.Rules)
+				assert.Equal(t, entry.Variants, got.Variants)
+				assert.Equal(t, entry.Passthrough, got.Passthrough)
+				assert.Equal(t, entry.Interstitial, got.Interstitial)
+				assert.True(t, entry.CreatedAt.Equal(got.CreatedAt))
+				if entry.Err == repository.ErrRecordNotFound || entry.Err == repository.ErrGone {
+					assert.Equal(t, entry.Err, got.Err)
+				} else if entry.Err != nil {
+					assert.EqualError(t, got.Err, entry.Err.Error())
+				} else {
+					assert.NoError(t, got.Err)
+				}
+			})
+		}
+	}
+}
+
+func Test_deserialize_legacy_gob(t *testing.T) {
+	entry := testEntries()["not found"]
+	// the entries written by the previous versions have no envelope
+	data, err := gobCodec{}.Encode(entry)
+	assert.NoError(t, err)
+
+	got, err := deserialize(data)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.ErrRecordNotFound, got.Err)
+	assert.True(t, entry.ExpiredAt.Equal(got.ExpiredAt))
+}
+
+func Test_serialize_gob_readable_by_legacy(t *testing.T) {
+	// the entry decoded by the previous versions
+	type serializable struct {
+		Url    string
+		Errmsg string
+	}
+	for _, entry := range []*cacher.Entry{
+		{Url: "https://example.com", Rules: []cacher.Rule{{Platform: "ios", Url: "https://example.com/ios"}}},
+		{Err: repository.ErrRecordNotFound},
+	} {
+		data, err := serialize(gobCodec{}, entry)
+		assert.NoError(t, err)
+		var got serializable
+		assert.NoError(t, gob.NewDecoder(bytes.NewReader(data)).Decode(&got))
+		assert.Equal(t, entry.Url, got.Url)
+		if entry.Err != nil {
+			assert.Equal(t, entry.Err.Error(), got.Errmsg)
+		}
+	}
+}
+
+func Test_deserialize_unknown(t *testing.T) {
+	_, err := deserialize([]byte{envelopeMagic, envelopeVersion + 1, FormatMsgpack})
+	assert.Equal(t, ErrUnsupportedVersion, err)
+	_, err = deserialize([]byte{envelopeMagic, envelopeVersion, 0xff})
+	assert.Equal(t, ErrUnsupportedFormat, err)
+	_, err = deserialize([]byte{envelopeMagic})
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func Test_msgpackCodec_compatibility(t *testing.T) {
+	// written by an older version which has fewer fields
+	var older msgpack.Writer
+	older.WriteArrayHeader(2)
+	older.WriteString("https://www.google.com")
+	older.WriteInt(errCodeNone)
+	entry, err := msgpackCodec{}.Decode(older.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.google.com", entry.Url)
+	assert.True(t, entry.ExpiredAt.IsZero())
+
+	// written by a newer version which has more fields
+	newer, err := msgpackCodec{}.Encode(testEntries()["url"])
+	assert.NoError(t, err)
+	newer[0]++ // the fixarray header
+	var extra msgpack.Writer
+	extra.WriteMapHeader(1)
+	extra.WriteString("clicks")
+	extra.WriteInt(42)
+	entry, err = msgpackCodec{}.Decode(append(newer, extra.Bytes()...))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.google.com", entry.Url)
+	assert.Equal(t, 15*time.Millisecond, entry.Delta)
+}
+
+func Test_codec_size(t *testing.T) {
+	entry := testEntries()["url"]
+	gob, _ := gobCodec{}.Encode(entry)
+	mp, _ := msgpackCodec{}.Encode(entry)
+	assert.Less(t, len(mp), len(gob))
+}
+
+func TestCodecOf(t *testing.T) {
+	for _, name := range []string{"gob", "json", "msgpack"} {
+		_, err := CodecOf(name)
+		assert.NoError(t, err)
+	}
+	_, err := CodecOf("xml")
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	defaultMaxIdle        = 10
+	defaultIdleTimeout    = 5 * time.Minute
+	defaultConnectTimeout = 5 * time.Second
+	defaultReadTimeout    = 3 * time.Second
+	defaultWriteTimeout   = 3 * time.Second
+)
+
+// Config configures how to connect to Redis.
+//
+// Use Host and Port to connect to a standalone server, SentinelAddrs and
+// SentinelMaster to discover the primary managed by Sentinel, or ClusterAddrs
+// to route commands by hash slots of Redis Cluster.
+type Config struct {
+	Host string
+	Port int
+
+	// Username is used for ACL (Redis 6+), leave it empty to AUTH with
+	// Password only.
+	Username string
+	Password string
+	// DB is the database index, must be 0 for Redis Cluster.
+	DB int
+
+	TLS bool
+	// TLSCAFile is a PEM file of the CA certificates to verify the server,
+	// use the system pool if empty.
+	TLSCAFile             string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	// MaxIdle and MaxActive are the pool size per node, 0 means the
+	// default idle size and unlimited active connections.
+	MaxIdle        int
+	MaxActive      int
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+
+	ClusterAddrs []string
+
+	// Codec encodes the entries, gob by default, which the previous versions
+	// are able to read. The entries in any known format are readable
+	// regardless of Codec, so it can be switched to MessagePack once all the
+	// replicas are upgraded.
+	Codec Codec
+}
+
+// Validate checks that the topology of config is complete and unambiguous.
+func (c Config) Validate() error {
+	if len(c.SentinelAddrs) > 0 && len(c.ClusterAddrs) > 0 {
+		return errors.New("sentinel and cluster are exclusive")
+	}
+	if len(c.SentinelAddrs) > 0 && c.SentinelMaster == "" {
+		return errors.New("sentinel needs the name of master")
+	}
+	if len(c.ClusterAddrs) > 0 && c.DB != 0 {
+		return errors.New("cluster only supports DB 0")
+	}
+	if len(c.SentinelAddrs) == 0 && len(c.ClusterAddrs) == 0 && (c.Host == "" || c.Port == 0) {
+		return errors.New("need host and port")
+	}
+	return nil
+}
+
+func (c Config) addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxIdle == 0 {
+		c.MaxIdle = defaultMaxIdle
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = defaultConnectTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.Codec == nil {
+		c.Codec = gobCodec{}
+	}
+	return c
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// dialOptions returns the options to dial the data nodes.
+func (c Config) dialOptions(tlsConfig *tls.Config) []redigo.DialOption {
+	options := []redigo.DialOption{
+		redigo.DialConnectTimeout(c.ConnectTimeout),
+		redigo.DialReadTimeout(c.ReadTimeout),
+		redigo.DialWriteTimeout(c.WriteTimeout),
+		redigo.DialDatabase(c.DB),
+		redigo.DialUsername(c.Username),
+		redigo.DialPassword(c.Password),
+	}
+	if tlsConfig != nil {
+		options = append(options,
+			redigo.DialUseTLS(true),
+			redigo.DialTLSConfig(tlsConfig),
+			redigo.DialTLSSkipVerify(c.TLSInsecureSkipVerify),
+		)
+	}
+	return options
+}
+
+// withOptions returns a copy of options appended by extra, the latter ones
+// take precedence.
+func withOptions(options []redigo.DialOption, extra ...redigo.DialOption) []redigo.DialOption {
+	return append(append([]redigo.DialOption{}, options...), extra...)
+}
+
+func (c Config) newPool(dial func(...redigo.DialOption) (redigo.Conn, error), testOnBorrow func(redigo.Conn, time.Time) error) *redigo.Pool {
+	return &redigo.Pool{
+		MaxIdle:      c.MaxIdle,
+		MaxActive:    c.MaxActive,
+		IdleTimeout:  c.IdleTimeout,
+		Dial:         func() (redigo.Conn, error) { return dial() },
+		TestOnBorrow: testOnBorrow,
+	}
+}
+
+// periodicPing pings the connection which is idle for more than a minute.
+func periodicPing(c redigo.Conn, t time.Time) error {
+	if time.Since(t) < time.Minute {
+		return nil
+	}
+	_, err := c.Do("PING")
+	return err
+}
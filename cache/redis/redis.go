@@ -1,99 +1,54 @@
 package redis
 
 import (
-	"bytes"
-	"encoding/gob"
-	"errors"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"goshorturl/cache/cacher"
-	"goshorturl/repository"
 	"time"
 
 	redigo "github.com/gomodule/redigo/redis"
 )
 
-const (
-	defaultSETEXTimeout = 30 * time.Second // to avoid deadlock
-	setexKey            = "setex:%s"
-)
-
-type serializable struct {
-	Url    string
-	Errmsg string
-}
-
-func entry2serializable(entry *cacher.Entry) serializable {
-	if entry.Err != nil {
-		return serializable{entry.Url, entry.Err.Error()}
-	}
-	return serializable{entry.Url, ""}
-}
+// lockKey is the same as the previous versions, so that they respect each
+// other during rolling update.
+const lockKey = "setex:%s"
 
-func serialized2entry(value serializable) cacher.Entry {
-	if value.Errmsg != "" {
-		err := errors.New(value.Errmsg)
-		if value.Errmsg == repository.ErrRecordNotFound.Error() {
-			err = repository.ErrRecordNotFound
-		}
-		return cacher.Entry{Url: value.Url, Err: err}
-	}
-	return cacher.Entry{Url: value.Url, Err: nil}
-}
-
-func serialize(entry *cacher.Entry) (*bytes.Buffer, error) {
-	var buffer bytes.Buffer
-	s := entry2serializable(entry)
-	err := gob.NewEncoder(&buffer).Encode(s)
-	return &buffer, err
-}
-
-func deserialize(valBytes []byte) (*cacher.Entry, error) {
-	var s serializable
-	err := gob.NewDecoder(bytes.NewReader(valBytes)).Decode(&s)
-	entry := serialized2entry(s)
-	return &entry, err
-}
+// counterKey holds the remaining clicks of a link.
+const counterKey = "clicks:%s"
 
 type redis struct {
-	pool *redigo.Pool
+	router router
+	codec  Codec
 }
 
+// New returns a Redis cache connecting to a standalone server with default
+// settings.
 func New(host string, port int) cacher.Engine {
-	pool := &redigo.Pool{
-		Dial: func() (redigo.Conn, error) {
-			c, err := redigo.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-			if err != nil {
-				return nil, err
-			}
-			// NOTE: consider a basic authentication by password
-			// if config.Password != "" {
-			// 	if _, err := c.Do("AUTH", config.Password); err != nil {
-			// 		c.Close()
-			// 		return nil, err
-			// 	}
-			// }
-			// NOTE: use number 0 as default
-			// if _, err := c.Do("SELECT", 0); err != nil {
-			// 	c.Close()
-			// 	return nil, err
-			// }
-			return c, nil
-		},
-
-		// Periodic check
-		TestOnBorrow: func(c redigo.Conn, t time.Time) error {
-			if time.Since(t) < time.Minute {
-				return nil
-			}
-			_, err := c.Do("PING")
-			return err
-		},
+	config := Config{Host: host, Port: port}.withDefaults()
+	return &redis{newSingle(config, nil), config.Codec}
+}
+
+// NewWithConfig returns a Redis cache connecting to a standalone server,
+// the master discovered by Sentinel or Redis Cluster by config.
+func NewWithConfig(config Config) (cacher.Engine, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config = config.withDefaults()
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
 	}
-	return &redis{pool}
+	if len(config.ClusterAddrs) > 0 {
+		return &redis{newCluster(config, tlsConfig), config.Codec}, nil
+	}
+	return &redis{newSingle(config, tlsConfig), config.Codec}, nil
 }
 
 func (r *redis) Get(id string) (*cacher.Entry, bool, error) {
-	reply, err := r.do("GET", id)
+	reply, err := r.do(id, "GET", id)
 	if reply == nil && err == nil {
 		return nil, false, cacher.ErrEntryNotFound
 	}
@@ -107,24 +62,37 @@ func (r *redis) Get(id string) (*cacher.Entry, bool, error) {
 	}
 	entry, err := deserialize(data)
 	if err != nil {
-		return nil, false, err
+		// regard the undecodable entry, e.g. written by a newer version, as
+		// a miss instead of a failure
+		return nil, false, fmt.Errorf("%w: %v", cacher.ErrSerializeFailed, err)
 	}
 	return entry, true, nil
 }
 
 func (r *redis) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
-	buffer, err := serialize(entry)
+	data, err := serialize(r.codec, entry)
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
-	if _, err := r.do("SET", id, buffer.Bytes(), "EX", uint64(expiration.Seconds())); err != nil {
+	if _, err := r.do(id, "SET", id, data, "PX", milliseconds(expiration)); err != nil {
 		return fmt.Errorf("call SET: %w", err)
 	}
 	return nil
 }
 
+// milliseconds rounds expiration down to milliseconds but at least one, since
+// Redis rejects the non-positive expire time. The entries capped by the
+// expiration of their links may expire within a second, which is zero in
+// seconds.
+func milliseconds(expiration time.Duration) int64 {
+	if ms := expiration.Milliseconds(); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
 func (r *redis) Delete(id string) error {
-	reply, err := r.do("DEL", id)
+	reply, err := r.do(id, "DEL", id)
 	if err != nil {
 		return err
 	}
@@ -138,66 +106,178 @@ func (r *redis) Delete(id string) error {
 	return nil
 }
 
-func (r *redis) Check(id string) (bool, error) {
-	script := `
-local ok = redis.call('SETNX', KEYS[1], 1)
-if ok == 0 then
-	return 0
-end
+// Check acquires the lock by SET NX PX with a random token, so that only
+// the holder is able to renew or release it.
+//
+// ref: https://redis.io/topics/distlock
+func (r *redis) Check(id string, lease time.Duration) (cacher.Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf(lockKey, id)
+	reply, err := r.do(key, "SET", key, token, "NX", "PX", lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	return &lock{r: r, key: key, token: token}, nil
+}
 
-ok = redis.call('EXPIRE', KEYS[1], ARGV[1])
-if ok == 0 then
-	return -1
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type lock struct {
+	r     *redis
+	key   string
+	token string
+}
+
+const renewScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
 end
+return 0
+`
 
-return ok
+const releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
 `
-	keys := []interface{}{fmt.Sprintf(setexKey, id)}
-	args := []interface{}{uint64(defaultSETEXTimeout.Seconds())}
-	reply, err := r.lua(script, keys, args)
 
+func (l *lock) Renew(lease time.Duration) error {
+	return l.compareAnd(renewScript, l.token, lease.Milliseconds())
+}
+
+func (l *lock) Release() error {
+	return l.compareAnd(releaseScript, l.token)
+}
+
+// compareAnd runs script which touches the key only if it still holds the
+// token, the script should return 1 on success.
+func (l *lock) compareAnd(script string, args ...interface{}) error {
+	ok, err := redigo.Bool(l.r.lua(script, []interface{}{l.key}, args))
 	if err != nil {
-		return false, err
+		return err
+	}
+	if !ok {
+		return cacher.ErrLockNotHeld
+	}
+	return nil
+}
+
+func (r *redis) SetCounter(id string, n int64, expiration time.Duration) error {
+	key := fmt.Sprintf(counterKey, id)
+	if _, err := r.do(key, "SET", key, n, "PX", milliseconds(expiration)); err != nil {
+		return fmt.Errorf("call SET: %w", err)
+	}
+	return nil
+}
+
+// decrScript never decrements the counter below zero, so that the exhausted
+// counter stays at zero however many redirects are rejected.
+const decrScript = `
+local n = redis.call('GET', KEYS[1])
+if not n then
+	return false
+end
+if tonumber(n) <= 0 then
+	return -1
+end
+return redis.call('DECR', KEYS[1])
+`
+
+func (r *redis) Decr(id string) (int64, bool, error) {
+	key := fmt.Sprintf(counterKey, id)
+	reply, err := r.lua(decrScript, []interface{}{key}, nil)
+	if reply == nil && err == nil {
+		return 0, false, nil
 	}
-	ret, err := redigo.Int(reply, err)
+	n, err := redigo.Int64(reply, err)
 	if err != nil {
-		return false, err
+		return 0, false, err
 	}
+	return n, true, nil
+}
 
-	switch ret {
-	case 1:
-		return true, nil
-	case 0:
-		return false, nil
-	default:
-		return false, cacher.ErrUnexpectedError
+func (r *redis) DeleteCounter(id string) error {
+	key := fmt.Sprintf(counterKey, id)
+	if _, err := r.do(key, "DEL", key); err != nil {
+		return fmt.Errorf("call DEL: %w", err)
 	}
+	return nil
+}
+
+func (r *redis) Ping() error {
+	_, err := r.do("", "PING")
+	return err
+}
+
+func (r *redis) Publish(channel, message string) error {
+	_, err := r.do(channel, "PUBLISH", channel, message)
+	return err
 }
 
-func (r *redis) Uncheck(id string) error {
-	reply, err := r.do("DEL", fmt.Sprintf(setexKey, id))
+func (r *redis) Subscribe(ctx context.Context, channel string, handler func(message string)) error {
+	// use a dedicated connection, the pooled ones are not able to be closed
+	// while another goroutine is receiving
+	c, err := r.router.dial()
 	if err != nil {
 		return err
 	}
-	ok, err := redigo.Bool(reply, err)
-	if err != nil {
+	defer c.Close()
+
+	psc := redigo.PubSubConn{Conn: c}
+	if err := psc.Subscribe(channel); err != nil {
 		return err
 	}
-	if !ok {
-		return cacher.ErrEntryNotFound
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redigo.Message:
+				handler(string(v.Data))
+			case error:
+				done <- v
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// closing the connection breaks the receiving loop
+		c.Close()
+		<-done
+		return ctx.Err()
+	case err := <-done:
+		return err
 	}
-	return nil
 }
 
-func (r *redis) do(commandName string, args ...interface{}) (reply interface{}, err error) {
-	c := r.pool.Get()
-	defer c.Close()
-	return c.Do(commandName, args...)
+// do executes the command on the node which serves key.
+func (r *redis) do(key string, commandName string, args ...interface{}) (reply interface{}, err error) {
+	return r.router.exec(key, func(c redigo.Conn) (interface{}, error) {
+		return c.Do(commandName, args...)
+	})
 }
 
+// lua evaluates the script on the node which serves the first key, all keys
+// should be in the same slot if using Redis Cluster.
 func (r *redis) lua(script string, keys []interface{}, args []interface{}) (interface{}, error) {
-	c := r.pool.Get()
-	defer c.Close()
 	lua := redigo.NewScript(len(keys), script)
-	return lua.Do(c, append(keys, args...)...)
+	key, _ := redigo.String(keys[0], nil)
+	return r.router.exec(key, func(c redigo.Conn) (interface{}, error) {
+		return lua.Do(c, append(keys, args...)...)
+	})
 }
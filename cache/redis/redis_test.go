@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"goshorturl/cache/cacher"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder records the commands instead of sending them to a node.
+type recorder struct {
+	redigo.Conn
+	commands [][]interface{}
+}
+
+func (r *recorder) Do(commandName string, args ...interface{}) (interface{}, error) {
+	r.commands = append(r.commands, append([]interface{}{commandName}, args...))
+	return "OK", nil
+}
+
+func (r *recorder) exec(key string, f func(c redigo.Conn) (interface{}, error)) (interface{}, error) {
+	return f(r)
+}
+
+func (r *recorder) dial() (redigo.Conn, error) {
+	return r, nil
+}
+
+func Test_redis_expiration(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		want       int64
+	}{
+		{"hours", 2 * time.Hour, 7200000},
+		{"less than one second", 300 * time.Millisecond, 300},
+		{"less than one millisecond", 10 * time.Microsecond, 1},
+		{"expired", -time.Second, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{}
+			r := &redis{rec, gobCodec{}}
+			assert.NoError(t, r.Set("aaaaaa", &cacher.Entry{Url: "https://example.com"}, tt.expiration))
+			assert.NoError(t, r.SetCounter("aaaaaa", 1, tt.expiration))
+
+			for _, command := range rec.commands {
+				assert.Equal(t, []interface{}{"PX", tt.want}, command[3:], command[0])
+			}
+		})
+	}
+}
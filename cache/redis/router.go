@@ -0,0 +1,142 @@
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+var errNoMaster = errors.New("no master found by sentinels")
+
+// router routes commands to the node which serves the key.
+type router interface {
+	// exec calls f with a connection to the node which serves key.
+	exec(key string, f func(c redigo.Conn) (interface{}, error)) (interface{}, error)
+	// dial returns a dedicated connection without read timeout, e.g. for
+	// subscribing.
+	dial() (redigo.Conn, error)
+}
+
+// single routes every command to one node, which is either a standalone
+// server or the master discovered by Sentinel.
+type single struct {
+	config  Config
+	options []redigo.DialOption
+
+	mu   sync.RWMutex
+	pool *redigo.Pool
+}
+
+func newSingle(config Config, tlsConfig *tls.Config) *single {
+	s := &single{
+		config:  config,
+		options: config.dialOptions(tlsConfig),
+	}
+	s.pool = s.newPool()
+	return s
+}
+
+func (s *single) newPool() *redigo.Pool {
+	if len(s.config.SentinelAddrs) == 0 {
+		return s.config.newPool(s.dialNode, periodicPing)
+	}
+	return s.config.newPool(s.dialNode, checkRole)
+}
+
+func (s *single) dialNode(extra ...redigo.DialOption) (redigo.Conn, error) {
+	options := withOptions(s.options, extra...)
+	if len(s.config.SentinelAddrs) == 0 {
+		return redigo.Dial("tcp", s.config.addr(), options...)
+	}
+
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	c, err := redigo.Dial("tcp", addr, options...)
+	if err != nil {
+		return nil, err
+	}
+	// the sentinels may not have noticed the failover yet
+	if err := checkRole(c, time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *single) exec(key string, f func(c redigo.Conn) (interface{}, error)) (interface{}, error) {
+	s.mu.RLock()
+	pool := s.pool
+	s.mu.RUnlock()
+
+	c := pool.Get()
+	reply, err := f(c)
+	c.Close()
+
+	if isReadOnly(err) && len(s.config.SentinelAddrs) > 0 {
+		// the master has been demoted by failover, drop all connections to
+		// it and rediscover the new one
+		s.mu.Lock()
+		if s.pool == pool {
+			s.pool = s.newPool()
+			pool.Close()
+		}
+		s.mu.Unlock()
+	}
+	return reply, err
+}
+
+func (s *single) dial() (redigo.Conn, error) {
+	return s.dialNode(redigo.DialReadTimeout(0))
+}
+
+// masterAddr asks the sentinels in order for the address of master.
+func (s *single) masterAddr() (string, error) {
+	options := []redigo.DialOption{
+		redigo.DialConnectTimeout(s.config.ConnectTimeout),
+		redigo.DialReadTimeout(s.config.ReadTimeout),
+		redigo.DialWriteTimeout(s.config.WriteTimeout),
+		redigo.DialPassword(s.config.SentinelPassword),
+	}
+	for _, sentinel := range s.config.SentinelAddrs {
+		c, err := redigo.Dial("tcp", sentinel, options...)
+		if err != nil {
+			continue
+		}
+		reply, err := redigo.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.config.SentinelMaster))
+		c.Close()
+		if err == nil && len(reply) == 2 {
+			return net.JoinHostPort(reply[0], reply[1]), nil
+		}
+	}
+	return "", errNoMaster
+}
+
+// checkRole ensures that the connection still connects to a master.
+func checkRole(c redigo.Conn, t time.Time) error {
+	if time.Since(t) < time.Second {
+		return nil
+	}
+	reply, err := redigo.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errNoMaster
+	}
+	if role, _ := redigo.String(reply[0], nil); role != "master" {
+		return errNoMaster
+	}
+	return nil
+}
+
+func isReadOnly(err error) bool {
+	redisErr, ok := err.(redigo.Error)
+	return ok && strings.HasPrefix(string(redisErr), "READONLY")
+}
@@ -0,0 +1,276 @@
+package tiered
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"goshorturl/cache/cacher"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	invalidationChannel   = "cache:invalidation"
+	resubscribeMinBackoff = 100 * time.Millisecond
+	resubscribeMaxBackoff = 30 * time.Second
+)
+
+var metrics = expvar.NewMap("cache_tiered")
+
+func init() {
+	metrics.Set("local_hit_ratio", expvar.Func(func() interface{} {
+		return ratio(metrics.Get("local_hits"), metrics.Get("local_misses"))
+	}))
+	metrics.Set("remote_hit_ratio", expvar.Func(func() interface{} {
+		return ratio(metrics.Get("remote_hits"), metrics.Get("remote_misses"))
+	}))
+}
+
+// Stats records the hits and misses of each tier.
+type Stats struct {
+	LocalHits    int64
+	LocalMisses  int64
+	RemoteHits   int64
+	RemoteMisses int64
+}
+
+// LocalHitRatio returns the ratio of requests served by the local tier.
+func (s Stats) LocalHitRatio() float64 {
+	return hitRatio(s.LocalHits, s.LocalMisses)
+}
+
+// RemoteHitRatio returns the ratio of local misses served by the remote tier.
+func (s Stats) RemoteHitRatio() float64 {
+	return hitRatio(s.RemoteHits, s.RemoteMisses)
+}
+
+// New composes a local tier in front of a remote tier. An entry lives in the
+// local tier at most localTTL.
+//
+// If the remote tier implements cacher.Notifier, the local entries are
+// invalidated across replicas whenever an id is set or deleted.
+func New(local, remote cacher.Engine, localTTL time.Duration, logger *zap.Logger) cacher.Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &tiered{
+		local:    local,
+		remote:   remote,
+		localTTL: localTTL,
+		logger:   logger,
+		node:     newNodeID(),
+		cancel:   cancel,
+	}
+	if notifier, ok := remote.(cacher.Notifier); ok {
+		t.notifier = notifier
+		go t.subscribe(ctx)
+	}
+	return t
+}
+
+type tiered struct {
+	local    cacher.Engine
+	remote   cacher.Engine
+	notifier cacher.Notifier
+	localTTL time.Duration
+	logger   *zap.Logger
+	node     string // to ignore the invalidation messages sent by itself
+	cancel   context.CancelFunc
+	stats    Stats
+}
+
+func (t *tiered) Get(id string) (*cacher.Entry, bool, error) {
+	entry, found, _ := t.local.Get(id)
+	if found {
+		t.record(&t.stats.LocalHits, "local_hits")
+		return entry, true, nil
+	}
+	t.record(&t.stats.LocalMisses, "local_misses")
+
+	entry, found, err := t.remote.Get(id)
+	if !found {
+		t.record(&t.stats.RemoteMisses, "remote_misses")
+		return entry, found, err
+	}
+	t.record(&t.stats.RemoteHits, "remote_hits")
+
+	if exp := t.localExpiration(entry, t.localTTL); exp > 0 {
+		t.local.Set(id, entry, exp)
+	}
+	return entry, true, nil
+}
+
+func (t *tiered) Set(id string, entry *cacher.Entry, expiration time.Duration) error {
+	if err := t.remote.Set(id, entry, expiration); err != nil {
+		return err
+	}
+	if exp := t.localExpiration(entry, expiration); exp > 0 {
+		t.local.Set(id, entry, exp)
+	}
+	t.invalidateOthers(id)
+	return nil
+}
+
+func (t *tiered) Delete(id string) error {
+	t.local.Delete(id)
+	err := t.remote.Delete(id)
+	t.invalidateOthers(id)
+	return err
+}
+
+// Flush flushes both tiers if they implement cacher.Flusher. The local
+// entries of the other replicas expire by the local TTL.
+func (t *tiered) Flush() error {
+	if flusher, ok := t.local.(cacher.Flusher); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := t.remote.(cacher.Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Ping pings the remote tier, the local one is always available.
+func (t *tiered) Ping() error {
+	if pinger, ok := t.remote.(cacher.Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+func (t *tiered) Check(id string, lease time.Duration) (cacher.Lock, error) {
+	return t.remote.Check(id, lease)
+}
+
+// SetCounter sets the counter in the remote tier only, the counters should
+// be shared across replicas.
+func (t *tiered) SetCounter(id string, n int64, expiration time.Duration) error {
+	if counter, ok := t.remote.(cacher.Counter); ok {
+		return counter.SetCounter(id, n, expiration)
+	}
+	return nil
+}
+
+// Decr decrements the counter in the remote tier only.
+func (t *tiered) Decr(id string) (int64, bool, error) {
+	if counter, ok := t.remote.(cacher.Counter); ok {
+		return counter.Decr(id)
+	}
+	return 0, false, nil
+}
+
+// DeleteCounter deletes the counter in the remote tier only.
+func (t *tiered) DeleteCounter(id string) error {
+	if counter, ok := t.remote.(cacher.Counter); ok {
+		return counter.DeleteCounter(id)
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the hits and misses of each tier.
+func (t *tiered) Stats() Stats {
+	return Stats{
+		LocalHits:    atomic.LoadInt64(&t.stats.LocalHits),
+		LocalMisses:  atomic.LoadInt64(&t.stats.LocalMisses),
+		RemoteHits:   atomic.LoadInt64(&t.stats.RemoteHits),
+		RemoteMisses: atomic.LoadInt64(&t.stats.RemoteMisses),
+	}
+}
+
+// Close stops receiving the invalidation messages.
+func (t *tiered) Close() error {
+	t.cancel()
+	return nil
+}
+
+// localExpiration caps the expiration by localTTL and by the real expiration
+// time of the link.
+func (t *tiered) localExpiration(entry *cacher.Entry, expiration time.Duration) time.Duration {
+	if expiration <= 0 || expiration > t.localTTL {
+		expiration = t.localTTL
+	}
+	if !entry.ExpiredAt.IsZero() {
+		if untilExpired := time.Until(entry.ExpiredAt); untilExpired < expiration {
+			expiration = untilExpired
+		}
+	}
+	return expiration
+}
+
+func (t *tiered) invalidateOthers(id string) {
+	if t.notifier == nil {
+		return
+	}
+	if err := t.notifier.Publish(invalidationChannel, t.node+" "+id); err != nil {
+		t.logger.Warn("publish invalidation error", zap.Error(err), zap.String("id", id))
+	}
+}
+
+// subscribe receives the invalidation messages until ctx is done, and
+// resubscribes with exponential backoff if the subscription is broken.
+func (t *tiered) subscribe(ctx context.Context) {
+	backoff := resubscribeMinBackoff
+	for {
+		start := time.Now()
+		err := t.notifier.Subscribe(ctx, invalidationChannel, t.onInvalidation)
+		if ctx.Err() != nil {
+			return
+		}
+		// the invalidation messages may be lost while unsubscribed, so the
+		// local entries are no longer trustworthy
+		if flusher, ok := t.local.(cacher.Flusher); ok {
+			flusher.Flush()
+		}
+		if time.Since(start) > resubscribeMaxBackoff {
+			backoff = resubscribeMinBackoff
+		}
+		t.logger.Warn("invalidation subscription broken", zap.Error(err), zap.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > resubscribeMaxBackoff {
+			backoff = resubscribeMaxBackoff
+		}
+	}
+}
+
+func (t *tiered) onInvalidation(message string) {
+	parts := strings.SplitN(message, " ", 2)
+	if len(parts) != 2 || parts[0] == t.node {
+		return
+	}
+	t.local.Delete(parts[1])
+}
+
+func (t *tiered) record(counter *int64, name string) {
+	atomic.AddInt64(counter, 1)
+	metrics.Add(name, 1)
+}
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func ratio(hits, misses expvar.Var) float64 {
+	value := func(v expvar.Var) int64 {
+		if i, ok := v.(*expvar.Int); ok {
+			return i.Value()
+		}
+		return 0
+	}
+	return hitRatio(value(hits), value(misses))
+}
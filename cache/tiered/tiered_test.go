@@ -0,0 +1,156 @@
+package tiered
+
+import (
+	"context"
+	"goshorturl/cache/cacher"
+	"goshorturl/cache/inmemory"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rShetty/asyncwait"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const (
+	exampleID  = "aaaaaa"
+	exampleURL = "http://example.com"
+)
+
+// bus is a stand-in of Redis pub/sub which is shared by remote engines.
+type bus struct {
+	mu       sync.Mutex
+	handlers []func(message string)
+}
+
+func (b *bus) publish(message string) {
+	b.mu.Lock()
+	handlers := append([]func(string){}, b.handlers...)
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+func (b *bus) subscribe(handler func(message string)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+type notifiableEngine struct {
+	cacher.Engine
+	bus        *bus
+	subscribed sync.WaitGroup
+}
+
+func (n *notifiableEngine) Publish(channel, message string) error {
+	n.bus.publish(message)
+	return nil
+}
+
+func (n *notifiableEngine) Subscribe(ctx context.Context, channel string, handler func(message string)) error {
+	n.bus.subscribe(handler)
+	n.subscribed.Done()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func newReplicas(t *testing.T, num int) []cacher.Engine {
+	shared := inmemory.NewBounded(inmemory.Config{DefaultExp: time.Hour})
+	b := &bus{}
+	replicas := make([]cacher.Engine, 0, num)
+	for i := 0; i < num; i++ {
+		remote := &notifiableEngine{Engine: shared, bus: b}
+		remote.subscribed.Add(1)
+		replica := New(inmemory.NewBounded(inmemory.Config{MaxEntries: 10, DefaultExp: time.Hour}), remote, time.Hour, zap.NewNop())
+		remote.subscribed.Wait()
+		t.Cleanup(func() { replica.(*tiered).Close() })
+		replicas = append(replicas, replica)
+	}
+	return replicas
+}
+
+func TestTiered_Get(t *testing.T) {
+	replicas := newReplicas(t, 1)
+	c := replicas[0].(*tiered)
+
+	_, found, err := c.Get(exampleID)
+	assert.False(t, found)
+	assert.Equal(t, cacher.ErrEntryNotFound, err)
+
+	assert.NoError(t, c.remote.Set(exampleID, &cacher.Entry{Url: exampleURL}, time.Hour))
+	for i := 0; i < 3; i++ {
+		entry, found, err := c.Get(exampleID)
+		assert.True(t, found)
+		assert.NoError(t, err)
+		assert.Equal(t, exampleURL, entry.Url)
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, int64(2), stats.LocalHits, "hit local tier after populated")
+	assert.Equal(t, int64(2), stats.LocalMisses)
+	assert.Equal(t, int64(1), stats.RemoteHits)
+	assert.Equal(t, int64(1), stats.RemoteMisses)
+	assert.Equal(t, 0.5, stats.LocalHitRatio())
+	assert.Equal(t, 0.5, stats.RemoteHitRatio())
+}
+
+func TestTiered_local_entry_should_not_outlive_the_link(t *testing.T) {
+	replicas := newReplicas(t, 1)
+	c := replicas[0].(*tiered)
+
+	entry := &cacher.Entry{Url: exampleURL, ExpiredAt: time.Now().Add(10 * time.Millisecond)}
+	assert.NoError(t, c.Set(exampleID, entry, time.Hour))
+	time.Sleep(20 * time.Millisecond)
+
+	_, found, _ := c.local.Get(exampleID)
+	assert.False(t, found)
+}
+
+func TestTiered_invalidate_other_replicas(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+
+	assert.NoError(t, a.Set(exampleID, &cacher.Entry{Url: exampleURL}, time.Hour))
+	_, found, _ := b.Get(exampleID)
+	assert.True(t, found, "populate the local tier of b")
+
+	t.Run("update", func(t *testing.T) {
+		updatedURL := "http://example.com/updated"
+		assert.NoError(t, a.Set(exampleID, &cacher.Entry{Url: updatedURL}, time.Hour))
+
+		var got string
+		asyncwait.NewAsyncWait(1000, 10).Check(func() bool {
+			entry, _, _ := b.Get(exampleID)
+			got = entry.Url
+			return got == updatedURL
+		})
+		assert.Equal(t, updatedURL, got)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.NoError(t, a.Delete(exampleID))
+
+		var found bool
+		asyncwait.NewAsyncWait(1000, 10).Check(func() bool {
+			_, found, _ = b.Get(exampleID)
+			return !found
+		})
+		assert.False(t, found)
+	})
+}
+
+func TestTiered_Flush(t *testing.T) {
+	remote := inmemory.NewBounded(inmemory.Config{DefaultExp: time.Hour})
+	c := New(inmemory.NewBounded(inmemory.Config{MaxEntries: 10, DefaultExp: time.Hour}), remote, time.Hour, zap.NewNop()).(*tiered)
+	defer c.Close()
+	assert.NoError(t, c.Set(exampleID, &cacher.Entry{Url: exampleURL}, time.Hour))
+
+	assert.NoError(t, c.Flush())
+	_, found, _ := c.local.Get(exampleID)
+	assert.False(t, found)
+	_, found, _ = remote.Get(exampleID)
+	assert.False(t, found)
+}
@@ -2,6 +2,11 @@ package config
 
 import (
 	"errors"
+	"goshorturl/cache/redis"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -9,19 +14,119 @@ import (
 const (
 	InMemory = "inmemory"
 	Redis    = "redis"
+	Tiered   = "tiered"
+)
+
+const (
+	LRU     = "lru"
+	LFU     = "lfu"
+	TinyLFU = "tinylfu"
+)
+
+// event sinks
+const (
+	SinkNone   = "none"
+	SinkStdout = "stdout"
+	SinkFile   = "file"
+	SinkRedis  = "redis"
+	SinkHTTP   = "http"
 )
 
 type Env struct {
-	AppPort        int    `envconfig:"APP_PORT"    default:"8080"`
-	DBHost         string `envconfig:"DB_HOST"     default:"localhost"`
-	DBPort         int    `envconfig:"DB_PORT"     default:"5555"`
-	DBName         string `envconfig:"DB_NAME"     default:"test"`
-	DBUser         string `envconfig:"DB_USER"     default:"test"`
-	DBPassword     string `envconfig:"DB_PASSWORD" default:"test"`
-	CacheMode      string `envconfig:"CACHE_MODE"  default:"inmemory"`
-	CacheHost      string `envconfig:"CACHE_HOST"  default:"localhost"`
-	CachePort      int    `envconfig:"CACHE_PORT"  default:"6679"`
-	RedirectOrigin string `envconfig:"REDIRECT_ORIGIN"  default:"http://localhost:8080"`
+	AppPort                  int           `envconfig:"APP_PORT"    default:"8080"`
+	DBHost                   string        `envconfig:"DB_HOST"     default:"localhost"`
+	DBPort                   int           `envconfig:"DB_PORT"     default:"5555"`
+	DBName                   string        `envconfig:"DB_NAME"     default:"test"`
+	DBUser                   string        `envconfig:"DB_USER"     default:"test"`
+	DBPassword               string        `envconfig:"DB_PASSWORD" default:"test"`
+	CacheMode                string        `envconfig:"CACHE_MODE"  default:"inmemory"`
+	CacheHost                string        `envconfig:"CACHE_HOST"  default:"localhost"`
+	CachePort                int           `envconfig:"CACHE_PORT"  default:"6679"`
+	CacheUsername            string        `envconfig:"CACHE_USERNAME"`
+	CachePassword            string        `envconfig:"CACHE_PASSWORD"`
+	CacheDB                  int           `envconfig:"CACHE_DB"          default:"0"`
+	CacheTLS                 bool          `envconfig:"CACHE_TLS"         default:"false"`
+	CacheTLSCAFile           string        `envconfig:"CACHE_TLS_CA_FILE"`
+	CacheTLSServerName       string        `envconfig:"CACHE_TLS_SERVER_NAME"`
+	CacheTLSSkipVerify       bool          `envconfig:"CACHE_TLS_INSECURE_SKIP_VERIFY" default:"false"`
+	CachePoolMaxIdle         int           `envconfig:"CACHE_POOL_MAX_IDLE"            default:"10"`
+	CachePoolMaxActive       int           `envconfig:"CACHE_POOL_MAX_ACTIVE"          default:"0"`
+	CachePoolIdleTimeout     time.Duration `envconfig:"CACHE_POOL_IDLE_TIMEOUT"        default:"5m"`
+	CacheConnectTimeout      time.Duration `envconfig:"CACHE_CONNECT_TIMEOUT"          default:"5s"`
+	CacheReadTimeout         time.Duration `envconfig:"CACHE_READ_TIMEOUT"             default:"3s"`
+	CacheWriteTimeout        time.Duration `envconfig:"CACHE_WRITE_TIMEOUT"            default:"3s"`
+	CacheSentinelAddrs       []string      `envconfig:"CACHE_SENTINEL_ADDRS"`
+	CacheSentinelMaster      string        `envconfig:"CACHE_SENTINEL_MASTER"`
+	CacheSentinelPassword    string        `envconfig:"CACHE_SENTINEL_PASSWORD"`
+	CacheClusterAddrs        []string      `envconfig:"CACHE_CLUSTER_ADDRS"`
+	CacheCodec               string        `envconfig:"CACHE_CODEC"                    default:"gob"`
+	CacheMaxEntries          int           `envconfig:"CACHE_MAX_ENTRIES" default:"0"`
+	CacheMaxBytes            int64         `envconfig:"CACHE_MAX_BYTES"   default:"0"`
+	CacheEviction            string        `envconfig:"CACHE_EVICTION"    default:"lru"`
+	CacheLocalSize           int           `envconfig:"CACHE_LOCAL_SIZE"  default:"10000"`
+	CacheLocalTTL            time.Duration `envconfig:"CACHE_LOCAL_TTL"   default:"5s"`
+	CacheValidTTL            time.Duration `envconfig:"CACHE_VALID_TTL"   default:"24h"`
+	CacheEmptyTTL            time.Duration `envconfig:"CACHE_EMPTY_TTL"   default:"1h"`
+	CacheStaleTTL            time.Duration `envconfig:"CACHE_STALE_TTL"   default:"1h"`
+	CacheXFetchBeta          float64       `envconfig:"CACHE_XFETCH_BETA" default:"1"`
+	CacheBreakerThreshold    int           `envconfig:"CACHE_BREAKER_THRESHOLD"    default:"5"`
+	CacheBreakerOpenTimeout  time.Duration `envconfig:"CACHE_BREAKER_OPEN_TIMEOUT" default:"10s"`
+	CacheBreakerProbes       int           `envconfig:"CACHE_BREAKER_PROBES"       default:"1"`
+	DBMaxConcurrency         int           `envconfig:"DB_MAX_CONCURRENCY"         default:"50"`
+	DBQueueTimeout           time.Duration `envconfig:"DB_QUEUE_TIMEOUT"           default:"1s"`
+	HealthCheckTimeout       time.Duration `envconfig:"HEALTH_CHECK_TIMEOUT"       default:"2s"`
+	ShutdownDrainDelay       time.Duration `envconfig:"SHUTDOWN_DRAIN_DELAY"       default:"5s"`
+	WarmUpSize               int           `envconfig:"WARMUP_SIZE"           default:"0"`
+	WarmUpOrderBy            string        `envconfig:"WARMUP_ORDER_BY"       default:"recent"`
+	WarmUpRate               int           `envconfig:"WARMUP_RATE"           default:"1000"`
+	WarmUpWatchInterval      time.Duration `envconfig:"WARMUP_WATCH_INTERVAL" default:"30s"`
+	ClickFlushInterval       time.Duration `envconfig:"CLICK_FLUSH_INTERVAL"  default:"10s"`
+	PurgeGrace               time.Duration `envconfig:"PURGE_GRACE"       default:"720h"`
+	PurgeInterval            time.Duration `envconfig:"PURGE_INTERVAL"    default:"0"`
+	PurgeBatchSize           int           `envconfig:"PURGE_BATCH_SIZE"  default:"500"`
+	PurgeMaxBatches          int           `envconfig:"PURGE_MAX_BATCHES" default:"0"`
+	PurgeArchive             bool          `envconfig:"PURGE_ARCHIVE"     default:"false"`
+	WebhookWindow            time.Duration `envconfig:"WEBHOOK_WINDOW"        default:"24h"`
+	WebhookScanInterval      time.Duration `envconfig:"WEBHOOK_SCAN_INTERVAL" default:"1m"`
+	WebhookPollInterval      time.Duration `envconfig:"WEBHOOK_POLL_INTERVAL" default:"5s"`
+	WebhookMaxAttempts       int           `envconfig:"WEBHOOK_MAX_ATTEMPTS"  default:"8"`
+	WebhookBackoffBase       time.Duration `envconfig:"WEBHOOK_BACKOFF_BASE"  default:"10s"`
+	WebhookBackoffMax        time.Duration `envconfig:"WEBHOOK_BACKOFF_MAX"   default:"1h"`
+	WebhookTimeout           time.Duration `envconfig:"WEBHOOK_TIMEOUT"       default:"5s"`
+	EventSink                string        `envconfig:"EVENT_SINK"           default:"none"`
+	EventFile                string        `envconfig:"EVENT_FILE"           default:"events.ndjson"`
+	EventHTTPURL             string        `envconfig:"EVENT_HTTP_URL"`
+	EventRedisAddr           string        `envconfig:"EVENT_REDIS_ADDR"     default:"localhost:6379"`
+	EventRedisPassword       string        `envconfig:"EVENT_REDIS_PASSWORD"`
+	EventRedisStream         string        `envconfig:"EVENT_REDIS_STREAM"   default:"goshorturl:events"`
+	EventRedisMaxLen         int64         `envconfig:"EVENT_REDIS_MAXLEN"   default:"1000000"`
+	EventRelayInterval       time.Duration `envconfig:"EVENT_RELAY_INTERVAL" default:"1s"`
+	EventBatchSize           int           `envconfig:"EVENT_BATCH_SIZE"     default:"100"`
+	LinkMaxLifetime          time.Duration `envconfig:"LINK_MAX_LIFETIME" default:"0"`
+	PasswordMaxAttempts      int           `envconfig:"PASSWORD_MAX_ATTEMPTS" default:"5"`
+	PasswordLinkMaxAttempts  int           `envconfig:"PASSWORD_LINK_MAX_ATTEMPTS" default:"100"`
+	TrustedProxies           []string      `envconfig:"TRUSTED_PROXIES"`
+	PasswordLockout          time.Duration `envconfig:"PASSWORD_LOCKOUT"      default:"15m"`
+	GeoIPFile                string        `envconfig:"GEOIP_FILE"`
+	URLAllowedSchemes        []string      `envconfig:"URL_ALLOWED_SCHEMES"        default:"http,https"`
+	URLAllowPrivate          bool          `envconfig:"URL_ALLOW_PRIVATE"          default:"false"`
+	URLResolveHosts          bool          `envconfig:"URL_RESOLVE_HOSTS"          default:"true"`
+	URLMaxHops               int           `envconfig:"URL_MAX_HOPS"               default:"0"`
+	URLPolicyFile            string        `envconfig:"URL_POLICY_FILE"`
+	URLPolicyReloadInterval  time.Duration `envconfig:"URL_POLICY_RELOAD_INTERVAL" default:"30s"`
+	ReputationFile           string        `envconfig:"REPUTATION_FILE"`
+	ReputationReloadInterval time.Duration `envconfig:"REPUTATION_RELOAD_INTERVAL" default:"1m"`
+	ReputationScanInterval   time.Duration `envconfig:"REPUTATION_SCAN_INTERVAL"   default:"1h"`
+	ReputationScanBatchSize  int           `envconfig:"REPUTATION_SCAN_BATCH_SIZE" default:"500"`
+	PreviewUntrusted         bool          `envconfig:"PREVIEW_UNTRUSTED"       default:"false"`
+	PreviewTrustedDomains    []string      `envconfig:"PREVIEW_TRUSTED_DOMAINS"`
+	RedirectOrigin           string        `envconfig:"REDIRECT_ORIGIN"  default:"http://localhost:8080"`
+	// AdminToken is the bearer token of the admin routes, which are not
+	// registered if it is empty.
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+	// RedirectOrigins are the other short domains besides the default one
+	// of RedirectOrigin, e.g. "https://ex.co".
+	RedirectOrigins []string `envconfig:"REDIRECT_ORIGINS"`
 }
 
 func Process() (env Env, err error) {
@@ -37,11 +142,169 @@ func validate(env Env) error {
 	switch env.CacheMode {
 	case InMemory:
 	case Redis:
-		if env.CacheHost == "" || env.CachePort == 0 {
-			return errors.New("redis cache mode need host and port")
+		if err := validateRedis(env); err != nil {
+			return err
+		}
+	case Tiered:
+		if err := validateRedis(env); err != nil {
+			return err
+		}
+		if env.CacheLocalSize <= 0 || env.CacheLocalTTL <= 0 {
+			return errors.New("tiered cache mode need positive local size and TTL")
 		}
 	default:
 		return errors.New("undefined cache mode: " + env.CacheMode)
 	}
+	switch env.CacheEviction {
+	case LRU, LFU, TinyLFU:
+	default:
+		return errors.New("undefined cache eviction policy: " + env.CacheEviction)
+	}
+	if env.CacheMaxEntries < 0 || env.CacheMaxBytes < 0 {
+		return errors.New("cache limits should not be negative")
+	}
+	if env.CachePoolMaxIdle < 0 || env.CachePoolMaxActive < 0 {
+		return errors.New("cache pool size should not be negative")
+	}
+	if env.CacheValidTTL <= 0 || env.CacheEmptyTTL <= 0 {
+		return errors.New("cache TTL of valid and empty entries should be positive")
+	}
+	if env.CacheStaleTTL < 0 {
+		return errors.New("cache stale TTL should not be negative")
+	}
+	if env.CacheXFetchBeta < 0 {
+		return errors.New("cache XFetch beta should not be negative")
+	}
+	if env.CacheBreakerThreshold <= 0 || env.CacheBreakerOpenTimeout <= 0 || env.CacheBreakerProbes <= 0 {
+		return errors.New("cache breaker threshold, open timeout and probes should be positive")
+	}
+	if env.DBMaxConcurrency <= 0 || env.DBQueueTimeout < 0 {
+		return errors.New("db max concurrency should be positive")
+	}
+	if env.HealthCheckTimeout <= 0 || env.ShutdownDrainDelay < 0 {
+		return errors.New("health check timeout should be positive and drain delay should not be negative")
+	}
+	switch env.WarmUpOrderBy {
+	case "recent", "clicks":
+	default:
+		return errors.New("undefined warm-up order: " + env.WarmUpOrderBy)
+	}
+	if env.WarmUpSize < 0 || env.WarmUpRate <= 0 || env.WarmUpWatchInterval < 0 {
+		return errors.New("warm-up size, rate and watch interval should not be negative")
+	}
+	if env.ClickFlushInterval <= 0 {
+		return errors.New("click flush interval should be positive")
+	}
+	if env.PurgeGrace <= 0 || env.PurgeBatchSize <= 0 {
+		return errors.New("purge grace and batch size should be positive")
+	}
+	if env.PurgeInterval < 0 || env.PurgeMaxBatches < 0 {
+		return errors.New("purge interval and max batches should not be negative")
+	}
+	if env.WebhookWindow <= 0 || env.WebhookScanInterval <= 0 || env.WebhookPollInterval <= 0 {
+		return errors.New("webhook window, scan and poll interval should be positive")
+	}
+	if env.WebhookMaxAttempts <= 0 || env.WebhookBackoffBase <= 0 || env.WebhookBackoffMax < env.WebhookBackoffBase || env.WebhookTimeout <= 0 {
+		return errors.New("webhook max attempts, backoff and timeout should be positive")
+	}
+	if err := validateEvents(env); err != nil {
+		return err
+	}
+	if env.LinkMaxLifetime < 0 {
+		return errors.New("link max lifetime should not be negative")
+	}
+	if env.PasswordMaxAttempts <= 0 || env.PasswordLinkMaxAttempts <= 0 || env.PasswordLockout <= 0 {
+		return errors.New("password max attempts and lockout should be positive")
+	}
+	for _, cidr := range env.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.New("invalid trusted proxy: " + cidr)
+		}
+	}
+	return validateOrigins(env)
+}
+
+// validateOrigins checks that each origin is a scheme and host, and that
+// the hosts, i.e. the domains of the links, are unique.
+func validateOrigins(env Env) error {
+	hosts := make(map[string]bool)
+	for _, origin := range append([]string{env.RedirectOrigin}, env.RedirectOrigins...) {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return errors.New("invalid redirect origin: " + origin)
+		}
+		host := strings.ToLower(u.Host)
+		if hosts[host] {
+			return errors.New("duplicated redirect origin: " + origin)
+		}
+		hosts[host] = true
+	}
+	return nil
+}
+
+// RedisConfig returns the config of the redis cache engine.
+func (env Env) RedisConfig() (redis.Config, error) {
+	codec, err := redis.CodecOf(env.CacheCodec)
+	if err != nil {
+		return redis.Config{}, errors.New("undefined redis cache codec: " + env.CacheCodec)
+	}
+	return redis.Config{
+		Host:                  env.CacheHost,
+		Port:                  env.CachePort,
+		Username:              env.CacheUsername,
+		Password:              env.CachePassword,
+		DB:                    env.CacheDB,
+		TLS:                   env.CacheTLS,
+		TLSCAFile:             env.CacheTLSCAFile,
+		TLSServerName:         env.CacheTLSServerName,
+		TLSInsecureSkipVerify: env.CacheTLSSkipVerify,
+		MaxIdle:               env.CachePoolMaxIdle,
+		MaxActive:             env.CachePoolMaxActive,
+		IdleTimeout:           env.CachePoolIdleTimeout,
+		ConnectTimeout:        env.CacheConnectTimeout,
+		ReadTimeout:           env.CacheReadTimeout,
+		WriteTimeout:          env.CacheWriteTimeout,
+		SentinelAddrs:         env.CacheSentinelAddrs,
+		SentinelMaster:        env.CacheSentinelMaster,
+		SentinelPassword:      env.CacheSentinelPassword,
+		ClusterAddrs:          env.CacheClusterAddrs,
+		Codec:                 codec,
+	}, nil
+}
+
+// validateRedis leaves the rules to the redis package, so that they are not
+// able to drift apart.
+func validateRedis(env Env) error {
+	config, err := env.RedisConfig()
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return errors.New("invalid redis cache config: " + err.Error())
+	}
+	return nil
+}
+
+func validateEvents(env Env) error {
+	switch env.EventSink {
+	case SinkNone, SinkStdout:
+	case SinkFile:
+		if env.EventFile == "" {
+			return errors.New("event file sink needs a path")
+		}
+	case SinkRedis:
+		if env.EventRedisAddr == "" || env.EventRedisStream == "" {
+			return errors.New("event redis sink needs an address and a stream")
+		}
+	case SinkHTTP:
+		if env.EventHTTPURL == "" {
+			return errors.New("event http sink needs a URL")
+		}
+	default:
+		return errors.New("undefined event sink: " + env.EventSink)
+	}
+	if env.EventRelayInterval <= 0 || env.EventBatchSize <= 0 {
+		return errors.New("event relay interval and batch size should be positive")
+	}
 	return nil
 }
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"goshorturl/purger"
+	"goshorturl/warmup"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type AdminController struct {
+	Log    *zap.Logger
+	Warmer warmup.Warmer
+	Purger purger.Purger
+}
+
+// WarmUp triggers warming up the cache, the progress is reported by the
+// health endpoint.
+func (a AdminController) WarmUp(c *gin.Context) {
+	if a.Warmer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "warm-up is disabled"})
+		return
+	}
+	if !a.Warmer.Start() {
+		c.JSON(http.StatusConflict, gin.H{"error": "warm-up is running", "warmup": a.Warmer.Progress()})
+		return
+	}
+	a.Log.Info("warm-up triggered")
+	c.JSON(http.StatusAccepted, gin.H{"warmup": a.Warmer.Progress()})
+}
+
+// Purge hard-deletes the links deleted or expired longer than the grace
+// period ago, or only reports them if dryRun=true.
+func (a AdminController) Purge(c *gin.Context) {
+	if a.Purger == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "purge is disabled"})
+		return
+	}
+	dryRun := c.Query("dryRun") == "true"
+	report, err := a.Purger.Run(c.Request.Context(), dryRun)
+	if err == purger.ErrRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		a.Log.Error("purge error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "purge": report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purge": report})
+}
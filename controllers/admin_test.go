@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"goshorturl/purger"
+	"goshorturl/warmup"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type fakeWarmer struct {
+	running bool
+}
+
+func (f *fakeWarmer) Start() bool {
+	if f.running {
+		return false
+	}
+	f.running = true
+	return true
+}
+
+func (f *fakeWarmer) Progress() warmup.Progress {
+	if f.running {
+		return warmup.Progress{State: warmup.StateRunning}
+	}
+	return warmup.Progress{State: warmup.StateIdle}
+}
+
+func (f *fakeWarmer) Close() {}
+
+func TestAdminController_WarmUp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger, _ := zap.NewDevelopment()
+
+	tests := []struct {
+		name               string
+		warmer             warmup.Warmer
+		expectedStatusCode int
+	}{
+		{"disabled", nil, http.StatusNotFound},
+		{"triggered", &fakeWarmer{}, http.StatusAccepted},
+		{"running", &fakeWarmer{running: true}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := AdminController{Log: logger, Warmer: tt.warmer}
+			r := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(r)
+			a.WarmUp(ctx)
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+		})
+	}
+}
+
+type fakePurger struct {
+	err error
+}
+
+func (f *fakePurger) Run(ctx context.Context, dryRun bool) (purger.Report, error) {
+	return purger.Report{DryRun: dryRun, Candidates: 2}, f.err
+}
+
+func (f *fakePurger) Close() {}
+
+func TestAdminController_Purge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger, _ := zap.NewDevelopment()
+
+	tests := []struct {
+		name               string
+		purger             purger.Purger
+		query              string
+		expectedStatusCode int
+		expectedDryRun     bool
+	}{
+		{"disabled", nil, "", http.StatusNotFound, false},
+		{"purged", &fakePurger{}, "", http.StatusOK, false},
+		{"dry run", &fakePurger{}, "dryRun=true", http.StatusOK, true},
+		{"running", &fakePurger{err: purger.ErrRunning}, "", http.StatusConflict, false},
+		{"failed", &fakePurger{err: errors.New("db down")}, "", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := AdminController{Log: logger, Purger: tt.purger}
+			r := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(r)
+			ctx.Request = httptest.NewRequest(http.MethodPost, "/api/v1/admin/purge?"+tt.query, nil)
+			a.Purge(ctx)
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+			if r.Code == http.StatusOK {
+				var got struct {
+					Purge purger.Report `json:"purge"`
+				}
+				assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+				assert.Equal(t, tt.expectedDryRun, got.Purge.DryRun)
+				assert.Equal(t, 2, got.Purge.Candidates)
+			}
+		})
+	}
+}
+
+func TestHealthController_Status_with_warmer(t *testing.T) {
+	h := HealthController{Warmer: &fakeWarmer{running: true}}
+	r := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(r)
+	h.Status(ctx)
+
+	var got struct {
+		Status string          `json:"status"`
+		WarmUp warmup.Progress `json:"warmup"`
+	}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Equal(t, "ok", got.Status)
+	assert.Equal(t, warmup.StateRunning, got.WarmUp.State)
+}
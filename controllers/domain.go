@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"fmt"
+	"goshorturl/idgenerator"
+	"goshorturl/models"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// requestDomain returns the domain of the redirect request by its Host
+// header, the unknown hosts are served as the default domain.
+func (u UrlController) requestDomain(c *gin.Context) string {
+	host := strings.ToLower(c.Request.Host)
+	if _, ok := u.Domains[host]; ok {
+		return host
+	}
+	return ""
+}
+
+// parseDomain validates the domain given to the API, both the empty string
+// and the host of RedirectOrigin stand for the default domain.
+func (u UrlController) parseDomain(domain string) (string, error) {
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return "", nil
+	}
+	if _, ok := u.Domains[domain]; ok {
+		return domain, nil
+	}
+	if origin, err := url.Parse(u.RedirectOrigin); err == nil && strings.ToLower(origin.Host) == domain {
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown domain: %s", domain)
+}
+
+// linkKey returns the key of the link of the API by the url_id parameter and
+// the optional domain query. It responds the error and reports false if
+// either is invalid.
+func (u UrlController) linkKey(c *gin.Context) (string, bool) {
+	urlID := c.Param("url_id")
+	if err := idgenerator.Validate(urlID); err != nil {
+		u.Log.Warn("invalid id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return "", false
+	}
+	domain, err := u.parseDomain(c.Query("domain"))
+	if err != nil {
+		u.Log.Warn("invalid domain", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid domain"})
+		return "", false
+	}
+	return models.Key(domain, urlID), true
+}
+
+// shortURL returns the short URL of id on domain, which is also encoded in
+// the QR code.
+func (u UrlController) shortURL(domain, id string) string {
+	origin, ok := u.Domains[domain]
+	if !ok {
+		origin = u.RedirectOrigin
+	}
+	return fmt.Sprintf("%s/%s", origin, id)
+}
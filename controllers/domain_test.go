@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"goshorturl/idgenerator"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// domainDB stores the links by their keys, see models.Key().
+type domainDB struct {
+	repository.UnimplementedRepository
+	links map[string]*models.Url
+}
+
+func (d *domainDB) Get(ctx context.Context, key string) (*models.Url, error) {
+	link, ok := d.links[key]
+	if !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+	return link, nil
+}
+
+func (d *domainDB) GetMetadata(ctx context.Context, key string) (*models.Url, error) {
+	return d.Get(ctx, key)
+}
+
+// sameIDGenerator gives every link the same id, which is allowed as long as
+// the domains differ.
+type sameIDGenerator struct {
+	db *domainDB
+}
+
+func (s sameIDGenerator) Get(ctx context.Context, link *models.Url) (string, error) {
+	link.Id = "aaaaaa"
+	s.db.links[link.Key()] = link
+	return link.Id, nil
+}
+
+func (sameIDGenerator) Pool() idgenerator.PoolStatus {
+	return idgenerator.PoolStatus{}
+}
+
+func (sameIDGenerator) Exclusive(ctx context.Context, f func(pooled map[string]bool) error) error {
+	return f(nil)
+}
+
+func TestUrlController_Redirect_by_domain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := &domainDB{links: map[string]*models.Url{
+		"aaaaaa":       {Id: "aaaaaa", Url: "https://example.com/default"},
+		"ex.co/aaaaaa": {Domain: "ex.co", Id: "aaaaaa", Url: "https://example.com/ex"},
+	}}
+	u := UrlController{
+		DB:             db,
+		Log:            zap.NewNop(),
+		RedirectOrigin: "http://localhost:8080",
+		Domains:        map[string]string{"ex.co": "https://ex.co"},
+	}
+	tests := []struct {
+		name     string
+		host     string
+		location string
+	}{
+		{"default domain", "localhost:8080", "https://example.com/default"},
+		{"other domain", "EX.co", "https://example.com/ex"},
+		{"unknown host", "127.0.0.1:8080", "https://example.com/default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, "/aaaaaa", nil)
+			c.Request.Host = tt.host
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+			u.Redirect(c)
+
+			assert.Equal(t, http.StatusMovedPermanently, r.Code)
+			assert.Equal(t, tt.location, r.Header().Get("Location"))
+		})
+	}
+}
+
+func TestUrlController_Upload_domain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := &domainDB{links: map[string]*models.Url{}}
+	u := UrlController{
+		DB:             db,
+		Log:            zap.NewNop(),
+		IDGenerator:    sameIDGenerator{db},
+		RedirectOrigin: "http://localhost:8080",
+		Domains:        map[string]string{"ex.co": "https://ex.co"},
+	}
+	upload := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/urls", bytes.NewBufferString(body))
+		u.Upload(c)
+		return r
+	}
+	type uploaded struct {
+		Id       string `json:"id"`
+		Domain   string `json:"domain"`
+		ShortUrl string `json:"shortUrl"`
+	}
+
+	tests := []struct {
+		name   string
+		domain string
+		want   uploaded
+	}{
+		{"default domain", "", uploaded{"aaaaaa", "", "http://localhost:8080/aaaaaa"}},
+		{"host of the redirect origin", "localhost:8080", uploaded{"aaaaaa", "", "http://localhost:8080/aaaaaa"}},
+		{"other domain", "EX.co", uploaded{"aaaaaa", "ex.co", "https://ex.co/aaaaaa"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := upload(`{"url": "https://example.com", "domain": "` + tt.domain + `"}`)
+			assert.Equal(t, http.StatusOK, r.Code)
+			var got uploaded
+			assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Len(t, db.links, 2, "should take the same id on both domains")
+
+	r := upload(`{"url": "https://example.com", "domain": "unknown.co"}`)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+}
+
+func TestUrlController_Metadata_domain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := &domainDB{links: map[string]*models.Url{
+		"ex.co/aaaaaa": {Domain: "ex.co", Id: "aaaaaa", Url: "https://example.com", Title: "On ex.co"},
+	}}
+	u := UrlController{
+		DB:             db,
+		Log:            zap.NewNop(),
+		RedirectOrigin: "http://localhost:8080",
+		Domains:        map[string]string{"ex.co": "https://ex.co"},
+	}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"other domain", "?domain=ex.co", http.StatusOK},
+		{"default domain", "", http.StatusNotFound},
+		{"unknown domain", "?domain=unknown.co", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/urls/aaaaaa"+tt.query, nil)
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+			u.Metadata(c)
+
+			assert.Equal(t, tt.status, r.Code)
+			if tt.status == http.StatusOK {
+				var got linkResponse
+				assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+				assert.Equal(t, "https://ex.co/aaaaaa", got.ShortUrl)
+				assert.Equal(t, "On ex.co", got.Title)
+			}
+		})
+	}
+}
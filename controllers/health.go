@@ -1,13 +1,56 @@
 package controllers
 
 import (
+	"goshorturl/cache/breaker"
+	"goshorturl/health"
+	"goshorturl/warmup"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-type HealthController struct{}
+type HealthController struct {
+	// Warmer is optional, its progress is reported if set.
+	Warmer warmup.Warmer
+	// Breaker is optional, the service is degraded while it is not closed.
+	Breaker *breaker.Breaker
+	// Checks is optional, the readiness runs its checks if set.
+	Checks *health.Registry
+}
 
 func (h HealthController) Status(c *gin.Context) {
+	status := gin.H{"status": "ok"}
+	if h.Warmer != nil {
+		status["warmup"] = h.Warmer.Progress()
+	}
+	if h.Breaker != nil {
+		stats := h.Breaker.Stats()
+		status["cacheBreaker"] = stats
+		if stats.State != breaker.Closed.String() {
+			// still able to serve by reading database directly
+			status["status"] = "degraded"
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// Liveness reports the process is able to serve, it never checks the
+// dependencies, otherwise an outage of them restarts every pod.
+func (h HealthController) Liveness(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+// Readiness reports whether the service should receive traffic, with the
+// breakdown of each dependency.
+func (h HealthController) Readiness(c *gin.Context) {
+	if h.Checks == nil {
+		c.JSON(http.StatusOK, health.Report{Status: health.StatusOK, Checks: map[string]health.Result{}})
+		return
+	}
+	report := h.Checks.Run(c.Request.Context())
+	if !report.Ready() {
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
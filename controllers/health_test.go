@@ -1,10 +1,14 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"goshorturl/health"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -39,3 +43,53 @@ func TestHealthController_Status(t *testing.T) {
 		})
 	}
 }
+
+func TestHealthController_Liveness(t *testing.T) {
+	h := HealthController{}
+	r := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(r)
+	h.Liveness(ctx)
+	assert.Equal(t, http.StatusOK, r.Code)
+}
+
+func TestHealthController_Readiness(t *testing.T) {
+	failing := func(ctx context.Context) (interface{}, error) { return nil, errors.New("connection refused") }
+
+	tests := []struct {
+		name               string
+		checks             func() *health.Registry
+		expectedStatusCode int
+		expectedStatus     string
+	}{
+		{"no checks", func() *health.Registry { return nil }, http.StatusOK, health.StatusOK},
+		{"cache failing", func() *health.Registry {
+			r := health.NewRegistry(time.Second)
+			r.Register("cache", false, failing)
+			return r
+		}, http.StatusOK, health.StatusDegraded},
+		{"database failing", func() *health.Registry {
+			r := health.NewRegistry(time.Second)
+			r.Register("database", true, failing)
+			return r
+		}, http.StatusServiceUnavailable, health.StatusFailing},
+		{"draining", func() *health.Registry {
+			r := health.NewRegistry(time.Second)
+			r.Drain()
+			return r
+		}, http.StatusServiceUnavailable, health.StatusDraining},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := HealthController{Checks: tt.checks()}
+			r := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(r)
+			ctx.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			h.Readiness(ctx)
+
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+			var got health.Report
+			assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+			assert.Equal(t, tt.expectedStatus, got.Status)
+		})
+	}
+}
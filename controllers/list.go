@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+	maxSearchLength  = 256
+	maxOwnerLength   = 64
+)
+
+var ownerPattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+func validateOwner(owner string) error {
+	if owner == "" {
+		return nil
+	}
+	if len(owner) > maxOwnerLength || !ownerPattern.MatchString(owner) {
+		return fmt.Errorf("owner should be at most %d letters, digits or ._@-", maxOwnerLength)
+	}
+	return nil
+}
+
+// linkResponse is a link in the public metadata, the password hash is never
+// responded, nor the targets of a protected or flagged link.
+type linkResponse struct {
+	Id string `json:"id"`
+	// empty for the default domain
+	Domain      string      `json:"domain"`
+	ShortUrl    string      `json:"shortUrl"`
+	Url         string      `json:"url"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Tags        models.Tags `json:"tags"`
+	// null if never expires
+	ExpireAt *time.Time `json:"expireAt"`
+	// null if unlimited
+	MaxClicks *int64             `json:"maxClicks"`
+	Protected bool               `json:"protected"`
+	Rules     models.TargetRules `json:"rules"`
+	Variants  models.Variants    `json:"variants"`
+	// null unless flagged by the reputation checker
+	FlaggedAt *time.Time `json:"flaggedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+	// null unless deleted
+	DeletedAt *time.Time `json:"deletedAt"`
+}
+
+// adminLinkResponse is a link in the responses of the admin routes, with the
+// fields of its owner.
+type adminLinkResponse struct {
+	linkResponse
+	Owner    string          `json:"owner"`
+	Metadata models.Metadata `json:"metadata"`
+	// null if unlimited
+	RemainingClicks *int64 `json:"remainingClicks"`
+}
+
+func (u UrlController) linkResponse(link *models.Url) linkResponse {
+	res := linkResponse{
+		Id:          link.Id,
+		Domain:      link.Domain,
+		ShortUrl:    u.shortURL(link.Domain, link.Id),
+		Url:         link.Url,
+		Title:       link.Title,
+		Description: link.Description,
+		Tags:        link.Tags,
+		ExpireAt:    link.ExpiredAt,
+		MaxClicks:   link.MaxClicks,
+		Protected:   link.Protected,
+		Rules:       link.Rules,
+		Variants:    link.Variants,
+		FlaggedAt:   link.FlaggedAt,
+		CreatedAt:   link.CreatedAt,
+	}
+	if link.Protected || link.FlaggedAt != nil {
+		// the targets are revealed only by the password, see Unlock(), and
+		// never for the flagged links, see Redirect()
+		res.Url, res.Rules, res.Variants = "", nil, nil
+	}
+	if link.DeletedAt.Valid {
+		res.DeletedAt = &link.DeletedAt.Time
+	}
+	return res
+}
+
+func (u UrlController) adminLinkResponse(link *models.Url) adminLinkResponse {
+	return adminLinkResponse{
+		linkResponse:    u.linkResponse(link),
+		Owner:           link.Owner,
+		Metadata:        link.Metadata,
+		RemainingClicks: link.RemainingClicks,
+	}
+}
+
+// List lists the links newest first, filtered by the query parameters:
+//
+//	domain=<domain>&owner=<owner>&state=active|expired|deleted
+//	&q=<substring of URL>&tag=<tag>
+//	&createdFrom=<RFC3339>&createdTo=<RFC3339>
+//	&expiresFrom=<RFC3339>&expiresTo=<RFC3339>
+//	&limit=20&cursor=<nextCursor of the previous page>
+func (u UrlController) List(c *gin.Context) {
+	query, err := u.parseLinkQuery(c)
+	if err != nil {
+		u.Log.Warn("invalid list query", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid query: " + err.Error()})
+		return
+	}
+	limit := query.Limit
+	// one more to know whether there is a next page
+	query.Limit++
+	links, err := u.DB.ListLinks(c.Request.Context(), query)
+	if err != nil {
+		u.Log.Error("list links error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list error"})
+		return
+	}
+
+	var next interface{} // null if no more
+	if len(links) > limit {
+		links = links[:limit]
+		last := links[limit-1]
+		next = encodeCursor(repository.Cursor{CreatedAt: last.CreatedAt, Domain: last.Domain, Id: last.Id})
+	}
+	urls := make([]adminLinkResponse, len(links))
+	for i, link := range links {
+		urls[i] = u.adminLinkResponse(link)
+	}
+	c.JSON(http.StatusOK, gin.H{"urls": urls, "nextCursor": next})
+}
+
+func (u UrlController) parseLinkQuery(c *gin.Context) (repository.LinkQuery, error) {
+	query := repository.LinkQuery{
+		Owner:  c.Query("owner"),
+		State:  c.Query("state"),
+		Search: c.Query("q"),
+		Limit:  defaultListLimit,
+	}
+	if domain, ok := c.GetQuery("domain"); ok {
+		domain, err := u.parseDomain(domain)
+		if err != nil {
+			return query, err
+		}
+		query.Domain = &domain
+	}
+	if err := validateOwner(query.Owner); err != nil {
+		return query, err
+	}
+	switch query.State {
+	case "", repository.StateActive, repository.StateExpired, repository.StateDeleted:
+	default:
+		return query, fmt.Errorf("unknown state: %s", query.State)
+	}
+	if len(query.Search) > maxSearchLength {
+		return query, fmt.Errorf("q should not exceed %d bytes", maxSearchLength)
+	}
+	if tag := c.Query("tag"); tag != "" {
+		var err error
+		if query.Tag, err = normalizeTag(tag); err != nil {
+			return query, err
+		}
+	}
+	times := map[string]*time.Time{
+		"createdFrom": &query.CreatedFrom,
+		"createdTo":   &query.CreatedTo,
+		"expiresFrom": &query.ExpiresFrom,
+		"expiresTo":   &query.ExpiresTo,
+	}
+	for name, t := range times {
+		if s := c.Query(name); s != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				return query, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return query, fmt.Errorf("limit should be 1 to %d", maxListLimit)
+		}
+		query.Limit = limit
+	}
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			return query, err
+		}
+		query.After = &cursor
+	}
+	return query, nil
+}
+
+// encodeCursor encodes the cursor opaquely in base64 of
+// "<nanoseconds>.<key>", see models.Key().
+func encodeCursor(cursor repository.Cursor) string {
+	s := strconv.FormatInt(cursor.CreatedAt.UnixNano(), 10) + "." + models.Key(cursor.Domain, cursor.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func decodeCursor(s string) (repository.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	parts := strings.SplitN(string(data), ".", 2)
+	if len(parts) != 2 {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	domain, id := models.SplitKey(parts[1])
+	if id == "" {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	return repository.Cursor{CreatedAt: time.Unix(0, nanos).UTC(), Domain: domain, Id: id}, nil
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestUrlController_List(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gormDB, mock := getMockDB(t)
+	u := UrlController{DB: gormDB, Log: zap.NewNop(), RedirectOrigin: "http://localhost:8080"}
+	list := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		u.List(c)
+		return r
+	}
+	type page struct {
+		Urls []struct {
+			Id        string     `json:"id"`
+			ShortUrl  string     `json:"shortUrl"`
+			Url       string     `json:"url"`
+			Owner     string     `json:"owner"`
+			Protected bool       `json:"protected"`
+			ExpireAt  *time.Time `json:"expireAt"`
+		} `json:"urls"`
+		NextCursor *string `json:"nextCursor"`
+	}
+
+	createdAt := time.Date(2021, 8, 9, 9, 20, 41, 123456000, time.UTC)
+	columns := []string{"id", "url", "owner", "password_hash", "expired_at", "created_at"}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE deleted_at IS NULL AND ((expired_at IS NULL OR expired_at > $1)) AND ((remaining_clicks IS NULL OR remaining_clicks > 0)) AND owner = $2 AND url ILIKE $3 ORDER BY created_at DESC, domain DESC, id DESC LIMIT 3`)).
+		WithArgs(anyExpireTime{}, "marketing", `%50\%\_off%`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("cccccc", "https://example.com/50%_off/c", "marketing", "", nil, createdAt).
+			AddRow("bbbbbb", "https://example.com/50%_off/b", "marketing", "$2a$10$hash", nil, createdAt).
+			AddRow("aaaaaa", "https://example.com/50%_off/a", "marketing", "", nil, createdAt.Add(-time.Hour)))
+	r := list("/api/v1/urls?owner=marketing&state=active&q=50%25_off&limit=2")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.NotContains(t, r.Body.String(), "$2a$10$hash")
+	var first page
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &first))
+	assert.Len(t, first.Urls, 2)
+	assert.Equal(t, "http://localhost:8080/cccccc", first.Urls[0].ShortUrl)
+	assert.Equal(t, "marketing", first.Urls[0].Owner, "should respond the owner to the admin")
+	assert.Nil(t, first.Urls[0].ExpireAt)
+	assert.True(t, first.Urls[1].Protected)
+	assert.Empty(t, first.Urls[1].Url, "should not reveal the target of a protected link")
+	assert.NotNil(t, first.NextCursor)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE deleted_at IS NULL AND ((expired_at IS NULL OR expired_at > $1)) AND ((remaining_clicks IS NULL OR remaining_clicks > 0)) AND owner = $2 AND url ILIKE $3 AND (created_at, domain, id) < ($4, $5, $6) ORDER BY created_at DESC, domain DESC, id DESC LIMIT 3`)).
+		WithArgs(anyExpireTime{}, "marketing", `%50\%\_off%`, createdAt, "", "bbbbbb").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("aaaaaa", "https://example.com/50%_off/a", "marketing", "", nil, createdAt.Add(-time.Hour)))
+	r = list("/api/v1/urls?owner=marketing&state=active&q=50%25_off&limit=2&cursor=" + *first.NextCursor)
+	assert.Equal(t, http.StatusOK, r.Code)
+	var second page
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &second))
+	assert.Len(t, second.Urls, 1)
+	assert.Equal(t, "aaaaaa", second.Urls[0].Id)
+	assert.Nil(t, second.NextCursor, "should be the last page")
+
+	expiresFrom := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE deleted_at IS NOT NULL AND expired_at >= $1 ORDER BY created_at DESC, domain DESC, id DESC LIMIT 21`)).
+		WithArgs(expiresFrom).
+		WillReturnRows(sqlmock.NewRows(columns))
+	r = list("/api/v1/urls?state=deleted&expiresFrom=2021-09-01T00:00:00Z")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.JSONEq(t, `{"urls": [], "nextCursor": null}`, r.Body.String())
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE deleted_at IS NULL AND tags @> $1 ORDER BY created_at DESC, domain DESC, id DESC LIMIT 21`)).
+		WithArgs(`["summer-2021"]`).
+		WillReturnRows(sqlmock.NewRows(columns))
+	r = list("/api/v1/urls?tag=Summer-2021")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	invalid := []string{
+		"state=gone", "owner=a%20b", "tag=a%20b", "limit=0", "limit=101", "createdFrom=yesterday", "cursor=xyz",
+	}
+	for _, query := range invalid {
+		r = list("/api/v1/urls?" + query)
+		assert.Equal(t, http.StatusBadRequest, r.Code, query)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	createdAt := time.Date(2021, 8, 9, 9, 20, 41, 123456000, time.UTC)
+	for _, cursor := range []repository.Cursor{
+		{CreatedAt: createdAt, Id: "XSIfKe"},
+		{CreatedAt: createdAt, Domain: "go.example.com", Id: "XSIfKe"},
+	} {
+		got, err := decodeCursor(encodeCursor(cursor))
+		assert.NoError(t, err)
+		assert.True(t, cursor.CreatedAt.Equal(got.CreatedAt))
+		assert.Equal(t, cursor.Domain, got.Domain)
+		assert.Equal(t, cursor.Id, got.Id)
+	}
+
+	for _, s := range []string{"", "!!", "MTIz", "YWJjLlhTSWZLZQ", "MTIzLmV4LmNvLw"} {
+		_, err := decodeCursor(s)
+		assert.Error(t, err, s)
+	}
+}
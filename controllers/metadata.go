@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// The limits of the descriptive fields, the lengths are in characters.
+const (
+	maxTitleLength         = 200
+	maxDescriptionLength   = 2000
+	maxTags                = 20
+	maxTagLength           = 50
+	maxMetadataKeys        = 20
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 512
+)
+
+var (
+	tagPattern         = regexp.MustCompile(`^[\p{L}\p{N}_.:-]+$`)
+	metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// normalizeTag trims and lowercases the tag, so that "Summer-Sale " and
+// "summer-sale" are the same tag.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if utf8.RuneCountInString(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("tag should be at most %d letters, digits or _.:-", maxTagLength)
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes each tag and removes the duplicates in order, nil
+// if there are none.
+func normalizeTags(tags models.Tags) (models.Tags, error) {
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("tags should not exceed %d", maxTags)
+	}
+	var result models.Tags
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+func validateMetadata(metadata models.Metadata) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata should not exceed %d keys", maxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if len(key) > maxMetadataKeyLength || !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("metadata key should be at most %d letters, digits or _.-", maxMetadataKeyLength)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return fmt.Errorf("metadata value of %s should not exceed %d characters", key, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+func validateText(name, s string, max int) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("%s should be UTF-8", name)
+	}
+	if utf8.RuneCountInString(s) > max {
+		return fmt.Errorf("%s should not exceed %d characters", name, max)
+	}
+	return nil
+}
+
+// describeReqData is the descriptive fields of a link, which never affect the
+// redirects. The nil fields of a patch are left unchanged, and the empty
+// ones clear the fields.
+type describeReqData struct {
+	Title       *string          `json:"title"`
+	Description *string          `json:"description"`
+	Tags        *models.Tags     `json:"tags"`
+	Metadata    *models.Metadata `json:"metadata"`
+}
+
+// parseAndValidate validates the given fields and normalizes them, the empty
+// tags and metadata become nil.
+func (d *describeReqData) parseAndValidate() error {
+	if d.Title != nil {
+		*d.Title = strings.TrimSpace(*d.Title)
+		if err := validateText("title", *d.Title, maxTitleLength); err != nil {
+			return err
+		}
+	}
+	if d.Description != nil {
+		if err := validateText("description", *d.Description, maxDescriptionLength); err != nil {
+			return err
+		}
+	}
+	if d.Tags != nil {
+		tags, err := normalizeTags(*d.Tags)
+		if err != nil {
+			return err
+		}
+		*d.Tags = tags
+	}
+	if d.Metadata != nil {
+		if err := validateMetadata(*d.Metadata); err != nil {
+			return err
+		}
+		if len(*d.Metadata) == 0 {
+			// stored as NULL anyway
+			*d.Metadata = nil
+		}
+	}
+	return nil
+}
+
+// apply overwrites the given fields of link.
+func (d *describeReqData) apply(link *models.Url) {
+	if d.Title != nil {
+		link.Title = *d.Title
+	}
+	if d.Description != nil {
+		link.Description = *d.Description
+	}
+	if d.Tags != nil {
+		link.Tags = *d.Tags
+	}
+	if d.Metadata != nil {
+		link.Metadata = *d.Metadata
+	}
+}
+
+// update returns the given fields to be updated.
+func (d *describeReqData) update() repository.MetadataUpdate {
+	return repository.MetadataUpdate{
+		Title:       d.Title,
+		Description: d.Description,
+		Tags:        d.Tags,
+		Metadata:    d.Metadata,
+	}
+}
+
+// Metadata responds the public fields of the link, see linkResponse,
+// including the expired and exhausted ones.
+func (u UrlController) Metadata(c *gin.Context) {
+	key, ok := u.linkKey(c)
+	if !ok {
+		return
+	}
+	link, err := u.DB.GetMetadata(c.Request.Context(), key)
+	if err != nil {
+		u.redirectError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, u.linkResponse(link))
+}
+
+// Patch updates the title, description, tags or metadata of the link, see
+// describeReqData, and responds the link with the fields of its owner.
+func (u UrlController) Patch(c *gin.Context) {
+	key, ok := u.linkKey(c)
+	if !ok {
+		return
+	}
+	var data describeReqData
+	if err := c.BindJSON(&data); err != nil {
+		u.Log.Warn("invalid request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := data.parseAndValidate(); err != nil {
+		u.Log.Warn("invalid patch data", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid patch data: " + err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	// the link is read after updated, so that the patches of the other
+	// fields are not overwritten by a stale read
+	var link *models.Url
+	err := u.DB.UpdateMetadata(ctx, key, data.update())
+	if err == nil {
+		link, err = u.DB.GetMetadata(ctx, key)
+	}
+	if err == repository.ErrRecordNotFound {
+		u.Log.Warn("id not exists", zap.String("key", key))
+		c.JSON(http.StatusNotFound, gin.H{"error": "id not exists"})
+		return
+	}
+	if err != nil {
+		u.Log.Error("patch error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "patch error"})
+		return
+	}
+	c.JSON(http.StatusOK, u.adminLinkResponse(link))
+}
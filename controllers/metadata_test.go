@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDescribeReqData_parseAndValidate(t *testing.T) {
+	var data describeReqData
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"title": "  Summer sale ",
+		"tags": ["Summer-2021", "campaign:sale", "summer-2021 ", "促销"],
+		"metadata": {"utm_source": "newsletter"}
+	}`), &data))
+	assert.NoError(t, data.parseAndValidate())
+	assert.Equal(t, "Summer sale", *data.Title)
+	assert.Nil(t, data.Description)
+	assert.Equal(t, models.Tags{"summer-2021", "campaign:sale", "促销"}, *data.Tags)
+
+	tooManyTags := make([]string, maxTags+1)
+	tooManyKeys := make(map[string]string)
+	for i := range tooManyTags {
+		tooManyTags[i] = strings.Repeat("a", i+1)
+		tooManyKeys[strings.Repeat("k", i+1)] = ""
+	}
+	invalid := []describeReqData{
+		{Title: stringPtr(strings.Repeat("标", maxTitleLength+1))},
+		{Description: stringPtr(strings.Repeat("a", maxDescriptionLength+1))},
+		{Description: stringPtr("\xff")},
+		{Tags: &models.Tags{""}},
+		{Tags: &models.Tags{"summer sale"}},
+		{Tags: &models.Tags{strings.Repeat("a", maxTagLength+1)}},
+		{Tags: (*models.Tags)(&tooManyTags)},
+		{Metadata: (*models.Metadata)(&tooManyKeys)},
+		{Metadata: &models.Metadata{"utm source": "newsletter"}},
+		{Metadata: &models.Metadata{"note": strings.Repeat("a", maxMetadataValueLength+1)}},
+	}
+	for i, data := range invalid {
+		assert.Error(t, data.parseAndValidate(), i)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+type describedDB struct {
+	repository.UnimplementedRepository
+	links   map[string]*models.Url
+	updates []repository.MetadataUpdate
+}
+
+func (d *describedDB) GetMetadata(ctx context.Context, key string) (*models.Url, error) {
+	link, ok := d.links[key]
+	if !ok {
+		return nil, repository.ErrRecordNotFound
+	}
+	copied := *link
+	return &copied, nil
+}
+
+func (d *describedDB) UpdateMetadata(ctx context.Context, key string, update repository.MetadataUpdate) error {
+	link, ok := d.links[key]
+	if !ok {
+		return repository.ErrRecordNotFound
+	}
+	d.updates = append(d.updates, update)
+	if update.Title != nil {
+		link.Title = *update.Title
+	}
+	if update.Description != nil {
+		link.Description = *update.Description
+	}
+	if update.Tags != nil {
+		link.Tags = *update.Tags
+	}
+	if update.Metadata != nil {
+		link.Metadata = *update.Metadata
+	}
+	return nil
+}
+
+func TestUrlController_Metadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := &describedDB{links: map[string]*models.Url{
+		"aaaaaa": {
+			Id:          "aaaaaa",
+			Url:         "https://example.com",
+			Title:       "Summer sale",
+			Description: "The landing page",
+			Tags:        models.Tags{"summer-2021"},
+			Metadata:    models.Metadata{"utm_source": "newsletter"},
+		},
+	}}
+	u := UrlController{DB: db, Log: zap.NewNop(), RedirectOrigin: "http://localhost:8080"}
+	call := func(handler gin.HandlerFunc, method, id, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(method, "/api/v1/urls/"+id, bytes.NewBufferString(body))
+		c.Params = []gin.Param{{Key: "url_id", Value: id}}
+		handler(c)
+		return r
+	}
+	type described struct {
+		ShortUrl    string            `json:"shortUrl"`
+		Title       string            `json:"title"`
+		Description string            `json:"description"`
+		Tags        []string          `json:"tags"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+
+	r := call(u.Metadata, http.MethodGet, "aaaaaa", "")
+	assert.Equal(t, http.StatusOK, r.Code)
+	var got described
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Equal(t, described{
+		ShortUrl:    "http://localhost:8080/aaaaaa",
+		Title:       "Summer sale",
+		Description: "The landing page",
+		Tags:        []string{"summer-2021"},
+	}, got, "should respond the metadata only to the admin")
+	assert.NotContains(t, r.Body.String(), `"metadata"`)
+
+	r = call(u.Patch, http.MethodPatch, "aaaaaa", `{"title": "Autumn sale", "tags": ["Autumn-2021", "sale"], "metadata": {}}`)
+	assert.Equal(t, http.StatusOK, r.Code)
+	got = described{}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Equal(t, "Autumn sale", got.Title)
+	assert.Contains(t, r.Body.String(), `"metadata"`, "should respond the metadata to the admin")
+	assert.Equal(t, "The landing page", got.Description, "should be unchanged if absent")
+	assert.Equal(t, []string{"autumn-2021", "sale"}, got.Tags)
+	assert.Nil(t, got.Metadata, "should be cleared")
+	assert.Equal(t, models.Tags{"autumn-2021", "sale"}, db.links["aaaaaa"].Tags)
+	assert.Equal(t, "https://example.com", db.links["aaaaaa"].Url)
+	assert.Nil(t, db.updates[0].Description, "should not write back the absent fields")
+
+	// patched by another request in the meantime
+	db.links["aaaaaa"].Description = "The new landing page"
+	r = call(u.Patch, http.MethodPatch, "aaaaaa", `{"title": "Winter sale"}`)
+	assert.Equal(t, http.StatusOK, r.Code)
+	got = described{}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Equal(t, "Winter sale", got.Title)
+	assert.Equal(t, "The new landing page", got.Description)
+
+	r = call(u.Patch, http.MethodPatch, "aaaaaa", `{"tags": ["a b"]}`)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+	r = call(u.Patch, http.MethodPatch, "bbbbbb", `{"title": "Winter sale"}`)
+	assert.Equal(t, http.StatusNotFound, r.Code)
+	r = call(u.Metadata, http.MethodGet, "bbbbbb", "")
+	assert.Equal(t, http.StatusNotFound, r.Code)
+}
+
+func TestUrlController_Metadata_hide_targets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	flaggedAt := time.Now()
+	tests := []struct {
+		name string
+		link models.Url
+	}{
+		{"protected", models.Url{Protected: true}},
+		{"flagged", models.Url{FlaggedAt: &flaggedAt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := tt.link
+			link.Id = "aaaaaa"
+			link.Url = "https://example.com/secret"
+			link.Rules = models.TargetRules{{Platform: "ios", Url: "https://example.com/secret/ios"}}
+			link.Variants = models.Variants{{Name: "a", Url: "https://example.com/secret/a", Weight: 1}}
+			link.Title = "Secret sale"
+			link.Owner = "marketing"
+			link.Metadata = models.Metadata{"campaign": "summer"}
+			u := UrlController{DB: &describedDB{links: map[string]*models.Url{"aaaaaa": &link}}, Log: zap.NewNop(), RedirectOrigin: "http://localhost:8080"}
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/urls/aaaaaa", nil)
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+			u.Metadata(c)
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NotContains(t, r.Body.String(), "secret", "should not reveal the targets")
+			assert.NotContains(t, r.Body.String(), "marketing", "should not reveal the owner")
+			assert.NotContains(t, r.Body.String(), "summer", "should not reveal the metadata")
+			var got linkResponse
+			assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+			assert.Equal(t, "Secret sale", got.Title)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"goshorturl/idgenerator"
+	"goshorturl/models"
+	"goshorturl/pkg/throttle"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcrypt ignores the bytes beyond 72
+	maxPasswordLength = 72
+	passwordField     = "password"
+)
+
+// promptTemplate posts the password back to the same path, see Unlock().
+var promptTemplate = template.Must(template.New("prompt").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+<form method="post">
+<p>This link is protected by a password.</p>
+{{if .}}<p>{{.}}</p>{{end}}
+<input type="password" name="` + passwordField + `" autofocus required>
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// prompt asks for the password of a protected link, message explains why the
+// last attempt failed if any.
+func (u UrlController) prompt(c *gin.Context, status int, message string) {
+	c.Header("Cache-Control", "no-store")
+	c.Render(status, render.HTML{Template: promptTemplate, Data: message})
+}
+
+// Unlock verifies the password submitted by the prompt of a protected link,
+// and redirects if it matches. The failed attempts of each client are
+// throttled per link, and so are the ones of all clients.
+func (u UrlController) Unlock(c *gin.Context) {
+	urlID := c.Param("url_id")
+	if err := idgenerator.Validate(urlID); err != nil {
+		u.Log.Warn("invalid id", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	link, err := u.DB.Get(c.Request.Context(), models.Key(u.requestDomain(c), urlID))
+	if err != nil {
+		u.redirectError(c, err)
+		return
+	}
+	if u.disabled(c, link) {
+		return
+	}
+	if !link.Protected {
+		u.follow(c, link, http.StatusSeeOther)
+		return
+	}
+
+	client := u.throttledClient(c)
+	throttles := map[string]throttle.Throttle{
+		link.Key() + "|" + client: u.Throttle,
+		link.Key():                u.LinkThrottle,
+	}
+	for key, t := range throttles {
+		if t == nil {
+			continue
+		}
+		if retryAfter, ok := t.Allow(key); !ok {
+			u.Log.Warn("password attempts throttled", zap.String("id", urlID), zap.String("client", client))
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			u.prompt(c, http.StatusTooManyRequests, "Too many attempts, please try again later.")
+			return
+		}
+	}
+
+	hash, err := u.DB.PasswordHash(c.Request.Context(), link.Key())
+	if err != nil {
+		u.redirectError(c, err)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.PostForm(passwordField))); err != nil {
+		for key, t := range throttles {
+			if t != nil {
+				t.Fail(key)
+			}
+		}
+		u.Log.Warn("wrong password", zap.String("id", urlID), zap.String("client", client))
+		u.prompt(c, http.StatusForbidden, "Wrong password.")
+		return
+	}
+	// the failures of the others still count for the link
+	if u.Throttle != nil {
+		u.Throttle.Reset(link.Key() + "|" + client)
+	}
+	u.follow(c, link, http.StatusSeeOther)
+}
+
+// throttledClient returns the address of the client of a password attempt.
+// Unlike c.ClientIP(), X-Forwarded-For is only followed through
+// TrustedProxies from the right, since the client is able to forge anything
+// on its left.
+func (u UrlController) throttledClient(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	hops := strings.Split(strings.Join(c.Request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && u.trustedProxy(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+func (u UrlController) trustedProxy(ip net.IP) bool {
+	for _, n := range u.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/pkg/throttle"
+	"goshorturl/repository"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type protectedDB struct {
+	repository.UnimplementedRepository
+	hash string
+}
+
+func (p *protectedDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	return &models.Url{Id: id, Url: "https://example.com", Protected: true}, nil
+}
+
+func (p *protectedDB) PasswordHash(ctx context.Context, id string) (string, error) {
+	return p.hash, nil
+}
+
+func TestUrlController_Redirect_protected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u := UrlController{DB: &protectedDB{}, Log: zap.NewNop()}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+	u.Redirect(c)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Empty(t, r.Header().Get("Location"))
+	assert.Contains(t, r.Header().Get("Content-Type"), "text/html")
+	assert.Equal(t, "no-store", r.Header().Get("Cache-Control"))
+	assert.Contains(t, r.Body.String(), `name="password"`)
+	assert.NotContains(t, r.Body.String(), "https://example.com")
+}
+
+func TestUrlController_Unlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hash, err := hashPassword("open sesame")
+	assert.NoError(t, err)
+	u := UrlController{
+		DB:       &protectedDB{hash: hash},
+		Log:      zap.NewNop(),
+		Throttle: throttle.New(2, time.Hour),
+	}
+	unlock := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		form := url.Values{"password": {password}}
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.Unlock(c)
+		// flushed by the engine after the handler
+		c.Writer.WriteHeaderNow()
+		return r
+	}
+
+	r := unlock("open sesame")
+	assert.Equal(t, http.StatusSeeOther, r.Code)
+	assert.Equal(t, "https://example.com", r.Header().Get("Location"))
+
+	r = unlock("wrong")
+	assert.Equal(t, http.StatusForbidden, r.Code)
+	assert.Contains(t, r.Body.String(), "Wrong password")
+	r = unlock("wrong")
+	assert.Equal(t, http.StatusForbidden, r.Code)
+
+	r = unlock("open sesame")
+	assert.Equal(t, http.StatusTooManyRequests, r.Code, "should throttle even the right password")
+	assert.NotEmpty(t, r.Header().Get("Retry-After"))
+	assert.Empty(t, r.Header().Get("Location"))
+}
+
+func TestUrlController_Unlock_throttled_clients(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hash, err := hashPassword("open sesame")
+	assert.NoError(t, err)
+	u := UrlController{
+		DB:           &protectedDB{hash: hash},
+		Log:          zap.NewNop(),
+		Throttle:     throttle.New(2, time.Hour),
+		LinkThrottle: throttle.New(4, time.Hour),
+	}
+	unlock := func(remoteAddr, forwardedFor string) int {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		form := url.Values{"password": {"wrong"}}
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.Request.RemoteAddr = remoteAddr
+		c.Request.Header.Set("X-Forwarded-For", forwardedFor)
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.Unlock(c)
+		return r.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, unlock("192.0.2.1:1234", "198.51.100.1"))
+	assert.Equal(t, http.StatusForbidden, unlock("192.0.2.1:1234", "198.51.100.2"))
+	assert.Equal(t, http.StatusTooManyRequests, unlock("192.0.2.1:1234", "198.51.100.3"), "should not be bypassed by a forged header")
+
+	assert.Equal(t, http.StatusForbidden, unlock("192.0.2.2:1234", ""))
+	assert.Equal(t, http.StatusForbidden, unlock("192.0.2.3:1234", ""))
+	assert.Equal(t, http.StatusTooManyRequests, unlock("192.0.2.4:1234", ""), "should limit the attempts of all clients")
+}
+
+func TestUrlController_throttledClient(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	u := UrlController{TrustedProxies: []*net.IPNet{proxies}}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"forged by the client", "10.0.0.1:1234", "203.0.113.1, 198.51.100.1", "198.51.100.1"},
+		{"chained proxies", "10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"invalid hop", "10.0.0.1:1234", "198.51.100.1, unknown", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+			c.Request.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				c.Request.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			assert.Equal(t, tt.want, u.throttledClient(c))
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"goshorturl/models"
+	"goshorturl/urlpolicy"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// previewSuffix suffixes the id to preview the link, like the "+" of bit.ly.
+const previewSuffix = "+"
+
+// previewTemplate posts back to the link to continue, see Unlock(), so that
+// the click is taken only once confirmed.
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Link preview</title>
+</head>
+<body>
+<p>This link goes to:</p>
+<p><code>{{.Target}}</code></p>
+<dl>
+{{if .CreatedAt}}<dt>Created</dt><dd>{{.CreatedAt}}</dd>{{end}}
+<dt>Expires</dt><dd>{{if .ExpiredAt}}{{.ExpiredAt}}{{else}}Never{{end}}</dd>
+</dl>
+<form method="post" action="{{.Action}}">
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+type previewData struct {
+	Target    string
+	CreatedAt string
+	ExpiredAt string
+	Action    string
+}
+
+// preview renders the preview page of link to target instead of
+// redirecting.
+func (u UrlController) preview(c *gin.Context, link *models.Url, target string) {
+	action := url.URL{Path: "/" + link.Id + c.Param("suffix"), RawQuery: c.Request.URL.RawQuery}
+	data := previewData{Target: target, Action: action.String()}
+	if !link.CreatedAt.IsZero() {
+		data.CreatedAt = link.CreatedAt.UTC().Format(time.RFC1123)
+	}
+	if link.ExpiredAt != nil {
+		data.ExpiredAt = link.ExpiredAt.UTC().Format(time.RFC1123)
+	}
+	// the target may depend on the request, e.g. the targeting rules
+	c.Header("Cache-Control", "no-store")
+	c.Render(http.StatusOK, render.HTML{Template: previewTemplate, Data: data})
+}
+
+// confirm reports whether the redirect to target should be confirmed on the
+// preview page first.
+func (u UrlController) confirm(link *models.Url, target string) bool {
+	if link.Interstitial {
+		return true
+	}
+	if !u.PreviewUntrusted {
+		return false
+	}
+	t, err := url.Parse(target)
+	if err != nil {
+		return true
+	}
+	return !urlpolicy.MatchDomain(u.TrustedDomains, strings.ToLower(t.Hostname()))
+}
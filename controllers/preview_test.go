@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type previewDB struct {
+	repository.UnimplementedRepository
+	link models.Url
+}
+
+func (p *previewDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	link := p.link
+	link.Id = id
+	return &link, nil
+}
+
+func TestUrlController_Redirect_preview(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	createdAt := time.Date(2021, 8, 9, 9, 20, 41, 0, time.UTC)
+	tests := []struct {
+		name     string
+		link     models.Url
+		target   string
+		params   []gin.Param
+		code     int
+		location string
+		action   string
+	}{
+		{
+			name:   "preview",
+			link:   models.Url{Url: "https://example.com", CreatedAt: createdAt},
+			target: "/aaaaaa+",
+			params: []gin.Param{{Key: "url_id", Value: "aaaaaa+"}},
+			code:   http.StatusOK,
+			action: `action="/aaaaaa"`,
+		},
+		{
+			name:     "redirect",
+			link:     models.Url{Url: "https://example.com", CreatedAt: createdAt},
+			target:   "/aaaaaa",
+			params:   []gin.Param{{Key: "url_id", Value: "aaaaaa"}},
+			code:     http.StatusMovedPermanently,
+			location: "https://example.com",
+		},
+		{
+			name:   "interstitial",
+			link:   models.Url{Url: "https://example.com/{path}", Interstitial: true, CreatedAt: createdAt},
+			target: "/aaaaaa/some/path?utm_source=x",
+			params: []gin.Param{{Key: "url_id", Value: "aaaaaa"}, {Key: "suffix", Value: "/some/path"}},
+			code:   http.StatusOK,
+			action: `action="/aaaaaa/some/path?utm_source=x"`,
+		},
+		{
+			name:   "protected",
+			link:   models.Url{Url: "https://example.com", Protected: true},
+			target: "/aaaaaa+",
+			params: []gin.Param{{Key: "url_id", Value: "aaaaaa+"}},
+			code:   http.StatusOK,
+			action: `name="password"`,
+		},
+		{
+			name:   "preview with suffix",
+			link:   models.Url{Url: "https://example.com/{path}"},
+			target: "/aaaaaa+/some/path",
+			params: []gin.Param{{Key: "url_id", Value: "aaaaaa+"}, {Key: "suffix", Value: "/some/path"}},
+			code:   http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := UrlController{DB: &previewDB{link: tt.link}, Log: zap.NewNop()}
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, tt.target, nil)
+			c.Params = tt.params
+			u.Redirect(c)
+
+			assert.Equal(t, tt.code, r.Code)
+			assert.Equal(t, tt.location, r.Header().Get("Location"))
+			if tt.action != "" {
+				assert.Equal(t, "no-store", r.Header().Get("Cache-Control"))
+				assert.Contains(t, r.Body.String(), tt.action)
+			}
+		})
+	}
+}
+
+func TestUrlController_Redirect_preview_page(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	createdAt := time.Date(2021, 8, 9, 9, 20, 41, 0, time.UTC)
+	u := UrlController{DB: &previewDB{link: models.Url{Url: "https://example.com/?q=<b>", CreatedAt: createdAt}}, Log: zap.NewNop()}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/aaaaaa+", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa+"}}
+	u.Redirect(c)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Contains(t, r.Body.String(), "https://example.com/?q=&lt;b&gt;", "should escape the target")
+	assert.Contains(t, r.Body.String(), "Mon, 09 Aug 2021 09:20:41 UTC")
+	assert.Contains(t, r.Body.String(), "Never")
+}
+
+func TestUrlController_Redirect_untrusted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"https://example.com", http.StatusMovedPermanently},
+		{"https://docs.EXAMPLE.com/a", http.StatusMovedPermanently},
+		{"https://badexample.com", http.StatusOK},
+		{"https://example.org", http.StatusOK},
+	}
+	for _, tt := range tests {
+		u := UrlController{
+			DB:               &previewDB{link: models.Url{Url: tt.url}},
+			Log:              zap.NewNop(),
+			PreviewUntrusted: true,
+			TrustedDomains:   []string{"example.com"},
+		}
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodGet, "/aaaaaa", nil)
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.Redirect(c)
+		assert.Equal(t, tt.code, r.Code, tt.url)
+
+		// the continue button posts back to the link
+		r = httptest.NewRecorder()
+		c, _ = gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodPost, "/aaaaaa", nil)
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.Unlock(c)
+		// flushed by the engine after the handler
+		c.Writer.WriteHeaderNow()
+		assert.Equal(t, http.StatusSeeOther, r.Code, tt.url)
+		assert.Equal(t, tt.url, r.Header().Get("Location"), tt.url)
+	}
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/pkg/qrcode"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// qrMaxAge is how long the clients cache the QR code before revalidating it
+// by ETag, the code never changes but the link may be deleted.
+const qrMaxAge = 3600
+
+// QRCode renders the QR code of the short URL of a link, the query
+// parameters override the defaults of qrcode.Default():
+//
+//	format=png|svg&size=256&level=L|M|Q|H&margin=4&fg=000000&bg=ffffff
+//
+// The link is on the default domain unless the domain query is given.
+func (u UrlController) QRCode(c *gin.Context) {
+	key, ok := u.linkKey(c)
+	if !ok {
+		return
+	}
+	options, err := parseQROptions(c)
+	if err == nil {
+		err = options.Validate()
+	}
+	if err != nil {
+		u.Log.Warn("invalid qr options", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid qr options: " + err.Error()})
+		return
+	}
+	if _, err := u.DB.Get(c.Request.Context(), key); err != nil {
+		u.redirectError(c, err)
+		return
+	}
+
+	content := u.shortURL(models.SplitKey(key))
+	etag := qrETag(content, options)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", qrMaxAge))
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	image, err := qrcode.Render(content, options)
+	if err != nil {
+		// e.g. the size is too small for a long RedirectOrigin
+		u.Log.Warn("render qr code error", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid qr options: " + err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, qrcode.ContentType(options.Format), image)
+}
+
+// parseQROptions normalizes the options, so that the same image always has
+// the same ETag.
+func parseQROptions(c *gin.Context) (qrcode.Options, error) {
+	options := qrcode.Default()
+	if format, ok := c.GetQuery("format"); ok {
+		options.Format = strings.ToLower(format)
+	}
+	if level, ok := c.GetQuery("level"); ok {
+		options.Level = strings.ToUpper(level)
+	}
+	if fg, ok := c.GetQuery("fg"); ok {
+		options.Foreground = strings.ToLower(strings.TrimPrefix(fg, "#"))
+	}
+	if bg, ok := c.GetQuery("bg"); ok {
+		options.Background = strings.ToLower(strings.TrimPrefix(bg, "#"))
+	}
+	var err error
+	if size, ok := c.GetQuery("size"); ok {
+		if options.Size, err = strconv.Atoi(size); err != nil {
+			return options, fmt.Errorf("invalid size: %s", size)
+		}
+	}
+	if margin, ok := c.GetQuery("margin"); ok {
+		if options.Margin, err = strconv.Atoi(margin); err != nil {
+			return options, fmt.Errorf("invalid margin: %s", margin)
+		}
+	}
+	return options, nil
+}
+
+func qrETag(content string, o qrcode.Options) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s|%d|%s|%s",
+		content, o.Format, o.Size, o.Level, o.Margin, o.Foreground, o.Background)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type missingDB struct {
+	repository.UnimplementedRepository
+}
+
+func (m *missingDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	return nil, repository.ErrRecordNotFound
+}
+
+func TestUrlController_QRCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u := UrlController{
+		DB:             &previewDB{link: models.Url{Url: "https://example.com"}},
+		Log:            zap.NewNop(),
+		RedirectOrigin: "http://localhost:8080",
+	}
+	qr := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		for key, values := range header {
+			c.Request.Header[key] = values
+		}
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.QRCode(c)
+		// flushed by the engine after the handler
+		c.Writer.WriteHeaderNow()
+		return r
+	}
+
+	r := qr("/api/v1/urls/aaaaaa/qr", nil)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "image/png", r.Header().Get("Content-Type"))
+	assert.Equal(t, "\x89PNG", r.Body.String()[:4])
+	etag := r.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	r = qr("/api/v1/urls/aaaaaa/qr?format=svg&size=512&level=h&margin=2&fg=%23112233&bg=FFFFFF", nil)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "image/svg+xml", r.Header().Get("Content-Type"))
+	assert.Contains(t, r.Body.String(), `fill="#112233"`)
+	assert.NotEqual(t, etag, r.Header().Get("ETag"), "should differ by the options")
+
+	r = qr("/api/v1/urls/aaaaaa/qr?format=png&fg=000000", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, r.Code, "should be the same as the defaults")
+	assert.Empty(t, r.Body.String())
+
+	for _, query := range []string{"format=gif", "size=big", "size=10", "level=X", "margin=-1", "fg=red"} {
+		r = qr("/api/v1/urls/aaaaaa/qr?"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, r.Code, query)
+	}
+
+	u.DB = &missingDB{}
+	r = qr("/api/v1/urls/aaaaaa/qr", nil)
+	assert.Equal(t, http.StatusNotFound, r.Code)
+}
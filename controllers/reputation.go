@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"goshorturl/models"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"go.uber.org/zap"
+)
+
+// disabledTemplate never links to the target of the flagged link.
+var disabledTemplate = template.Must(template.New("disabled").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Link disabled</title>
+</head>
+<body>
+<p>This link has been disabled because its destination was reported as {{if .}}{{.}}{{else}}unsafe{{end}}.</p>
+</body>
+</html>
+`))
+
+// disabled responds the interstitial page of a flagged link instead of
+// redirecting, it returns false if the link is not flagged.
+func (u UrlController) disabled(c *gin.Context, link *models.Url) bool {
+	if link.FlaggedAt == nil {
+		return false
+	}
+	u.Log.Warn("flagged link requested", zap.String("id", link.Id), zap.String("reason", link.FlagReason))
+	c.Header("Cache-Control", "no-store")
+	c.Render(http.StatusUnavailableForLegalReasons, render.HTML{Template: disabledTemplate, Data: link.FlagReason})
+	return true
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"goshorturl/reputation"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type flaggedDB struct {
+	repository.UnimplementedRepository
+}
+
+func (f *flaggedDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	flaggedAt := time.Now()
+	return &models.Url{Id: id, Url: "https://evil.example.com", Protected: true, FlaggedAt: &flaggedAt, FlagReason: "phishing"}, nil
+}
+
+func TestUrlController_Redirect_flagged(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u := UrlController{DB: &flaggedDB{}, Log: zap.NewNop()}
+	handlers := map[string]gin.HandlerFunc{http.MethodGet: u.Redirect, http.MethodPost: u.Unlock}
+	for method, handler := range handlers {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(method, "/", nil)
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		handler(c)
+
+		assert.Equal(t, http.StatusUnavailableForLegalReasons, r.Code, method)
+		assert.Empty(t, r.Header().Get("Location"), method)
+		assert.Equal(t, "no-store", r.Header().Get("Cache-Control"), method)
+		assert.Contains(t, r.Body.String(), "phishing", method)
+		assert.NotContains(t, r.Body.String(), "evil.example.com", method)
+		assert.NotContains(t, r.Body.String(), `name="password"`, "should not prompt for the password")
+	}
+}
+
+type fakeChecker map[string]string
+
+func (f fakeChecker) Check(ctx context.Context, target string) (reputation.Verdict, error) {
+	return reputation.Verdict{Threat: f[target]}, nil
+}
+
+func TestUrlController_Upload_flagged(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	u := UrlController{Log: zap.NewNop(), Reputation: fakeChecker{"https://evil.example.com": "phishing"}}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(
+		`{"url": "https://example.com", "rules": [{"platform": "android", "url": "https://evil.example.com"}]}`))
+	u.Upload(c)
+
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+	var res struct {
+		Rule string `json:"rule"`
+		Url  string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &res))
+	assert.Equal(t, "reputation", res.Rule)
+	assert.Equal(t, "https://evil.example.com", res.Url)
+}
@@ -4,52 +4,218 @@ import (
 	"errors"
 	"fmt"
 	"goshorturl/idgenerator"
+	"goshorturl/models"
+	"goshorturl/notifier"
+	"goshorturl/pkg/throttle"
 	"goshorturl/repository"
+	"goshorturl/reputation"
+	"goshorturl/targeting"
+	"goshorturl/tracker"
+	"goshorturl/urlpolicy"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-const (
-	expireAtLayout = "2006-01-02T15:04:05Z"
-)
-
 type uploadReqData struct {
-	Url         string `json:"url"`
+	Url string `json:"url"`
+	// ExpireAtStr is a RFC3339 timestamp, and TTL is relative to now, e.g.
+	// "72h" or "30d". The link never expires if neither is given.
 	ExpireAtStr string `json:"expireAt"`
+	TTL         string `json:"ttl"`
 	expireAt    time.Time
+	// MaxClicks limits the redirects of the link, unlimited if nil.
+	MaxClicks *int64 `json:"maxClicks"`
+	// Password protects the link if not empty.
+	Password string `json:"password"`
+	// Rules override Url for the matched requests, see targeting.Match().
+	Rules models.TargetRules `json:"rules"`
+	// Variants split the traffic by weights instead of Url, see
+	// targeting.Pick().
+	Variants models.Variants `json:"variants"`
+	// Passthrough is the mode passing the query of the redirect requests,
+	// i.e. "drop" (default), "append" or "merge".
+	Passthrough string `json:"passthrough"`
+	// Interstitial renders the preview page before every redirect.
+	Interstitial bool `json:"interstitial"`
+	// Owner is an optional label to list the links by.
+	Owner string `json:"owner"`
+	// Domain is the short domain of the link, the default one if empty.
+	Domain string `json:"domain"`
+	// the optional title, description, tags and metadata
+	describeReqData
 }
 
-// parseAndValidate parses the expireAt and stores result if parsing successful.
+// parseAndValidate parses the expireAt or ttl and stores result if parsing
+// successful, the zero expireAt means never expires.
 //
-// Also validates the requested data should be valid.
+// Also validates the requested data should be valid, and the lifetime should
+// not exceed maxLifetime unless it is zero.
 //
 // Return non-nil error if validation failed.
-func (u *uploadReqData) parseAndValidate() (err error) {
+func (u *uploadReqData) parseAndValidate(maxLifetime time.Duration) (err error) {
+	if len(u.Variants) > 0 {
+		if u.Url != "" {
+			return errors.New("only one of url and variants is allowed")
+		}
+		if err := targeting.ValidateVariants(u.Variants); err != nil {
+			return err
+		}
+		// the first variant stands for the link where a single URL is
+		// expected, e.g. the webhooks and the popular links
+		u.Url = u.Variants[0].Url
+	}
 	if _, err = url.ParseRequestURI(u.Url); err != nil {
 		return fmt.Errorf("invalid URL: %w", err)
 	}
-
-	u.expireAt, err = time.Parse(expireAtLayout, u.ExpireAtStr)
-	if err != nil {
+	if u.MaxClicks != nil && *u.MaxClicks <= 0 {
+		return errors.New("maxClicks should be positive")
+	}
+	if len(u.Password) > maxPasswordLength {
+		return fmt.Errorf("password should not exceed %d bytes", maxPasswordLength)
+	}
+	if err := targeting.Validate(u.Rules); err != nil {
+		return err
+	}
+	if err := targeting.ValidatePassthrough(u.Passthrough); err != nil {
+		return err
+	}
+	if err := validateOwner(u.Owner); err != nil {
 		return err
 	}
+	if err := u.describeReqData.parseAndValidate(); err != nil {
+		return err
+	}
+	for _, target := range u.link().Targets() {
+		if err := targeting.ValidateTemplate(target); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now()
+	switch {
+	case u.ExpireAtStr != "" && u.TTL != "":
+		return errors.New("only one of expireAt and ttl is allowed")
+	case u.ExpireAtStr != "":
+		u.expireAt, err = time.Parse(time.RFC3339, u.ExpireAtStr)
+		if err != nil {
+			return err
+		}
+	case u.TTL != "":
+		ttl, err := parseTTL(u.TTL)
+		if err != nil {
+			return err
+		}
+		u.expireAt = now.Add(ttl)
+	}
+
+	if u.expireAt.IsZero() {
+		if maxLifetime > 0 {
+			return errors.New("uploaded URL should expire")
+		}
+		return nil
+	}
 	if u.expireAt.Before(now) {
 		return errors.New("uploaded URL has already expired")
 	}
-
+	if maxLifetime > 0 && u.expireAt.Sub(now) > maxLifetime {
+		return fmt.Errorf("uploaded URL should expire within %s", maxLifetime)
+	}
 	return nil
 }
 
+// link returns the link of the validated data without the password.
+func (u *uploadReqData) link() *models.Url {
+	link := &models.Url{
+		Domain:       u.Domain,
+		Url:          u.Url,
+		MaxClicks:    u.MaxClicks,
+		Rules:        u.Rules,
+		Variants:     u.Variants,
+		Passthrough:  u.Passthrough,
+		Interstitial: u.Interstitial,
+		Owner:        u.Owner,
+	}
+	if !u.expireAt.IsZero() {
+		link.ExpiredAt = &u.expireAt
+	}
+	u.apply(link)
+	return link
+}
+
+// parseTTL parses a positive duration, which accepts the "d" unit of days as
+// well as the units of time.ParseDuration().
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		// NaN, Inf and the out of range ones are not able to be a
+		// time.Duration
+		if err != nil || math.IsNaN(days) || math.Abs(days*float64(24*time.Hour)) >= math.MaxInt64 {
+			return 0, fmt.Errorf("invalid ttl: %s", s)
+		}
+		ttl = time.Duration(days * float64(24*time.Hour))
+	} else {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid ttl: %w", err)
+		}
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl should be positive: %s", s)
+	}
+	return ttl, nil
+}
+
+const (
+	// variantCookiePrefix names the cookie of the assigned variant of each
+	// link, e.g. "v_XSIfKe".
+	variantCookiePrefix = "v_"
+	variantCookieMaxAge = 30 * 24 * time.Hour
+)
+
 type UrlController struct {
 	DB             repository.Repository
 	Log            *zap.Logger
 	IDGenerator    idgenerator.IDGenerator
 	RedirectOrigin string
+	// Domains maps the other short domains besides the default one of
+	// RedirectOrigin to their origins, e.g. "ex.co" to "https://ex.co".
+	// The same id may exist on each domain.
+	Domains map[string]string
+	// MaxLifetime limits how long a link lives, zero means unlimited.
+	MaxLifetime time.Duration
+	// Tracker is optional, it counts the clicks of redirected links.
+	Tracker tracker.Tracker
+	// Notifier is optional, it notifies the webhooks of deleted links.
+	Notifier notifier.Notifier
+	// Throttle is optional, it limits the password attempts of each client
+	// to the protected links.
+	Throttle throttle.Throttle
+	// LinkThrottle is optional, it limits the password attempts to a
+	// protected link regardless of the clients, e.g. rotating addresses.
+	LinkThrottle throttle.Throttle
+	// TrustedProxies are the proxies whose X-Forwarded-For is followed to
+	// find the clients of the password attempts, see throttledClient().
+	TrustedProxies []*net.IPNet
+	// GeoIP is optional, the rules of countries never match without it.
+	GeoIP targeting.GeoIP
+	// Policy is optional, it rejects the unsafe targets on upload.
+	Policy urlpolicy.Policy
+	// Reputation is optional, it rejects the known malicious targets on
+	// upload.
+	Reputation reputation.Checker
+	// PreviewUntrusted renders the preview page before redirecting to the
+	// targets out of TrustedDomains, a domain covers its subdomains.
+	PreviewUntrusted bool
+	TrustedDomains   []string
 }
 
 func (u UrlController) Upload(c *gin.Context) {
@@ -60,36 +226,87 @@ func (u UrlController) Upload(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
-	if err := req.parseAndValidate(); err != nil {
+	if err = req.parseAndValidate(u.MaxLifetime); err == nil {
+		req.Domain, err = u.parseDomain(req.Domain)
+	}
+	if err != nil {
 		u.Log.Warn("invalid upload data", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload data"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload data: " + err.Error()})
 		return
 	}
 
-	id, err := u.IDGenerator.Get(c.Request.Context(), req.Url, req.expireAt)
+	link := req.link()
+	if u.Policy != nil {
+		for _, target := range link.Targets() {
+			err := u.Policy.Check(c.Request.Context(), target)
+			if violation, ok := err.(*urlpolicy.Violation); ok {
+				u.Log.Warn("rejected upload URL", zap.String("url", target), zap.Error(err))
+				c.JSON(http.StatusBadRequest, gin.H{"error": "rejected URL: " + violation.Reason, "rule": violation.Rule, "url": target})
+				return
+			}
+			if err != nil {
+				u.Log.Error("check upload URL error", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "internal upload error"})
+				return
+			}
+		}
+	}
+	if u.Reputation != nil {
+		for _, target := range link.Targets() {
+			verdict, err := u.Reputation.Check(c.Request.Context(), target)
+			if err != nil {
+				// the re-scan flags the link later if it is malicious
+				u.Log.Warn("check upload URL reputation error", zap.String("url", target), zap.Error(err))
+				continue
+			}
+			if verdict.Flagged() {
+				u.Log.Warn("flagged upload URL", zap.String("url", target), zap.String("threat", verdict.Threat))
+				c.JSON(http.StatusBadRequest, gin.H{"error": "rejected URL: flagged as " + verdict.Threat, "rule": "reputation", "url": target})
+				return
+			}
+		}
+	}
+
+	if req.Password != "" {
+		if link.PasswordHash, err = hashPassword(req.Password); err != nil {
+			u.Log.Error("hash password error", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal upload error"})
+			return
+		}
+	}
+	id, err := u.IDGenerator.Get(c.Request.Context(), link)
 	if err != nil {
 		u.Log.Error("upload error", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal upload error"})
 		return
 	}
 
+	var expireAt interface{} // null if never expires
+	if !req.expireAt.IsZero() {
+		expireAt = req.expireAt.UTC().Format(time.RFC3339)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"id":       id,
-		"shortUrl": fmt.Sprintf("%s/%s", u.RedirectOrigin, id),
+		"domain":   link.Domain,
+		"shortUrl": u.shortURL(link.Domain, id),
+		"expireAt": expireAt,
+		// null if unlimited
+		"maxClicks": req.MaxClicks,
+		"protected": link.PasswordHash != "",
+		// null if not split
+		"variants": req.Variants,
 	})
 }
 
 func (u UrlController) Delete(c *gin.Context) {
-	urlID := c.Param("url_id")
-	if err := idgenerator.Validate(urlID); err != nil {
-		u.Log.Warn("invalid id", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+	key, ok := u.linkKey(c)
+	if !ok {
 		return
 	}
 
-	if err := u.DB.Delete(c.Request.Context(), urlID); err != nil {
+	if err := u.DB.Delete(c.Request.Context(), key); err != nil {
 		if err == repository.ErrRecordNotFound {
-			u.Log.Warn("id not exists", zap.String("id", urlID))
+			u.Log.Warn("id not exists", zap.String("key", key))
 			c.JSON(http.StatusNotFound, gin.H{"error": "id not exists"})
 			return
 		}
@@ -97,27 +314,190 @@ func (u UrlController) Delete(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete error"})
 		return
 	}
+	if u.Notifier != nil {
+		if err := u.Notifier.Deleted(c.Request.Context(), key); err != nil {
+			u.Log.Error("notify deleted link error", zap.String("key", key), zap.Error(err))
+		}
+	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
 func (u UrlController) Redirect(c *gin.Context) {
 	urlID := c.Param("url_id")
+	// the id suffixed by "+" previews the link instead, e.g. "/XSIfKe+"
+	preview := c.Param("suffix") == "" && strings.HasSuffix(urlID, previewSuffix)
+	if preview {
+		urlID = strings.TrimSuffix(urlID, previewSuffix)
+	}
 	if err := idgenerator.Validate(urlID); err != nil {
 		u.Log.Warn("invalid id", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
 
-	oriUrl, err := u.DB.Get(c.Request.Context(), urlID)
+	// the same id may exist on each domain
+	link, err := u.DB.Get(c.Request.Context(), models.Key(u.requestDomain(c), urlID))
 	if err != nil {
-		if err == repository.ErrRecordNotFound {
-			u.Log.Warn("record not found", zap.Error(err))
-			c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
+		u.redirectError(c, err)
+		return
+	}
+	if u.disabled(c, link) {
+		return
+	}
+	if link.Protected {
+		u.prompt(c, http.StatusOK, "")
+		return
+	}
+	target, variant, ok := u.resolve(c, link)
+	if !ok {
+		return
+	}
+	if preview || u.confirm(link, target) {
+		u.preview(c, link, target)
+		return
+	}
+	u.redirect(c, link, target, variant, http.StatusMovedPermanently)
+}
+
+// follow resolves the target of link and redirects to it by code.
+func (u UrlController) follow(c *gin.Context, link *models.Url, code int) {
+	if target, variant, ok := u.resolve(c, link); ok {
+		u.redirect(c, link, target, variant, code)
+	}
+}
+
+// resolve returns the target of link for the request and the assigned
+// variant if any, see target(). It responds the error and reports false if
+// the target is unable to be resolved.
+func (u UrlController) resolve(c *gin.Context, link *models.Url) (string, string, bool) {
+	target, variant := u.target(c, link)
+	target, err := u.expand(c, link, target)
+	if err == targeting.ErrUnexpectedPath {
+		u.Log.Warn("unexpected path suffix", zap.String("id", link.Id), zap.String("suffix", c.Param("suffix")))
+		c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
+		return "", "", false
+	}
+	if err != nil {
+		u.redirectError(c, err)
+		return "", "", false
+	}
+	return target, variant, true
+}
+
+// redirect takes a click from the link and redirects to target by code.
+func (u UrlController) redirect(c *gin.Context, link *models.Url, target, variant string, code int) {
+	if link.MaxClicks != nil {
+		if _, err := u.DB.Consume(c.Request.Context(), link.Key()); err != nil {
+			u.redirectError(c, err)
 			return
 		}
+	}
+	if u.Tracker != nil {
+		if variant != "" {
+			u.Tracker.TrackVariant(link.Key(), variant)
+		} else {
+			u.Tracker.Track(link.Key())
+		}
+	}
+	if len(link.Rules) > 0 || len(link.Variants) > 0 {
+		// the permanent redirect is cached by browsers regardless of the
+		// conditions, e.g. the country changes with the network
+		c.Header("Vary", "User-Agent, Accept-Language, Cookie")
+		if code == http.StatusMovedPermanently {
+			code = http.StatusFound
+		}
+	}
+	c.Redirect(code, target)
+}
+
+// target evaluates the targeting rules of link against the request, and then
+// assigns a variant if the link is split. The URL of link is the default.
+//
+// The name of the assigned variant is returned, empty if the target is not a
+// variant.
+func (u UrlController) target(c *gin.Context, link *models.Url) (string, string) {
+	if target, ok := u.matchRules(c, link); ok {
+		return target, ""
+	}
+	if len(link.Variants) == 0 {
+		return link.Url, ""
+	}
+	v := u.assignVariant(c, link)
+	return v.Url, v.Name
+}
+
+// expand fills the placeholders of target by the request, and then passes
+// the rest of the query through by the mode of link.
+func (u UrlController) expand(c *gin.Context, link *models.Url, target string) (string, error) {
+	query := c.Request.URL.Query()
+	target, used, err := targeting.Expand(target, query, c.Param("suffix"))
+	if err != nil {
+		return "", err
+	}
+	return targeting.Passthrough(target, link.Passthrough, query, used)
+}
+
+// assignVariant keeps the client on the variant of its cookie, otherwise
+// picks one by hashing the client, and remembers it by the cookie.
+func (u UrlController) assignVariant(c *gin.Context, link *models.Url) models.Variant {
+	cookie := variantCookiePrefix + link.Id
+	if name, err := c.Cookie(cookie); err == nil {
+		if v, ok := targeting.Find(link.Variants, name); ok {
+			return v
+		}
+	}
+	// the clients without cookies, e.g. the ones opening the link in
+	// different apps, still stick to the same variant mostly
+	v := targeting.Pick(link.Variants, link.Id+"|"+c.ClientIP()+"|"+c.GetHeader("User-Agent"))
+	c.SetCookie(cookie, v.Name, int(variantCookieMaxAge.Seconds()), "/"+link.Id, "", false, true)
+	return v
+}
+
+// matchRules evaluates the targeting rules of link against the request.
+func (u UrlController) matchRules(c *gin.Context, link *models.Url) (string, bool) {
+	if len(link.Rules) == 0 {
+		return "", false
+	}
+	req := targeting.Request{
+		Platform:  targeting.Platform(c.GetHeader("User-Agent")),
+		Languages: targeting.Languages(c.GetHeader("Accept-Language")),
+	}
+	if u.GeoIP != nil {
+		req.Country = u.GeoIP.Country(net.ParseIP(c.ClientIP()))
+	}
+	return targeting.Match(link.Rules, req)
+}
+
+// Stats returns the clicks of each variant of the link.
+func (u UrlController) Stats(c *gin.Context) {
+	key, ok := u.linkKey(c)
+	if !ok {
+		return
+	}
+	stats, err := u.DB.ListVariantStats(c.Request.Context(), key)
+	if err != nil {
+		u.Log.Error("list variant stats error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "stats error"})
+		return
+	}
+	_, urlID := models.SplitKey(key)
+	c.JSON(http.StatusOK, gin.H{"id": urlID, "variants": stats})
+}
+
+func (u UrlController) redirectError(c *gin.Context, err error) {
+	switch err {
+	case repository.ErrRecordNotFound:
+		u.Log.Warn("record not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
+	case repository.ErrGone:
+		u.Log.Warn("record is gone", zap.Error(err))
+		c.JSON(http.StatusGone, gin.H{"error": "record is gone"})
+	case repository.ErrBusy:
+		u.Log.Warn("redirect shed", zap.Error(err))
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "service busy"})
+	default:
 		u.Log.Error("redirect error", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "redirect error"})
-		return
 	}
-	c.Redirect(http.StatusMovedPermanently, oriUrl)
 }
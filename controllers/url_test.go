@@ -1,12 +1,16 @@
 package controllers
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"goshorturl/idgenerator"
+	"goshorturl/models"
 	"goshorturl/repository"
+	"goshorturl/urlpolicy"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -43,7 +47,7 @@ func (a anyValidID) Match(v driver.Value) bool {
 	return ok && (err == nil)
 }
 
-func getMockDB(t *testing.T) (repository.Repository, sqlmock.Sqlmock) {
+func getMockDB(t *testing.T, options ...repository.Option) (repository.Repository, sqlmock.Sqlmock) {
 	sqlDB, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 
@@ -52,6 +56,7 @@ func getMockDB(t *testing.T) (repository.Repository, sqlmock.Sqlmock) {
 		gorm.Config{
 			Logger: logger.Default.LogMode(logger.Info), // to display SQL statement for debugging
 		},
+		options...,
 	)
 	assert.NoError(t, err)
 
@@ -118,14 +123,14 @@ func TestUrlController_Upload(t *testing.T) {
 		mock.MatchExpectationsInOrder(false)
 
 		mock.ExpectBegin() // called by gorm
-		exec := mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "urls" ("id","url","expired_at","created_at","updated_at","deleted_at") VALUES ($1,$2,$3,$4,$5,$6)`))
+		exec := mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "urls" ("domain","id","url","expired_at","max_clicks","remaining_clicks","password_hash","rules","variants","passthrough","interstitial","flagged_at","flag_reason","owner","title","description","tags","metadata","created_at","updated_at","deleted_at") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21)`))
 		if !wantDBError {
 			// convert to and back to trim the clocking
-			expiredAtStr := jsonArgs.expiredAt.Format(expireAtLayout)
-			expiredAt, _ := time.Parse(expireAtLayout, expiredAtStr)
+			expiredAtStr := jsonArgs.expiredAt.Format(time.RFC3339)
+			expiredAt, _ := time.Parse(time.RFC3339, expiredAtStr)
 
 			exec.
-				WithArgs(anyValidID{}, jsonArgs.url, expiredAt, anyExpireTime{}, anyExpireTime{}, nil).
+				WithArgs("", anyValidID{}, jsonArgs.url, expiredAt, nil, nil, "", nil, nil, "", false, nil, "", "", "", "", nil, nil, anyExpireTime{}, anyExpireTime{}, nil).
 				WillReturnResult(result)
 			mock.ExpectCommit() // called by gorm
 		} else {
@@ -133,15 +138,15 @@ func TestUrlController_Upload(t *testing.T) {
 			mock.ExpectRollback() // called by gorm
 		}
 		// this statement will be used by `db.SelectDeletedAndExpired()`
-		query := mock.ExpectQuery(regexp.QuoteMeta(`SELECT "id" FROM "urls" WHERE deleted_at IS NOT NULL OR expired_at < $1`))
-		query.WithArgs(anyExpireTime{}).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		query := mock.ExpectQuery(regexp.QuoteMeta(`SELECT "domain","id" FROM "urls" WHERE deleted_at IS NOT NULL OR expired_at < $1 OR remaining_clicks <= 0`))
+		query.WithArgs(anyExpireTime{}).WillReturnRows(sqlmock.NewRows([]string{"domain", "id"}))
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			reqJSON := fmt.Sprintf(
 				`{"url": "%s", "expireAt": "%s"}`,
-				tt.jsonArgs.url, tt.jsonArgs.expiredAt.Format(expireAtLayout),
+				tt.jsonArgs.url, tt.jsonArgs.expiredAt.Format(time.RFC3339),
 			)
 
 			r := httptest.NewRecorder()
@@ -185,6 +190,125 @@ func TestUrlController_Upload(t *testing.T) {
 	}
 }
 
+func TestUploadReqData_parseAndValidate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		req         uploadReqData
+		maxLifetime time.Duration
+		expireAt    time.Time // zero means never expires
+		wantErr     bool
+	}{
+		{"UTC", uploadReqData{ExpireAtStr: "2100-01-02T03:04:05Z"}, 0, time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"offset", uploadReqData{ExpireAtStr: "2100-01-02T11:04:05+08:00"}, 0, time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"fraction", uploadReqData{ExpireAtStr: "2100-01-02T03:04:05.5Z"}, 0, time.Date(2100, 1, 2, 3, 4, 5, 5e8, time.UTC), false},
+		{"not RFC3339", uploadReqData{ExpireAtStr: "2100-01-02 03:04:05"}, 0, time.Time{}, true},
+		{"ttl in hours", uploadReqData{TTL: "72h"}, 0, now.Add(72 * time.Hour), false},
+		{"ttl in days", uploadReqData{TTL: "30d"}, 0, now.Add(30 * 24 * time.Hour), false},
+		{"ttl in half days", uploadReqData{TTL: "1.5d"}, 0, now.Add(36 * time.Hour), false},
+		{"invalid ttl", uploadReqData{TTL: "forever"}, 0, time.Time{}, true},
+		{"negative ttl", uploadReqData{TTL: "-1d"}, 0, time.Time{}, true},
+		{"NaN ttl", uploadReqData{TTL: "NaNd"}, 0, time.Time{}, true},
+		{"infinite ttl", uploadReqData{TTL: "Infd"}, 0, time.Time{}, true},
+		{"negative infinite ttl", uploadReqData{TTL: "-Infd"}, 0, time.Time{}, true},
+		{"overflowed ttl", uploadReqData{TTL: "1e6d"}, 0, time.Time{}, true},
+		{"both expireAt and ttl", uploadReqData{ExpireAtStr: "2100-01-02T03:04:05Z", TTL: "1h"}, 0, time.Time{}, true},
+		{"never expires", uploadReqData{}, 0, time.Time{}, false},
+		{"never expires exceeds max lifetime", uploadReqData{}, time.Hour, time.Time{}, true},
+		{"within max lifetime", uploadReqData{TTL: "30m"}, time.Hour, now.Add(30 * time.Minute), false},
+		{"exceeds max lifetime", uploadReqData{TTL: "2h"}, time.Hour, time.Time{}, true},
+		{"max clicks", uploadReqData{MaxClicks: int64Ptr(10)}, 0, time.Time{}, false},
+		{"zero max clicks", uploadReqData{MaxClicks: int64Ptr(0)}, 0, time.Time{}, true},
+		{"rules", uploadReqData{Rules: models.TargetRules{{Platform: "ios", Url: "https://apps.apple.com"}}}, 0, time.Time{}, false},
+		{"invalid rules", uploadReqData{Rules: models.TargetRules{{Url: "https://apps.apple.com"}}}, 0, time.Time{}, true},
+		{"variants", uploadReqData{Variants: models.Variants{{Url: "https://example.com/a", Weight: 50}, {Url: "https://example.com/b", Weight: 50}}}, 0, time.Time{}, false},
+		{"invalid variants", uploadReqData{Variants: models.Variants{{Url: "https://example.com/a", Weight: 50}}}, 0, time.Time{}, true},
+		{"passthrough", uploadReqData{Passthrough: "merge"}, 0, time.Time{}, false},
+		{"invalid passthrough", uploadReqData{Passthrough: "override"}, 0, time.Time{}, true},
+		{"template", uploadReqData{Rules: models.TargetRules{{Platform: "ios", Url: "https://example.com/ios/{path}"}}}, 0, time.Time{}, false},
+		{"template in host", uploadReqData{Rules: models.TargetRules{{Platform: "ios", Url: "https://{host}/ios"}}}, 0, time.Time{}, true},
+		{"owner", uploadReqData{Owner: "growth-team@example.com"}, 0, time.Time{}, false},
+		{"invalid owner", uploadReqData{Owner: "growth team"}, 0, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.req.Variants) == 0 {
+				tt.req.Url = "http://example.com"
+			}
+			err := tt.req.parseAndValidate(tt.maxLifetime)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.expireAt.IsZero() {
+				assert.True(t, tt.req.expireAt.IsZero())
+			} else {
+				assert.WithinDuration(t, tt.expireAt, tt.req.expireAt, time.Second)
+			}
+		})
+	}
+}
+
+func TestUrlController_Upload_rejected_by_policy(t *testing.T) {
+	policy, err := urlpolicy.New(nil, zap.NewNop(), urlpolicy.Config{Self: []string{"http://localhost:8080"}})
+	assert.NoError(t, err)
+	defer policy.Close()
+	tests := []struct {
+		body string
+		rule string
+		url  string
+	}{
+		{`{"url": "javascript:alert(1)"}`, urlpolicy.RuleScheme, "javascript:alert(1)"},
+		{`{"url": "http://169.254.169.254/latest/meta-data"}`, urlpolicy.RulePrivate, "http://169.254.169.254/latest/meta-data"},
+		{`{"url": "http://localhost:8080/XSIfKe"}`, urlpolicy.RuleLoop, "http://localhost:8080/XSIfKe"},
+		{`{"url": "https://example.com", "rules": [{"platform": "ios", "url": "file:///etc/passwd"}]}`, urlpolicy.RuleScheme, "file:///etc/passwd"},
+	}
+	u := UrlController{Log: zap.NewNop(), Policy: policy}
+	for _, tt := range tests {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		u.Upload(c)
+
+		assert.Equal(t, http.StatusBadRequest, r.Code, tt.body)
+		var res struct {
+			Rule string `json:"rule"`
+			Url  string `json:"url"`
+		}
+		assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &res))
+		assert.Equal(t, tt.rule, res.Rule, tt.body)
+		assert.Equal(t, tt.url, res.Url, tt.body)
+	}
+}
+
+func TestUrlController_Upload_never_expires(t *testing.T) {
+	gormDB, mock := getMockDB(t)
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "urls" ("domain","id","url","expired_at","max_clicks","remaining_clicks","password_hash","rules","variants","passthrough","interstitial","flagged_at","flag_reason","owner","title","description","tags","metadata","created_at","updated_at","deleted_at") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21)`)).
+		WithArgs("", anyValidID{}, "http://example.com", nil, nil, nil, "", nil, nil, "", false, nil, "", "", "", "", nil, nil, anyExpireTime{}, anyExpireTime{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "domain","id" FROM "urls" WHERE deleted_at IS NOT NULL OR expired_at < $1 OR remaining_clicks <= 0`)).
+		WithArgs(anyExpireTime{}).WillReturnRows(sqlmock.NewRows([]string{"domain", "id"}))
+
+	u := UrlController{DB: gormDB, Log: zap.NewNop(), IDGenerator: idgenerator.New(gormDB, zap.NewNop())}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"url": "http://example.com"}`))
+	u.Upload(c)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Contains(t, r.Body.String(), `"expireAt":null`)
+	var expectationsWereNotMetErr error
+	asyncwait.NewAsyncWait(1000, 100).Check(func() bool {
+		expectationsWereNotMetErr = mock.ExpectationsWereMet()
+		return expectationsWereNotMetErr == nil
+	})
+	assert.NoError(t, expectationsWereNotMetErr)
+}
+
 func TestUrlController_Delete(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	logger, _ := zap.NewDevelopment()
@@ -233,10 +357,14 @@ func TestUrlController_Delete(t *testing.T) {
 
 	injectMock := func(mock sqlmock.Sqlmock, id string, result driver.Result, wantDBError bool) {
 		mock.ExpectBegin() // called by gorm
-		exec := mock.ExpectExec(regexp.QuoteMeta(`UPDATE "urls" SET "deleted_at"=$1 WHERE "urls"."id" = $2 AND "urls"."deleted_at" IS NULL`))
+		exec := mock.ExpectExec(regexp.QuoteMeta(`UPDATE "urls" SET "deleted_at"=$1 WHERE (domain = $2 AND id = $3) AND "urls"."deleted_at" IS NULL`))
 		if !wantDBError {
-			exec.WithArgs(anyExpireTime{}, id).
+			exec.WithArgs(anyExpireTime{}, "", id).
 				WillReturnResult(result)
+			if n, _ := result.RowsAffected(); n == 0 {
+				mock.ExpectRollback() // not found rolls back the transaction
+				return
+			}
 			mock.ExpectCommit() // called by gorm
 		} else {
 			exec.WillReturnError(errInternalDBError)
@@ -268,6 +396,29 @@ func TestUrlController_Delete(t *testing.T) {
 	}
 }
 
+func TestUrlController_Delete_with_outbox(t *testing.T) {
+	gormDB, mock := getMockDB(t, repository.WithOutbox())
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "urls" SET "deleted_at"=$1 WHERE (domain = $2 AND id = $3) AND "urls"."deleted_at" IS NULL`)).
+		WithArgs(anyExpireTime{}, "", "okokok").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// the event is written in the same transaction
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox_events" ("type","domain","url_id","url","expired_at","clicks","created_at") VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "seq"`)).
+		WithArgs("link.deleted", "", "okokok", "", nil, 0, anyExpireTime{}).
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(1))
+	mock.ExpectCommit()
+
+	u := UrlController{DB: gormDB, Log: zap.NewNop()}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodDelete, "/", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "okokok"}}
+	u.Delete(c)
+
+	assert.Equal(t, http.StatusNoContent, r.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestUrlController_Redirect(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	logger, _ := zap.NewDevelopment()
@@ -315,10 +466,10 @@ func TestUrlController_Redirect(t *testing.T) {
 	}
 
 	injectMock := func(mock sqlmock.Sqlmock, id, wantURL string, dbErr error) {
-		exec := mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE (id = $1 AND expired_at > $2) AND "urls"."deleted_at" IS NULL LIMIT 1`))
+		exec := mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE (domain = $1 AND id = $2 AND (expired_at IS NULL OR expired_at > $3)) AND "urls"."deleted_at" IS NULL LIMIT 1`))
 		if dbErr == nil {
 			rows := sqlmock.NewRows([]string{"url"}).AddRow(wantURL)
-			exec.WithArgs(id, anyExpireTime{}).
+			exec.WithArgs("", id, anyExpireTime{}).
 				WillReturnRows(rows)
 		} else {
 			exec.WillReturnError(dbErr)
@@ -349,3 +500,245 @@ func TestUrlController_Redirect(t *testing.T) {
 		})
 	}
 }
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+func TestUrlController_Redirect_limited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name               string
+		remaining          int64
+		consumed           bool
+		expectedStatusCode int
+	}{
+		{"last click", 1, true, http.StatusMovedPermanently},
+		{"exhausted", 0, false, http.StatusGone},
+		{"exhausted by others", 1, false, http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gormDB, mock := getMockDB(t)
+			rows := sqlmock.NewRows([]string{"id", "url", "max_clicks", "remaining_clicks"}).
+				AddRow("aaaaaa", "https://example.com", 10, tt.remaining)
+			mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "urls" WHERE (domain = $1 AND id = $2 AND (expired_at IS NULL OR expired_at > $3)) AND "urls"."deleted_at" IS NULL LIMIT 1`)).
+				WithArgs("", "aaaaaa", anyExpireTime{}).
+				WillReturnRows(rows)
+			if tt.remaining > 0 {
+				consumed := sqlmock.NewRows([]string{"remaining_clicks"})
+				if tt.consumed {
+					consumed.AddRow(tt.remaining - 1)
+				}
+				mock.ExpectQuery(regexp.QuoteMeta(`UPDATE "urls" SET "remaining_clicks" = "remaining_clicks" - 1 WHERE "domain" = $1 AND "id" = $2 AND "remaining_clicks" > 0 AND "deleted_at" IS NULL RETURNING "remaining_clicks"`)).
+					WithArgs("", "aaaaaa").
+					WillReturnRows(consumed)
+			}
+
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+			u := UrlController{DB: gormDB, Log: zap.NewNop()}
+			u.Redirect(c)
+
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+type targetedDB struct {
+	repository.UnimplementedRepository
+}
+
+func (*targetedDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	return &models.Url{Id: id, Url: "https://example.com", Rules: models.TargetRules{
+		{Platform: "ios", Url: "https://apps.apple.com"},
+		{Country: "TW", Url: "https://example.com.tw"},
+	}}, nil
+}
+
+type fakeGeoIP map[string]string
+
+func (f fakeGeoIP) Country(ip net.IP) string {
+	return f[ip.String()]
+}
+
+func TestUrlController_Redirect_targeted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name      string
+		userAgent string
+		ip        string
+		location  string
+	}{
+		{"ios", "Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X)", "192.0.2.1", "https://apps.apple.com"},
+		{"country", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "192.0.2.2", "https://example.com.tw"},
+		{"default", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "192.0.2.1", "https://example.com"},
+	}
+	u := UrlController{DB: &targetedDB{}, Log: zap.NewNop(), GeoIP: fakeGeoIP{"192.0.2.2": "TW"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			c.Request.RemoteAddr = tt.ip + ":12345"
+			c.Request.Header.Set("User-Agent", tt.userAgent)
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+			u.Redirect(c)
+
+			assert.Equal(t, http.StatusFound, r.Code, "should not be cached permanently")
+			assert.Equal(t, tt.location, r.Header().Get("Location"))
+			assert.Contains(t, r.Header().Get("Vary"), "User-Agent")
+		})
+	}
+}
+
+func TestUploadReqData_parseAndValidate_variants(t *testing.T) {
+	req := uploadReqData{Variants: models.Variants{
+		{Url: "https://example.com/a", Weight: 90},
+		{Url: "https://example.com/b", Weight: 10},
+	}}
+	assert.NoError(t, req.parseAndValidate(0))
+	assert.Equal(t, "https://example.com/a", req.Url, "should stand for the link by the first variant")
+
+	req.Url = "https://example.com"
+	assert.Error(t, req.parseAndValidate(0), "should not allow both url and variants")
+}
+
+type trackerRecorder struct {
+	clicks   []string
+	variants []string
+}
+
+func (t *trackerRecorder) Track(id string) {
+	t.clicks = append(t.clicks, id)
+}
+
+func (t *trackerRecorder) TrackVariant(id, variant string) {
+	t.variants = append(t.variants, id+"/"+variant)
+}
+
+func (t *trackerRecorder) Close() {}
+
+type splitDB struct {
+	repository.UnimplementedRepository
+}
+
+func (*splitDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	return &models.Url{Id: id, Url: "https://example.com/a", Variants: models.Variants{
+		{Name: "a", Url: "https://example.com/a", Weight: 50},
+		{Name: "b", Url: "https://example.com/b", Weight: 50},
+	}}, nil
+}
+
+func TestUrlController_Redirect_split(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tracker := &trackerRecorder{}
+	u := UrlController{DB: &splitDB{}, Log: zap.NewNop(), Tracker: tracker}
+	redirect := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(r)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.RemoteAddr = "192.0.2.1:12345"
+		if cookie != nil {
+			c.Request.AddCookie(cookie)
+		}
+		c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+		u.Redirect(c)
+		return r
+	}
+
+	r := redirect(nil)
+	assert.Equal(t, http.StatusFound, r.Code, "should not be cached permanently")
+	assert.Contains(t, r.Header().Get("Vary"), "Cookie")
+	cookies := r.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "v_aaaaaa", cookies[0].Name)
+	assert.Equal(t, "/aaaaaa", cookies[0].Path)
+	assigned := cookies[0].Value
+	assert.Equal(t, "https://example.com/"+assigned, r.Header().Get("Location"))
+
+	assert.Equal(t, r.Header().Get("Location"), redirect(nil).Header().Get("Location"), "should stick to the same client")
+
+	other := map[string]string{"a": "b", "b": "a"}[assigned]
+	r = redirect(&http.Cookie{Name: "v_aaaaaa", Value: other})
+	assert.Equal(t, "https://example.com/"+other, r.Header().Get("Location"), "should stick to the cookie")
+	assert.Empty(t, r.Result().Cookies(), "should keep the cookie")
+
+	r = redirect(&http.Cookie{Name: "v_aaaaaa", Value: "removed"})
+	assert.Equal(t, "https://example.com/"+assigned, r.Header().Get("Location"), "should reassign the unknown variant")
+
+	assert.Empty(t, tracker.clicks)
+	assert.Equal(t, []string{"aaaaaa/" + assigned, "aaaaaa/" + assigned, "aaaaaa/" + other, "aaaaaa/" + assigned}, tracker.variants)
+}
+
+func TestUrlController_Stats(t *testing.T) {
+	gormDB, mock := getMockDB(t)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "variant_stats" WHERE domain = $1 AND id = $2 ORDER BY variant`)).
+		WithArgs("", "aaaaaa").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "variant", "clicks"}).
+			AddRow("aaaaaa", "a", 90).
+			AddRow("aaaaaa", "b", 10))
+
+	gin.SetMode(gin.TestMode)
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}}
+	u := UrlController{DB: gormDB, Log: zap.NewNop()}
+	u.Stats(c)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.JSONEq(t, `{"id":"aaaaaa","variants":[{"variant":"a","clicks":90},{"variant":"b","clicks":10}]}`, r.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+type templatedDB struct {
+	repository.UnimplementedRepository
+}
+
+func (*templatedDB) Get(ctx context.Context, id string) (*models.Url, error) {
+	return &models.Url{Id: id, Url: "https://example.com/docs/{path}?lang={lang}", Passthrough: models.PassthroughMerge}, nil
+}
+
+func TestUrlController_Redirect_templated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		target   string
+		suffix   string
+		code     int
+		location string
+	}{
+		{"no suffix", "/aaaaaa?utm_source=x", "", http.StatusMovedPermanently, "https://example.com/docs/?lang=&utm_source=x"},
+		{"suffix", "/aaaaaa/some/path?lang=zh&utm_source=x", "/some/path", http.StatusMovedPermanently, "https://example.com/docs/some/path?lang=zh&utm_source=x"},
+		{"climbing suffix", "/aaaaaa/../admin", "/../admin", http.StatusNotFound, ""},
+	}
+	u := UrlController{DB: &templatedDB{}, Log: zap.NewNop()}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodGet, tt.target, nil)
+			c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}, {Key: "suffix", Value: tt.suffix}}
+			u.Redirect(c)
+
+			assert.Equal(t, tt.code, r.Code)
+			assert.Equal(t, tt.location, r.Header().Get("Location"))
+		})
+	}
+}
+
+func TestUrlController_Redirect_unexpected_suffix(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/aaaaaa/some/path?utm_source=x", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "aaaaaa"}, {Key: "suffix", Value: "/some/path"}}
+	u := UrlController{DB: &targetedDB{}, Log: zap.NewNop()}
+	u.Redirect(c)
+
+	assert.Equal(t, http.StatusNotFound, r.Code, "should not accept the suffix without the placeholder")
+}
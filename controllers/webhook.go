@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"goshorturl/models"
+	"goshorturl/notifier"
+	"goshorturl/repository"
+	"goshorturl/urlpolicy"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+type webhookReqData struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is generated if empty.
+	Secret string `json:"secret"`
+}
+
+func (w *webhookReqData) validate(ctx context.Context, allowPrivate, resolve bool) error {
+	u, err := url.ParseRequestURI(w.Url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook URL should be http or https")
+	}
+	if !allowPrivate {
+		// checked again on connecting, see urlpolicy.DialControl()
+		if err := urlpolicy.CheckHost(ctx, u.Hostname(), resolve); err != nil {
+			return err
+		}
+	}
+	for _, event := range w.Events {
+		if !notifier.ValidEvent(event) {
+			return errors.New("undefined event: " + event)
+		}
+	}
+	return nil
+}
+
+type webhookResp struct {
+	Id     uint     `json:"id"`
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is only returned once on registering.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newWebhookResp(webhook *models.Webhook) webhookResp {
+	events := notifier.Events
+	if webhook.Events != "" {
+		events = strings.Split(webhook.Events, ",")
+	}
+	return webhookResp{
+		Id:        webhook.Id,
+		Url:       webhook.Url,
+		Events:    events,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
+
+type deliveryResp struct {
+	Id            uint       `json:"id"`
+	Event         string     `json:"event"`
+	UrlId         string     `json:"urlId"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"responseCode,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	DeliveredAt   *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+type WebhookController struct {
+	DB  repository.Repository
+	Log *zap.Logger
+	// AllowPrivate accepts the webhooks of the loopback, private and
+	// link-local addresses, e.g. in development.
+	AllowPrivate bool
+	// Resolve looks up the hostnames of the webhooks to reject the private
+	// ones on registering.
+	Resolve bool
+}
+
+func (w WebhookController) Register(c *gin.Context) {
+	var req webhookReqData
+	if err := c.BindJSON(&req); err != nil {
+		w.Log.Warn("invalid request", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := req.validate(c.Request.Context(), w.AllowPrivate, w.Resolve); err != nil {
+		w.Log.Warn("invalid webhook", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook: " + err.Error()})
+		return
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			w.Log.Error("generate webhook secret error", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal register error"})
+			return
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook := &models.Webhook{
+		Url:    req.Url,
+		Secret: req.Secret,
+		Events: strings.Join(req.Events, ","),
+	}
+	if err := w.DB.CreateWebhook(c.Request.Context(), webhook); err != nil {
+		w.Log.Error("register webhook error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal register error"})
+		return
+	}
+	resp := newWebhookResp(webhook)
+	resp.Secret = webhook.Secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (w WebhookController) List(c *gin.Context) {
+	webhooks, err := w.DB.ListWebhooks(c.Request.Context())
+	if err != nil {
+		w.Log.Error("list webhooks error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list webhooks error"})
+		return
+	}
+	resp := make([]webhookResp, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		resp = append(resp, newWebhookResp(webhook))
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": resp})
+}
+
+func (w WebhookController) Delete(c *gin.Context) {
+	id, ok := w.webhookID(c)
+	if !ok {
+		return
+	}
+	if err := w.DB.DeleteWebhook(c.Request.Context(), id); err != nil {
+		if err == repository.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook not exists"})
+			return
+		}
+		w.Log.Error("delete webhook error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete webhook error"})
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Deliveries returns the latest deliveries of the webhook, at most the
+// given limit.
+func (w WebhookController) Deliveries(c *gin.Context) {
+	id, ok := w.webhookID(c)
+	if !ok {
+		return
+	}
+	limit := defaultDeliveryLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxDeliveryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	deliveries, err := w.DB.ListDeliveries(c.Request.Context(), id, limit)
+	if err != nil {
+		w.Log.Error("list deliveries error", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "list deliveries error"})
+		return
+	}
+	resp := make([]deliveryResp, 0, len(deliveries))
+	for _, d := range deliveries {
+		r := deliveryResp{
+			Id:           d.Id,
+			Event:        d.Event,
+			UrlId:        d.UrlId,
+			Status:       d.Status,
+			Attempts:     d.Attempts,
+			ResponseCode: d.ResponseCode,
+			LastError:    d.LastError,
+			DeliveredAt:  d.DeliveredAt,
+			CreatedAt:    d.CreatedAt,
+		}
+		if d.Status == models.DeliveryPending {
+			nextAttemptAt := d.NextAttemptAt
+			r.NextAttemptAt = &nextAttemptAt
+		}
+		resp = append(resp, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": resp})
+}
+
+func (w WebhookController) webhookID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("webhook_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return 0, false
+	}
+	return uint(id), true
+}
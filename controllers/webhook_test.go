@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"goshorturl/models"
+	"goshorturl/notifier"
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type webhookDB struct {
+	repository.UnimplementedRepository
+	webhooks   []*models.Webhook
+	deliveries []*models.WebhookDelivery
+}
+
+func (w *webhookDB) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	webhook.Id = uint(len(w.webhooks) + 1)
+	w.webhooks = append(w.webhooks, webhook)
+	return nil
+}
+
+func (w *webhookDB) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	return w.webhooks, nil
+}
+
+func (w *webhookDB) DeleteWebhook(ctx context.Context, id uint) error {
+	for i, webhook := range w.webhooks {
+		if webhook.Id == id {
+			w.webhooks = append(w.webhooks[:i], w.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return repository.ErrRecordNotFound
+}
+
+func (w *webhookDB) ListDeliveries(ctx context.Context, webhookID uint, limit int) ([]*models.WebhookDelivery, error) {
+	return w.deliveries, nil
+}
+
+func TestWebhookController_Register(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger, _ := zap.NewDevelopment()
+
+	tests := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+	}{
+		{"all events", `{"url": "https://example.com/hook"}`, http.StatusCreated},
+		{"some events", `{"url": "https://example.com/hook", "events": ["link.expired"], "secret": "s3cr3t"}`, http.StatusCreated},
+		{"undefined event", `{"url": "https://example.com/hook", "events": ["link.clicked"]}`, http.StatusBadRequest},
+		{"invalid url", `{"url": "example.com/hook"}`, http.StatusBadRequest},
+		{"unsupported scheme", `{"url": "ftp://example.com/hook"}`, http.StatusBadRequest},
+		{"loopback", `{"url": "http://127.0.0.1:8080/hook"}`, http.StatusBadRequest},
+		{"cloud metadata", `{"url": "http://169.254.169.254/latest/meta-data"}`, http.StatusBadRequest},
+		{"localhost", `{"url": "http://localhost/hook"}`, http.StatusBadRequest},
+		{"invalid json", `{"url": `, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &webhookDB{}
+			w := WebhookController{DB: db, Log: logger}
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", strings.NewReader(tt.body))
+			w.Register(c)
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+			if r.Code != http.StatusCreated {
+				assert.Empty(t, db.webhooks)
+				return
+			}
+
+			var got webhookResp
+			assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+			assert.Equal(t, uint(1), got.Id)
+			assert.NotEmpty(t, got.Secret)
+			assert.Equal(t, db.webhooks[0].Secret, got.Secret)
+			assert.NotEmpty(t, got.Events)
+		})
+	}
+}
+
+func TestWebhookController_List_hides_secret(t *testing.T) {
+	db := &webhookDB{webhooks: []*models.Webhook{{Id: 1, Url: "https://example.com", Secret: "s3cr3t", Events: notifier.EventDeleted}}}
+	w := WebhookController{DB: db, Log: zap.NewNop()}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/webhooks", nil)
+	w.List(c)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.NotContains(t, r.Body.String(), "s3cr3t")
+	var got struct {
+		Webhooks []webhookResp `json:"webhooks"`
+	}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Equal(t, []string{notifier.EventDeleted}, got.Webhooks[0].Events)
+}
+
+func TestWebhookController_Delete(t *testing.T) {
+	tests := []struct {
+		name               string
+		id                 string
+		expectedStatusCode int
+	}{
+		{"deleted", "1", http.StatusNoContent},
+		{"not found", "2", http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &webhookDB{webhooks: []*models.Webhook{{Id: 1}}}
+			w := WebhookController{DB: db, Log: zap.NewNop()}
+			r := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(r)
+			c.Request = httptest.NewRequest(http.MethodDelete, "/", nil)
+			c.Params = []gin.Param{{Key: "webhook_id", Value: tt.id}}
+			w.Delete(c)
+			assert.Equal(t, tt.expectedStatusCode, r.Code)
+		})
+	}
+}
+
+func TestWebhookController_Deliveries(t *testing.T) {
+	now := time.Now()
+	db := &webhookDB{deliveries: []*models.WebhookDelivery{
+		{Id: 2, Event: notifier.EventExpired, UrlId: "aaaaaa", Status: models.DeliveryPending, Attempts: 1, ResponseCode: 502, NextAttemptAt: now},
+		{Id: 1, Event: notifier.EventDeleted, UrlId: "bbbbbb", Status: models.DeliveryDelivered, Attempts: 1, ResponseCode: 200, DeliveredAt: &now},
+	}}
+	w := WebhookController{DB: db, Log: zap.NewNop()}
+
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/?limit=10", nil)
+	c.Params = []gin.Param{{Key: "webhook_id", Value: "1"}}
+	w.Deliveries(c)
+	assert.Equal(t, http.StatusOK, r.Code)
+	var got struct {
+		Deliveries []deliveryResp `json:"deliveries"`
+	}
+	assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &got))
+	assert.Len(t, got.Deliveries, 2)
+	assert.NotNil(t, got.Deliveries[0].NextAttemptAt)
+	assert.Nil(t, got.Deliveries[1].NextAttemptAt)
+
+	r = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodGet, "/?limit=0", nil)
+	c.Params = []gin.Param{{Key: "webhook_id", Value: "1"}}
+	w.Deliveries(c)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+}
+
+type fakeNotifier struct {
+	deleted []string
+}
+
+func (f *fakeNotifier) Deleted(ctx context.Context, id string) error {
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+func (f *fakeNotifier) Close() {}
+
+func TestUrlController_Delete_notifies(t *testing.T) {
+	gormDB, mock := getMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "urls" SET "deleted_at"=$1 WHERE (domain = $2 AND id = $3) AND "urls"."deleted_at" IS NULL`)).
+		WithArgs(anyExpireTime{}, "", "okokok").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	notifier := &fakeNotifier{}
+	u := UrlController{DB: gormDB, Log: zap.NewNop(), Notifier: notifier}
+	r := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(r)
+	c.Request = httptest.NewRequest(http.MethodDelete, "/", nil)
+	c.Params = []gin.Param{{Key: "url_id", Value: "okokok"}}
+	u.Delete(c)
+
+	assert.Equal(t, http.StatusNoContent, r.Code)
+	assert.Equal(t, []string{"okokok"}, notifier.deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,47 @@
+// Package events relays the link lifecycle events written in the outbox to
+// the pluggable sinks, i.e. NDJSON file, stdout, Redis Streams or HTTP.
+package events
+
+import (
+	"context"
+	"goshorturl/models"
+	"time"
+)
+
+// Event is published as a JSON object, the types are models.EventLink*.
+type Event struct {
+	// Seq increases with the order of the changes, consumers are able to
+	// deduplicate the events relayed more than once by it.
+	Seq  uint64 `json:"seq"`
+	Type string `json:"type"`
+	// Domain is empty for the links of the default domain.
+	Domain    string     `json:"domain,omitempty"`
+	Id        string     `json:"id"`
+	Url       string     `json:"url,omitempty"`
+	ExpiredAt *time.Time `json:"expiredAt,omitempty"`
+	// Clicks is the number of redirects since the last redirected event of
+	// the link, the redirects are aggregated per flush of the click tracker.
+	Clicks     int64     `json:"clicks,omitempty"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+func fromOutbox(e *models.OutboxEvent) Event {
+	return Event{
+		Seq:        e.Seq,
+		Type:       e.Type,
+		Domain:     e.Domain,
+		Id:         e.UrlId,
+		Url:        e.Url,
+		ExpiredAt:  e.ExpiredAt,
+		Clicks:     e.Clicks,
+		OccurredAt: e.CreatedAt,
+	}
+}
+
+// Publisher is implemented by the sinks.
+type Publisher interface {
+	// Publish publishes the events in order, the events are relayed again
+	// if it fails.
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
@@ -0,0 +1,169 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rShetty/asyncwait"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var testEvents = []Event{
+	{Seq: 1, Type: models.EventLinkCreated, Id: "aaaaaa", Url: "https://example.com"},
+	{Seq: 2, Type: models.EventLinkRedirected, Id: "aaaaaa", Clicks: 3},
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	for i := 0; i < 2; i++ {
+		// reopening appends to the file
+		sink, err := NewFile(path)
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Publish(context.Background(), testEvents))
+		assert.NoError(t, sink.Close())
+	}
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var got []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		got = append(got, e)
+	}
+	assert.Equal(t, append(testEvents, testEvents...), got)
+}
+
+func TestHTTP(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink := NewHTTP(srv.URL, time.Second)
+	defer sink.Close()
+	assert.NoError(t, sink.Publish(context.Background(), testEvents))
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"type":"link.redirected"`)
+
+	status = http.StatusServiceUnavailable
+	assert.Error(t, sink.Publish(context.Background(), testEvents))
+}
+
+type fakeConn struct {
+	sent [][]interface{}
+}
+
+func (f *fakeConn) Close() error { return nil }
+func (f *fakeConn) Err() error   { return nil }
+func (f *fakeConn) Flush() error { return nil }
+func (f *fakeConn) Receive() (interface{}, error) {
+	return nil, nil
+}
+func (f *fakeConn) Send(cmd string, args ...interface{}) error {
+	f.sent = append(f.sent, append([]interface{}{cmd}, args...))
+	return nil
+}
+func (f *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, f.Send(cmd, args...)
+}
+
+func TestXadd(t *testing.T) {
+	conn := &fakeConn{}
+	assert.NoError(t, xadd(conn, "stream", 100, testEvents))
+	assert.Len(t, conn.sent, 4)
+	assert.Equal(t, "MULTI", conn.sent[0][0])
+	assert.Equal(t, []interface{}{"XADD", "stream", "MAXLEN", "~", int64(100), "*", "event"}, conn.sent[1][:7])
+	var e Event
+	assert.NoError(t, json.Unmarshal(conn.sent[2][7].([]byte), &e))
+	assert.Equal(t, testEvents[1], e)
+	assert.Equal(t, "EXEC", conn.sent[3][0])
+}
+
+type outboxDB struct {
+	repository.UnimplementedRepository
+	mu     sync.Mutex
+	outbox []*models.OutboxEvent
+}
+
+func (o *outboxDB) RelayOutbox(ctx context.Context, limit int, relay func(events []*models.OutboxEvent) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := len(o.outbox)
+	if n > limit {
+		n = limit
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := relay(o.outbox[:n]); err != nil {
+		return 0, err
+	}
+	o.outbox = o.outbox[n:]
+	return n, nil
+}
+
+func (o *outboxDB) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.outbox)
+}
+
+func TestRelay(t *testing.T) {
+	db := &outboxDB{}
+	for i := 1; i <= 5; i++ {
+		db.outbox = append(db.outbox, &models.OutboxEvent{Seq: uint64(i), Type: models.EventLinkCreated, UrlId: "aaaaaa"})
+	}
+	sink := NewMemory()
+	sink.Fail(errors.New("sink down"))
+	r := NewRelay(db, sink, zap.NewNop(), Config{Interval: 10 * time.Millisecond, BatchSize: 2})
+	defer r.Close()
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 5, db.len(), "the events are kept until published")
+
+	sink.Fail(nil)
+	relayed := asyncwait.NewAsyncWait(2000, 10).Check(func() bool {
+		return db.len() == 0
+	})
+	assert.True(t, relayed)
+	published := sink.Events()
+	assert.Len(t, published, 5)
+	for i, e := range published {
+		assert.Equal(t, uint64(i+1), e.Seq, "published in order")
+	}
+}
+
+func TestRelay_Close_drains(t *testing.T) {
+	db := &outboxDB{outbox: []*models.OutboxEvent{{Seq: 1, Type: models.EventLinkDeleted, UrlId: "aaaaaa"}}}
+	sink := NewMemory()
+	r := NewRelay(db, sink, zap.NewNop(), Config{Interval: time.Hour})
+	r.Close()
+	assert.Equal(t, []Event{{Seq: 1, Type: models.EventLinkDeleted, Id: "aaaaaa"}}, sink.Events())
+}
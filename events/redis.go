@@ -0,0 +1,90 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	defaultStream       = "goshorturl:events"
+	defaultStreamMaxLen = 1000000
+)
+
+type RedisConfig struct {
+	// Addr is host:port of the Redis server.
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// Stream is the key of the stream, each event is an entry whose "event"
+	// field is the JSON.
+	Stream string
+	// MaxLen trims the stream approximately, zero means the default.
+	MaxLen int64
+}
+
+type redisSink struct {
+	pool   *redigo.Pool
+	stream string
+	maxLen int64
+}
+
+// NewRedisStream appends the events to a Redis stream by XADD.
+func NewRedisStream(config RedisConfig) Publisher {
+	if config.Stream == "" {
+		config.Stream = defaultStream
+	}
+	if config.MaxLen <= 0 {
+		config.MaxLen = defaultStreamMaxLen
+	}
+	pool := &redigo.Pool{
+		MaxIdle:     2,
+		IdleTimeout: time.Minute,
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", config.Addr,
+				redigo.DialUsername(config.Username),
+				redigo.DialPassword(config.Password),
+				redigo.DialDatabase(config.DB),
+				redigo.DialConnectTimeout(5*time.Second),
+				redigo.DialReadTimeout(5*time.Second),
+				redigo.DialWriteTimeout(5*time.Second),
+			)
+		},
+	}
+	return &redisSink{pool: pool, stream: config.Stream, maxLen: config.MaxLen}
+}
+
+func (s *redisSink) Publish(ctx context.Context, events []Event) error {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return xadd(conn, s.stream, s.maxLen, events)
+}
+
+// xadd pipelines the XADDs in a MULTI, so that a batch is appended entirely
+// or not at all.
+func xadd(conn redigo.Conn, stream string, maxLen int64, events []Event) error {
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := conn.Send("XADD", stream, "MAXLEN", "~", maxLen, "*", "event", data); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *redisSink) Close() error {
+	return s.pool.Close()
+}
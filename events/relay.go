@@ -0,0 +1,109 @@
+package events
+
+import (
+	"context"
+	"expvar"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInterval  = time.Second
+	defaultBatchSize = 100
+	relayTimeout     = 30 * time.Second
+)
+
+var metrics = expvar.NewMap("events")
+
+type Config struct {
+	// Interval is how often to look for the new events in the outbox.
+	Interval  time.Duration
+	BatchSize int
+}
+
+// Relay moves the events from the outbox to the publisher in background,
+// every event is published at least once.
+type Relay interface {
+	// Close stops relaying after relaying the remaining events.
+	Close()
+}
+
+func NewRelay(db repository.Repository, publisher Publisher, logger *zap.Logger, config Config) Relay {
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	r := &relay{
+		db:        db,
+		publisher: publisher,
+		logger:    logger,
+		config:    config,
+		done:      make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.loop()
+	return r
+}
+
+type relay struct {
+	db        repository.Repository
+	publisher Publisher
+	logger    *zap.Logger
+	config    Config
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (r *relay) Close() {
+	close(r.done)
+	r.wg.Wait()
+	if err := r.publisher.Close(); err != nil {
+		r.logger.Warn("close event publisher error", zap.Error(err))
+	}
+}
+
+func (r *relay) loop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			r.drain()
+			return
+		case <-ticker.C:
+			r.drain()
+		}
+	}
+}
+
+// drain relays batch by batch until the outbox is empty or relaying fails.
+func (r *relay) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+	for {
+		n, err := r.db.RelayOutbox(ctx, r.config.BatchSize, func(outbox []*models.OutboxEvent) error {
+			events := make([]Event, 0, len(outbox))
+			for _, e := range outbox {
+				events = append(events, fromOutbox(e))
+			}
+			return r.publisher.Publish(ctx, events)
+		})
+		if err != nil {
+			metrics.Add("failed", 1)
+			r.logger.Error("relay events error", zap.Error(err))
+			return
+		}
+		metrics.Add("published", int64(n))
+		if n < r.config.BatchSize {
+			return
+		}
+	}
+}
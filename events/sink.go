@@ -0,0 +1,155 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultHTTPTimeout = 5 * time.Second
+
+// writeNDJSON writes the events as newline-delimited JSON.
+func writeNDJSON(w io.Writer, events []Event) error {
+	encoder := json.NewEncoder(w)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type writerSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	sync   func() error
+}
+
+// NewStdout publishes the events to stdout as NDJSON.
+func NewStdout() Publisher {
+	return &writerSink{w: os.Stdout}
+}
+
+// NewFile appends the events to the file as NDJSON, the file is synced after
+// each batch.
+func NewFile(path string) (Publisher, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f, closer: f, sync: f.Sync}, nil
+}
+
+func (s *writerSink) Publish(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// write a batch at once, so that a failure never leaves a partial line
+	buf := bufio.NewWriter(s.w)
+	if err := writeNDJSON(buf, events); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if s.sync != nil {
+		return s.sync()
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP POSTs each batch of events to url as NDJSON, any non-2xx response
+// fails the batch.
+func NewHTTP(url string, timeout time.Duration) Publisher {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	return &httpSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *httpSink) Publish(ctx context.Context, events []Event) error {
+	var body bytes.Buffer
+	if err := writeNDJSON(&body, events); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Memory keeps the published events in memory, it stands in for the real
+// sinks in tests.
+type Memory struct {
+	mu     sync.Mutex
+	events []Event
+	err    error
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Publish(ctx context.Context, events []Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Events returns a copy of the published events.
+func (m *Memory) Events() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event{}, m.events...)
+}
+
+// Fail makes the following publishing fail with err, nil recovers it.
+func (m *Memory) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
@@ -0,0 +1,152 @@
+// Package health runs the pluggable checks of dependencies for readiness.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTimeout = 2 * time.Second
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusFailing  = "failing"
+	StatusDraining = "draining"
+)
+
+// CheckFunc checks a dependency, detail is optional and reported as is.
+type CheckFunc func(ctx context.Context) (detail interface{}, err error)
+
+// Result is the result of a check.
+type Result struct {
+	Status   string      `json:"status"`
+	Critical bool        `json:"critical"`
+	Latency  string      `json:"latency"`
+	Error    string      `json:"error,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+// Report is the breakdown of all checks.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Ready reports whether the service should receive traffic.
+func (r Report) Ready() bool {
+	return r.Status == StatusOK || r.Status == StatusDegraded
+}
+
+type check struct {
+	name     string
+	critical bool
+	run      CheckFunc
+}
+
+// Registry holds the checks, it is goroutine-safe.
+type Registry struct {
+	timeout  time.Duration
+	draining int32
+
+	mu     sync.RWMutex
+	checks []check
+}
+
+// NewRegistry returns a registry whose checks time out after timeout.
+func NewRegistry(timeout time.Duration) *Registry {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Registry{timeout: timeout}
+}
+
+// Register adds a check. A failing critical check fails the readiness, the
+// others only degrade it.
+func (r *Registry) Register(name string, critical bool, run CheckFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, check{name, critical, run})
+	sort.Slice(r.checks, func(i, j int) bool { return r.checks[i].name < r.checks[j].name })
+}
+
+// Drain makes the readiness fail, so that the load balancer stops routing
+// new requests before shutting down.
+func (r *Registry) Drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+func (r *Registry) Draining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+// Run runs all checks concurrently.
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := append([]check{}, r.checks...)
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.run(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for i, c := range checks {
+		result := results[i]
+		report.Checks[c.name] = result
+		if result.Status == StatusOK {
+			continue
+		}
+		if c.critical {
+			report.Status = StatusFailing
+		} else if report.Status == StatusOK {
+			report.Status = StatusDegraded
+		}
+	}
+	if r.Draining() {
+		report.Status = StatusDraining
+	}
+	return report
+}
+
+func (r *Registry) run(ctx context.Context, c check) Result {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	type outcome struct {
+		detail interface{}
+		err    error
+	}
+	// the check may ignore ctx, e.g. a Redis PING bounded by its own timeouts
+	done := make(chan outcome, 1)
+	start := time.Now()
+	go func() {
+		detail, err := c.run(ctx)
+		done <- outcome{detail, err}
+	}()
+
+	result := Result{Status: StatusOK, Critical: c.critical}
+	select {
+	case o := <-done:
+		result.Detail = o.detail
+		if o.err != nil {
+			result.Status = StatusFailing
+			result.Error = o.err.Error()
+		}
+	case <-ctx.Done():
+		result.Status = StatusFailing
+		result.Error = ctx.Err().Error()
+	}
+	result.Latency = time.Since(start).String()
+	return result
+}
@@ -0,0 +1,78 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ok(ctx context.Context) (interface{}, error) { return "fine", nil }
+
+func fail(ctx context.Context) (interface{}, error) { return nil, errors.New("unreachable") }
+
+func hang(ctx context.Context) (interface{}, error) {
+	time.Sleep(time.Second)
+	return nil, nil
+}
+
+func TestRegistry_Run(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(r *Registry)
+		status string
+		ready  bool
+	}{
+		{"no checks", func(r *Registry) {}, StatusOK, true},
+		{"all ok", func(r *Registry) {
+			r.Register("database", true, ok)
+			r.Register("cache", false, ok)
+		}, StatusOK, true},
+		{"non-critical failing", func(r *Registry) {
+			r.Register("database", true, ok)
+			r.Register("cache", false, fail)
+		}, StatusDegraded, true},
+		{"critical failing", func(r *Registry) {
+			r.Register("database", true, fail)
+			r.Register("cache", false, fail)
+		}, StatusFailing, false},
+		{"critical timeout", func(r *Registry) {
+			r.Register("database", true, hang)
+		}, StatusFailing, false},
+		{"draining", func(r *Registry) {
+			r.Register("database", true, ok)
+			r.Drain()
+		}, StatusDraining, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(20 * time.Millisecond)
+			tt.setup(r)
+			report := r.Run(context.Background())
+			assert.Equal(t, tt.status, report.Status)
+			assert.Equal(t, tt.ready, report.Ready())
+		})
+	}
+}
+
+func TestRegistry_Run_breakdown(t *testing.T) {
+	r := NewRegistry(20 * time.Millisecond)
+	r.Register("database", true, ok)
+	r.Register("cache", false, fail)
+	r.Register("slow", false, hang)
+
+	start := time.Now()
+	report := r.Run(context.Background())
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "checks run concurrently with timeout")
+
+	assert.Equal(t, Result{Status: StatusOK, Critical: true, Detail: "fine"}, withoutLatency(report.Checks["database"]))
+	assert.Equal(t, Result{Status: StatusFailing, Error: "unreachable"}, withoutLatency(report.Checks["cache"]))
+	assert.Equal(t, Result{Status: StatusFailing, Error: context.DeadlineExceeded.Error()}, withoutLatency(report.Checks["slow"]))
+}
+
+func withoutLatency(r Result) Result {
+	r.Latency = ""
+	return r
+}
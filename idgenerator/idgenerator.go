@@ -5,9 +5,11 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"goshorturl/models"
 	"goshorturl/pkg/concurrentstack"
 	"goshorturl/repository"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,6 +22,15 @@ const (
 	encodedChars     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 	selectAll        = -1
 	doRecycleTimeout = 30 * time.Second
+
+	exclusiveRetryInterval = 100 * time.Millisecond
+)
+
+// states of idGenerator.doRecycling
+const (
+	idle int32 = iota
+	recycling
+	exclusive
 )
 
 type empty struct{}
@@ -66,69 +77,145 @@ func Validate(id string) error {
 }
 
 type IDGenerator interface {
-	Get(ctx context.Context, url string, expiredAt time.Time) (string, error)
+	// Get stores link with a recycled or new id on link.Domain, which is
+	// set to link.Id and returned.
+	Get(ctx context.Context, link *models.Url) (string, error)
+	// Pool returns the status of the recycled id pools.
+	Pool() PoolStatus
+	// Exclusive runs f while the recycling is not in progress, and the
+	// recycling is not able to start until f returns. pooled is a snapshot
+	// of the keys of the recycled ids waiting in the pools, see
+	// models.Key().
+	Exclusive(ctx context.Context, f func(pooled map[string]bool) error) error
+}
+
+// PoolStatus is reported through the readiness endpoint.
+type PoolStatus struct {
+	Available int  `json:"available"`
+	Recycling bool `json:"recycling"`
 }
 
 func New(db repository.Repository, logger *zap.Logger) IDGenerator {
 	return &idGenerator{
 		db:     db,
 		logger: logger,
-		ids:    concurrentstack.New(),
+		pools:  make(map[string]concurrentstack.Stack),
 	}
 }
 
 type idGenerator struct {
-	db          repository.Repository
-	logger      *zap.Logger
-	ids         concurrentstack.Stack
+	db     repository.Repository
+	logger *zap.Logger
+	// pools are the recycled ids of each domain, an id is only recycled on
+	// its own domain.
+	mu          sync.Mutex
+	pools       map[string]concurrentstack.Stack
 	doRecycling int32
 }
 
-func (i *idGenerator) Get(ctx context.Context, url string, expiredAt time.Time) (string, error) {
-	id, err := i.ids.Pop()
+// pool returns the recycled ids of domain.
+func (i *idGenerator) pool(domain string) concurrentstack.Stack {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	ids, ok := i.pools[domain]
+	if !ok {
+		ids = concurrentstack.New()
+		i.pools[domain] = ids
+	}
+	return ids
+}
+
+func (i *idGenerator) Get(ctx context.Context, link *models.Url) (string, error) {
+	ids := i.pool(link.Domain)
+	id, err := ids.Pop()
 	if err != concurrentstack.ErrEmpty {
-		i.logger.Debug("get id from pool", zap.String("id", id))
-		err := i.db.Update(ctx, id, url, expiredAt)
-		if err != nil {
+		i.logger.Debug("get id from pool", zap.String("domain", link.Domain), zap.String("id", id))
+		link.Id = id
+		err := i.db.Update(ctx, link)
+		if err == nil {
+			return id, nil
+		}
+		if err != repository.ErrRecordNotFound {
 			i.logger.Error("refresh id with new meta error", zap.Error(err))
-			i.ids.Push(id)
+			ids.Push(id)
 			return "", err
 		}
-		return id, nil
+		// the record has been purged, e.g. by another replica, so drop the
+		// id and create a new one
+		i.logger.Warn("drop purged id from pool", zap.String("id", id))
 	}
 
 	// try to trigger background recycling process
 	i.recycleID(ctx)
 
 	// create a new id
-	id = generate(url)
-	if err := i.db.Create(ctx, id, url, expiredAt); err != nil {
+	link.Id = generate(link.Url)
+	if err := i.db.Create(ctx, link); err != nil {
 		i.logger.Error("create new record error", zap.Error(err))
 		return "", err
 	}
-	return id, nil
+	return link.Id, nil
+}
+
+func (i *idGenerator) Pool() PoolStatus {
+	i.mu.Lock()
+	available := 0
+	for _, ids := range i.pools {
+		available += ids.Len()
+	}
+	i.mu.Unlock()
+	return PoolStatus{
+		Available: available,
+		Recycling: atomic.LoadInt32(&i.doRecycling) == recycling,
+	}
+}
+
+func (i *idGenerator) Exclusive(ctx context.Context, f func(pooled map[string]bool) error) error {
+	for !atomic.CompareAndSwapInt32(&i.doRecycling, idle, exclusive) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(exclusiveRetryInterval):
+		}
+	}
+	defer atomic.StoreInt32(&i.doRecycling, idle)
+
+	pooled := make(map[string]bool)
+	i.mu.Lock()
+	for domain, ids := range i.pools {
+		for _, id := range ids.Snapshot() {
+			pooled[models.Key(domain, id)] = true
+		}
+	}
+	i.mu.Unlock()
+	return f(pooled)
 }
 
 // RecycleID will guarantee only one goroutine can trigger background recycling process
 func (i *idGenerator) recycleID(ctx context.Context) {
-	if atomic.CompareAndSwapInt32(&i.doRecycling, 0, 1) {
+	if atomic.CompareAndSwapInt32(&i.doRecycling, idle, recycling) {
 		go func() {
 			i.logger.Debug("trigger recycling process")
 
 			ctxWithDealine, cancel := context.WithTimeout(ctx, doRecycleTimeout)
 			defer cancel()
 
-			ids, err := i.db.SelectDeletedAndExpired(ctxWithDealine, selectAll)
+			keys, err := i.db.SelectDeletedAndExpired(ctxWithDealine, selectAll)
 			if err != nil && err != repository.ErrRecordNotFound {
 				i.logger.Error("recycle deleted ids error", zap.Error(err))
-				i.doRecycling = 0
+				atomic.StoreInt32(&i.doRecycling, idle)
 				return
 			}
-			i.logger.Debug("recycled ids", zap.Int("count", len(ids)), zap.String("ids", strings.Join(ids, " | ")))
-			if len(ids) > 0 {
-				i.ids.BatchPush(ids)
+			i.logger.Debug("recycled ids", zap.Int("count", len(keys)), zap.String("keys", strings.Join(keys, " | ")))
+			domains := make(map[string][]string)
+			for _, key := range keys {
+				domain, id := models.SplitKey(key)
+				domains[domain] = append(domains[domain], id)
+			}
+			for domain, ids := range domains {
+				i.pool(domain).BatchPush(ids)
 			}
-			i.doRecycling = 0
+			atomic.StoreInt32(&i.doRecycling, idle)
 		}()
 	}
 }
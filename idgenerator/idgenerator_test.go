@@ -2,6 +2,7 @@ package idgenerator
 
 import (
 	"context"
+	"goshorturl/models"
 	"goshorturl/pkg/concurrentstack"
 	"goshorturl/repository"
 	"strings"
@@ -20,20 +21,21 @@ type dbRecorder struct {
 	createCount int
 	updateCount int
 	selectCount int
+	updateErr   error
 }
 
-func (d *dbRecorder) Create(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (d *dbRecorder) Create(ctx context.Context, link *models.Url) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.createCount++
 	return nil
 }
 
-func (d *dbRecorder) Update(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (d *dbRecorder) Update(ctx context.Context, link *models.Url) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.updateCount++
-	return nil
+	return d.updateErr
 }
 
 func (d *dbRecorder) SelectDeletedAndExpired(ctx context.Context, limit int) ([]string, error) {
@@ -51,7 +53,7 @@ func TestIDGenerator_Get(t *testing.T) {
 		db := &dbRecorder{wg: &wg}
 		idgenerator := New(db, zap.NewNop())
 
-		id, err := idgenerator.Get(context.Background(), "http://example.com", time.Now())
+		id, err := idgenerator.Get(context.Background(), &models.Url{Url: "http://example.com"})
 		assert.NoError(t, err)
 		assert.NotEmpty(t, id)
 		assert.Equal(t, 1, db.createCount)
@@ -70,10 +72,10 @@ func TestIDGenerator_Get(t *testing.T) {
 		idgenerator := &idGenerator{
 			db:     db,
 			logger: zap.NewNop(),
-			ids:    stack,
+			pools:  map[string]concurrentstack.Stack{"": stack},
 		}
 
-		id, err := idgenerator.Get(context.Background(), "http://example.com", time.Now())
+		id, err := idgenerator.Get(context.Background(), &models.Url{Url: "http://example.com"})
 		assert.NoError(t, err)
 		assert.Equal(t, expected, id)
 		assert.Equal(t, 0, db.createCount)
@@ -84,9 +86,60 @@ func TestIDGenerator_Get(t *testing.T) {
 	})
 }
 
+func TestIDGenerator_Get_purged_id(t *testing.T) {
+	stack := concurrentstack.New()
+	stack.Push("qwerty")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	db := &dbRecorder{wg: &wg, updateErr: repository.ErrRecordNotFound}
+	idgenerator := &idGenerator{
+		db:     db,
+		logger: zap.NewNop(),
+		pools:  map[string]concurrentstack.Stack{"": stack},
+	}
+
+	id, err := idgenerator.Get(context.Background(), &models.Url{Url: "http://example.com"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "qwerty", id)
+	assert.Equal(t, 1, db.updateCount)
+	assert.Equal(t, 1, db.createCount)
+	wg.Wait()
+	assert.Equal(t, 0, stack.Len(), "purged id is dropped")
+}
+
+func TestIDGenerator_Exclusive(t *testing.T) {
+	stack := concurrentstack.New()
+	stack.BatchPush([]string{"aaaaaa", "bbbbbb"})
+	idgenerator := &idGenerator{
+		db:     &dbRecorder{},
+		logger: zap.NewNop(),
+		pools:  map[string]concurrentstack.Stack{"": stack},
+	}
+
+	err := idgenerator.Exclusive(context.Background(), func(pooled map[string]bool) error {
+		assert.Equal(t, map[string]bool{"aaaaaa": true, "bbbbbb": true}, pooled)
+		assert.False(t, idgenerator.Pool().Recycling)
+		// recycling is not able to start meanwhile
+		idgenerator.recycleID(context.Background())
+		return nil
+	})
+	assert.NoError(t, err)
+
+	t.Run("wait for recycling", func(t *testing.T) {
+		idgenerator.doRecycling = recycling
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := idgenerator.Exclusive(ctx, func(pooled map[string]bool) error {
+			t.Error("should not run while recycling")
+			return nil
+		})
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
+
 func TestValidate(t *testing.T) {
 	idgenerator := New(&repository.UnimplementedRepository{}, zap.NewNop())
-	generatedID, err := idgenerator.Get(context.Background(), "http://example.com", time.Now().Add(time.Hour))
+	generatedID, err := idgenerator.Get(context.Background(), &models.Url{Url: "http://example.com"})
 	assert.NoError(t, err)
 
 	tests := []struct {
@@ -4,15 +4,29 @@ import (
 	"context"
 	"fmt"
 	"goshorturl/cache"
+	"goshorturl/cache/breaker"
+	"goshorturl/cache/cacher"
+	"goshorturl/cache/inmemory"
+	"goshorturl/cache/redis"
 	"goshorturl/config"
+	"goshorturl/events"
+	"goshorturl/health"
 	"goshorturl/idgenerator"
 	"goshorturl/logger"
+	"goshorturl/notifier"
+	"goshorturl/purger"
 	"goshorturl/repository"
+	"goshorturl/reputation"
 	"goshorturl/server"
+	"goshorturl/targeting"
+	"goshorturl/tracker"
+	"goshorturl/urlpolicy"
+	"goshorturl/warmup"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -38,24 +52,218 @@ func main() {
 		log.Fatalf("failed to process env: %s", err)
 	}
 
-	db, err = repository.NewPG(env.DBPort, env.DBHost, env.DBUser, env.DBName, env.DBPassword)
+	var dbOptions []repository.Option
+	publisher := newPublisher(env)
+	if publisher != nil {
+		dbOptions = append(dbOptions, repository.WithOutbox())
+	}
+	db, err = repository.NewPG(env.DBPort, env.DBHost, env.DBUser, env.DBName, env.DBPassword, dbOptions...)
 	if err != nil {
 		log.Fatalf("failed to connect db: %s", err)
 	}
+	if publisher != nil {
+		relay := events.NewRelay(db, publisher, zaplogger, events.Config{
+			Interval:  env.EventRelayInterval,
+			BatchSize: env.EventBatchSize,
+		})
+		defer relay.Close()
+		zaplogger.Debug("publish events", zap.String("sink", env.EventSink))
+	}
 
 	cacheOption := cache.UseInMemoryCache()
-	if env.CacheMode == config.Redis {
-		cacheOption = cache.UseRedis(env.CacheHost, env.CachePort)
+	switch env.CacheMode {
+	case config.InMemory:
+		if env.CacheMaxEntries > 0 || env.CacheMaxBytes > 0 {
+			cacheOption = cache.UseBoundedInMemoryCache(inmemory.Config{
+				MaxEntries: env.CacheMaxEntries,
+				MaxBytes:   env.CacheMaxBytes,
+				Policy:     env.CacheEviction,
+			})
+			zaplogger.Debug("use UseBoundedInMemoryCache", zap.Int("maxEntries", env.CacheMaxEntries),
+				zap.Int64("maxBytes", env.CacheMaxBytes), zap.String("policy", env.CacheEviction))
+		}
+	case config.Redis:
+		cacheOption = cache.UseEngine(newRedis(env))
 		zaplogger.Debug("use UseRedis", zap.String("host", env.CacheHost), zap.Int("post", env.CachePort))
+	case config.Tiered:
+		cacheOption = cache.UseTiered(
+			cache.UseBoundedInMemoryCache(inmemory.Config{
+				MaxEntries: env.CacheLocalSize,
+				MaxBytes:   env.CacheMaxBytes,
+				Policy:     env.CacheEviction,
+			}),
+			cache.UseEngine(newRedis(env)),
+			env.CacheLocalTTL,
+		)
+		zaplogger.Debug("use UseTiered", zap.String("host", env.CacheHost), zap.Int("post", env.CachePort),
+			zap.Int("localSize", env.CacheLocalSize), zap.Duration("localTTL", env.CacheLocalTTL))
 	}
-	cache := cache.New(db, zaplogger, cacheOption)
+	cacheTTL := cache.UseTTL(cache.TTL{
+		Valid: env.CacheValidTTL,
+		Empty: env.CacheEmptyTTL,
+		Stale: env.CacheStaleTTL,
+		Beta:  env.CacheXFetchBeta,
+	})
+	cacheBreaker := breaker.New(breaker.Config{
+		Threshold:   env.CacheBreakerThreshold,
+		OpenTimeout: env.CacheBreakerOpenTimeout,
+		Probes:      env.CacheBreakerProbes,
+		Name:        "cache",
+	}, zaplogger)
+	checks := health.NewRegistry(env.HealthCheckTimeout)
+	checks.Register("database", true, func(ctx context.Context) (interface{}, error) {
+		return nil, db.Ping(ctx)
+	})
+	cache := cache.New(db, zaplogger, cacheOption, cacheTTL,
+		cache.UseCircuitBreaker(cacheBreaker),
+		cache.UseDBConcurrencyLimit(env.DBMaxConcurrency, env.DBQueueTimeout),
+		cache.UseHealthChecks(checks))
 	idGenerator := idgenerator.New(cache, zaplogger)
+	checks.Register("idpool", false, func(ctx context.Context) (interface{}, error) {
+		return idGenerator.Pool(), nil
+	})
 
-	r := server.NewRouter(cache, idGenerator, zaplogger, env.RedirectOrigin)
-	run(r, fmt.Sprintf(":%d", env.AppPort))
+	clicks := tracker.New(db, zaplogger, env.ClickFlushInterval)
+	defer clicks.Close()
+	routerOptions := []server.Option{
+		server.WithTracker(clicks),
+		server.WithBreaker(cacheBreaker),
+		server.WithHealthChecks(checks),
+		server.WithMaxLifetime(env.LinkMaxLifetime),
+		server.WithPasswordThrottle(env.PasswordMaxAttempts, env.PasswordLinkMaxAttempts, env.PasswordLockout),
+		server.WithTrustedProxies(env.TrustedProxies),
+		server.WithDomains(env.RedirectOrigins),
+		server.WithAdminToken(env.AdminToken),
+	}
+	if env.GeoIPFile != "" {
+		geoIP, err := targeting.LoadCSV(env.GeoIPFile)
+		if err != nil {
+			log.Fatalf("failed to load geoip file: %s", err)
+		}
+		routerOptions = append(routerOptions, server.WithGeoIP(geoIP))
+	}
+	policy, err := urlpolicy.New(cache.Get, zaplogger, urlpolicy.Config{
+		Schemes:        env.URLAllowedSchemes,
+		AllowPrivate:   env.URLAllowPrivate,
+		Resolve:        env.URLResolveHosts,
+		Self:           append([]string{env.RedirectOrigin}, env.RedirectOrigins...),
+		MaxHops:        env.URLMaxHops,
+		ListFile:       env.URLPolicyFile,
+		ReloadInterval: env.URLPolicyReloadInterval,
+	})
+	if err != nil {
+		log.Fatalf("failed to load url policy: %s", err)
+	}
+	defer policy.Close()
+	routerOptions = append(routerOptions, server.WithURLPolicy(policy))
+	if env.ReputationFile != "" {
+		blocklist, err := reputation.NewBlocklist(env.ReputationFile, env.ReputationReloadInterval, zaplogger)
+		if err != nil {
+			log.Fatalf("failed to load reputation file: %s", err)
+		}
+		defer blocklist.Close()
+		// scan through the cache, so that the flagged links are evicted
+		scanner := reputation.NewScanner(cache, blocklist, zaplogger, reputation.ScanConfig{
+			Interval:  env.ReputationScanInterval,
+			BatchSize: env.ReputationScanBatchSize,
+		})
+		defer scanner.Close()
+		routerOptions = append(routerOptions, server.WithReputation(blocklist))
+	}
+	if env.PreviewUntrusted {
+		var trusted []string
+		for _, domain := range env.PreviewTrustedDomains {
+			trusted = append(trusted, strings.ToLower(strings.TrimPrefix(domain, "*.")))
+		}
+		routerOptions = append(routerOptions, server.WithUntrustedPreview(trusted))
+	}
+	if env.WarmUpSize > 0 {
+		warmUpConfig := warmup.Config{
+			Size:    env.WarmUpSize,
+			OrderBy: env.WarmUpOrderBy,
+			Rate:    env.WarmUpRate,
+		}
+		if env.CacheMode != config.InMemory {
+			// the in-memory cache is never flushed by others
+			warmUpConfig.WatchInterval = env.WarmUpWatchInterval
+		}
+		warmer := warmup.New(db, cache.(warmup.Primer), zaplogger, warmUpConfig)
+		defer warmer.Close()
+		warmer.Start()
+		checks.Register("warmup", false, func(ctx context.Context) (interface{}, error) {
+			return warmer.Progress(), nil
+		})
+		routerOptions = append(routerOptions, server.WithWarmer(warmer))
+	}
+
+	purge := purger.New(db, idGenerator, zaplogger, purger.Config{
+		Grace:      env.PurgeGrace,
+		BatchSize:  env.PurgeBatchSize,
+		MaxBatches: env.PurgeMaxBatches,
+		Interval:   env.PurgeInterval,
+		Archive:    env.PurgeArchive,
+	})
+	defer purge.Close()
+	routerOptions = append(routerOptions, server.WithPurger(purge))
+
+	notify := notifier.New(db, zaplogger, notifier.Config{
+		Window:       env.WebhookWindow,
+		ScanInterval: env.WebhookScanInterval,
+		PollInterval: env.WebhookPollInterval,
+		MaxAttempts:  env.WebhookMaxAttempts,
+		BackoffBase:  env.WebhookBackoffBase,
+		BackoffMax:   env.WebhookBackoffMax,
+		Timeout:      env.WebhookTimeout,
+		AllowPrivate: env.URLAllowPrivate,
+	})
+	defer notify.Close()
+	routerOptions = append(routerOptions, server.WithNotifier(notify))
+	if env.URLAllowPrivate {
+		routerOptions = append(routerOptions, server.WithPrivateWebhooks())
+	}
+
+	r := server.NewRouter(cache, idGenerator, zaplogger, env.RedirectOrigin, routerOptions...)
+	run(r, fmt.Sprintf(":%d", env.AppPort), checks, env.ShutdownDrainDelay)
+}
+
+// newPublisher returns nil if the events are not published, so that the
+// outbox is not written at all.
+func newPublisher(env config.Env) events.Publisher {
+	switch env.EventSink {
+	case config.SinkStdout:
+		return events.NewStdout()
+	case config.SinkFile:
+		publisher, err := events.NewFile(env.EventFile)
+		if err != nil {
+			log.Fatalf("failed to open event file: %s", err)
+		}
+		return publisher
+	case config.SinkRedis:
+		return events.NewRedisStream(events.RedisConfig{
+			Addr:     env.EventRedisAddr,
+			Password: env.EventRedisPassword,
+			Stream:   env.EventRedisStream,
+			MaxLen:   env.EventRedisMaxLen,
+		})
+	case config.SinkHTTP:
+		return events.NewHTTP(env.EventHTTPURL, 0)
+	}
+	return nil
+}
+
+func newRedis(env config.Env) cacher.Engine {
+	redisConfig, err := env.RedisConfig()
+	if err != nil {
+		log.Fatalf("failed to create redis cache config: %s", err)
+	}
+	engine, err := redis.NewWithConfig(redisConfig)
+	if err != nil {
+		log.Fatalf("failed to create redis cache: %s", err)
+	}
+	return engine
 }
 
-func run(r *gin.Engine, addr string) {
+func run(r *gin.Engine, addr string, checks *health.Registry, drainDelay time.Duration) {
 	// Graceful stop: https://gin-gonic.com/docs/examples/graceful-restart-or-stop/
 	srv := &http.Server{
 		Addr:    addr,
@@ -71,12 +279,17 @@ func run(r *gin.Engine, addr string) {
 
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscanll.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	// fail the readiness first, and keep serving until the load balancer
+	// stops routing new requests to us
+	log.Println("Drain Server ...")
+	checks.Drain()
+	time.Sleep(drainDelay)
 	log.Println("Shutdown Server ...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+const (
+	EventLinkCreated    = "link.created"
+	EventLinkReused     = "link.reused"
+	EventLinkDeleted    = "link.deleted"
+	EventLinkRedirected = "link.redirected"
+)
+
+// OutboxEvent is written in the same transaction as the change of Url, and
+// relayed to the event sinks afterwards.
+type OutboxEvent struct {
+	Seq       uint64 `gorm:"primaryKey"`
+	Type      string
+	Domain    string
+	UrlId     string
+	Url       string
+	ExpiredAt *time.Time
+	// Clicks is the number of redirects since the last event of the link.
+	Clicks    int64
+	CreatedAt time.Time
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"database/sql/driver"
+)
+
+// Tags group the links, e.g. by campaign. They are stored as a JSON array
+// so that the listing can filter them by containment with a GIN index.
+type Tags []string
+
+func (t Tags) Value() (driver.Value, error) {
+	return jsonValue(t, len(t) == 0)
+}
+
+func (t *Tags) Scan(src interface{}) error {
+	*t = nil
+	return jsonScan(src, t)
+}
+
+// Metadata is the free-form key/value pairs of a link, stored as a JSON
+// object, nil if there are none.
+type Metadata map[string]string
+
+func (m Metadata) Value() (driver.Value, error) {
+	return jsonValue(m, len(m) == 0)
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	*m = nil
+	return jsonScan(src, m)
+}
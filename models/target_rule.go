@@ -0,0 +1,31 @@
+package models
+
+import (
+	"database/sql/driver"
+)
+
+// TargetRule redirects the requests matching all of its non-empty conditions
+// to Url instead of the default URL of the link.
+type TargetRule struct {
+	// Platform is the platform of the user agent, e.g. "ios" or "android".
+	Platform string `json:"platform,omitempty"`
+	// Language is the most preferred language of Accept-Language, e.g. "zh"
+	// matches "zh-TW" while "zh-TW" only matches itself.
+	Language string `json:"language,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code resolved from the client IP.
+	Country string `json:"country,omitempty"`
+	Url     string `json:"url"`
+}
+
+// TargetRules are evaluated in order, the first matched one wins. They are
+// stored as a JSON array, nil if there are no rules.
+type TargetRules []TargetRule
+
+func (r TargetRules) Value() (driver.Value, error) {
+	return jsonValue(r, len(r) == 0)
+}
+
+func (r *TargetRules) Scan(src interface{}) error {
+	*r = nil
+	return jsonScan(src, r)
+}
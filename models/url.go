@@ -1,16 +1,101 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// The passthrough modes of the query of the redirect requests.
+const (
+	// PassthroughDrop ignores the query, which is the default.
+	PassthroughDrop = "drop"
+	// PassthroughAppend appends the query to the query of Url as is.
+	PassthroughAppend = "append"
+	// PassthroughMerge merges the query into the query of Url, and
+	// overrides the parameters of the same names.
+	PassthroughMerge = "merge"
+)
+
 type Url struct {
-	Id        string `gorm:"primaryKey"`
-	Url       string
-	ExpiredAt time.Time `gorm:"index"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// Domain is the short domain serving the link, the same id may exist on
+	// different domains. It is empty for the default domain, see Key().
+	Domain string `gorm:"primaryKey;default:''"`
+	Id     string `gorm:"primaryKey"`
+	Url    string
+	// ExpiredAt is nil if the link never expires.
+	ExpiredAt *time.Time `gorm:"index"`
+	// MaxClicks is nil if the clicks are unlimited, otherwise the link is
+	// gone once RemainingClicks reaches zero.
+	MaxClicks       *int64
+	RemainingClicks *int64
+	// PasswordHash is the bcrypt hash of the password, empty if the link is
+	// not protected.
+	PasswordHash string `json:"-"`
+	// Protected is set by the repository instead of PasswordHash, since the
+	// cached links do not carry the hash.
+	Protected bool `gorm:"-"`
+	// Rules override Url for the matched requests.
+	Rules TargetRules `gorm:"type:jsonb"`
+	// Variants split the traffic not matched by Rules, Url is the first
+	// variant if there are any.
+	Variants Variants `gorm:"type:jsonb"`
+	// Passthrough is the mode passing the query of the redirect requests to
+	// the target, empty means PassthroughDrop.
+	Passthrough string
+	// Interstitial renders the preview page before every redirect.
+	Interstitial bool
+	// FlaggedAt is set once the reputation checker flags a target of the
+	// link, the flagged links are disabled and never cached.
+	FlaggedAt  *time.Time
+	FlagReason string
+	// Owner is an optional label of who uploaded the link, the links are
+	// listed by it.
+	Owner string `gorm:"index:idx_urls_owner_created_at,priority:1"`
+	// Title, Description, Tags and Metadata describe the link, they are
+	// never used by the redirects and hence never cached.
+	Title       string
+	Description string
+	Tags        Tags      `gorm:"type:jsonb;index:idx_urls_tags,type:gin"`
+	Metadata    Metadata  `gorm:"type:jsonb"`
+	CreatedAt   time.Time `gorm:"index;index:idx_urls_owner_created_at,priority:2"`
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+// Key identifies the link of id on domain, the repository, the cache and
+// the stats are keyed by it. The links of the default domain are keyed by
+// their ids as is, so that the keys of the links created before the domains
+// stay the same.
+func Key(domain, id string) string {
+	if domain == "" {
+		return id
+	}
+	return domain + "/" + id
+}
+
+// SplitKey returns the domain and id of key, see Key().
+func SplitKey(key string) (domain, id string) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// Key returns the key of the link, see Key().
+func (u *Url) Key() string {
+	return Key(u.Domain, u.Id)
+}
+
+// Targets returns all the URLs the link may redirect to, Url comes first.
+func (u *Url) Targets() []string {
+	targets := []string{u.Url}
+	for _, rule := range u.Rules {
+		targets = append(targets, rule.Url)
+	}
+	for _, v := range u.Variants {
+		targets = append(targets, v.Url)
+	}
+	return targets
 }
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// UrlArchive keeps the purged records, an id may be archived many times
+// since it is recycled.
+type UrlArchive struct {
+	ArchiveId  uint `gorm:"primaryKey"`
+	Domain     string
+	Id         string `gorm:"index"`
+	Url        string
+	ExpiredAt  *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	DeletedAt  *time.Time
+	ArchivedAt time.Time `gorm:"index"`
+}
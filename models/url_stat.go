@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// UrlStat is kept apart from Url, so that counting the clicks does not
+// touch the rows of links.
+type UrlStat struct {
+	Domain     string    `gorm:"primaryKey;default:''"`
+	Id         string    `gorm:"primaryKey"`
+	Clicks     int64     `gorm:"not null;default:0;index"`
+	AccessedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"database/sql/driver"
+)
+
+// Variant is one of the weighted destinations of a link split for A/B
+// testing, which receives Weight / (sum of weights) of the traffic.
+type Variant struct {
+	// Name identifies the variant in the stats and the sticky cookie.
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Weight int64  `json:"weight"`
+}
+
+// Variants are stored as a JSON array, nil if the link is not split.
+type Variants []Variant
+
+func (v Variants) Value() (driver.Value, error) {
+	return jsonValue(v, len(v) == 0)
+}
+
+func (v *Variants) Scan(src interface{}) error {
+	*v = nil
+	return jsonScan(src, v)
+}
+
+// VariantStat counts the clicks of each variant of a link, see UrlStat for
+// the clicks of the whole link.
+type VariantStat struct {
+	Domain  string `gorm:"primaryKey;default:''" json:"-"`
+	Id      string `gorm:"primaryKey" json:"-"`
+	Variant string `gorm:"primaryKey" json:"variant"`
+	Clicks  int64  `gorm:"not null;default:0" json:"clicks"`
+}
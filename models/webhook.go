@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook is an endpoint notified of the link events.
+type Webhook struct {
+	Id     uint `gorm:"primaryKey"`
+	Url    string
+	Secret string
+	// Events is a comma-separated list of the subscribed events, empty means
+	// all of them.
+	Events    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is the delivery log of an event to a webhook.
+type WebhookDelivery struct {
+	Id        uint `gorm:"primaryKey"`
+	WebhookId uint `gorm:"index"`
+	// Key deduplicates the same event of the same link, e.g. found by
+	// several scans.
+	Key   string `gorm:"uniqueIndex"`
+	Event string
+	// UrlId is the key of the link, see Key().
+	UrlId         string `gorm:"index"`
+	Payload       string
+	Status        string `gorm:"index:idx_webhook_deliveries_pending,priority:1"`
+	Attempts      int
+	ResponseCode  int
+	LastError     string
+	NextAttemptAt time.Time `gorm:"index:idx_webhook_deliveries_pending,priority:2"`
+	DeliveredAt   *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
@@ -0,0 +1,170 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/urlpolicy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of
+	// "<timestamp>.<body>" keyed by the secret of the webhook.
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader is the Unix time of sending, receivers should reject
+	// the stale ones to prevent replaying.
+	TimestampHeader = "X-Webhook-Timestamp"
+	EventHeader     = "X-Webhook-Event"
+	// DeliveryHeader is the same across the retries of a delivery, so that
+	// receivers are able to deduplicate.
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// maxErrorBody limits how much of a failed response is logged.
+const maxErrorBody = 256
+
+var errWebhookRemoved = errors.New("webhook removed")
+
+// Sign returns the signature of body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type sender struct {
+	client *http.Client
+}
+
+// newSender returns a sender which only connects to the public addresses
+// unless allowPrivate, so that the webhooks are not able to reach the hosts
+// next to the server. The proxies are not used, since they would connect on
+// behalf of the sender without the check.
+func newSender(timeout time.Duration, allowPrivate bool) *sender {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = urlpolicy.DialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &sender{client: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+// send POSTs the payload of the delivery, it returns the status code if a
+// response is received.
+func (s *sender) send(ctx context.Context, webhook *models.Webhook, d *models.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(d.Id), 10))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, msg)
+	}
+	// drain the body to reuse the connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	return resp.StatusCode, nil
+}
+
+// dispatch claims the due deliveries and sends them concurrently.
+func (n *notifier) dispatch(ctx context.Context) error {
+	// every send of a batch finishes within the timeout
+	lease := 2 * n.config.Timeout
+	deliveries, err := n.db.ClaimDeliveries(ctx, time.Now(), lease, n.config.BatchSize)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	webhooks, err := n.db.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	byID := make(map[uint]*models.Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byID[webhook.Id] = webhook
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d *models.WebhookDelivery) {
+			defer wg.Done()
+			n.deliver(ctx, byID[d.WebhookId], d)
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+// deliver sends the delivery once, and records the result in the delivery
+// log.
+func (n *notifier) deliver(ctx context.Context, webhook *models.Webhook, d *models.WebhookDelivery) {
+	d.Attempts++
+	err := errWebhookRemoved
+	if webhook != nil {
+		d.ResponseCode, err = n.sender.send(ctx, webhook, d)
+	}
+	now := time.Now()
+	switch {
+	case err == nil:
+		d.Status = models.DeliveryDelivered
+		d.LastError = ""
+		d.DeliveredAt = &now
+		metrics.Add("delivered", 1)
+	case webhook == nil || d.Attempts >= n.config.MaxAttempts:
+		d.Status = models.DeliveryFailed
+		d.LastError = err.Error()
+		metrics.Add("failed", 1)
+		n.logger.Warn("give up webhook delivery", zap.Uint("delivery", d.Id), zap.Int("attempts", d.Attempts), zap.Error(err))
+	default:
+		d.LastError = err.Error()
+		d.NextAttemptAt = now.Add(n.backoff(d.Attempts))
+		metrics.Add("retried", 1)
+		n.logger.Debug("retry webhook delivery", zap.Uint("delivery", d.Id), zap.Time("at", d.NextAttemptAt), zap.Error(err))
+	}
+	if err := n.db.UpdateDelivery(ctx, d); err != nil {
+		// it is sent again after the lease, receivers deduplicate it by the
+		// delivery header
+		n.logger.Error("update webhook delivery error", zap.Uint("delivery", d.Id), zap.Error(err))
+	}
+}
+
+// backoff returns how long to wait after the given number of attempts.
+func (n *notifier) backoff(attempts int) time.Duration {
+	wait := n.config.BackoffBase
+	for i := 1; i < attempts && wait < n.config.BackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > n.config.BackoffMax {
+		wait = n.config.BackoffMax
+	}
+	return wait
+}
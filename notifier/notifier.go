@@ -0,0 +1,256 @@
+// Package notifier notifies the registered webhooks of the link events, i.e.
+// a link is going to expire, has expired or has been deleted.
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	EventExpiringSoon = "link.expiring_soon"
+	EventExpired      = "link.expired"
+	EventDeleted      = "link.deleted"
+)
+
+// Events are all the events a webhook is able to subscribe.
+var Events = []string{EventExpiringSoon, EventExpired, EventDeleted}
+
+const (
+	defaultWindow       = 24 * time.Hour
+	defaultScanInterval = time.Minute
+	defaultPollInterval = 5 * time.Second
+	defaultMaxAttempts  = 8
+	defaultBackoffBase  = 10 * time.Second
+	defaultBackoffMax   = time.Hour
+	defaultTimeout      = 5 * time.Second
+	defaultBatchSize    = 100
+)
+
+var metrics = expvar.NewMap("webhook")
+
+type Config struct {
+	// Window is how long before expiring to send the expiring-soon event,
+	// and how long after expiring the expired event is still sent, e.g.
+	// after a downtime.
+	Window       time.Duration
+	ScanInterval time.Duration
+	// PollInterval is how often to look for the due deliveries.
+	PollInterval time.Duration
+	// MaxAttempts is the number of attempts before giving up a delivery,
+	// the n-th retry waits BackoffBase * 2^(n-1) up to BackoffMax.
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Timeout bounds a POST to a webhook.
+	Timeout   time.Duration
+	BatchSize int
+	// AllowPrivate delivers to the loopback, private and link-local
+	// addresses, e.g. in development.
+	AllowPrivate bool
+}
+
+// Payload is the body POSTed to the webhooks.
+type Payload struct {
+	Event string `json:"event"`
+	// Domain is empty for the links of the default domain.
+	Domain     string     `json:"domain,omitempty"`
+	Id         string     `json:"id"`
+	Url        string     `json:"url,omitempty"`
+	ExpiredAt  *time.Time `json:"expiredAt,omitempty"`
+	OccurredAt time.Time  `json:"occurredAt"`
+}
+
+// ValidEvent reports whether event is one of Events.
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribes reports whether the webhook subscribes the event.
+func Subscribes(webhook *models.Webhook, event string) bool {
+	if webhook.Events == "" {
+		return true
+	}
+	for _, e := range strings.Split(webhook.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type Notifier interface {
+	// Deleted enqueues the deleted event of the link of key, see
+	// models.Key().
+	Deleted(ctx context.Context, key string) error
+	// Close stops scanning and delivering.
+	Close()
+}
+
+func New(db repository.Repository, logger *zap.Logger, config Config) Notifier {
+	if config.Window <= 0 {
+		config.Window = defaultWindow
+	}
+	if config.ScanInterval <= 0 {
+		config.ScanInterval = defaultScanInterval
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = defaultBackoffBase
+	}
+	if config.BackoffMax <= 0 {
+		config.BackoffMax = defaultBackoffMax
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &notifier{
+		db:     db,
+		logger: logger,
+		config: config,
+		sender: newSender(config.Timeout, config.AllowPrivate),
+		cancel: cancel,
+	}
+	n.wg.Add(1)
+	go n.loop(ctx)
+	return n
+}
+
+type notifier struct {
+	db     repository.Repository
+	logger *zap.Logger
+	config Config
+	sender *sender
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (n *notifier) Deleted(ctx context.Context, key string) error {
+	domain, id := models.SplitKey(key)
+	_, err := n.enqueue(ctx, EventDeleted, []*models.Url{{Domain: domain, Id: id}}, time.Now())
+	return err
+}
+
+func (n *notifier) Close() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *notifier) loop(ctx context.Context) {
+	defer n.wg.Done()
+	scan := time.NewTicker(n.config.ScanInterval)
+	defer scan.Stop()
+	poll := time.NewTicker(n.config.PollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scan.C:
+			if err := n.scan(ctx); err != nil && ctx.Err() == nil {
+				n.logger.Error("scan expiring links error", zap.Error(err))
+			}
+		case <-poll.C:
+			if err := n.dispatch(ctx); err != nil && ctx.Err() == nil {
+				n.logger.Error("dispatch webhook deliveries error", zap.Error(err))
+			}
+		}
+	}
+}
+
+// scan enqueues the events of the links expiring in the window, or expired
+// within the window. A link found by several scans is enqueued only once.
+func (n *notifier) scan(ctx context.Context) error {
+	now := time.Now()
+	if err := n.scanRange(ctx, EventExpiringSoon, now, now.Add(n.config.Window), now); err != nil {
+		return err
+	}
+	return n.scanRange(ctx, EventExpired, now.Add(-n.config.Window), now, now)
+}
+
+func (n *notifier) scanRange(ctx context.Context, event string, from, to, now time.Time) error {
+	for after := ""; ; {
+		links, err := n.db.SelectExpiring(ctx, from, to, after, n.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			return nil
+		}
+		if _, err := n.enqueue(ctx, event, links, now); err != nil {
+			return err
+		}
+		if len(links) < n.config.BatchSize {
+			return nil
+		}
+		after = links[len(links)-1].Key()
+	}
+}
+
+// enqueue creates a pending delivery of the event of each link for each
+// subscribing webhook.
+func (n *notifier) enqueue(ctx context.Context, event string, links []*models.Url, occurredAt time.Time) (int64, error) {
+	webhooks, err := n.db.ListWebhooks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var deliveries []*models.WebhookDelivery
+	for _, webhook := range webhooks {
+		if !Subscribes(webhook, event) {
+			continue
+		}
+		for _, link := range links {
+			payload := Payload{Event: event, Domain: link.Domain, Id: link.Id, Url: link.Url, OccurredAt: occurredAt}
+			// a key is recycled with a new expiration time, so it identifies
+			// the same link together with the key
+			key := fmt.Sprintf("%d:%s:%s:%d", webhook.Id, event, link.Key(), occurredAt.UnixNano())
+			if event != EventDeleted && link.ExpiredAt != nil {
+				payload.ExpiredAt = link.ExpiredAt
+				key = fmt.Sprintf("%d:%s:%s:%d", webhook.Id, event, link.Key(), link.ExpiredAt.UnixNano())
+			}
+			body, err := json.Marshal(payload)
+			if err != nil {
+				return 0, err
+			}
+			deliveries = append(deliveries, &models.WebhookDelivery{
+				WebhookId:     webhook.Id,
+				Key:           key,
+				Event:         event,
+				UrlId:         link.Key(),
+				Payload:       string(body),
+				Status:        models.DeliveryPending,
+				NextAttemptAt: occurredAt,
+			})
+		}
+	}
+	enqueued, err := n.db.EnqueueDeliveries(ctx, deliveries)
+	if enqueued > 0 {
+		metrics.Add("enqueued", enqueued)
+		n.logger.Debug("enqueue webhook deliveries", zap.String("event", event), zap.Int64("count", enqueued))
+	}
+	return enqueued, err
+}
@@ -0,0 +1,248 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type webhookDB struct {
+	repository.UnimplementedRepository
+	mu         sync.Mutex
+	links      []*models.Url
+	webhooks   []*models.Webhook
+	deliveries []*models.WebhookDelivery
+}
+
+func (w *webhookDB) SelectExpiring(ctx context.Context, from, to time.Time, after string, limit int) ([]*models.Url, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sort.Slice(w.links, func(i, j int) bool { return w.links[i].Id < w.links[j].Id })
+	var links []*models.Url
+	for _, link := range w.links {
+		if link.Id > after && link.ExpiredAt != nil && !link.ExpiredAt.Before(from) && link.ExpiredAt.Before(to) && len(links) < limit {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (w *webhookDB) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*models.Webhook{}, w.webhooks...), nil
+}
+
+func (w *webhookDB) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var created int64
+	for _, d := range deliveries {
+		exists := false
+		for _, e := range w.deliveries {
+			exists = exists || e.Key == d.Key
+		}
+		if !exists {
+			created++
+			d.Id = uint(len(w.deliveries) + 1)
+			w.deliveries = append(w.deliveries, d)
+		}
+	}
+	return created, nil
+}
+
+func (w *webhookDB) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*models.WebhookDelivery, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var claimed []*models.WebhookDelivery
+	for _, d := range w.deliveries {
+		if d.Status == models.DeliveryPending && !d.NextAttemptAt.After(now) && len(claimed) < limit {
+			d.NextAttemptAt = now.Add(lease)
+			copied := *d
+			claimed = append(claimed, &copied)
+		}
+	}
+	return claimed, nil
+}
+
+func (w *webhookDB) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	copied := *delivery
+	w.deliveries[delivery.Id-1] = &copied
+	return nil
+}
+
+func (w *webhookDB) delivery(i int) models.WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return *w.deliveries[i]
+}
+
+func timeAt(t time.Time) *time.Time {
+	return &t
+}
+
+func newTestNotifier(db repository.Repository, config Config) *notifier {
+	// stop the background loop, the tests drive it instead
+	n := New(db, zap.NewNop(), config).(*notifier)
+	n.Close()
+	return n
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1600000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=1e56a11da123b137c26fa37b7c222060bdf22988aa9b3248c31244f8b2ef4a28", Sign("secret", 1600000000, []byte("{}")))
+}
+
+func TestSubscribes(t *testing.T) {
+	all := &models.Webhook{}
+	some := &models.Webhook{Events: EventExpired + "," + EventDeleted}
+	assert.True(t, Subscribes(all, EventExpiringSoon))
+	assert.False(t, Subscribes(some, EventExpiringSoon))
+	assert.True(t, Subscribes(some, EventDeleted))
+}
+
+func TestScan(t *testing.T) {
+	now := time.Now()
+	db := &webhookDB{
+		links: []*models.Url{
+			{Id: "aaaaa1", Url: "https://a.com", ExpiredAt: timeAt(now.Add(time.Hour))},
+			{Id: "aaaaa2", Url: "https://b.com", ExpiredAt: timeAt(now.Add(-time.Hour))},
+			{Id: "aaaaa3", Url: "https://c.com", ExpiredAt: timeAt(now.Add(48 * time.Hour))},
+			{Id: "aaaaa4", Url: "https://d.com"}, // never expires
+		},
+		webhooks: []*models.Webhook{
+			{Id: 1},
+			{Id: 2, Events: EventExpired},
+		},
+	}
+	n := newTestNotifier(db, Config{Window: 24 * time.Hour, BatchSize: 1})
+
+	assert.NoError(t, n.scan(context.Background()))
+	assert.NoError(t, n.scan(context.Background()), "scanning again enqueues nothing")
+	assert.Len(t, db.deliveries, 3)
+
+	events := map[uint][]string{}
+	for _, d := range db.deliveries {
+		events[d.WebhookId] = append(events[d.WebhookId], d.Event+" "+d.UrlId)
+	}
+	assert.Equal(t, []string{EventExpiringSoon + " aaaaa1", EventExpired + " aaaaa2"}, events[1])
+	assert.Equal(t, []string{EventExpired + " aaaaa2"}, events[2])
+
+	var payload Payload
+	assert.NoError(t, json.Unmarshal([]byte(db.deliveries[0].Payload), &payload))
+	assert.Equal(t, "https://a.com", payload.Url)
+	assert.True(t, payload.ExpiredAt.Equal(*db.links[0].ExpiredAt))
+}
+
+func TestDispatch(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	fail := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	db := &webhookDB{webhooks: []*models.Webhook{{Id: 1, Url: srv.URL, Secret: "secret"}}}
+	// the test server listens on loopback
+	n := newTestNotifier(db, Config{MaxAttempts: 5, BackoffBase: time.Millisecond, AllowPrivate: true})
+	assert.NoError(t, n.Deleted(context.Background(), "aaaaa1"))
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(5 * time.Millisecond) // wait for the backoff
+		assert.NoError(t, n.dispatch(context.Background()))
+	}
+	d := db.delivery(0)
+	assert.Equal(t, models.DeliveryDelivered, d.Status)
+	assert.Equal(t, 3, d.Attempts)
+	assert.Equal(t, http.StatusOK, d.ResponseCode)
+	assert.NotNil(t, d.DeliveredAt)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, received, 3)
+	r := received[2]
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, Sign("secret", timestamp, bodies[2]), r.Header.Get(SignatureHeader))
+	assert.Equal(t, EventDeleted, r.Header.Get(EventHeader))
+	assert.Equal(t, "1", r.Header.Get(DeliveryHeader))
+}
+
+func TestDispatch_private_address(t *testing.T) {
+	received := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+	}))
+	defer srv.Close()
+
+	db := &webhookDB{webhooks: []*models.Webhook{{Id: 1, Url: srv.URL}}}
+	n := newTestNotifier(db, Config{MaxAttempts: 2, BackoffBase: time.Hour})
+	assert.NoError(t, n.Deleted(context.Background(), "aaaaa1"))
+
+	assert.NoError(t, n.dispatch(context.Background()))
+	assert.False(t, received, "should never connect to loopback")
+	assert.Contains(t, db.delivery(0).LastError, "is not public")
+}
+
+func TestDispatch_give_up(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	db := &webhookDB{webhooks: []*models.Webhook{{Id: 1, Url: srv.URL}}}
+	n := newTestNotifier(db, Config{MaxAttempts: 2, BackoffBase: time.Hour, AllowPrivate: true})
+	assert.NoError(t, n.Deleted(context.Background(), "aaaaa1"))
+
+	assert.NoError(t, n.dispatch(context.Background()))
+	d := db.delivery(0)
+	assert.Equal(t, models.DeliveryPending, d.Status)
+	assert.Equal(t, http.StatusInternalServerError, d.ResponseCode)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), d.NextAttemptAt, time.Second)
+
+	// not due yet
+	assert.NoError(t, n.dispatch(context.Background()))
+	assert.Equal(t, 1, db.delivery(0).Attempts)
+
+	db.deliveries[0].NextAttemptAt = time.Now()
+	assert.NoError(t, n.dispatch(context.Background()))
+	d = db.delivery(0)
+	assert.Equal(t, models.DeliveryFailed, d.Status)
+	assert.Equal(t, 2, d.Attempts)
+	assert.Contains(t, d.LastError, "unexpected status 500")
+}
+
+func TestBackoff(t *testing.T) {
+	n := &notifier{config: Config{BackoffBase: time.Second, BackoffMax: 10 * time.Second}}
+	assert.Equal(t, time.Second, n.backoff(1))
+	assert.Equal(t, 2*time.Second, n.backoff(2))
+	assert.Equal(t, 8*time.Second, n.backoff(4))
+	assert.Equal(t, 10*time.Second, n.backoff(5))
+	assert.Equal(t, 10*time.Second, n.backoff(100))
+}
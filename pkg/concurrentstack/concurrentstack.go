@@ -14,6 +14,8 @@ type Stack interface {
 	BatchPush(ids []string)
 	Pop() (string, error)
 	Len() int
+	// Snapshot returns a copy of the elements.
+	Snapshot() []string
 }
 
 func New() Stack {
@@ -59,3 +61,9 @@ func (c *filo) Len() int {
 	c.mu.RUnlock()
 	return len
 }
+
+func (c *filo) Snapshot() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string{}, c.stack...)
+}
@@ -0,0 +1,57 @@
+// Package filewatch reloads a file whenever it is modified, e.g. the lists
+// updated offline and copied onto the servers.
+package filewatch
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Watch polls the modification time of path every interval, and calls
+// reload once it changes. The failed reloads are logged, and retried only
+// after the file is modified again. It stops once stop is called.
+func Watch(path string, interval time.Duration, reload func() error, logger *zap.Logger) (stop func()) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil {
+					logger.Warn("stat watched file error", zap.String("file", path), zap.Error(err))
+					continue
+				}
+				if info.ModTime().Equal(modTime) {
+					continue
+				}
+				modTime = info.ModTime()
+				if err := reload(); err != nil {
+					logger.Error("reload watched file error", zap.String("file", path), zap.Error(err))
+					continue
+				}
+				logger.Info("reload watched file", zap.String("file", path))
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
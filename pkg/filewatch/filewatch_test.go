@@ -0,0 +1,57 @@
+package filewatch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "watched.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("a"), 0644))
+
+	var reloads int32
+	fail := atomic.Value{}
+	fail.Store(false)
+	stop := Watch(file, 10*time.Millisecond, func() error {
+		atomic.AddInt32(&reloads, 1)
+		if fail.Load().(bool) {
+			return errors.New("invalid file")
+		}
+		return nil
+	}, zap.NewNop())
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&reloads), "should not reload the unmodified file")
+
+	// set the modification time explicitly for the coarse file systems
+	touch := func(d time.Duration) {
+		mtime := time.Now().Add(d)
+		assert.NoError(t, os.Chtimes(file, mtime, mtime))
+	}
+	touch(time.Second)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&reloads) == 1 }, time.Second, 10*time.Millisecond)
+
+	fail.Store(true)
+	touch(2 * time.Second)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&reloads) == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reloads), "should not retry until modified again")
+
+	stop()
+	stop()
+	touch(3 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reloads), "should stop watching")
+}
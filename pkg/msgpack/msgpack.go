@@ -0,0 +1,404 @@
+// Package msgpack implements a subset of MessagePack, which is enough to
+// encode nil, booleans, integers, strings, binaries, arrays and maps.
+//
+// ref: https://github.com/msgpack/msgpack/blob/master/spec.md
+package msgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrShortBuffer    = errors.New("msgpack: short buffer")
+	ErrUnexpectedType = errors.New("msgpack: unexpected type")
+)
+
+const (
+	codeNil     = 0xc0
+	codeFalse   = 0xc2
+	codeTrue    = 0xc3
+	codeBin8    = 0xc4
+	codeBin16   = 0xc5
+	codeBin32   = 0xc6
+	codeFloat32 = 0xca
+	codeFloat64 = 0xcb
+	codeUint8   = 0xcc
+	codeUint16  = 0xcd
+	codeUint32  = 0xce
+	codeUint64  = 0xcf
+	codeInt8    = 0xd0
+	codeInt16   = 0xd1
+	codeInt32   = 0xd2
+	codeInt64   = 0xd3
+	codeStr8    = 0xd9
+	codeStr16   = 0xda
+	codeStr32   = 0xdb
+	codeArray16 = 0xdc
+	codeArray32 = 0xdd
+	codeMap16   = 0xde
+	codeMap32   = 0xdf
+)
+
+// Writer appends encoded values to its buffer.
+type Writer struct {
+	buf []byte
+}
+
+// Bytes returns the encoded bytes.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) WriteNil() {
+	w.buf = append(w.buf, codeNil)
+}
+
+func (w *Writer) WriteBool(v bool) {
+	if v {
+		w.buf = append(w.buf, codeTrue)
+	} else {
+		w.buf = append(w.buf, codeFalse)
+	}
+}
+
+// WriteInt writes v in the most compact format.
+func (w *Writer) WriteInt(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		w.buf = append(w.buf, byte(v))
+	case v < 0 && v >= -32:
+		w.buf = append(w.buf, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		w.buf = append(w.buf, codeInt8, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		w.buf = append(w.buf, codeInt16)
+		w.buf = appendUint16(w.buf, uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		w.buf = append(w.buf, codeInt32)
+		w.buf = appendUint32(w.buf, uint32(v))
+	default:
+		w.buf = append(w.buf, codeInt64)
+		w.buf = appendUint64(w.buf, uint64(v))
+	}
+}
+
+func (w *Writer) WriteString(v string) {
+	n := len(v)
+	switch {
+	case n <= 31:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, codeStr8, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, codeStr16)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, codeStr32)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, v...)
+}
+
+func (w *Writer) WriteBytes(v []byte) {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, codeBin8, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, codeBin16)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, codeBin32)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, v...)
+}
+
+// WriteArrayHeader writes the header of an array, which should be followed
+// by n values.
+func (w *Writer) WriteArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, codeArray16)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, codeArray32)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+}
+
+// WriteMapHeader writes the header of a map, which should be followed by n
+// pairs of key and value.
+func (w *Writer) WriteMapHeader(n int) {
+	switch {
+	case n <= 15:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, codeMap16)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, codeMap32)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+}
+
+// Reader decodes values from its buffer in order.
+type Reader struct {
+	buf []byte
+	off int
+}
+
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+// Len returns the number of unread bytes.
+func (r *Reader) Len() int {
+	return len(r.buf) - r.off
+}
+
+// IsNil reports whether the next value is nil, and consumes it if so.
+func (r *Reader) IsNil() bool {
+	if r.Len() > 0 && r.buf[r.off] == codeNil {
+		r.off++
+		return true
+	}
+	return false
+}
+
+func (r *Reader) ReadBool() (bool, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return false, err
+	}
+	switch code[0] {
+	case codeTrue:
+		return true, nil
+	case codeFalse:
+		return false, nil
+	}
+	return false, ErrUnexpectedType
+}
+
+func (r *Reader) ReadInt() (int64, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	c := code[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8Of(c)), nil
+	}
+	switch c {
+	case codeUint8, codeInt8:
+		b, err := r.next(1)
+		if err != nil {
+			return 0, err
+		}
+		if c == codeInt8 {
+			return int64(int8Of(b[0])), nil
+		}
+		return int64(b[0]), nil
+	case codeUint16, codeInt16:
+		b, err := r.next(2)
+		if err != nil {
+			return 0, err
+		}
+		v := binary.BigEndian.Uint16(b)
+		if c == codeInt16 {
+			return int64(int16Of(v)), nil
+		}
+		return int64(v), nil
+	case codeUint32, codeInt32:
+		b, err := r.next(4)
+		if err != nil {
+			return 0, err
+		}
+		v := binary.BigEndian.Uint32(b)
+		if c == codeInt32 {
+			return int64(int32Of(v)), nil
+		}
+		return int64(v), nil
+	case codeUint64, codeInt64:
+		b, err := r.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	}
+	return 0, ErrUnexpectedType
+}
+
+func (r *Reader) ReadString() (string, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch c := code[0]; {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == codeStr8, c == codeStr16, c == codeStr32:
+		if n, err = r.readLength(1 << (c - codeStr8)); err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrUnexpectedType
+	}
+	b, err := r.next(n)
+	return string(b), err
+}
+
+func (r *Reader) ReadBytes() ([]byte, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := code[0]
+	if c != codeBin8 && c != codeBin16 && c != codeBin32 {
+		return nil, ErrUnexpectedType
+	}
+	n, err := r.readLength(1 << (c - codeBin8))
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, b...), nil
+}
+
+func (r *Reader) ReadArrayHeader() (int, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch c := code[0]; {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), nil
+	case c == codeArray16:
+		return r.readLength(2)
+	case c == codeArray32:
+		return r.readLength(4)
+	}
+	return 0, ErrUnexpectedType
+}
+
+func (r *Reader) ReadMapHeader() (int, error) {
+	code, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch c := code[0]; {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == codeMap16:
+		return r.readLength(2)
+	case c == codeMap32:
+		return r.readLength(4)
+	}
+	return 0, ErrUnexpectedType
+}
+
+// Skip skips the next value, which is useful to ignore the unknown fields
+// appended by a newer version.
+func (r *Reader) Skip() error {
+	if r.Len() == 0 {
+		return ErrShortBuffer
+	}
+	c := r.buf[r.off]
+	switch {
+	case c <= 0x7f || c >= 0xe0, c == codeNil, c == codeFalse, c == codeTrue:
+		r.off++
+		return nil
+	case c&0xe0 == 0xa0, c == codeStr8, c == codeStr16, c == codeStr32:
+		_, err := r.ReadString()
+		return err
+	case c == codeBin8, c == codeBin16, c == codeBin32:
+		_, err := r.ReadBytes()
+		return err
+	case c == codeFloat32:
+		_, err := r.next(5)
+		return err
+	case c == codeFloat64:
+		_, err := r.next(9)
+		return err
+	case c >= codeUint8 && c <= codeInt64:
+		_, err := r.ReadInt()
+		return err
+	case c&0xf0 == 0x90, c == codeArray16, c == codeArray32:
+		n, err := r.ReadArrayHeader()
+		if err != nil {
+			return err
+		}
+		return r.skipN(n)
+	case c&0xf0 == 0x80, c == codeMap16, c == codeMap32:
+		n, err := r.ReadMapHeader()
+		if err != nil {
+			return err
+		}
+		return r.skipN(2 * n)
+	}
+	return ErrUnexpectedType
+}
+
+func (r *Reader) skipN(n int) error {
+	for i := 0; i < n; i++ {
+		if err := r.Skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLength reads a big-endian length which takes size (1, 2 or 4) bytes.
+func (r *Reader) readLength(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (r *Reader) next(n int) ([]byte, error) {
+	if n < 0 || r.Len() < n {
+		return nil, ErrShortBuffer
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func int8Of(b byte) int8 { return int8(b) }
+
+func int16Of(v uint16) int16 { return int16(v) }
+
+func int32Of(v uint32) int32 { return int32(v) }
@@ -0,0 +1,108 @@
+package msgpack
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		value int64
+		size  int
+	}{
+		{0, 1},
+		{127, 1},
+		{-32, 1},
+		{-33, 2},
+		{128, 3},
+		{math.MinInt16, 3},
+		{math.MaxInt32, 5},
+		{math.MaxInt64, 9},
+		{math.MinInt64, 9},
+	}
+	for _, tt := range tests {
+		var w Writer
+		w.WriteInt(tt.value)
+		assert.Len(t, w.Bytes(), tt.size, "value: %d", tt.value)
+
+		got, err := NewReader(w.Bytes()).ReadInt()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.value, got)
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, n := range []int{0, 31, 32, 255, 256, math.MaxUint16 + 1} {
+		value := strings.Repeat("x", n)
+		var w Writer
+		w.WriteString(value)
+
+		got, err := NewReader(w.Bytes()).ReadString()
+		assert.NoError(t, err)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestCompound(t *testing.T) {
+	var w Writer
+	w.WriteArrayHeader(3)
+	w.WriteString("url")
+	w.WriteNil()
+	w.WriteBytes([]byte{1, 2, 3})
+	w.WriteMapHeader(1)
+	w.WriteString("key")
+	w.WriteBool(true)
+
+	r := NewReader(w.Bytes())
+	n, err := r.ReadArrayHeader()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	s, err := r.ReadString()
+	assert.NoError(t, err)
+	assert.Equal(t, "url", s)
+	assert.True(t, r.IsNil())
+	b, err := r.ReadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, b)
+	n, err = r.ReadMapHeader()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, r.Skip())
+	v, err := r.ReadBool()
+	assert.NoError(t, err)
+	assert.True(t, v)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestSkip(t *testing.T) {
+	var w Writer
+	w.WriteArrayHeader(2)
+	w.WriteInt(math.MaxInt64)
+	w.WriteMapHeader(1)
+	w.WriteString("nested")
+	w.WriteArrayHeader(1)
+	w.WriteString("value")
+	w.WriteString("next")
+
+	r := NewReader(w.Bytes())
+	assert.NoError(t, r.Skip())
+	s, err := r.ReadString()
+	assert.NoError(t, err)
+	assert.Equal(t, "next", s)
+}
+
+func TestShortBuffer(t *testing.T) {
+	var w Writer
+	w.WriteString("truncated")
+	buf := w.Bytes()
+
+	_, err := NewReader(buf[:len(buf)-1]).ReadString()
+	assert.Equal(t, ErrShortBuffer, err)
+	_, err = NewReader(nil).ReadInt()
+	assert.Equal(t, ErrShortBuffer, err)
+	_, err = NewReader(buf).ReadInt()
+	assert.Equal(t, ErrUnexpectedType, err)
+}
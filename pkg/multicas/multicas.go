@@ -2,46 +2,107 @@ package multicas
 
 import (
 	"sync"
+	"time"
 )
 
 type MultiCAS interface {
 	// Set will guarantee there is only one of concurrent goroutines can set successfully.
 	Set(key interface{}) bool
 	Unset(key interface{})
+
+	// SetWithTTL is like Set, but the key is able to be set again after ttl
+	// even if it is never unset, e.g. the holder panicked. It returns a token
+	// which identifies the holder, see Renew() and UnsetWithToken().
+	SetWithTTL(key interface{}, ttl time.Duration) (token uint64, ok bool)
+	// Renew extends the ttl of key, it fails if the key has expired or is
+	// not held by token.
+	Renew(key interface{}, token uint64, ttl time.Duration) bool
+	// UnsetWithToken unsets the key only if it is held by token.
+	UnsetWithToken(key interface{}, token uint64) bool
 }
 
 func NewMultiCAS() MultiCAS {
 	return &multicas{
-		table: make(map[interface{}]bool),
+		table: make(map[interface{}]holder),
 	}
 }
 
+// holder is who set the key, a zero expireAt means never expires.
+type holder struct {
+	token    uint64
+	expireAt time.Time
+}
+
+func (h holder) expired(now time.Time) bool {
+	return !h.expireAt.IsZero() && !now.Before(h.expireAt)
+}
+
 type multicas struct {
 	mu    sync.RWMutex
-	table map[interface{}]bool
+	table map[interface{}]holder
+	last  uint64 // the last token issued, guarded by mu
 }
 
 func (m *multicas) Set(key interface{}) (ok bool) {
+	_, ok = m.set(key, 0)
+	return ok
+}
+
+func (m *multicas) SetWithTTL(key interface{}, ttl time.Duration) (uint64, bool) {
+	return m.set(key, ttl)
+}
+
+func (m *multicas) set(key interface{}, ttl time.Duration) (token uint64, ok bool) {
+	now := time.Now()
 	m.mu.RLock()
-	isSet := m.table[key]
+	h, isSet := m.table[key]
 	m.mu.RUnlock()
-	if isSet {
-		return false
+	if isSet && !h.expired(now) {
+		return 0, false
 	}
 
 	m.mu.Lock()
-	if !m.table[key] {
-		m.table[key] = true
-		ok = true
+	defer m.mu.Unlock()
+	if h, isSet := m.table[key]; isSet && !h.expired(now) {
+		return 0, false
 	}
-	m.mu.Unlock()
-	return ok
+	m.last++
+	h = holder{token: m.last}
+	if ttl > 0 {
+		h.expireAt = now.Add(ttl)
+	}
+	m.table[key] = h
+	return h.token, true
 }
 
-func (m *multicas) Unset(key interface{}) {
+func (m *multicas) Renew(key interface{}, token uint64, ttl time.Duration) bool {
+	now := time.Now()
 	m.mu.Lock()
-	if m.table[key] {
-		delete(m.table, key)
+	defer m.mu.Unlock()
+	h, isSet := m.table[key]
+	if !isSet || h.token != token || h.expired(now) {
+		return false
 	}
+	h.expireAt = now.Add(ttl)
+	m.table[key] = h
+	return true
+}
+
+func (m *multicas) Unset(key interface{}) {
+	m.mu.Lock()
+	delete(m.table, key)
 	m.mu.Unlock()
 }
+
+func (m *multicas) UnsetWithToken(key interface{}, token uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, isSet := m.table[key]
+	if !isSet || h.token != token {
+		return false
+	}
+	delete(m.table, key)
+	// an expired holder is removed as well, but it reports the lock has
+	// been lost
+	return !h.expired(time.Now())
+}
@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -125,6 +126,51 @@ func (suite *multiCASTestSuite) Test_different_key_every_GR_set_successfully() {
 	}
 }
 
+func (suite *multiCASTestSuite) Test_expired_key_can_be_set_again() {
+	for _, ver := range suite.versions {
+		suite.Run(ver.name, func() {
+			token, ok := ver.multiCAS.SetWithTTL("key", 10*time.Millisecond)
+			suite.True(ok)
+			_, ok = ver.multiCAS.SetWithTTL("key", 10*time.Millisecond)
+			suite.False(ok)
+
+			// the holder never unsets the key, e.g. it panicked
+			time.Sleep(20 * time.Millisecond)
+			newToken, ok := ver.multiCAS.SetWithTTL("key", time.Minute)
+			suite.True(ok)
+			suite.NotEqual(token, newToken)
+
+			// the former holder is not able to touch the key anymore
+			suite.False(ver.multiCAS.Renew("key", token, time.Minute))
+			suite.False(ver.multiCAS.UnsetWithToken("key", token))
+			_, ok = ver.multiCAS.SetWithTTL("key", time.Minute)
+			suite.False(ok)
+
+			suite.True(ver.multiCAS.UnsetWithToken("key", newToken))
+			_, ok = ver.multiCAS.SetWithTTL("key", time.Minute)
+			suite.True(ok)
+		})
+	}
+}
+
+func (suite *multiCASTestSuite) Test_renew() {
+	for _, ver := range suite.versions {
+		suite.Run(ver.name, func() {
+			token, ok := ver.multiCAS.SetWithTTL("key", 30*time.Millisecond)
+			suite.True(ok)
+			for i := 0; i < 3; i++ {
+				time.Sleep(15 * time.Millisecond)
+				suite.True(ver.multiCAS.Renew("key", token, 30*time.Millisecond))
+			}
+			_, ok = ver.multiCAS.SetWithTTL("key", time.Minute)
+			suite.False(ok, "renewed key should not expire")
+
+			time.Sleep(40 * time.Millisecond)
+			suite.False(ver.multiCAS.Renew("key", token, time.Minute))
+		})
+	}
+}
+
 func Test_suiteTestMultiCAS(t *testing.T) {
 	suite.Run(t, new(multiCASTestSuite))
 }
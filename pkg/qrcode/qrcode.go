@@ -0,0 +1,200 @@
+// Package qrcode renders QR codes into PNG or SVG images with the given
+// size, margin and colors.
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	qr "github.com/skip2/go-qrcode"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+const (
+	MinSize   = 64
+	MaxSize   = 2048
+	MaxMargin = 16
+)
+
+// Options are the rendering options, see Default().
+type Options struct {
+	// Format is FormatPNG or FormatSVG.
+	Format string
+	// Size is the width and height of the image in pixels.
+	Size int
+	// Level is the error correction level, i.e. "L", "M", "Q" or "H".
+	Level string
+	// Margin is the quiet zone around the code in modules.
+	Margin int
+	// Foreground and Background are the colors of the dark and light
+	// modules, in hex "RRGGBB" or "RRGGBBAA" with an optional "#" prefix.
+	Foreground string
+	Background string
+}
+
+// Default returns the default options, a 256 pixels black on white PNG
+// with the medium error correction and the 4 modules margin.
+func Default() Options {
+	return Options{
+		Format:     FormatPNG,
+		Size:       256,
+		Level:      "M",
+		Margin:     4,
+		Foreground: "000000",
+		Background: "ffffff",
+	}
+}
+
+var levels = map[string]qr.RecoveryLevel{
+	"L": qr.Low,
+	"M": qr.Medium,
+	"Q": qr.High,
+	"H": qr.Highest,
+}
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	if format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Validate returns an error if the options are invalid.
+func (o Options) Validate() error {
+	if o.Format != FormatPNG && o.Format != FormatSVG {
+		return fmt.Errorf("format should be %s or %s", FormatPNG, FormatSVG)
+	}
+	if o.Size < MinSize || o.Size > MaxSize {
+		return fmt.Errorf("size should be %d to %d", MinSize, MaxSize)
+	}
+	if _, ok := levels[o.Level]; !ok {
+		return errors.New("level should be L, M, Q or H")
+	}
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return fmt.Errorf("margin should be 0 to %d", MaxMargin)
+	}
+	if _, err := ParseColor(o.Foreground); err != nil {
+		return fmt.Errorf("invalid foreground: %w", err)
+	}
+	if _, err := ParseColor(o.Background); err != nil {
+		return fmt.Errorf("invalid background: %w", err)
+	}
+	return nil
+}
+
+// ParseColor parses a hex color "RRGGBB" or "RRGGBBAA", the "#" prefix is
+// optional.
+func ParseColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("color should be RRGGBB or RRGGBBAA: %s", s)
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("color should be hex: %s", s)
+	}
+	if len(s) == 6 {
+		n = n<<8 | 0xff
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// Render encodes content into a QR code image of the validated options.
+func Render(content string, o Options) ([]byte, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	code, err := qr.New(content, levels[o.Level])
+	if err != nil {
+		return nil, err
+	}
+	// the margin is drawn by us instead of the fixed border
+	code.DisableBorder = true
+	modules := code.Bitmap()
+	if len(modules)+2*o.Margin > o.Size {
+		return nil, fmt.Errorf("size should be at least %d for the content", len(modules)+2*o.Margin)
+	}
+	fg, _ := ParseColor(o.Foreground)
+	bg, _ := ParseColor(o.Background)
+	if o.Format == FormatSVG {
+		return renderSVG(modules, o, fg, bg), nil
+	}
+	return renderPNG(modules, o, fg, bg)
+}
+
+// renderPNG scales the modules by the same integral factor, and centers
+// them in the image of o.Size.
+func renderPNG(modules [][]bool, o Options, fg, bg color.NRGBA) ([]byte, error) {
+	n := len(modules)
+	scale := o.Size / (n + 2*o.Margin)
+	offset := (o.Size - scale*n) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, o.Size, o.Size), color.Palette{bg, fg})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				start := img.PixOffset(offset+x*scale, offset+y*scale+dy)
+				for dx := 0; dx < scale; dx++ {
+					img.Pix[start+dx] = 1
+				}
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// renderSVG draws the dark modules of each row by horizontal runs, the
+// image scales without blurring.
+func renderSVG(modules [][]bool, o Options, fg, bg color.NRGBA) []byte {
+	total := len(modules) + 2*o.Margin
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		o.Size, o.Size, total, total)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="%s"%s/>`, total, total, hex(bg), opacity(bg))
+	fmt.Fprintf(&b, `<path fill="%s"%s d="`, hex(fg), opacity(fg))
+	for y, row := range modules {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x+o.Margin, y+o.Margin, run, run)
+			x += run
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+func hex(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func opacity(c color.NRGBA) string {
+	if c.A == 0xff {
+		return ""
+	}
+	return fmt.Sprintf(` fill-opacity="%.3g"`, float64(c.A)/0xff)
+}
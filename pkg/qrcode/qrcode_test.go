@@ -0,0 +1,92 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColor(t *testing.T) {
+	c, err := ParseColor("#1a2B3c")
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff}, c)
+
+	c, err = ParseColor("ffffff00")
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{R: 0xff, G: 0xff, B: 0xff}, c)
+
+	for _, s := range []string{"", "fff", "red", "gggggg", "1a2b3c4"} {
+		_, err := ParseColor(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+
+	invalid := []func(o *Options){
+		func(o *Options) { o.Format = "gif" },
+		func(o *Options) { o.Size = MinSize - 1 },
+		func(o *Options) { o.Size = MaxSize + 1 },
+		func(o *Options) { o.Level = "X" },
+		func(o *Options) { o.Margin = -1 },
+		func(o *Options) { o.Margin = MaxMargin + 1 },
+		func(o *Options) { o.Foreground = "black" },
+		func(o *Options) { o.Background = "#fff" },
+	}
+	for i, modify := range invalid {
+		o := Default()
+		modify(&o)
+		assert.Error(t, o.Validate(), i)
+	}
+}
+
+func TestRender_png(t *testing.T) {
+	o := Default()
+	o.Size = 300
+	o.Foreground = "ff0000"
+	data, err := Render("http://localhost:8080/XSIfKe", o)
+	assert.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 300, img.Bounds().Dy())
+
+	// version 3 has 29 modules, plus the margins there are 37, so each
+	// module is 8 pixels and the code is centered by 34 pixels
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	white := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	assert.Equal(t, white, color.NRGBAModel.Convert(img.At(33, 33)), "margin")
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(34, 34)), "finder pattern")
+	assert.Equal(t, white, color.NRGBAModel.Convert(img.At(34+8, 34+8)), "inside finder pattern")
+	assert.Equal(t, red, color.NRGBAModel.Convert(img.At(34+8*3, 34+8*3)), "center of finder pattern")
+	assert.Equal(t, white, color.NRGBAModel.Convert(img.At(34+8*29, 34+8*29)), "margin")
+}
+
+func TestRender_svg(t *testing.T) {
+	o := Default()
+	o.Format = FormatSVG
+	o.Margin = 2
+	o.Background = "ffffff00"
+	data, err := Render("http://localhost:8080/XSIfKe", o)
+	assert.NoError(t, err)
+
+	svg := string(data)
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256" viewBox="0 0 33 33"`))
+	assert.Contains(t, svg, `<rect width="33" height="33" fill="#ffffff" fill-opacity="0"/>`)
+	// the top row of the finder patterns
+	assert.Contains(t, svg, `d="M2 2h7v1h-7z`)
+}
+
+func TestRender_too_small(t *testing.T) {
+	o := Default()
+	o.Size = MinSize
+	o.Margin = MaxMargin
+	_, err := Render("http://localhost:8080/"+strings.Repeat("a", 100), o)
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle blocks a key for a while after it fails too many times in a row,
+// e.g. guessing the password of a link from the same client.
+type Throttle interface {
+	// Allow reports whether key is allowed to try, otherwise it returns how
+	// long the key is still blocked.
+	Allow(key string) (retryAfter time.Duration, ok bool)
+	// Fail records a failed try of key, and blocks the key for lockout if it
+	// has failed max times.
+	Fail(key string)
+	// Reset forgets the failures of key.
+	Reset(key string)
+}
+
+// New returns a Throttle blocking a key for lockout after max failures. The
+// failures are forgotten if the key does not fail again within lockout.
+func New(max int, lockout time.Duration) Throttle {
+	return &throttle{
+		max:     max,
+		lockout: lockout,
+		table:   make(map[string]*record),
+	}
+}
+
+type record struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+type throttle struct {
+	mu      sync.Mutex
+	max     int
+	lockout time.Duration
+	table   map[string]*record
+	swept   time.Time // the last time the forgotten records were removed
+}
+
+func (t *throttle) Allow(key string) (time.Duration, bool) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.table[key]
+	if !ok || !now.Before(r.blockedUntil) {
+		return 0, true
+	}
+	return r.blockedUntil.Sub(now), false
+}
+
+func (t *throttle) Fail(key string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+
+	r, ok := t.table[key]
+	if !ok || t.forgotten(r, now) {
+		r = &record{}
+		t.table[key] = r
+	}
+	r.failures++
+	r.lastFailure = now
+	if r.failures >= t.max {
+		r.failures = 0
+		r.blockedUntil = now.Add(t.lockout)
+	}
+}
+
+func (t *throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.table, key)
+}
+
+func (t *throttle) forgotten(r *record, now time.Time) bool {
+	return !now.Before(r.lastFailure.Add(t.lockout)) && !now.Before(r.blockedUntil)
+}
+
+// sweep removes the forgotten records at most once per lockout, so that the
+// table does not grow with the keys never coming back.
+func (t *throttle) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.lockout {
+		return
+	}
+	t.swept = now
+	for key, r := range t.table {
+		if t.forgotten(r, now) {
+			delete(t.table, key)
+		}
+	}
+}
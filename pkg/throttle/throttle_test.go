@@ -0,0 +1,52 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	th := New(3, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		th.Fail("a")
+		_, ok := th.Allow("a")
+		assert.True(t, ok, "should allow before max failures")
+	}
+	th.Fail("a")
+	retryAfter, ok := th.Allow("a")
+	assert.False(t, ok, "should block after max failures")
+	assert.True(t, retryAfter > 0 && retryAfter <= 50*time.Millisecond)
+
+	_, ok = th.Allow("b")
+	assert.True(t, ok, "should not block the other keys")
+
+	time.Sleep(60 * time.Millisecond)
+	_, ok = th.Allow("a")
+	assert.True(t, ok, "should allow after lockout")
+}
+
+func TestThrottle_Reset(t *testing.T) {
+	th := New(2, time.Hour)
+	th.Fail("a")
+	th.Reset("a")
+	th.Fail("a")
+	_, ok := th.Allow("a")
+	assert.True(t, ok, "should forget the failures before reset")
+}
+
+func TestThrottle_forget_old_failures(t *testing.T) {
+	th := New(2, 50*time.Millisecond).(*throttle)
+	th.Fail("a")
+	time.Sleep(60 * time.Millisecond)
+	th.Fail("a")
+	_, ok := th.Allow("a")
+	assert.True(t, ok, "should forget the failure older than lockout")
+
+	th.Fail("b")
+	time.Sleep(60 * time.Millisecond)
+	th.Fail("c")
+	_, found := th.table["b"]
+	assert.False(t, found, "should sweep the forgotten keys")
+}
@@ -0,0 +1,178 @@
+// Package purger hard-deletes, or archives, the links deleted or expired
+// longer than a grace period ago.
+package purger
+
+import (
+	"context"
+	"errors"
+	"goshorturl/repository"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultGrace     = 30 * 24 * time.Hour
+	defaultBatchSize = 500
+	// sampleSize limits the ids listed in a report.
+	sampleSize = 100
+)
+
+var ErrRunning = errors.New("purge is running")
+
+// Pool is implemented by idgenerator.IDGenerator, the ids waiting in the
+// pool are never purged.
+type Pool interface {
+	Exclusive(ctx context.Context, f func(pooled map[string]bool) error) error
+}
+
+type Config struct {
+	// Grace is how long to keep the records after they were deleted or
+	// expired.
+	Grace     time.Duration
+	BatchSize int
+	// MaxBatches bounds the batches of a run, zero means unlimited.
+	MaxBatches int
+	// Interval is how often to purge in background, zero disables it.
+	Interval time.Duration
+	// Archive copies the records into url_archives before deleting.
+	Archive bool
+}
+
+// Report is the result of a run, a dry run only counts the candidates.
+type Report struct {
+	DryRun     bool      `json:"dryRun"`
+	Before     time.Time `json:"before"`
+	Batches    int       `json:"batches"`
+	Candidates int       `json:"candidates"`
+	// Skipped is the number of candidates waiting in the recycled id pool.
+	Skipped  int      `json:"skipped"`
+	Purged   int64    `json:"purged"`
+	Archived bool     `json:"archived"`
+	Sample   []string `json:"sample,omitempty"`
+}
+
+type Purger interface {
+	// Run purges batch by batch, it returns ErrRunning if another run is in
+	// progress.
+	Run(ctx context.Context, dryRun bool) (Report, error)
+	// Close stops purging in background.
+	Close()
+}
+
+func New(db repository.Repository, pool Pool, logger *zap.Logger, config Config) Purger {
+	if config.Grace <= 0 {
+		config.Grace = defaultGrace
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &purger{
+		db:     db,
+		pool:   pool,
+		logger: logger,
+		config: config,
+		cancel: cancel,
+	}
+	if config.Interval > 0 {
+		p.wg.Add(1)
+		go p.loop(ctx)
+	}
+	return p
+}
+
+type purger struct {
+	db     repository.Repository
+	pool   Pool
+	logger *zap.Logger
+	config Config
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	running int32
+}
+
+func (p *purger) Run(ctx context.Context, dryRun bool) (Report, error) {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return Report{}, ErrRunning
+	}
+	defer atomic.StoreInt32(&p.running, 0)
+
+	report := Report{
+		DryRun:   dryRun,
+		Before:   time.Now().Add(-p.config.Grace),
+		Archived: p.config.Archive && !dryRun,
+	}
+	// keyset pagination, so that the skipped ids are not selected again
+	after := ""
+	for p.config.MaxBatches == 0 || report.Batches < p.config.MaxBatches {
+		var ids []string
+		// keep recycling from popping ids out of the pool in the meanwhile
+		err := p.pool.Exclusive(ctx, func(pooled map[string]bool) error {
+			var err error
+			ids, err = p.db.SelectPurgeable(ctx, report.Before, after, p.config.BatchSize)
+			if err != nil || len(ids) == 0 {
+				return err
+			}
+			purgeable := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if pooled[id] {
+					report.Skipped++
+					continue
+				}
+				purgeable = append(purgeable, id)
+			}
+			report.Candidates += len(purgeable)
+			if dryRun {
+				if rest := sampleSize - len(report.Sample); rest > 0 {
+					if len(purgeable) < rest {
+						rest = len(purgeable)
+					}
+					report.Sample = append(report.Sample, purgeable[:rest]...)
+				}
+				return nil
+			}
+			purged, err := p.db.Purge(ctx, purgeable, report.Before, p.config.Archive)
+			report.Purged += purged
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		report.Batches++
+		after = ids[len(ids)-1]
+		if len(ids) < p.config.BatchSize {
+			break
+		}
+	}
+	p.logger.Info("purge done", zap.Bool("dryRun", dryRun), zap.Int("candidates", report.Candidates),
+		zap.Int("skipped", report.Skipped), zap.Int64("purged", report.Purged))
+	return report, nil
+}
+
+func (p *purger) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *purger) loop(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.Run(ctx, false); err != nil && err != ErrRunning && ctx.Err() == nil {
+				p.logger.Error("purge error", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package purger
+
+import (
+	"context"
+	"goshorturl/repository"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type purgeableDB struct {
+	repository.UnimplementedRepository
+	mu       sync.Mutex
+	ids      []string
+	archived []string
+	selects  int
+}
+
+func (p *purgeableDB) SelectPurgeable(ctx context.Context, before time.Time, after string, limit int) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.selects++
+	sort.Strings(p.ids)
+	var ids []string
+	for _, id := range p.ids {
+		if id > after && len(ids) < limit {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (p *purgeableDB) Purge(ctx context.Context, ids []string, before time.Time, archive bool) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	purged := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		purged[id] = true
+	}
+	var rest []string
+	for _, id := range p.ids {
+		if !purged[id] {
+			rest = append(rest, id)
+		} else if archive {
+			p.archived = append(p.archived, id)
+		}
+	}
+	n := len(p.ids) - len(rest)
+	p.ids = rest
+	return int64(n), nil
+}
+
+type fakePool map[string]bool
+
+func (f fakePool) Exclusive(ctx context.Context, fn func(pooled map[string]bool) error) error {
+	return fn(f)
+}
+
+func TestRun(t *testing.T) {
+	db := &purgeableDB{ids: []string{"aaaaa1", "aaaaa2", "aaaaa3", "aaaaa4", "aaaaa5"}}
+	p := New(db, fakePool{"aaaaa2": true}, zap.NewNop(), Config{BatchSize: 2, Archive: true})
+	defer p.Close()
+
+	report, err := p.Run(context.Background(), false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Batches)
+	assert.Equal(t, 4, report.Candidates)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, int64(4), report.Purged)
+	assert.True(t, report.Archived)
+	assert.Equal(t, []string{"aaaaa2"}, db.ids, "pooled id is never purged")
+	assert.Len(t, db.archived, 4)
+}
+
+func TestRun_dry_run(t *testing.T) {
+	db := &purgeableDB{ids: []string{"aaaaa1", "aaaaa2", "aaaaa3"}}
+	p := New(db, fakePool{}, zap.NewNop(), Config{Grace: time.Hour, Archive: true})
+	defer p.Close()
+
+	start := time.Now()
+	report, err := p.Run(context.Background(), true)
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.False(t, report.Archived)
+	assert.Equal(t, 3, report.Candidates)
+	assert.Equal(t, int64(0), report.Purged)
+	assert.Equal(t, []string{"aaaaa1", "aaaaa2", "aaaaa3"}, report.Sample)
+	assert.WithinDuration(t, start.Add(-time.Hour), report.Before, time.Second)
+	assert.Len(t, db.ids, 3)
+}
+
+func TestRun_bounded_batches(t *testing.T) {
+	db := &purgeableDB{ids: []string{"aaaaa1", "aaaaa2", "aaaaa3", "aaaaa4"}}
+	p := New(db, fakePool{}, zap.NewNop(), Config{BatchSize: 1, MaxBatches: 2})
+	defer p.Close()
+
+	report, err := p.Run(context.Background(), false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Batches)
+	assert.Equal(t, int64(2), report.Purged)
+	assert.Equal(t, []string{"aaaaa3", "aaaaa4"}, db.ids)
+}
+
+func TestClose_stops_background(t *testing.T) {
+	db := &purgeableDB{ids: []string{"aaaaa1"}}
+	p := New(db, fakePool{}, zap.NewNop(), Config{Interval: 10 * time.Millisecond})
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	assert.Empty(t, db.ids)
+	assert.Greater(t, db.selects, 0)
+}
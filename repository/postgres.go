@@ -3,85 +3,278 @@ package repository
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"goshorturl/models"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func NewPG(port int, host, dbuser, dbname, password string) (Repository, error) {
+type Option struct {
+	f func(*postgresRepository)
+}
+
+// WithOutbox writes the events of the link changes into the outbox table in
+// the same transaction, see RelayOutbox().
+func WithOutbox() Option {
+	return Option{func(p *postgresRepository) {
+		p.outbox = true
+	}}
+}
+
+func NewPG(port int, host, dbuser, dbname, password string, options ...Option) (Repository, error) {
 	args := fmt.Sprintf("host=%s port=%v user=%s dbname=%s password=%s TimeZone=Asia/Taipei",
 		host, port, dbuser, dbname, password)
 	db, err := gorm.Open(postgres.Open(args), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
 
-	db.AutoMigrate(&models.Url{})
-	return &postgresRepository{db: db}, err
+	db.AutoMigrate(&models.Url{}, &models.UrlStat{}, &models.VariantStat{}, &models.UrlArchive{},
+		&models.Webhook{}, &models.WebhookDelivery{}, &models.OutboxEvent{})
+	// the trigram index serves the substring search of ListLinks(), the
+	// search still works by scanning if the extension is unavailable
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		db.Logger.Warn(context.Background(), "failed to create extension pg_trgm, the search of urls scans the table: %s", err)
+	} else if err := db.Exec(`CREATE INDEX IF NOT EXISTS "idx_urls_url_trgm" ON "urls" USING gin ("url" gin_trgm_ops)`).Error; err != nil {
+		db.Logger.Warn(context.Background(), "failed to create the trigram index, the search of urls scans the table: %s", err)
+	}
+	// the links became domain-scoped, AutoMigrate() adds the domain columns
+	// to the tables created before but leaves their primary keys, the links
+	// of the other domains would collide without them
+	for _, pk := range domainPrimaryKeys {
+		if err := migratePrimaryKey(db, pk.table, pk.alter); err != nil {
+			return nil, fmt.Errorf("failed to migrate the primary key of %s: %w", pk.table, err)
+		}
+	}
+	return newPostgresRepository(db, options), nil
+}
+
+// domainPrimaryKeys are the statements adding the domain to the primary keys,
+// see migratePrimaryKey().
+var domainPrimaryKeys = []struct {
+	table string
+	alter string
+}{
+	{"urls", `ALTER TABLE "urls" DROP CONSTRAINT IF EXISTS "urls_pkey", ADD PRIMARY KEY ("domain","id")`},
+	{"url_stats", `ALTER TABLE "url_stats" DROP CONSTRAINT IF EXISTS "url_stats_pkey", ADD PRIMARY KEY ("domain","id")`},
+	{"variant_stats", `ALTER TABLE "variant_stats" DROP CONSTRAINT IF EXISTS "variant_stats_pkey", ADD PRIMARY KEY ("domain","id","variant")`},
+}
+
+// migratePrimaryKey executes alter on table unless the domain is a part of
+// its primary key already.
+func migratePrimaryKey(db *gorm.DB, table, alter string) error {
+	var scoped int64
+	if err := db.Raw(`SELECT COUNT(*) FROM information_schema.key_column_usage `+
+		`WHERE table_name = ? AND constraint_name = ? AND column_name = 'domain'`, table, table+"_pkey").
+		Scan(&scoped).Error; err != nil {
+		return err
+	}
+	if scoped > 0 {
+		return nil
+	}
+	return db.Exec(alter).Error
 }
 
 // NewPGForTestWith is used for testing purposes (NO calls AutoMigrate() internally).
-func NewPGForTestWith(dial gorm.Dialector, cfg gorm.Config) (Repository, error) {
+func NewPGForTestWith(dial gorm.Dialector, cfg gorm.Config, options ...Option) (Repository, error) {
 	db, err := gorm.Open(dial, &cfg)
-	return &postgresRepository{db: db}, err
+	return newPostgresRepository(db, options), err
+}
+
+func newPostgresRepository(db *gorm.DB, options []Option) *postgresRepository {
+	p := &postgresRepository{db: db}
+	for _, option := range options {
+		option.f(p)
+	}
+	return p
 }
 
 type postgresRepository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	outbox bool
 }
 
-func (p *postgresRepository) Create(ctx context.Context, id, url string, expiredAt time.Time) error {
-	urlEntry := models.Url{
-		Id:        id,
-		Url:       url,
-		ExpiredAt: expiredAt,
+// resetClicks makes the remaining clicks of link start from its max clicks.
+func resetClicks(link *models.Url) {
+	link.RemainingClicks = nil
+	if link.MaxClicks != nil {
+		remaining := *link.MaxClicks
+		link.RemainingClicks = &remaining
 	}
-	return p.db.Create(&urlEntry).Error
 }
 
-func (p *postgresRepository) Update(ctx context.Context, id, url string, expiredAt time.Time) error {
-	res := p.db.
-		Debug().
-		Model(&models.Url{}).
-		Where("id = ?", id).
-		Updates(map[string]interface{}{
-			"url":        url,
-			"expired_at": expiredAt,
-			"deleted_at": nil,
-		})
-	if res.Error != nil {
-		return res.Error
-	}
-	if res.RowsAffected != 1 {
-		return ErrRecordNotFound
-	}
-	return nil
+// byKey narrows tx to the link of key. The conditions are always explicit,
+// since gorm skips the zero primary keys, e.g. the default domain.
+func byKey(tx *gorm.DB, key string) *gorm.DB {
+	domain, id := models.SplitKey(key)
+	return tx.Where("domain = ? AND id = ?", domain, id)
 }
 
-func (p *postgresRepository) Delete(ctx context.Context, id string) error {
-	res := p.db.Delete(&models.Url{Id: id})
-	if res.Error != nil {
-		return res.Error
+// keyPairs returns the (domain, id) of keys for the IN conditions.
+func keyPairs(keys []string) [][]interface{} {
+	pairs := make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		domain, id := models.SplitKey(key)
+		pairs = append(pairs, []interface{}{domain, id})
 	}
-	if res.RowsAffected != 1 {
-		return ErrRecordNotFound
+	return pairs
+}
+
+// emit writes the event in the transaction of the change if the outbox is
+// enabled.
+func (p *postgresRepository) emit(tx *gorm.DB, events ...*models.OutboxEvent) error {
+	if !p.outbox || len(events) == 0 {
+		return nil
 	}
-	return nil
+	return tx.Create(&events).Error
+}
+
+func (p *postgresRepository) Create(ctx context.Context, link *models.Url) error {
+	resetClicks(link)
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(link).Error; err != nil {
+			return err
+		}
+		return p.emit(tx, &models.OutboxEvent{Type: models.EventLinkCreated, Domain: link.Domain, UrlId: link.Id, Url: link.Url, ExpiredAt: link.ExpiredAt})
+	})
+}
+
+func (p *postgresRepository) Update(ctx context.Context, link *models.Url) error {
+	resetClicks(link)
+	// the recycled key is a new link
+	link.CreatedAt = time.Now()
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		res := byKey(tx.Debug().Model(&models.Url{}), link.Key()).
+			Updates(map[string]interface{}{
+				"url":              link.Url,
+				"expired_at":       link.ExpiredAt,
+				"max_clicks":       link.MaxClicks,
+				"remaining_clicks": link.RemainingClicks,
+				"password_hash":    link.PasswordHash,
+				"rules":            link.Rules,
+				"variants":         link.Variants,
+				"passthrough":      link.Passthrough,
+				"interstitial":     link.Interstitial,
+				"owner":            link.Owner,
+				"title":            link.Title,
+				"description":      link.Description,
+				"tags":             link.Tags,
+				"metadata":         link.Metadata,
+				"created_at":       link.CreatedAt,
+				"flagged_at":       nil,
+				"flag_reason":      "",
+				"deleted_at":       nil,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrRecordNotFound
+		}
+		// the recycled key starts counting from scratch
+		if err := byKey(tx, link.Key()).Delete(&models.UrlStat{}).Error; err != nil {
+			return err
+		}
+		if err := byKey(tx, link.Key()).Delete(&models.VariantStat{}).Error; err != nil {
+			return err
+		}
+		return p.emit(tx, &models.OutboxEvent{Type: models.EventLinkReused, Domain: link.Domain, UrlId: link.Id, Url: link.Url, ExpiredAt: link.ExpiredAt})
+	})
+}
+
+func (p *postgresRepository) Delete(ctx context.Context, key string) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		res := byKey(tx, key).Delete(&models.Url{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrRecordNotFound
+		}
+		domain, id := models.SplitKey(key)
+		return p.emit(tx, &models.OutboxEvent{Type: models.EventLinkDeleted, Domain: domain, UrlId: id})
+	})
 }
 
-func (p *postgresRepository) Get(ctx context.Context, id string) (string, error) {
+func (p *postgresRepository) Get(ctx context.Context, key string) (*models.Url, error) {
 	var result models.Url
+	domain, id := models.SplitKey(key)
 	if err := p.db.Where(
 		// REMINDER: GORM will use `"urls"."deleted_at" IS NULL` to filter the deleted record
-		"id = ? AND expired_at > ?",
-		id, time.Now(),
+		"domain = ? AND id = ? AND (expired_at IS NULL OR expired_at > ?)",
+		domain, id, time.Now(),
 	).Take(&result).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	if result.RemainingClicks != nil && *result.RemainingClicks <= 0 {
+		return nil, ErrGone
+	}
+	result.Protected = result.PasswordHash != ""
+	result.PasswordHash = ""
+	return &result, nil
+}
+
+func (p *postgresRepository) PasswordHash(ctx context.Context, key string) (string, error) {
+	var link models.Url
+	if err := byKey(p.db.WithContext(ctx).Select("password_hash"), key).
+		Take(&link).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return "", ErrRecordNotFound
 		}
 		return "", err
 	}
-	return result.Url, nil
+	return link.PasswordHash, nil
+}
+
+func (p *postgresRepository) GetMetadata(ctx context.Context, key string) (*models.Url, error) {
+	var result models.Url
+	if err := byKey(p.db.WithContext(ctx), key).
+		Take(&result).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	result.Protected = result.PasswordHash != ""
+	result.PasswordHash = ""
+	return &result, nil
+}
+
+func (p *postgresRepository) UpdateMetadata(ctx context.Context, key string, update MetadataUpdate) error {
+	// only the given columns are set, instead of writing back the link read
+	// before
+	fields := map[string]interface{}{}
+	if update.Title != nil {
+		fields["title"] = *update.Title
+	}
+	if update.Description != nil {
+		fields["description"] = *update.Description
+	}
+	if update.Tags != nil {
+		fields["tags"] = *update.Tags
+	}
+	if update.Metadata != nil {
+		fields["metadata"] = *update.Metadata
+	}
+	if len(fields) == 0 {
+		_, err := p.GetMetadata(ctx, key)
+		return err
+	}
+	res := byKey(p.db.WithContext(ctx).Model(&models.Url{}), key).Updates(fields)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return ErrRecordNotFound
+	}
+	return nil
 }
 
 func (p *postgresRepository) SelectDeletedAndExpired(ctx context.Context, limit int) ([]string, error) {
@@ -92,10 +285,11 @@ func (p *postgresRepository) SelectDeletedAndExpired(ctx context.Context, limit
 	var urls []models.Url
 	if err := p.db.
 		Debug().
-		Select("id").
+		Select("domain", "id").
 		Unscoped(). // call Unscoped() to find soft deleted records
 		Where("deleted_at IS NOT NULL").
 		Or("expired_at < ?", time.Now()).
+		Or("remaining_clicks <= 0").
 		Find(&urls).
 		Limit(limit).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -104,9 +298,381 @@ func (p *postgresRepository) SelectDeletedAndExpired(ctx context.Context, limit
 		return nil, err
 	}
 
-	ids := make([]string, 0, len(urls))
+	keys := make([]string, 0, len(urls))
+	for _, url := range urls {
+		keys = append(keys, url.Key())
+	}
+	return keys, nil
+}
+
+// Consume decrements the remaining clicks in a single statement, so that the
+// concurrent redirects across replicas never take more clicks than allowed.
+func (p *postgresRepository) Consume(ctx context.Context, key string) (int64, error) {
+	var remaining []int64
+	domain, id := models.SplitKey(key)
+	if err := p.db.
+		WithContext(ctx).
+		Raw(`UPDATE "urls" SET "remaining_clicks" = "remaining_clicks" - 1 `+
+			`WHERE "domain" = ? AND "id" = ? AND "remaining_clicks" > 0 AND "deleted_at" IS NULL RETURNING "remaining_clicks"`, domain, id).
+		Scan(&remaining).Error; err != nil {
+		return 0, err
+	}
+	if len(remaining) == 0 {
+		return 0, ErrGone
+	}
+	return remaining[0], nil
+}
+
+func (p *postgresRepository) AddClicks(ctx context.Context, clicks map[string]int64, accessedAt time.Time) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	stats := make([]models.UrlStat, 0, len(clicks))
+	events := make([]*models.OutboxEvent, 0, len(clicks))
+	for key, n := range clicks {
+		domain, id := models.SplitKey(key)
+		stats = append(stats, models.UrlStat{Domain: domain, Id: id, Clicks: n, AccessedAt: accessedAt})
+		events = append(events, &models.OutboxEvent{Type: models.EventLinkRedirected, Domain: domain, UrlId: id, Clicks: n, CreatedAt: accessedAt})
+	}
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "domain"}, {Name: "id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"clicks":      gorm.Expr(`"url_stats"."clicks" + "excluded"."clicks"`),
+				"accessed_at": gorm.Expr(`"excluded"."accessed_at"`),
+			}),
+		}).Create(&stats).Error; err != nil {
+			return err
+		}
+		return p.emit(tx, events...)
+	})
+}
+
+func (p *postgresRepository) AddVariantClicks(ctx context.Context, clicks []*models.VariantStat) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	return p.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "domain"}, {Name: "id"}, {Name: "variant"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"clicks": gorm.Expr(`"variant_stats"."clicks" + "excluded"."clicks"`),
+		}),
+	}).Create(&clicks).Error
+}
+
+func (p *postgresRepository) ListVariantStats(ctx context.Context, key string) ([]*models.VariantStat, error) {
+	var stats []*models.VariantStat
+	if err := byKey(p.db.WithContext(ctx), key).Order("variant").Find(&stats).Error; err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (p *postgresRepository) SelectPopular(ctx context.Context, orderBy string, offset, limit int) ([]*models.Url, error) {
+	order := `COALESCE("url_stats"."clicks", 0) DESC`
+	if orderBy == OrderByRecent {
+		// the links never clicked are ordered by when they were uploaded
+		order = `COALESCE("url_stats"."accessed_at", "urls"."updated_at") DESC`
+	}
+
+	var urls []*models.Url
+	if err := p.db.
+		WithContext(ctx).
+		Select(`"urls".*`).
+		Joins(`LEFT JOIN "url_stats" ON "url_stats"."domain" = "urls"."domain" AND "url_stats"."id" = "urls"."id"`).
+		Where(`("urls"."expired_at" IS NULL OR "urls"."expired_at" > ?)`, time.Now()).
+		Where(`("urls"."remaining_clicks" IS NULL OR "urls"."remaining_clicks" > 0)`).
+		Order(order).
+		Offset(offset).
+		Limit(limit).
+		Find(&urls).Error; err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// purgeableCondition should be used with Unscoped() to find the soft
+// deleted records.
+const purgeableCondition = "(deleted_at < ? OR expired_at < ?)"
+
+func (p *postgresRepository) SelectPurgeable(ctx context.Context, before time.Time, after string, limit int) ([]string, error) {
+	var urls []models.Url
+	if err := afterKey(p.db.WithContext(ctx).Unscoped(), after).
+		Select("domain", "id").
+		Where(purgeableCondition, before, before).
+		Order("domain, id").
+		Limit(limit).
+		Find(&urls).Error; err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(urls))
 	for _, url := range urls {
-		ids = append(ids, url.Id)
+		keys = append(keys, url.Key())
+	}
+	return keys, nil
+}
+
+// afterKey narrows tx to the links ordered by domain and id after key.
+func afterKey(tx *gorm.DB, key string) *gorm.DB {
+	domain, id := models.SplitKey(key)
+	return tx.Where("(domain, id) > (?, ?)", domain, id)
+}
+
+func (p *postgresRepository) Purge(ctx context.Context, keys []string, before time.Time, archive bool) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	pairs := keyPairs(keys)
+	var purged int64
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// check the condition again, the keys may have been recycled since
+		// they were selected
+		if archive {
+			if err := tx.Exec(`INSERT INTO "url_archives" ("domain","id","url","expired_at","created_at","updated_at","deleted_at","archived_at") `+
+				`SELECT "domain","id","url","expired_at","created_at","updated_at","deleted_at",? FROM "urls" WHERE (domain, id) IN ? AND `+purgeableCondition,
+				time.Now(), pairs, before, before).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Unscoped().Where("(domain, id) IN ?", pairs).Where(purgeableCondition, before, before).Delete(&models.Url{})
+		if res.Error != nil {
+			return res.Error
+		}
+		purged = res.RowsAffected
+		if err := tx.Exec(`DELETE FROM "url_stats" WHERE (domain, id) IN ? AND NOT EXISTS `+
+			`(SELECT 1 FROM "urls" WHERE "urls"."domain" = "url_stats"."domain" AND "urls"."id" = "url_stats"."id")`, pairs).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM "variant_stats" WHERE (domain, id) IN ? AND NOT EXISTS `+
+			`(SELECT 1 FROM "urls" WHERE "urls"."domain" = "variant_stats"."domain" AND "urls"."id" = "variant_stats"."id")`, pairs).Error
+	})
+	return purged, err
+}
+
+func (p *postgresRepository) SelectLive(ctx context.Context, after string, limit int) ([]*models.Url, error) {
+	var urls []*models.Url
+	if err := afterKey(p.db.WithContext(ctx), after).
+		Where("(expired_at IS NULL OR expired_at > ?)", time.Now()).
+		Where("(remaining_clicks IS NULL OR remaining_clicks > 0)").
+		Order("domain, id").
+		Limit(limit).
+		Find(&urls).Error; err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (p *postgresRepository) Flag(ctx context.Context, key string, reason string) error {
+	var flaggedAt *time.Time
+	if reason != "" {
+		now := time.Now()
+		flaggedAt = &now
+	}
+	res := byKey(p.db.WithContext(ctx).Model(&models.Url{}), key).
+		Updates(map[string]interface{}{"flagged_at": flaggedAt, "flag_reason": reason})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *postgresRepository) ListLinks(ctx context.Context, query LinkQuery) ([]*models.Url, error) {
+	now := time.Now()
+	tx := p.db.WithContext(ctx).Unscoped()
+	switch query.State {
+	case StateActive:
+		tx = tx.
+			Where("deleted_at IS NULL").
+			Where("(expired_at IS NULL OR expired_at > ?)", now).
+			Where("(remaining_clicks IS NULL OR remaining_clicks > 0)")
+	case StateExpired:
+		tx = tx.
+			Where("deleted_at IS NULL").
+			Where("(expired_at <= ? OR remaining_clicks <= 0)", now)
+	case StateDeleted:
+		tx = tx.Where("deleted_at IS NOT NULL")
+	default:
+		tx = tx.Where("deleted_at IS NULL")
+	}
+	if query.Domain != nil {
+		tx = tx.Where("domain = ?", *query.Domain)
+	}
+	if query.Owner != "" {
+		tx = tx.Where("owner = ?", query.Owner)
+	}
+	if !query.CreatedFrom.IsZero() {
+		tx = tx.Where("created_at >= ?", query.CreatedFrom)
+	}
+	if !query.CreatedTo.IsZero() {
+		tx = tx.Where("created_at < ?", query.CreatedTo)
+	}
+	if !query.ExpiresFrom.IsZero() {
+		tx = tx.Where("expired_at >= ?", query.ExpiresFrom)
+	}
+	if !query.ExpiresTo.IsZero() {
+		tx = tx.Where("expired_at < ?", query.ExpiresTo)
+	}
+	if query.Search != "" {
+		tx = tx.Where("url ILIKE ?", "%"+escapeLike(query.Search)+"%")
+	}
+	if query.Tag != "" {
+		// containment is served by the GIN index of tags
+		tx = tx.Where("tags @> ?", models.Tags{query.Tag})
+	}
+	if query.After != nil {
+		tx = tx.Where("(created_at, domain, id) < (?, ?, ?)", query.After.CreatedAt, query.After.Domain, query.After.Id)
+	}
+
+	var urls []*models.Url
+	if err := tx.
+		// the same id may be taken on the other domains
+		Order("created_at DESC, domain DESC, id DESC").
+		Limit(query.Limit).
+		Find(&urls).Error; err != nil {
+		return nil, err
+	}
+	for _, link := range urls {
+		link.Protected = link.PasswordHash != ""
+		link.PasswordHash = ""
+	}
+	return urls, nil
+}
+
+// escapeLike escapes the wildcards of LIKE, backslash is the default escape
+// character of Postgres.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (p *postgresRepository) SelectExpiring(ctx context.Context, from, to time.Time, after string, limit int) ([]*models.Url, error) {
+	var urls []*models.Url
+	if err := afterKey(p.db.WithContext(ctx), after).
+		Where("expired_at >= ? AND expired_at < ?", from, to).
+		Order("domain, id").
+		Limit(limit).
+		Find(&urls).Error; err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (p *postgresRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	return p.db.WithContext(ctx).Create(webhook).Error
+}
+
+func (p *postgresRepository) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	var webhooks []*models.Webhook
+	if err := p.db.WithContext(ctx).Order("id").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (p *postgresRepository) DeleteWebhook(ctx context.Context, id uint) error {
+	res := p.db.WithContext(ctx).Delete(&models.Webhook{Id: id})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *postgresRepository) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) (int64, error) {
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	res := p.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoNothing: true,
+	}).Create(&deliveries)
+	return res.RowsAffected, res.Error
+}
+
+func (p *postgresRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*models.WebhookDelivery, error) {
+	var deliveries []*models.WebhookDelivery
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// skip the rows locked by the other replicas instead of waiting
+		if err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries).Error; err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		ids := make([]uint, 0, len(deliveries))
+		for _, d := range deliveries {
+			ids = append(ids, d.Id)
+		}
+		return tx.Model(&models.WebhookDelivery{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (p *postgresRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	return p.db.WithContext(ctx).Save(delivery).Error
+}
+
+func (p *postgresRepository) ListDeliveries(ctx context.Context, webhookID uint, limit int) ([]*models.WebhookDelivery, error) {
+	var deliveries []*models.WebhookDelivery
+	if err := p.db.
+		WithContext(ctx).
+		Where("webhook_id = ?", webhookID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (p *postgresRepository) RelayOutbox(ctx context.Context, limit int, relay func(events []*models.OutboxEvent) error) (int, error) {
+	var events []*models.OutboxEvent
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// skip the rows being relayed by the other replicas instead of
+		// waiting
+		if err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Order("seq").
+			Limit(limit).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if err := relay(events); err != nil {
+			return err
+		}
+		seqs := make([]uint64, 0, len(events))
+		for _, e := range events {
+			seqs = append(seqs, e.Seq)
+		}
+		return tx.Where("seq IN ?", seqs).Delete(&models.OutboxEvent{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+func (p *postgresRepository) Ping(ctx context.Context) error {
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		return err
 	}
-	return ids, nil
+	return sqlDB.PingContext(ctx)
 }
@@ -4,28 +4,169 @@ import (
 	"context"
 	"errors"
 	"time"
+
+	"goshorturl/models"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	// ErrBusy is returned when a request is shed to protect the storage.
+	ErrBusy = errors.New("storage is busy")
+	// ErrGone is returned when the clicks of a link are exhausted.
+	ErrGone = errors.New("record is gone")
 )
 
+// Repository identifies the links by their keys, i.e. models.Key() of the
+// domain and id.
 type Repository interface {
-	Create(ctx context.Context, id, url string, expiredAt time.Time) error
-	Update(ctx context.Context, id, url string, expiredAt time.Time) error
-	Delete(ctx context.Context, id string) error
-	Get(ctx context.Context, id string) (string, error)
+	// Create and Update store the link of link.Key(), the remaining clicks
+	// start from link.MaxClicks. Update overwrites the recycled key.
+	Create(ctx context.Context, link *models.Url) error
+	Update(ctx context.Context, link *models.Url) error
+	Delete(ctx context.Context, key string) error
+	// Get returns ErrGone if the clicks of the link are exhausted. The
+	// returned link never carries the password hash, see PasswordHash().
+	Get(ctx context.Context, key string) (*models.Url, error)
+	// PasswordHash returns the password hash of the link, it is never
+	// cached.
+	PasswordHash(ctx context.Context, key string) (string, error)
+	// GetMetadata returns the link of key even if it is expired or
+	// exhausted, with the descriptive fields which Get() may omit since
+	// they are not cached. The returned link never carries the password
+	// hash.
+	GetMetadata(ctx context.Context, key string) (*models.Url, error)
+	// UpdateMetadata overwrites the given fields of update of the link of
+	// key, which never affect the redirects. The other fields are left as
+	// they are, so the concurrent updates of them are not lost. It returns
+	// ErrRecordNotFound if the link is deleted.
+	UpdateMetadata(ctx context.Context, key string, update MetadataUpdate) error
+	// SelectDeletedAndExpired returns the recyclable keys, which are
+	// deleted, expired or exhausted.
 	SelectDeletedAndExpired(ctx context.Context, limit int) ([]string, error)
+	// Consume takes a click from the link of limited clicks, and returns
+	// the remaining clicks. It returns ErrGone if none remains.
+	Consume(ctx context.Context, key string) (int64, error)
+
+	// AddClicks adds the number of clicks of each key, and marks them as
+	// accessed at the given time.
+	AddClicks(ctx context.Context, clicks map[string]int64, accessedAt time.Time) error
+	// AddVariantClicks adds the number of clicks of each variant, the clicks
+	// of their links are added by AddClicks().
+	AddVariantClicks(ctx context.Context, clicks []*models.VariantStat) error
+	// ListVariantStats returns the clicks of the variants of key ordered
+	// by name, the variants never clicked are absent.
+	ListVariantStats(ctx context.Context, key string) ([]*models.VariantStat, error)
+	// SelectPopular returns the live links ordered by the given criteria,
+	// i.e. OrderByRecent or OrderByClicks.
+	SelectPopular(ctx context.Context, orderBy string, offset, limit int) ([]*models.Url, error)
+
+	// SelectPurgeable returns the keys ordered by domain and id after the
+	// given one, which were deleted or expired before the given time.
+	SelectPurgeable(ctx context.Context, before time.Time, after string, limit int) ([]string, error)
+	// Purge hard-deletes the records of keys which are still deleted or
+	// expired before the given time, and returns the number of them. The
+	// records are copied into the archive first if archive is true.
+	Purge(ctx context.Context, keys []string, before time.Time, archive bool) (int64, error)
+
+	// SelectLive returns the live links, i.e. not deleted, expired or
+	// exhausted, ordered by domain and id after the given key.
+	SelectLive(ctx context.Context, after string, limit int) ([]*models.Url, error)
+	// Flag disables the link of key for reason, or enables it again if
+	// reason is empty. It returns ErrRecordNotFound if the link is deleted.
+	Flag(ctx context.Context, key string, reason string) error
+
+	// ListLinks returns the links matching query, newest first, see
+	// LinkQuery. The returned links never carry the password hash.
+	ListLinks(ctx context.Context, query LinkQuery) ([]*models.Url, error)
+
+	// SelectExpiring returns the links not deleted ordered by domain and id
+	// after the given key, which expire in [from, to).
+	SelectExpiring(ctx context.Context, from, to time.Time, after string, limit int) ([]*models.Url, error)
+
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	ListWebhooks(ctx context.Context) ([]*models.Webhook, error)
+	DeleteWebhook(ctx context.Context, id uint) error
+	// EnqueueDeliveries creates the pending deliveries, the ones whose key
+	// exists already are ignored. It returns the number of created ones.
+	EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) (int64, error)
+	// ClaimDeliveries returns the pending deliveries due at now, and
+	// postpones their next attempt by lease, so that the other replicas do
+	// not claim them in the meanwhile.
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*models.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+	// ListDeliveries returns the latest deliveries of the webhook.
+	ListDeliveries(ctx context.Context, webhookID uint, limit int) ([]*models.WebhookDelivery, error)
+
+	// RelayOutbox passes the oldest events of the outbox to relay, and
+	// removes them if relay succeeds. It returns the number of relayed
+	// events.
+	RelayOutbox(ctx context.Context, limit int, relay func(events []*models.OutboxEvent) error) (int, error)
+
+	// Ping checks whether the storage is reachable.
+	Ping(ctx context.Context) error
+}
+
+const (
+	OrderByRecent = "recent"
+	OrderByClicks = "clicks"
+)
+
+// The states of the links filtered by LinkQuery.
+const (
+	StateActive = "active"
+	// StateExpired includes the links of exhausted clicks.
+	StateExpired = "expired"
+	StateDeleted = "deleted"
+)
+
+// LinkQuery filters the links of ListLinks(), the zero values match any.
+// The time ranges are [from, to).
+type LinkQuery struct {
+	// Domain is nil to match the links of any domain, and points to the
+	// empty string for the default domain.
+	Domain *string
+	Owner  string
+	// State is one of the State constants, empty means any state but
+	// StateDeleted.
+	State       string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// ExpiresFrom and ExpiresTo never match the links never expire.
+	ExpiresFrom time.Time
+	ExpiresTo   time.Time
+	// Search is a case-insensitive substring of the URL.
+	Search string
+	// Tag is one of the tags of the links.
+	Tag string
+	// After is the last link of the previous page, nil for the first page.
+	After *Cursor
+	Limit int
+}
+
+// MetadataUpdate is the descriptive fields of UpdateMetadata(), the nil ones
+// are left unchanged.
+type MetadataUpdate struct {
+	Title       *string
+	Description *string
+	Tags        *models.Tags
+	Metadata    *models.Metadata
+}
+
+// Cursor is the position of a link in the order of ListLinks().
+type Cursor struct {
+	CreatedAt time.Time
+	Domain    string
+	Id        string
 }
 
 // UnimplementedRepository is mainly used in tests to reuse the codes.
 type UnimplementedRepository struct{}
 
-func (u *UnimplementedRepository) Create(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (u *UnimplementedRepository) Create(ctx context.Context, link *models.Url) error {
 	return nil
 }
 
-func (u *UnimplementedRepository) Update(ctx context.Context, id, url string, expiredAt time.Time) error {
+func (u *UnimplementedRepository) Update(ctx context.Context, link *models.Url) error {
 	return nil
 }
 
@@ -37,6 +178,98 @@ func (u *UnimplementedRepository) SelectDeletedAndExpired(ctx context.Context, l
 	return nil, nil
 }
 
-func (u *UnimplementedRepository) Get(ctx context.Context, id string) (string, error) {
+func (u *UnimplementedRepository) PasswordHash(ctx context.Context, id string) (string, error) {
 	return "", nil
 }
+
+func (u *UnimplementedRepository) GetMetadata(ctx context.Context, id string) (*models.Url, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) UpdateMetadata(ctx context.Context, id string, update MetadataUpdate) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) Consume(ctx context.Context, id string) (int64, error) {
+	return 0, nil
+}
+
+func (u *UnimplementedRepository) AddClicks(ctx context.Context, clicks map[string]int64, accessedAt time.Time) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) AddVariantClicks(ctx context.Context, clicks []*models.VariantStat) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) ListVariantStats(ctx context.Context, id string) ([]*models.VariantStat, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) SelectPopular(ctx context.Context, orderBy string, offset, limit int) ([]*models.Url, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) SelectPurgeable(ctx context.Context, before time.Time, after string, limit int) ([]string, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) Purge(ctx context.Context, ids []string, before time.Time, archive bool) (int64, error) {
+	return 0, nil
+}
+
+func (u *UnimplementedRepository) SelectLive(ctx context.Context, after string, limit int) ([]*models.Url, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) Flag(ctx context.Context, id string, reason string) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) ListLinks(ctx context.Context, query LinkQuery) ([]*models.Url, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) SelectExpiring(ctx context.Context, from, to time.Time, after string, limit int) ([]*models.Url, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) ListWebhooks(ctx context.Context) ([]*models.Webhook, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) DeleteWebhook(ctx context.Context, id uint) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) EnqueueDeliveries(ctx context.Context, deliveries []*models.WebhookDelivery) (int64, error) {
+	return 0, nil
+}
+
+func (u *UnimplementedRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) ListDeliveries(ctx context.Context, webhookID uint, limit int) ([]*models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (u *UnimplementedRepository) RelayOutbox(ctx context.Context, limit int, relay func(events []*models.OutboxEvent) error) (int, error) {
+	return 0, nil
+}
+
+func (u *UnimplementedRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (u *UnimplementedRepository) Get(ctx context.Context, id string) (*models.Url, error) {
+	return &models.Url{Id: id}, nil
+}
@@ -0,0 +1,236 @@
+package reputation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"goshorturl/pkg/filewatch"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultReloadInterval = time.Minute
+	// minPrefixLength is the shortest hash prefix in bytes, the same as the
+	// one of Safe Browsing.
+	minPrefixLength = 4
+	maxHostSuffixes = 4
+	maxPathPrefixes = 4
+)
+
+// Blocklist is a Checker backed by a local file of SHA-256 hash prefixes of
+// the URL expressions, in the manner of Safe Browsing, so that the list
+// could be updated offline without revealing the URLs. See Expressions().
+//
+// Each line of the file is "<threat> <hex hash prefix>", e.g.
+// "phishing 3f2a8b1c", and the prefix is at least 4 bytes long. The empty
+// lines and the ones starting with "#" are ignored.
+type Blocklist struct {
+	path   string
+	hashes atomic.Value // hashDB
+	stop   func()
+}
+
+// NewBlocklist loads the file of path, and reloads it every reloadInterval
+// once it is modified. The last hashes are kept if the reload fails.
+func NewBlocklist(path string, reloadInterval time.Duration, logger *zap.Logger) (*Blocklist, error) {
+	if reloadInterval <= 0 {
+		reloadInterval = defaultReloadInterval
+	}
+	b := &Blocklist{path: path}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	b.stop = filewatch.Watch(path, reloadInterval, b.load, logger)
+	return b, nil
+}
+
+func (b *Blocklist) load() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hashes, err := readHashes(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.path, err)
+	}
+	b.hashes.Store(hashes)
+	return nil
+}
+
+// Close stops reloading the file.
+func (b *Blocklist) Close() {
+	b.stop()
+}
+
+func (b *Blocklist) Check(ctx context.Context, target string) (Verdict, error) {
+	return b.hashes.Load().(hashDB).check(target)
+}
+
+type hashEntry struct {
+	prefix []byte
+	threat string
+}
+
+// hashDB indexes the entries by their first minPrefixLength bytes.
+type hashDB map[[minPrefixLength]byte][]hashEntry
+
+func readHashes(r io.Reader) (hashDB, error) {
+	db := make(hashDB)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: should be \"<threat> <hex hash prefix>\"", line)
+		}
+		prefix, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(prefix) < minPrefixLength || len(prefix) > sha256.Size {
+			return nil, fmt.Errorf("line %d: hash prefix should be %d to %d bytes", line, minPrefixLength, sha256.Size)
+		}
+		var key [minPrefixLength]byte
+		copy(key[:], prefix)
+		db[key] = append(db[key], hashEntry{prefix: prefix, threat: fields[0]})
+	}
+	return db, scanner.Err()
+}
+
+func (db hashDB) check(target string) (Verdict, error) {
+	expressions, err := Expressions(target)
+	if err != nil {
+		return Verdict{}, err
+	}
+	for _, expression := range expressions {
+		hash := sha256.Sum256([]byte(expression))
+		var key [minPrefixLength]byte
+		copy(key[:], hash[:])
+		for _, entry := range db[key] {
+			if bytes.HasPrefix(hash[:], entry.prefix) {
+				return Verdict{Threat: entry.threat}, nil
+			}
+		}
+	}
+	return Verdict{}, nil
+}
+
+// Expressions returns the canonical host-suffix/path-prefix expressions of
+// target, e.g. "a.b.example.com/1/2.html?q" gives "a.b.example.com/1/2.html?q",
+// "b.example.com/1/" and "example.com/" among others. An entry of the
+// blocklist is the hash of one of them, e.g. the output of
+//
+//	printf '%s' 'example.com/' | sha256sum
+func Expressions(target string) ([]string, error) {
+	host, p, query, err := canonicalize(target)
+	if err != nil {
+		return nil, err
+	}
+	var expressions []string
+	for _, h := range hostSuffixes(host) {
+		for _, prefix := range pathPrefixes(p, query) {
+			expressions = append(expressions, h+prefix)
+		}
+	}
+	return expressions, nil
+}
+
+func canonicalize(target string) (host, p, query string, err error) {
+	u, err := url.Parse(strings.TrimSpace(target))
+	if err != nil {
+		return "", "", "", err
+	}
+	host = strings.ToLower(u.Hostname())
+	host = strings.Trim(host, ".")
+	for strings.Contains(host, "..") {
+		host = strings.Replace(host, "..", ".", -1)
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("missing host: %s", target)
+	}
+
+	p = u.Path
+	if p == "" {
+		p = "/"
+	}
+	trailing := strings.HasSuffix(p, "/")
+	p = path.Clean(p)
+	if trailing && p != "/" {
+		p += "/"
+	}
+	return host, escape(p), u.RawQuery, nil
+}
+
+// escape escapes the control characters, spaces, non-ASCII, "#" and "%".
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= 0x20 || c >= 0x7f || c == '#' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// hostSuffixes returns host and up to 4 of its suffixes starting with the
+// last 5 components, the top-level domain is skipped.
+func hostSuffixes(host string) []string {
+	suffixes := []string{host}
+	if net.ParseIP(host) != nil {
+		return suffixes
+	}
+	components := strings.Split(host, ".")
+	start := len(components) - 5
+	if start < 1 {
+		start = 1
+	}
+	for i := start; i < len(components)-1 && len(suffixes) <= maxHostSuffixes; i++ {
+		suffixes = append(suffixes, strings.Join(components[i:], "."))
+	}
+	return suffixes
+}
+
+// pathPrefixes returns the path with and without the query, and up to 4
+// prefixes of the path from the root.
+func pathPrefixes(p, query string) []string {
+	var prefixes []string
+	if query != "" {
+		prefixes = append(prefixes, p+"?"+query)
+	}
+	prefixes = append(prefixes, p)
+	dirs := strings.Split(strings.Trim(p, "/"), "/")
+	if !strings.HasSuffix(p, "/") {
+		// the last component is a file
+		dirs = dirs[:len(dirs)-1]
+	}
+	prefix := "/"
+	for i := 0; i < maxPathPrefixes; i++ {
+		if prefix != p {
+			prefixes = append(prefixes, prefix)
+		}
+		if i >= len(dirs) || dirs[i] == "" {
+			break
+		}
+		prefix += dirs[i] + "/"
+	}
+	return prefixes
+}
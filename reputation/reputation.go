@@ -0,0 +1,36 @@
+// Package reputation checks the targets of links against the known phishing
+// and malware URLs, both on upload and by re-scanning the live links.
+package reputation
+
+import (
+	"context"
+	"goshorturl/models"
+)
+
+// Verdict is the result of checking a URL.
+type Verdict struct {
+	// Threat is the type of the matched threat, e.g. "phishing", empty if
+	// the URL is clean.
+	Threat string
+}
+
+func (v Verdict) Flagged() bool {
+	return v.Threat != ""
+}
+
+// Checker is implemented by the sources of URL reputation, e.g. Blocklist.
+type Checker interface {
+	Check(ctx context.Context, target string) (Verdict, error)
+}
+
+// CheckLink checks all the targets of link, and returns the first flagged
+// verdict.
+func CheckLink(ctx context.Context, checker Checker, link *models.Url) (Verdict, error) {
+	for _, target := range link.Targets() {
+		verdict, err := checker.Check(ctx, target)
+		if err != nil || verdict.Flagged() {
+			return verdict, err
+		}
+	}
+	return Verdict{}, nil
+}
@@ -0,0 +1,206 @@
+package reputation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func prefixOf(expression string, n int) string {
+	hash := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(hash[:n])
+}
+
+func TestExpressions(t *testing.T) {
+	got, err := Expressions("http://a.b.c/1/2.html?param=1#frag")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+		"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+	}, got)
+
+	got, err = Expressions("https://A.B.C.D.E.F.G/1/")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"a.b.c.d.e.f.g/1/", "a.b.c.d.e.f.g/",
+		"c.d.e.f.g/1/", "c.d.e.f.g/",
+		"d.e.f.g/1/", "d.e.f.g/",
+		"e.f.g/1/", "e.f.g/",
+		"f.g/1/", "f.g/",
+	}, got)
+
+	got, err = Expressions("http://1.2.3.4/a/../b")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.3.4/b", "1.2.3.4/"}, got, "should resolve the path")
+
+	_, err = Expressions("mailto:someone@example.com")
+	assert.Error(t, err)
+}
+
+func TestReadHashes(t *testing.T) {
+	db, err := readHashes(strings.NewReader(fmt.Sprintf("# comment\n\nphishing %s\nmalware %s\n",
+		prefixOf("evil.example.com/", 4), prefixOf("example.org/download/", 32))))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		target string
+		threat string
+	}{
+		{"https://evil.example.com", "phishing"},
+		{"https://www.evil.example.com/login?next=/", "phishing"},
+		{"https://example.com", ""},
+		{"https://example.org/download/payload.exe", "malware"},
+		{"https://example.org/download", ""},
+	}
+	for _, tt := range tests {
+		verdict, err := db.check(tt.target)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.threat, verdict.Threat, tt.target)
+	}
+
+	invalid := []string{"phishing\n", "phishing zz\n", "phishing 0102\n"}
+	for _, text := range invalid {
+		_, err := readHashes(strings.NewReader(text))
+		assert.Error(t, err, text)
+	}
+}
+
+func TestBlocklist_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reputation")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blocklist.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("phishing "+prefixOf("evil.example.com/", 4)+"\n"), 0644))
+
+	b, err := NewBlocklist(file, 10*time.Millisecond, zap.NewNop())
+	assert.NoError(t, err)
+	defer b.Close()
+
+	ctx := context.Background()
+	verdict, err := b.Check(ctx, "https://evil.example.com")
+	assert.NoError(t, err)
+	assert.True(t, verdict.Flagged())
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("malware "+prefixOf("example.org/", 8)+"\n"), 0644))
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(file, later, later))
+	assert.Eventually(t, func() bool {
+		verdict, _ := b.Check(ctx, "https://example.org/anything")
+		return verdict.Threat == "malware"
+	}, time.Second, 10*time.Millisecond, "should reload the file")
+	verdict, _ = b.Check(ctx, "https://evil.example.com")
+	assert.False(t, verdict.Flagged())
+
+	_, err = NewBlocklist(filepath.Join(dir, "missing.txt"), 0, zap.NewNop())
+	assert.Error(t, err)
+}
+
+type fakeChecker map[string]string
+
+func (f fakeChecker) Check(ctx context.Context, target string) (Verdict, error) {
+	return Verdict{Threat: f[target]}, nil
+}
+
+func TestCheckLink(t *testing.T) {
+	checker := fakeChecker{"https://evil.example.com": "phishing"}
+	link := &models.Url{Url: "https://example.com", Rules: models.TargetRules{
+		{Platform: "ios", Url: "https://evil.example.com"},
+	}}
+	verdict, err := CheckLink(context.Background(), checker, link)
+	assert.NoError(t, err)
+	assert.Equal(t, "phishing", verdict.Threat, "should check the rules")
+}
+
+type liveDB struct {
+	repository.UnimplementedRepository
+	mu    sync.Mutex
+	links map[string]*models.Url
+	// deleted are selected but gone when flagged
+	deleted map[string]bool
+}
+
+func (l *liveDB) SelectLive(ctx context.Context, after string, limit int) ([]*models.Url, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []string
+	for id := range l.links {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	links := make([]*models.Url, len(ids))
+	for i, id := range ids {
+		link := *l.links[id]
+		links[i] = &link
+	}
+	return links, nil
+}
+
+func (l *liveDB) Flag(ctx context.Context, id string, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deleted[id] {
+		return repository.ErrRecordNotFound
+	}
+	link := l.links[id]
+	link.FlaggedAt, link.FlagReason = nil, reason
+	if reason != "" {
+		now := time.Now()
+		link.FlaggedAt = &now
+	}
+	return nil
+}
+
+func TestScanner(t *testing.T) {
+	flaggedAt := time.Now()
+	db := &liveDB{links: map[string]*models.Url{
+		"aaaaaa": {Id: "aaaaaa", Url: "https://example.com"},
+		"bbbbbb": {Id: "bbbbbb", Url: "https://evil.example.com"},
+		"cccccc": {Id: "cccccc", Url: "https://example.org", FlaggedAt: &flaggedAt, FlagReason: "phishing"},
+		"dddddd": {Id: "dddddd", Url: "https://evil.example.com", FlaggedAt: &flaggedAt, FlagReason: "phishing"},
+	}}
+	s := NewScanner(db, fakeChecker{"https://evil.example.com": "phishing"}, zap.NewNop(), ScanConfig{Interval: time.Hour, BatchSize: 3})
+	defer s.Close()
+
+	report, err := s.Scan(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ScanReport{Scanned: 4, Flagged: 1, Unflagged: 1}, report)
+	assert.Equal(t, "phishing", db.links["bbbbbb"].FlagReason)
+	assert.Nil(t, db.links["cccccc"].FlaggedAt, "should enable the link no longer listed")
+	assert.Equal(t, &flaggedAt, db.links["dddddd"].FlaggedAt, "should keep when it was flagged")
+}
+
+func TestScanner_flag_error(t *testing.T) {
+	db := &liveDB{
+		links: map[string]*models.Url{
+			"aaaaaa": {Id: "aaaaaa", Url: "https://evil.example.com"},
+			"bbbbbb": {Id: "bbbbbb", Url: "https://evil.example.com"},
+		},
+		deleted: map[string]bool{"aaaaaa": true},
+	}
+	s := NewScanner(db, fakeChecker{"https://evil.example.com": "phishing"}, zap.NewNop(), ScanConfig{Interval: time.Hour, BatchSize: 3})
+	defer s.Close()
+
+	report, err := s.Scan(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ScanReport{Scanned: 2, Flagged: 1}, report)
+	assert.Equal(t, "phishing", db.links["bbbbbb"].FlagReason, "should go on with the other links")
+}
@@ -0,0 +1,138 @@
+package reputation
+
+import (
+	"context"
+	"goshorturl/repository"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultScanInterval  = time.Hour
+	defaultScanBatchSize = 500
+	scanTimeout          = 10 * time.Minute
+)
+
+type ScanConfig struct {
+	// Interval is how often to re-scan the live links.
+	Interval  time.Duration
+	BatchSize int
+}
+
+// ScanReport is the result of a scan.
+type ScanReport struct {
+	Scanned   int
+	Flagged   int
+	Unflagged int
+}
+
+// Scanner re-scans the live links in background, so that the links turned
+// malicious after upload are flagged, and the ones no longer listed are
+// enabled again.
+type Scanner interface {
+	// Scan scans all the live links batch by batch.
+	Scan(ctx context.Context) (ScanReport, error)
+	// Close stops scanning in background.
+	Close()
+}
+
+func NewScanner(db repository.Repository, checker Checker, logger *zap.Logger, config ScanConfig) Scanner {
+	if config.Interval <= 0 {
+		config.Interval = defaultScanInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultScanBatchSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scanner{
+		db:      db,
+		checker: checker,
+		logger:  logger,
+		config:  config,
+		cancel:  cancel,
+	}
+	s.wg.Add(1)
+	go s.loop(ctx)
+	return s
+}
+
+type scanner struct {
+	db      repository.Repository
+	checker Checker
+	logger  *zap.Logger
+	config  ScanConfig
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (s *scanner) Scan(ctx context.Context) (ScanReport, error) {
+	var report ScanReport
+	// keyset pagination, so that the flagged links are not skipped
+	after := ""
+	for {
+		links, err := s.db.SelectLive(ctx, after, s.config.BatchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, link := range links {
+			verdict, err := CheckLink(ctx, s.checker, link)
+			if err != nil {
+				// e.g. the checker is unavailable, leave the link as it is
+				s.logger.Warn("check link reputation error", zap.String("key", link.Key()), zap.Error(err))
+				continue
+			}
+			switch {
+			case verdict.Flagged() && link.FlaggedAt == nil:
+				if err := s.db.Flag(ctx, link.Key(), verdict.Threat); err != nil {
+					// e.g. the link is deleted during the scan, go on with the others
+					s.logger.Warn("flag link error", zap.String("key", link.Key()), zap.Error(err))
+					continue
+				}
+				s.logger.Warn("flag link", zap.String("key", link.Key()), zap.String("threat", verdict.Threat))
+				report.Flagged++
+			case !verdict.Flagged() && link.FlaggedAt != nil:
+				if err := s.db.Flag(ctx, link.Key(), ""); err != nil {
+					s.logger.Warn("unflag link error", zap.String("key", link.Key()), zap.Error(err))
+					continue
+				}
+				s.logger.Info("unflag link", zap.String("key", link.Key()))
+				report.Unflagged++
+			}
+		}
+		report.Scanned += len(links)
+		if len(links) < s.config.BatchSize {
+			return report, nil
+		}
+		after = links[len(links)-1].Key()
+	}
+}
+
+func (s *scanner) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *scanner) loop(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
+			report, err := s.Scan(scanCtx)
+			cancel()
+			if err != nil {
+				s.logger.Error("scan link reputation error", zap.Error(err))
+				continue
+			}
+			s.logger.Info("scan link reputation", zap.Int("scanned", report.Scanned),
+				zap.Int("flagged", report.Flagged), zap.Int("unflagged", report.Unflagged))
+		}
+	}
+}
@@ -2,10 +2,25 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"expvar"
+	"goshorturl/cache/breaker"
 	"goshorturl/controllers"
+	"goshorturl/health"
 	"goshorturl/idgenerator"
+	"goshorturl/notifier"
+	"goshorturl/pkg/throttle"
+	"goshorturl/purger"
 	"goshorturl/repository"
+	"goshorturl/reputation"
+	"goshorturl/targeting"
+	"goshorturl/tracker"
+	"goshorturl/urlpolicy"
+	"goshorturl/warmup"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,29 +29,271 @@ import (
 
 const (
 	defaultTimeout = 30 * time.Second
+
+	defaultPasswordAttempts     = 5
+	defaultPasswordLinkAttempts = 100
+	defaultPasswordLockout      = 15 * time.Minute
 )
 
-func NewRouter(db repository.Repository, idGenerator idgenerator.IDGenerator, logger *zap.Logger, redirectOrigin string) *gin.Engine {
+type routerOptions struct {
+	tracker     tracker.Tracker
+	warmer      warmup.Warmer
+	purger      purger.Purger
+	notifier    notifier.Notifier
+	maxLifetime time.Duration
+	throttle    throttle.Throttle
+	// linkThrottle limits the attempts of all clients to a link
+	linkThrottle throttle.Throttle
+	proxies      []*net.IPNet
+	geoIP        targeting.GeoIP
+	policy       urlpolicy.Policy
+	reputation   reputation.Checker
+	// trusted is nil unless the untrusted targets are previewed
+	trusted []string
+	// domains maps the other short domains to their origins
+	domains map[string]string
+	breaker *breaker.Breaker
+	checks  *health.Registry
+	// adminToken is empty unless the admin routes are registered
+	adminToken      string
+	privateWebhooks bool
+}
+
+type Option struct {
+	f func(*routerOptions)
+}
+
+// WithTracker counts the clicks of redirected links.
+func WithTracker(t tracker.Tracker) Option {
+	return Option{func(o *routerOptions) {
+		o.tracker = t
+	}}
+}
+
+// WithWarmer reports the progress of warming up in the health endpoint, and
+// enables the admin route to trigger it.
+func WithWarmer(w warmup.Warmer) Option {
+	return Option{func(o *routerOptions) {
+		o.warmer = w
+	}}
+}
+
+// WithPurger enables the admin route to purge old links.
+func WithPurger(p purger.Purger) Option {
+	return Option{func(o *routerOptions) {
+		o.purger = p
+	}}
+}
+
+// WithNotifier notifies the webhooks of deleted links.
+func WithNotifier(n notifier.Notifier) Option {
+	return Option{func(o *routerOptions) {
+		o.notifier = n
+	}}
+}
+
+// WithMaxLifetime rejects the uploaded links living longer than d, including
+// the ones never expire.
+func WithMaxLifetime(d time.Duration) Option {
+	return Option{func(o *routerOptions) {
+		o.maxLifetime = d
+	}}
+}
+
+// WithPasswordThrottle blocks a client from a protected link for lockout
+// after max wrong passwords, and blocks all clients after linkMax ones.
+func WithPasswordThrottle(max, linkMax int, lockout time.Duration) Option {
+	return Option{func(o *routerOptions) {
+		o.throttle = throttle.New(max, lockout)
+		o.linkThrottle = throttle.New(linkMax, lockout)
+	}}
+}
+
+// WithTrustedProxies follows X-Forwarded-For through the proxies of cidrs to
+// throttle the password attempts by the clients behind them, the invalid
+// ones are validated by the config.
+func WithTrustedProxies(cidrs []string) Option {
+	return Option{func(o *routerOptions) {
+		for _, cidr := range cidrs {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				o.proxies = append(o.proxies, n)
+			}
+		}
+	}}
+}
+
+// WithGeoIP resolves the countries of clients for the targeting rules.
+func WithGeoIP(g targeting.GeoIP) Option {
+	return Option{func(o *routerOptions) {
+		o.geoIP = g
+	}}
+}
+
+// WithURLPolicy rejects the unsafe targets on upload.
+func WithURLPolicy(p urlpolicy.Policy) Option {
+	return Option{func(o *routerOptions) {
+		o.policy = p
+	}}
+}
+
+// WithReputation rejects the known malicious targets on upload.
+func WithReputation(c reputation.Checker) Option {
+	return Option{func(o *routerOptions) {
+		o.reputation = c
+	}}
+}
+
+// WithUntrustedPreview renders the preview page before redirecting to the
+// targets out of the trusted domains.
+func WithUntrustedPreview(trusted []string) Option {
+	return Option{func(o *routerOptions) {
+		o.trusted = append([]string{}, trusted...)
+	}}
+}
+
+// WithDomains serves the links of the other short domains besides the
+// default one of the redirect origin, origins are validated by the config.
+func WithDomains(origins []string) Option {
+	return Option{func(o *routerOptions) {
+		o.domains = make(map[string]string, len(origins))
+		for _, origin := range origins {
+			if u, err := url.Parse(origin); err == nil {
+				o.domains[strings.ToLower(u.Host)] = strings.TrimSuffix(origin, "/")
+			}
+		}
+	}}
+}
+
+// WithBreaker reports the state of the cache circuit breaker in the health
+// endpoint.
+func WithBreaker(b *breaker.Breaker) Option {
+	return Option{func(o *routerOptions) {
+		o.breaker = b
+	}}
+}
+
+// WithHealthChecks runs the checks of registry in the readiness endpoint.
+func WithHealthChecks(registry *health.Registry) Option {
+	return Option{func(o *routerOptions) {
+		o.checks = registry
+	}}
+}
+
+// WithPrivateWebhooks accepts the webhooks of the loopback, private and
+// link-local addresses, e.g. in development.
+func WithPrivateWebhooks() Option {
+	return Option{func(o *routerOptions) {
+		o.privateWebhooks = true
+	}}
+}
+
+// WithAdminToken registers the admin routes, which require token in the
+// "Authorization: Bearer <token>" header.
+func WithAdminToken(token string) Option {
+	return Option{func(o *routerOptions) {
+		o.adminToken = token
+	}}
+}
+
+func NewRouter(db repository.Repository, idGenerator idgenerator.IDGenerator, logger *zap.Logger, redirectOrigin string, options ...Option) *gin.Engine {
+	o := routerOptions{
+		throttle:     throttle.New(defaultPasswordAttempts, defaultPasswordLockout),
+		linkThrottle: throttle.New(defaultPasswordLinkAttempts, defaultPasswordLockout),
+	}
+	for _, option := range options {
+		option.f(&o)
+	}
+
 	router := gin.Default()
 	router.HandleMethodNotAllowed = true
 
-	health := new(controllers.HealthController)
+	health := controllers.HealthController{Warmer: o.warmer, Breaker: o.breaker, Checks: o.checks}
 	router.GET("/health", health.Status)
+	router.GET("/healthz", health.Liveness)
+	router.GET("/readyz", health.Readiness)
+	if o.adminToken != "" {
+		debug := router.Group("/debug", requireToken(o.adminToken))
+		debug.GET("/vars", gin.WrapH(expvar.Handler()))
+	}
+
+	admin := controllers.AdminController{
+		Log:    logger,
+		Warmer: o.warmer,
+		Purger: o.purger,
+	}
+	if o.adminToken != "" {
+		// warming up scans the DB and purging hard-deletes the records, so
+		// they are not left open to anyone
+		adminGroup := router.Group("/api/v1/admin", requireToken(o.adminToken))
+		adminGroup.POST("/warmup", admin.WarmUp)
+		adminGroup.POST("/purge", admin.Purge)
+	}
+
+	if o.adminToken != "" {
+		// a webhook subscribes to the events of every link
+		webhook := controllers.WebhookController{DB: db, Log: logger, AllowPrivate: o.privateWebhooks, Resolve: true}
+		webhooks := router.Group("/api/v1/webhooks", requireToken(o.adminToken))
+		webhooks.POST("", withTimeout(webhook.Register, defaultTimeout))
+		webhooks.GET("", withTimeout(webhook.List, defaultTimeout))
+		webhooks.DELETE("/:webhook_id", withTimeout(webhook.Delete, defaultTimeout))
+		webhooks.GET("/:webhook_id/deliveries", withTimeout(webhook.Deliveries, defaultTimeout))
+	}
 
 	url := controllers.UrlController{
-		DB:             db,
-		Log:            logger,
-		IDGenerator:    idGenerator,
-		RedirectOrigin: redirectOrigin,
+		DB:               db,
+		Log:              logger,
+		IDGenerator:      idGenerator,
+		RedirectOrigin:   redirectOrigin,
+		Domains:          o.domains,
+		MaxLifetime:      o.maxLifetime,
+		Tracker:          o.tracker,
+		Notifier:         o.notifier,
+		Throttle:         o.throttle,
+		LinkThrottle:     o.linkThrottle,
+		TrustedProxies:   o.proxies,
+		GeoIP:            o.geoIP,
+		Policy:           o.policy,
+		Reputation:       o.reputation,
+		PreviewUntrusted: o.trusted != nil,
+		TrustedDomains:   o.trusted,
 	}
 
 	router.POST("/api/v1/urls", withTimeout(url.Upload, defaultTimeout))
+	if o.adminToken != "" {
+		// the listing enumerates the links of everyone, and responds their
+		// owners and metadata
+		router.GET("/api/v1/urls", requireToken(o.adminToken), withTimeout(url.List, defaultTimeout))
+	}
+	router.GET("/api/v1/urls/:url_id", withTimeout(url.Metadata, defaultTimeout))
+	if o.adminToken != "" {
+		router.PATCH("/api/v1/urls/:url_id", requireToken(o.adminToken), withTimeout(url.Patch, defaultTimeout))
+	}
 	router.DELETE("/api/v1/urls/:url_id", withTimeout(url.Delete, defaultTimeout))
+	router.GET("/api/v1/urls/:url_id/stats", withTimeout(url.Stats, defaultTimeout))
+	router.GET("/api/v1/urls/:url_id/qr", withTimeout(url.QRCode, defaultTimeout))
 	router.GET("/:url_id", withTimeout(url.Redirect, defaultTimeout))
+	router.POST("/:url_id", withTimeout(url.Unlock, defaultTimeout))
+	// the suffix fills the {path} placeholder of the target, see
+	// targeting.Expand()
+	router.GET("/:url_id/*suffix", withTimeout(url.Redirect, defaultTimeout))
+	router.POST("/:url_id/*suffix", withTimeout(url.Unlock, defaultTimeout))
 
 	return router
 }
 
+// requireToken aborts the requests without the bearer token.
+func requireToken(token string) gin.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		got := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
 func withTimeout(handler gin.HandlerFunc, timeout time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
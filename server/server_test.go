@@ -0,0 +1,71 @@
+package server
+
+import (
+	"goshorturl/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestNewRouter_admin_token(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		// taken as a short link instead
+		{"not registered", "", "", http.StatusBadRequest},
+		{"no token", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&repository.UnimplementedRepository{}, nil, zap.NewNop(), "http://localhost:8080", WithAdminToken(tt.token))
+			r := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			router.ServeHTTP(r, req)
+			assert.Equal(t, tt.status, r.Code)
+			assert.Equal(t, tt.status == http.StatusOK, strings.Contains(r.Body.String(), "memstats"))
+		})
+	}
+}
+
+func TestNewRouter_admin_routes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := NewRouter(&repository.UnimplementedRepository{}, nil, zap.NewNop(), "http://localhost:8080", WithAdminToken("s3cret"))
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/api/v1/admin/warmup"},
+		{http.MethodPost, "/api/v1/admin/purge?dryRun=true"},
+		{http.MethodGet, "/api/v1/urls"},
+		{http.MethodPatch, "/api/v1/urls/aaaaaa"},
+		{http.MethodGet, "/api/v1/webhooks"},
+		{http.MethodDelete, "/api/v1/webhooks/1"},
+	}
+	for _, route := range routes {
+		t.Run(route.path, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			router.ServeHTTP(r, httptest.NewRequest(route.method, route.path, nil))
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+
+			r = httptest.NewRecorder()
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			router.ServeHTTP(r, req)
+			assert.NotEqual(t, http.StatusUnauthorized, r.Code)
+		})
+	}
+}
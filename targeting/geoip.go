@@ -0,0 +1,82 @@
+package targeting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errInvalidRange = errors.New("invalid IP range")
+
+// GeoIP resolves the country of a client IP.
+type GeoIP interface {
+	// Country returns the ISO 3166-1 alpha-2 code of ip, empty if unknown.
+	Country(ip net.IP) string
+}
+
+// LoadCSV loads an offline GeoIP database from path, see ReadCSV().
+func LoadCSV(path string) (GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCSV(f)
+}
+
+// ReadCSV reads the IP ranges, each record of which is "first IP,last IP,
+// country code", e.g. the free country databases of DB-IP. Both IPv4 and
+// IPv6 ranges are supported, and the extra columns are ignored.
+func ReadCSV(r io.Reader) (GeoIP, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	var db rangeDB
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: %w", line, errInvalidRange)
+		}
+		first, last := net.ParseIP(strings.TrimSpace(record[0])), net.ParseIP(strings.TrimSpace(record[1]))
+		if first == nil || last == nil || bytes.Compare(first.To16(), last.To16()) > 0 {
+			return nil, fmt.Errorf("line %d: %w", line, errInvalidRange)
+		}
+		db = append(db, ipRange{first.To16(), last.To16(), strings.ToUpper(strings.TrimSpace(record[2]))})
+	}
+	sort.Slice(db, func(i, j int) bool { return bytes.Compare(db[i].first, db[j].first) < 0 })
+	return db, nil
+}
+
+type ipRange struct {
+	first, last net.IP // in the 16-byte form
+	country     string
+}
+
+// rangeDB is sorted by the first IP of ranges, which should not overlap.
+type rangeDB []ipRange
+
+func (db rangeDB) Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	// the first range starting after ip, so the previous one may contain it
+	i := sort.Search(len(db), func(i int) bool { return bytes.Compare(db[i].first, ip) > 0 })
+	if i == 0 || bytes.Compare(ip, db[i-1].last) > 0 {
+		return ""
+	}
+	return db[i-1].country
+}
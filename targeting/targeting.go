@@ -0,0 +1,161 @@
+// Package targeting picks the redirect target of a link by the platform,
+// language and country of the request.
+package targeting
+
+import (
+	"fmt"
+	"goshorturl/models"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// platforms of user agents
+const (
+	IOS     = "ios"
+	Android = "android"
+	Windows = "windows"
+	MacOS   = "macos"
+	Linux   = "linux"
+)
+
+// MaxRules limits the rules of a link, they are evaluated on every redirect.
+const MaxRules = 20
+
+// Request is what the rules are matched against.
+type Request struct {
+	Platform string
+	// Languages are ordered by preference.
+	Languages []string
+	Country   string
+}
+
+// Platform detects the platform of userAgent, or returns empty if unknown.
+// The mobile platforms are checked first, since their user agents often
+// mention the desktop ones, e.g. "Linux; Android 11".
+func Platform(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"),
+		strings.Contains(userAgent, "iPad"),
+		strings.Contains(userAgent, "iPod"):
+		return IOS
+	case strings.Contains(userAgent, "Android"):
+		return Android
+	case strings.Contains(userAgent, "Windows"):
+		return Windows
+	case strings.Contains(userAgent, "Macintosh"),
+		strings.Contains(userAgent, "Mac OS X"):
+		return MacOS
+	case strings.Contains(userAgent, "Linux"),
+		strings.Contains(userAgent, "X11"):
+		return Linux
+	}
+	return ""
+}
+
+// Languages parses acceptLanguage into the language tags ordered by their
+// quality values, the ones of zero quality and the wildcard are dropped.
+func Languages(acceptLanguage string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	languages := make([]string, 0, len(tags))
+	for _, t := range tags {
+		languages = append(languages, t.tag)
+	}
+	return languages
+}
+
+// Match returns the URL of the first rule matching req.
+func Match(rules models.TargetRules, req Request) (string, bool) {
+	for _, rule := range rules {
+		if matches(rule, req) {
+			return rule.Url, true
+		}
+	}
+	return "", false
+}
+
+func matches(rule models.TargetRule, req Request) bool {
+	if rule.Platform != "" && rule.Platform != req.Platform {
+		return false
+	}
+	if rule.Country != "" && !strings.EqualFold(rule.Country, req.Country) {
+		return false
+	}
+	if rule.Language != "" {
+		// only the most preferred language counts, otherwise a rule of a
+		// fallback language may take over the preferred one
+		if len(req.Languages) == 0 || !languageMatches(rule.Language, req.Languages[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// languageMatches reports whether tag is range itself or one of its
+// subtags, e.g. "zh" matches "zh-TW".
+func languageMatches(rng, tag string) bool {
+	if len(tag) < len(rng) || !strings.EqualFold(tag[:len(rng)], rng) {
+		return false
+	}
+	return len(tag) == len(rng) || tag[len(rng)] == '-'
+}
+
+// Validate validates the uploaded rules, and normalizes their conditions.
+func Validate(rules models.TargetRules) error {
+	if len(rules) > MaxRules {
+		return fmt.Errorf("at most %d rules are allowed", MaxRules)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		rule.Platform = strings.ToLower(rule.Platform)
+		rule.Country = strings.ToUpper(rule.Country)
+		if rule.Platform == "" && rule.Language == "" && rule.Country == "" {
+			return fmt.Errorf("rule %d: at least one condition is required", i)
+		}
+		switch rule.Platform {
+		case "", IOS, Android, Windows, MacOS, Linux:
+		default:
+			return fmt.Errorf("rule %d: unknown platform: %s", i, rule.Platform)
+		}
+		if rule.Country != "" && !isCountryCode(rule.Country) {
+			return fmt.Errorf("rule %d: country should be an ISO 3166-1 alpha-2 code: %s", i, rule.Country)
+		}
+		if strings.ContainsAny(rule.Language, ",;* ") {
+			return fmt.Errorf("rule %d: invalid language: %s", i, rule.Language)
+		}
+		if _, err := url.ParseRequestURI(rule.Url); err != nil {
+			return fmt.Errorf("rule %d: invalid URL: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
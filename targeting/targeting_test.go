@@ -0,0 +1,225 @@
+package targeting
+
+import (
+	"fmt"
+	"goshorturl/models"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlatform(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		platform  string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) AppleWebKit/605.1.15", IOS},
+		{"Mozilla/5.0 (iPad; CPU OS 14_6 like Mac OS X) AppleWebKit/605.1.15", IOS},
+		{"Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36", Android},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36", Windows},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36", MacOS},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36", Linux},
+		{"curl/7.64.1", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.platform, Platform(tt.userAgent), tt.userAgent)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	assert.Equal(t, []string{"zh-TW", "zh", "en"}, Languages("zh-TW,zh;q=0.9,en;q=0.8"))
+	assert.Equal(t, []string{"en", "fr"}, Languages("fr;q=0.5, en, de;q=0, *;q=0.1"))
+	assert.Empty(t, Languages(""))
+}
+
+func TestMatch(t *testing.T) {
+	rules := models.TargetRules{
+		{Platform: IOS, Url: "https://apps.apple.com"},
+		{Platform: Android, Url: "https://play.google.com"},
+		{Language: "zh", Country: "TW", Url: "https://example.com/tw"},
+		{Language: "ja", Url: "https://example.com/ja"},
+	}
+	tests := []struct {
+		name string
+		req  Request
+		url  string
+		ok   bool
+	}{
+		{"ios", Request{Platform: IOS, Country: "TW"}, "https://apps.apple.com", true},
+		{"android", Request{Platform: Android}, "https://play.google.com", true},
+		{"all conditions", Request{Languages: []string{"zh-TW"}, Country: "tw"}, "https://example.com/tw", true},
+		{"partial conditions", Request{Languages: []string{"zh-TW"}, Country: "US"}, "", false},
+		{"preferred language only", Request{Languages: []string{"en", "ja"}}, "", false},
+		{"language prefix", Request{Languages: []string{"ja-JP"}}, "https://example.com/ja", true},
+		{"not a subtag", Request{Languages: []string{"jav"}}, "", false},
+		{"default", Request{Platform: Windows}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, ok := Match(rules, tt.req)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.url, url)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rules := models.TargetRules{{Platform: "iOS", Country: "tw", Url: "https://apps.apple.com"}}
+	assert.NoError(t, Validate(rules))
+	assert.Equal(t, IOS, rules[0].Platform, "should normalize platform")
+	assert.Equal(t, "TW", rules[0].Country, "should normalize country")
+
+	invalid := []models.TargetRule{
+		{Url: "https://example.com"},
+		{Platform: "symbian", Url: "https://example.com"},
+		{Country: "TWN", Url: "https://example.com"},
+		{Language: "en;q=1", Url: "https://example.com"},
+		{Platform: IOS, Url: "foobar"},
+	}
+	for _, rule := range invalid {
+		assert.Error(t, Validate(models.TargetRules{rule}), "%+v", rule)
+	}
+	assert.Error(t, Validate(make(models.TargetRules, MaxRules+1)))
+}
+
+func TestReadCSV(t *testing.T) {
+	db, err := ReadCSV(strings.NewReader(`# first,last,country
+1.0.0.0,1.0.0.255,AU
+"1.0.4.0","1.0.7.255","au",extra
+203.69.0.0,203.69.255.255,TW
+2001:b000::,2001:b01f:ffff:ffff:ffff:ffff:ffff:ffff,TW
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "AU", db.Country(net.ParseIP("1.0.0.1")))
+	assert.Equal(t, "AU", db.Country(net.ParseIP("1.0.5.5")))
+	assert.Equal(t, "", db.Country(net.ParseIP("1.0.2.1")), "should not be in the gap")
+	assert.Equal(t, "TW", db.Country(net.ParseIP("203.69.1.2")))
+	assert.Equal(t, "TW", db.Country(net.ParseIP("2001:b000::1")))
+	assert.Equal(t, "", db.Country(net.ParseIP("0.0.0.1")))
+	assert.Equal(t, "", db.Country(net.ParseIP("255.255.255.255")))
+	assert.Equal(t, "", db.Country(nil))
+
+	_, err = ReadCSV(strings.NewReader("1.0.0.255,1.0.0.0,AU\n"))
+	assert.Error(t, err)
+	_, err = ReadCSV(strings.NewReader("1.0.0.0,AU\n"))
+	assert.Error(t, err)
+}
+
+func TestValidateVariants(t *testing.T) {
+	variants := models.Variants{
+		{Url: "https://example.com/a", Weight: 90},
+		{Name: "control", Url: "https://example.com/b", Weight: 10},
+	}
+	assert.NoError(t, ValidateVariants(variants))
+	assert.Equal(t, "a", variants[0].Name, "should name the unnamed variant")
+	assert.NoError(t, ValidateVariants(nil))
+
+	invalid := []models.Variants{
+		{{Url: "https://example.com/a", Weight: 1}},
+		{{Url: "https://example.com/a", Weight: 1}, {Url: "https://example.com/b", Weight: 0}},
+		{{Url: "https://example.com/a", Weight: 1}, {Url: "foobar", Weight: 1}},
+		{{Name: "x", Url: "https://example.com/a", Weight: 1}, {Name: "x", Url: "https://example.com/b", Weight: 1}},
+		{{Name: "a;b", Url: "https://example.com/a", Weight: 1}, {Url: "https://example.com/b", Weight: 1}},
+		{{Url: "https://example.com/a", Weight: MaxWeight + 1}, {Url: "https://example.com/b", Weight: 1}},
+	}
+	for _, variants := range invalid {
+		assert.Error(t, ValidateVariants(variants), "%+v", variants)
+	}
+}
+
+func TestPick(t *testing.T) {
+	variants := models.Variants{
+		{Name: "a", Url: "https://example.com/a", Weight: 90},
+		{Name: "b", Url: "https://example.com/b", Weight: 10},
+	}
+	picked := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		picked[Pick(variants, fmt.Sprint("client", i)).Name]++
+	}
+	assert.InDelta(t, 9000, picked["a"], 300, "should split by weights")
+	assert.InDelta(t, 1000, picked["b"], 300, "should split by weights")
+
+	assert.Equal(t, Pick(variants, "client"), Pick(variants, "client"), "should be sticky to key")
+
+	v, ok := Find(variants, "b")
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/b", v.Url)
+	_, ok = Find(variants, "c")
+	assert.False(t, ok)
+}
+
+func TestValidateTemplate(t *testing.T) {
+	valid := []string{
+		"https://example.com",
+		"https://example.com/docs/{path}",
+		"https://example.com/{lang}/landing?ref={ref}#{section}",
+	}
+	for _, target := range valid {
+		assert.NoError(t, ValidateTemplate(target), target)
+	}
+	invalid := []string{
+		"https://{sub}.example.com",
+		"https://example.com{path}",
+		"https://{user}@example.com",
+		"{scheme}://example.com",
+	}
+	for _, target := range invalid {
+		assert.Error(t, ValidateTemplate(target), target)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	query := url.Values{"lang": {"zh TW"}, "ref": {"a&b"}}
+	tests := []struct {
+		target string
+		suffix string
+		want   string
+		used   []string
+		err    error
+	}{
+		{"https://example.com", "", "https://example.com", nil, nil},
+		{"https://example.com", "/some/path", "", nil, ErrUnexpectedPath},
+		{"https://example.com/docs/{path}", "/some/path", "https://example.com/docs/some/path", nil, nil},
+		{"https://example.com/docs/{path}", "", "https://example.com/docs/", nil, nil},
+		{"https://example.com/docs/{path}", "/a b/?c", "https://example.com/docs/a%20b/%3Fc", nil, nil},
+		{"https://example.com/docs/{path}", "/../admin", "", nil, ErrUnexpectedPath},
+		{"https://example.com/{lang}?ref={ref}&x={missing}", "", "https://example.com/zh%20TW?ref=a%26b&x=", []string{"lang", "ref", "missing"}, nil},
+		{"https://example.com/{lang}", "/some/path", "", nil, ErrUnexpectedPath},
+	}
+	for _, tt := range tests {
+		got, used, err := Expand(tt.target, query, tt.suffix)
+		assert.Equal(t, tt.err, err, "%s %s", tt.target, tt.suffix)
+		assert.Equal(t, tt.want, got, "%s %s", tt.target, tt.suffix)
+		assert.Equal(t, tt.used, used, "%s %s", tt.target, tt.suffix)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	query := url.Values{"utm_source": {"x"}, "id": {"2"}}
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "https://example.com/?id=1#top"},
+		{models.PassthroughDrop, "https://example.com/?id=1#top"},
+		{models.PassthroughAppend, "https://example.com/?id=1&id=2&utm_source=x#top"},
+		{models.PassthroughMerge, "https://example.com/?id=2&utm_source=x#top"},
+	}
+	for _, tt := range tests {
+		got, err := Passthrough("https://example.com/?id=1#top", tt.mode, query, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got, tt.mode)
+	}
+
+	got, err := Passthrough("https://example.com/", models.PassthroughAppend, query, []string{"id"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/?utm_source=x", got, "should exclude the filled parameters")
+	assert.Equal(t, url.Values{"utm_source": {"x"}, "id": {"2"}}, query, "should not modify the query")
+
+	assert.NoError(t, ValidatePassthrough(""))
+	assert.NoError(t, ValidatePassthrough(models.PassthroughMerge))
+	assert.Error(t, ValidatePassthrough("override"))
+}
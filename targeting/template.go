@@ -0,0 +1,169 @@
+package targeting
+
+import (
+	"errors"
+	"fmt"
+	"goshorturl/models"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PathPlaceholder is filled by the path suffix of the short link, e.g.
+// "some/path" of "/XSIfKe/some/path", the others are filled by the query
+// parameters of the same names.
+const PathPlaceholder = "path"
+
+// ErrUnexpectedPath is returned if a path suffix is given to a target
+// without PathPlaceholder, or the suffix tries to climb up the target path.
+var ErrUnexpectedPath = errors.New("unexpected path suffix")
+
+var placeholder = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// ValidateTemplate validates the placeholders of target if any. They are
+// only allowed in the path, query and fragment, so that the destination host
+// never depends on the request.
+func ValidateTemplate(target string) error {
+	if !placeholder.MatchString(target) {
+		return nil
+	}
+	a, err := url.Parse(placeholder.ReplaceAllString(target, "a"))
+	if err != nil {
+		return fmt.Errorf("invalid URL template: %w", err)
+	}
+	b, err := url.Parse(placeholder.ReplaceAllString(target, "b"))
+	if err != nil {
+		return fmt.Errorf("invalid URL template: %w", err)
+	}
+	if a.Scheme != b.Scheme || a.User.String() != b.User.String() || a.Host != b.Host {
+		return errors.New("placeholders are not allowed in the scheme and host")
+	}
+	return nil
+}
+
+// Expand fills the placeholders of target by the query parameters and the
+// path suffix, the missing parameters are filled by empty strings. It
+// returns the names of the filled parameters as well, which should not be
+// passed through again.
+func Expand(target string, query url.Values, suffix string) (string, []string, error) {
+	suffix = strings.Trim(suffix, "/")
+	if !placeholder.MatchString(target) {
+		if suffix != "" {
+			return "", nil, ErrUnexpectedPath
+		}
+		return target, nil, nil
+	}
+	// the values are escaped by where they are
+	pathEnd := strings.IndexAny(target, "?#")
+	if pathEnd < 0 {
+		pathEnd = len(target)
+	}
+
+	var b strings.Builder
+	var used []string
+	last := 0
+	usedPath := false
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(target, -1) {
+		b.WriteString(target[last:loc[0]])
+		last = loc[1]
+		name := target[loc[2]:loc[3]]
+		inPath := loc[0] < pathEnd
+		if name == PathPlaceholder {
+			escaped, err := escapeSuffix(suffix, inPath)
+			if err != nil {
+				return "", nil, err
+			}
+			b.WriteString(escaped)
+			usedPath = true
+			continue
+		}
+		if inPath {
+			b.WriteString(url.PathEscape(query.Get(name)))
+		} else {
+			b.WriteString(url.QueryEscape(query.Get(name)))
+		}
+		used = append(used, name)
+	}
+	b.WriteString(target[last:])
+	if suffix != "" && !usedPath {
+		return "", nil, ErrUnexpectedPath
+	}
+	return b.String(), used, nil
+}
+
+// escapeSuffix escapes each segment of suffix, so that the suffix stays
+// under the path of the placeholder.
+func escapeSuffix(suffix string, inPath bool) (string, error) {
+	if !inPath {
+		return url.QueryEscape(suffix), nil
+	}
+	if suffix == "" {
+		return "", nil
+	}
+	segments := strings.Split(suffix, "/")
+	for i, s := range segments {
+		if s == "." || s == ".." {
+			return "", ErrUnexpectedPath
+		}
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// Passthrough passes the query of the request to target by mode, the ones
+// filled into the placeholders are excluded.
+func Passthrough(target string, mode string, query url.Values, used []string) (string, error) {
+	if mode == "" || mode == models.PassthroughDrop || len(query) == 0 {
+		return target, nil
+	}
+	if len(used) > 0 {
+		query = cloneValues(query)
+		for _, name := range used {
+			query.Del(name)
+		}
+		if len(query) == 0 {
+			return target, nil
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	switch mode {
+	case models.PassthroughAppend:
+		if u.RawQuery == "" {
+			u.RawQuery = query.Encode()
+		} else {
+			u.RawQuery += "&" + query.Encode()
+		}
+	case models.PassthroughMerge:
+		// the request overrides the parameters of the same names
+		merged := u.Query()
+		for name, values := range query {
+			merged[name] = values
+		}
+		u.RawQuery = merged.Encode()
+	default:
+		return "", fmt.Errorf("unknown passthrough mode: %s", mode)
+	}
+	return u.String(), nil
+}
+
+// ValidatePassthrough validates the passthrough mode of a link, empty is
+// the same as models.PassthroughDrop.
+func ValidatePassthrough(mode string) error {
+	switch mode {
+	case "", models.PassthroughDrop, models.PassthroughAppend, models.PassthroughMerge:
+		return nil
+	}
+	return fmt.Errorf("passthrough should be one of %s, %s and %s",
+		models.PassthroughDrop, models.PassthroughAppend, models.PassthroughMerge)
+}
+
+func cloneValues(values url.Values) url.Values {
+	cloned := make(url.Values, len(values))
+	for name, v := range values {
+		cloned[name] = v
+	}
+	return cloned
+}
@@ -0,0 +1,82 @@
+package targeting
+
+import (
+	"fmt"
+	"goshorturl/models"
+	"hash/fnv"
+	"net/url"
+	"regexp"
+)
+
+const (
+	// MaxVariants limits the variants of a link.
+	MaxVariants = 10
+	// MaxWeight limits the weight of a variant, e.g. the weights in basis
+	// points are allowed.
+	MaxWeight = 10000
+)
+
+// variantName is safe to be a cookie value.
+var variantName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidateVariants validates the uploaded variants, and names the unnamed
+// ones by their positions, i.e. "a", "b" and so on.
+func ValidateVariants(variants models.Variants) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	if len(variants) < 2 || len(variants) > MaxVariants {
+		return fmt.Errorf("variants should be between 2 and %d", MaxVariants)
+	}
+	names := make(map[string]bool, len(variants))
+	for i := range variants {
+		v := &variants[i]
+		if v.Name == "" {
+			v.Name = string(rune('a' + i))
+		}
+		if !variantName.MatchString(v.Name) {
+			return fmt.Errorf("variant %d: invalid name: %s", i, v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("variant %d: duplicate name: %s", i, v.Name)
+		}
+		names[v.Name] = true
+		if v.Weight <= 0 || v.Weight > MaxWeight {
+			return fmt.Errorf("variant %d: weight should be between 1 and %d", i, MaxWeight)
+		}
+		if _, err := url.ParseRequestURI(v.Url); err != nil {
+			return fmt.Errorf("variant %d: invalid URL: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Pick returns the variant whose share of the weights covers the hash of
+// key, so that a key is always assigned to the same variant as long as the
+// variants are not changed.
+func Pick(variants models.Variants, key string) models.Variant {
+	var total int64
+	for _, v := range variants {
+		total += v.Weight
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	n := int64(h.Sum64() % uint64(total))
+	for _, v := range variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return variants[len(variants)-1]
+}
+
+// Find returns the variant of name.
+func Find(variants models.Variants, name string) (models.Variant, bool) {
+	for _, v := range variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return models.Variant{}, false
+}
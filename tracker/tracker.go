@@ -0,0 +1,129 @@
+package tracker
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFlushInterval = 10 * time.Second
+	flushTimeout         = 10 * time.Second
+)
+
+// Tracker counts the clicks of links by their keys, i.e. models.Key(), the
+// counts are buffered in memory and written to database in batches.
+type Tracker interface {
+	// Track records a click of key without blocking on database.
+	Track(key string)
+	// TrackVariant records a click of key attributed to its variant, the
+	// click of key itself is recorded as well.
+	TrackVariant(key, variant string)
+	// Close stops the background flushing and flushes the remaining counts.
+	Close()
+}
+
+func New(db repository.Repository, logger *zap.Logger, interval time.Duration) Tracker {
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	t := &tracker{
+		db:       db,
+		logger:   logger,
+		counts:   make(map[string]int64),
+		variants: make(map[variantKey]int64),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+type tracker struct {
+	db     repository.Repository
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	counts   map[string]int64
+	variants map[variantKey]int64
+
+	done   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (t *tracker) Track(key string) {
+	t.mu.Lock()
+	t.counts[key]++
+	t.mu.Unlock()
+}
+
+type variantKey struct {
+	key, variant string
+}
+
+func (t *tracker) TrackVariant(key, variant string) {
+	t.mu.Lock()
+	t.counts[key]++
+	t.variants[variantKey{key, variant}]++
+	t.mu.Unlock()
+}
+
+func (t *tracker) Close() {
+	t.once.Do(func() {
+		close(t.done)
+		<-t.closed
+	})
+}
+
+func (t *tracker) run(interval time.Duration) {
+	defer close(t.closed)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.done:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *tracker) flush() {
+	t.mu.Lock()
+	counts, variants := t.counts, t.variants
+	t.counts = make(map[string]int64)
+	t.variants = make(map[variantKey]int64)
+	t.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := t.db.AddClicks(ctx, counts, time.Now()); err != nil {
+		// the counts are dropped rather than piling up while database is
+		// unavailable, they are only used to rank the links
+		t.logger.Warn("flush clicks error", zap.Error(err), zap.Int("ids", len(counts)))
+		return
+	}
+	t.logger.Debug("flush clicks", zap.Int("ids", len(counts)))
+
+	if len(variants) == 0 {
+		return
+	}
+	stats := make([]*models.VariantStat, 0, len(variants))
+	for key, n := range variants {
+		domain, id := models.SplitKey(key.key)
+		stats = append(stats, &models.VariantStat{Domain: domain, Id: id, Variant: key.variant, Clicks: n})
+	}
+	if err := t.db.AddVariantClicks(ctx, stats); err != nil {
+		t.logger.Warn("flush variant clicks error", zap.Error(err), zap.Int("variants", len(stats)))
+	}
+}
@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type clicksRecorder struct {
+	repository.UnimplementedRepository
+	mu      sync.Mutex
+	batches int
+	clicks  map[string]int64
+	variant map[string]int64
+}
+
+func (c *clicksRecorder) AddClicks(ctx context.Context, clicks map[string]int64, accessedAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches++
+	for id, n := range clicks {
+		c.clicks[id] += n
+	}
+	return nil
+}
+
+func (c *clicksRecorder) AddVariantClicks(ctx context.Context, clicks []*models.VariantStat) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stat := range clicks {
+		c.variant[stat.Id+"/"+stat.Variant] += stat.Clicks
+	}
+	return nil
+}
+
+func TestTracker(t *testing.T) {
+	db := &clicksRecorder{clicks: make(map[string]int64), variant: make(map[string]int64)}
+	tracker := New(db, zap.NewNop(), time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tracker.Track("aaaaaa")
+			if i%2 == 0 {
+				tracker.Track("bbbbbb")
+			}
+		}(i)
+	}
+	wg.Wait()
+	tracker.Close()
+	tracker.Close()
+
+	assert.Equal(t, 1, db.batches, "counts should be written in one batch")
+	assert.Equal(t, map[string]int64{"aaaaaa": 100, "bbbbbb": 50}, db.clicks)
+}
+
+func TestTrackerVariants(t *testing.T) {
+	db := &clicksRecorder{clicks: make(map[string]int64), variant: make(map[string]int64)}
+	tracker := New(db, zap.NewNop(), time.Hour)
+
+	for i := 0; i < 10; i++ {
+		tracker.TrackVariant("aaaaaa", "a")
+		if i%5 == 0 {
+			tracker.TrackVariant("aaaaaa", "b")
+		}
+	}
+	tracker.Close()
+
+	assert.Equal(t, map[string]int64{"aaaaaa": 12}, db.clicks, "variant clicks should count for the link")
+	assert.Equal(t, map[string]int64{"aaaaaa/a": 10, "aaaaaa/b": 2}, db.variant)
+}
@@ -0,0 +1,99 @@
+package urlpolicy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// privateRanges are not routable on the internet, or reach the hosts next
+// to the server, e.g. the cloud metadata at 169.254.169.254. The NAT64
+// prefix is included since it maps to any IPv4 address, private ones too.
+var privateRanges = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateRanges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialControl is a net.Dialer.Control rejecting the connections to the
+// private addresses. It checks the addresses resolved by the dialer, so that
+// a hostname is not able to be rebound to them after CheckHost().
+func DialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivate(ip) {
+		return violate(RulePrivate, "address %s is not public", host)
+	}
+	return nil
+}
+
+// parseIP parses the IP literal of a host, including the IPv4 forms
+// accepted by browsers, e.g. "2130706433" and "0x7f.1" for 127.0.0.1.
+func parseIP(host string) net.IP {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return ip
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	nums := make([]uint64, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 0, 32)
+		if err != nil {
+			return nil
+		}
+		nums[i] = n
+	}
+	// the last part fills the rest of the bytes
+	var v uint64
+	for i, n := range nums[:len(nums)-1] {
+		if n > 0xff {
+			return nil
+		}
+		v |= n << (8 * uint(3-i))
+	}
+	last := nums[len(nums)-1]
+	if last >= 1<<(8*uint(5-len(nums))) {
+		return nil
+	}
+	v |= last
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
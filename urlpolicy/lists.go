@@ -0,0 +1,80 @@
+package urlpolicy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Lists are the domain allow and deny lists, a domain covers its
+// subdomains as well.
+type Lists struct {
+	Allow []string
+	Deny  []string
+}
+
+// ReadLists reads a domain per line prefixed by "allow" or "deny", e.g.
+// "deny example.com". The empty lines and the ones starting with "#" are
+// ignored.
+func ReadLists(r io.Reader) (*Lists, error) {
+	lists := &Lists{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: should be \"allow|deny <domain>\"", line)
+		}
+		domain := normalizeHost(strings.TrimPrefix(fields[1], "*."))
+		switch fields[0] {
+		case "allow":
+			lists.Allow = append(lists.Allow, domain)
+		case "deny":
+			lists.Deny = append(lists.Deny, domain)
+		default:
+			return nil, fmt.Errorf("line %d: unknown list: %s", line, fields[0])
+		}
+	}
+	return lists, scanner.Err()
+}
+
+// allowed reports whether host is allowed, all hosts are allowed if the
+// allow list is empty.
+func (l *Lists) allowed(host string) bool {
+	return len(l.Allow) == 0 || MatchDomain(l.Allow, host)
+}
+
+func (l *Lists) denied(host string) bool {
+	return MatchDomain(l.Deny, host)
+}
+
+// MatchDomain reports whether host is one of domains or their subdomains,
+// the domains should be lowercase.
+func MatchDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// load loads the list file, the last lists are kept if it fails.
+func (p *policy) load() error {
+	f, err := os.Open(p.config.ListFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lists, err := ReadLists(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.config.ListFile, err)
+	}
+	p.lists.Store(lists)
+	return nil
+}
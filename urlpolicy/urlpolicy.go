@@ -0,0 +1,278 @@
+// Package urlpolicy decides whether a URL is allowed to be the target of a
+// short link, and reports the rule rejecting it.
+package urlpolicy
+
+import (
+	"context"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/pkg/filewatch"
+	"goshorturl/repository"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The rules reported by Violation.
+const (
+	RuleSyntax  = "syntax"
+	RuleScheme  = "scheme"
+	RulePrivate = "private"
+	RuleLoop    = "loop"
+	RuleDeny    = "deny"
+	RuleAllow   = "allow"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+var defaultSchemes = []string{"http", "https"}
+
+// Violation is returned by Policy.Check() if a URL is rejected.
+type Violation struct {
+	// Rule is the one of the Rule constants rejecting the URL.
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (v *Violation) Error() string {
+	return v.Rule + ": " + v.Reason
+}
+
+func violate(rule, format string, args ...interface{}) *Violation {
+	return &Violation{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Lookup returns the link of a short link key, see models.Key(). It is used
+// to follow the short links chained through Config.Self.
+type Lookup func(ctx context.Context, key string) (*models.Url, error)
+
+type Config struct {
+	// Schemes are the allowed schemes, http and https by default.
+	Schemes []string
+	// AllowPrivate accepts the loopback, private and link-local targets,
+	// e.g. in development.
+	AllowPrivate bool
+	// Resolve looks up the addresses of hostnames to block the private
+	// targets, otherwise only the IP literals and localhost are blocked.
+	Resolve bool
+	// Self are the origins serving the short links, the first one is the
+	// default domain, e.g. RedirectOrigin, and the others are the domains of
+	// their hosts.
+	Self []string
+	// MaxHops limits the chain of short links through Self, zero rejects
+	// any target on Self.
+	MaxHops int
+	// ListFile is the optional domain allow/deny lists, see ReadLists().
+	// It is reloaded every ReloadInterval once it is modified.
+	ListFile       string
+	ReloadInterval time.Duration
+}
+
+type Policy interface {
+	// Check returns a *Violation if target is rejected, or the error of
+	// looking up the chained short links.
+	Check(ctx context.Context, target string) error
+	// Close stops reloading the list file.
+	Close()
+}
+
+// New returns an error if the list file cannot be loaded, the later reload
+// errors are logged and the last lists are kept.
+func New(lookup Lookup, logger *zap.Logger, config Config) (Policy, error) {
+	if len(config.Schemes) == 0 {
+		config.Schemes = defaultSchemes
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = defaultReloadInterval
+	}
+	p := &policy{
+		lookup: lookup,
+		config: config,
+		stop:   func() {},
+	}
+	for i, origin := range config.Self {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid origin: %s", origin)
+		}
+		p.self = append(p.self, hostKey(u))
+		domain := ""
+		if i > 0 {
+			domain = strings.ToLower(u.Host)
+		}
+		p.domains = append(p.domains, domain)
+	}
+	p.lists.Store(&Lists{})
+	if config.ListFile != "" {
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+		p.stop = filewatch.Watch(config.ListFile, config.ReloadInterval, p.load, logger)
+	}
+	return p, nil
+}
+
+type policy struct {
+	lookup Lookup
+	config Config
+	self   []string
+	// domains are the domains of the links of self in order
+	domains []string
+	lists   atomic.Value // *Lists
+	stop    func()
+}
+
+func (p *policy) Check(ctx context.Context, target string) error {
+	return p.check(ctx, target, nil, p.config.MaxHops)
+}
+
+// check follows the short links through Self, visited are the ones on the
+// way to target, and hops is the number of short links left to follow.
+func (p *policy) check(ctx context.Context, target string, visited []string, hops int) error {
+	u, err := p.checkOne(ctx, target)
+	if err != nil {
+		return err
+	}
+	key, ok := p.shortKey(u)
+	if !ok {
+		return nil
+	}
+	for _, v := range visited {
+		if v == key {
+			return violate(RuleLoop, "the short links loop through %s", target)
+		}
+	}
+	if hops <= 0 {
+		return violate(RuleLoop, "links to the short link %s", target)
+	}
+	link, err := p.lookup(ctx, key)
+	if err == repository.ErrRecordNotFound || err == repository.ErrGone {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the chain branches by the rules and variants
+	visited = append(visited[:len(visited):len(visited)], key)
+	for _, next := range link.Targets() {
+		if err := p.check(ctx, next, visited, hops-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOne checks target itself regardless of where it leads to.
+func (p *policy) checkOne(ctx context.Context, target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, violate(RuleSyntax, "%s", err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if !contains(p.config.Schemes, scheme) {
+		return nil, violate(RuleScheme, "scheme %q is not allowed", u.Scheme)
+	}
+	if u.Opaque != "" {
+		// e.g. mailto:, which has no host to check
+		return u, nil
+	}
+	host := normalizeHost(u.Hostname())
+	if host == "" {
+		return nil, violate(RuleSyntax, "missing host")
+	}
+	if _, ok := p.shortKey(u); ok {
+		// the short links are checked by following them
+		return u, nil
+	}
+	lists := p.lists.Load().(*Lists)
+	if lists.denied(host) {
+		return nil, violate(RuleDeny, "host %s is denied", host)
+	}
+	if !lists.allowed(host) {
+		return nil, violate(RuleAllow, "host %s is not allowed", host)
+	}
+	if !p.config.AllowPrivate {
+		if err := CheckHost(ctx, host, p.config.Resolve); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// CheckHost returns a *Violation if host is loopback or a private address,
+// the hostnames are looked up only if resolve is set. It is also used to
+// check the webhooks, see DialControl() for the connections.
+func CheckHost(ctx context.Context, host string, resolve bool) error {
+	host = normalizeHost(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return violate(RulePrivate, "host %s is loopback", host)
+	}
+	if ip := parseIP(host); ip != nil {
+		if isPrivate(ip) {
+			return violate(RulePrivate, "address %s is not public", ip)
+		}
+		return nil
+	}
+	if !resolve {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return violate(RulePrivate, "failed to resolve host %s", host)
+	}
+	for _, addr := range addrs {
+		if isPrivate(addr.IP) {
+			return violate(RulePrivate, "host %s resolves to %s", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// shortKey returns the key of u if it is a short link served by Self.
+func (p *policy) shortKey(u *url.URL) (string, bool) {
+	if u.Host == "" {
+		return "", false
+	}
+	origin := indexOf(p.self, hostKey(u))
+	if origin < 0 {
+		return "", false
+	}
+	id := strings.Trim(u.Path, "/")
+	if i := strings.Index(id, "/"); i >= 0 {
+		// the path suffix, see targeting.Expand()
+		id = id[:i]
+	}
+	// the other paths of Self are not redirected, but still rejected
+	return models.Key(p.domains[origin], id), true
+}
+
+func (p *policy) Close() {
+	p.stop()
+}
+
+// hostKey identifies the origin of u regardless of the scheme and port,
+// e.g. http is usually redirected to https by the proxies.
+func hostKey(u *url.URL) string {
+	return normalizeHost(u.Hostname())
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func contains(list []string, s string) bool {
+	return indexOf(list, s) >= 0
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
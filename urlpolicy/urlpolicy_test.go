@@ -0,0 +1,176 @@
+package urlpolicy
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func lookupOf(links map[string]*models.Url) Lookup {
+	return func(ctx context.Context, key string) (*models.Url, error) {
+		link, ok := links[key]
+		if !ok {
+			return nil, repository.ErrRecordNotFound
+		}
+		return link, nil
+	}
+}
+
+func ruleOf(err error) string {
+	if v, ok := err.(*Violation); ok {
+		return v.Rule
+	}
+	return ""
+}
+
+func TestCheck(t *testing.T) {
+	p, err := New(lookupOf(nil), zap.NewNop(), Config{Self: []string{"https://sho.rt"}})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	tests := []struct {
+		target string
+		rule   string // empty if allowed
+	}{
+		{"https://example.com/path?q=1", ""},
+		{"HTTP://EXAMPLE.COM", ""},
+		{"https://example.com/docs/{path}", ""},
+		{"javascript:alert(1)", RuleScheme},
+		{"data:text/html,<script>alert(1)</script>", RuleScheme},
+		{"file:///etc/passwd", RuleScheme},
+		{"ftp://example.com", RuleScheme},
+		{"http://localhost:8080", RulePrivate},
+		{"http://app.localhost", RulePrivate},
+		{"http://127.0.0.1", RulePrivate},
+		{"http://2130706433", RulePrivate},
+		{"http://0x7f.1", RulePrivate},
+		{"http://10.1.2.3", RulePrivate},
+		{"http://192.168.0.1", RulePrivate},
+		{"http://169.254.169.254/latest/meta-data", RulePrivate},
+		{"http://[::1]", RulePrivate},
+		{"http://[fd00::1]", RulePrivate},
+		{"http://[64:ff9b::a9fe:a9fe]", RulePrivate},
+		{"http://198.18.0.1", RulePrivate},
+		{"http://224.0.0.1", RulePrivate},
+		{"http://255.255.255.255", RulePrivate},
+		{"http://8.8.8.8", ""},
+		{"https:///path", RuleSyntax},
+		{"https://sho.rt/XSIfKe", RuleLoop},
+		{"http://SHO.RT:8080/XSIfKe/some/path", RuleLoop},
+	}
+	for _, tt := range tests {
+		err := p.Check(context.Background(), tt.target)
+		if tt.rule == "" {
+			assert.NoError(t, err, tt.target)
+		} else {
+			assert.Equal(t, tt.rule, ruleOf(err), "%s: %v", tt.target, err)
+		}
+	}
+}
+
+func TestCheck_allow_private(t *testing.T) {
+	p, err := New(lookupOf(nil), zap.NewNop(), Config{AllowPrivate: true, Schemes: []string{"http", "https", "mailto"}})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	assert.NoError(t, p.Check(context.Background(), "http://localhost:8080"))
+	assert.NoError(t, p.Check(context.Background(), "mailto:someone@example.com"))
+}
+
+func TestCheck_chained_short_links(t *testing.T) {
+	links := map[string]*models.Url{
+		"aaaaaa": {Id: "aaaaaa", Url: "https://example.com"},
+		"bbbbbb": {Id: "bbbbbb", Url: "https://sho.rt/aaaaaa"},
+		"cccccc": {Id: "cccccc", Url: "https://sho.rt/dddddd"},
+		"dddddd": {Id: "dddddd", Url: "https://example.com", Rules: models.TargetRules{
+			{Platform: "ios", Url: "https://sho.rt/cccccc"},
+		}},
+		"eeeeee": {Id: "eeeeee", Url: "https://example.com", Variants: models.Variants{
+			{Name: "a", Url: "https://example.com/a", Weight: 1},
+			{Name: "b", Url: "javascript:alert(1)", Weight: 1},
+		}},
+	}
+	p, err := New(lookupOf(links), zap.NewNop(), Config{Self: []string{"https://sho.rt"}, MaxHops: 2})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, p.Check(ctx, "https://sho.rt/aaaaaa"))
+	assert.NoError(t, p.Check(ctx, "https://sho.rt/bbbbbb"), "should allow 2 hops")
+	assert.NoError(t, p.Check(ctx, "https://sho.rt/zzzzzz"), "should allow the missing link")
+	assert.Equal(t, RuleLoop, ruleOf(p.Check(ctx, "https://sho.rt/cccccc")), "should detect the loop through the rules")
+	assert.Equal(t, RuleScheme, ruleOf(p.Check(ctx, "https://sho.rt/eeeeee")), "should check the variants")
+
+	links["ffffff"] = &models.Url{Id: "ffffff", Url: "https://sho.rt/bbbbbb"}
+	assert.Equal(t, RuleLoop, ruleOf(p.Check(ctx, "https://sho.rt/ffffff")), "should limit the hops")
+}
+
+func TestCheck_chained_short_links_across_domains(t *testing.T) {
+	links := map[string]*models.Url{
+		"aaaaaa":       {Id: "aaaaaa", Url: "https://ex.co/aaaaaa"},
+		"ex.co/aaaaaa": {Domain: "ex.co", Id: "aaaaaa", Url: "https://example.com"},
+		"bbbbbb":       {Id: "bbbbbb", Url: "https://ex.co/bbbbbb"},
+		"ex.co/bbbbbb": {Domain: "ex.co", Id: "bbbbbb", Url: "https://sho.rt/bbbbbb"},
+	}
+	p, err := New(lookupOf(links), zap.NewNop(), Config{Self: []string{"https://sho.rt", "https://EX.co"}, MaxHops: 2})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, p.Check(ctx, "https://sho.rt/aaaaaa"), "should follow the same id on the other domain")
+	assert.Equal(t, RuleLoop, ruleOf(p.Check(ctx, "https://ex.co/bbbbbb")), "should detect the loop across the domains")
+}
+
+func TestReadLists(t *testing.T) {
+	lists, err := ReadLists(strings.NewReader("# comment\n\nallow example.com\ndeny *.Evil.COM\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, &Lists{Allow: []string{"example.com"}, Deny: []string{"evil.com"}}, lists)
+
+	_, err = ReadLists(strings.NewReader("block example.com\n"))
+	assert.Error(t, err)
+	_, err = ReadLists(strings.NewReader("deny\n"))
+	assert.Error(t, err)
+}
+
+func TestCheck_lists_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urlpolicy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lists.txt")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("deny evil.com\n"), 0644))
+
+	p, err := New(lookupOf(nil), zap.NewNop(), Config{ListFile: file, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	ctx := context.Background()
+	assert.Equal(t, RuleDeny, ruleOf(p.Check(ctx, "https://www.evil.com")))
+	assert.NoError(t, p.Check(ctx, "https://notevil.com"))
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("allow example.com\n"), 0644))
+	// make sure the modification time changes on coarse file systems
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(file, later, later))
+	assert.Eventually(t, func() bool {
+		return ruleOf(p.Check(ctx, "https://www.evil.com")) == RuleAllow
+	}, time.Second, 10*time.Millisecond, "should reload the lists")
+	assert.NoError(t, p.Check(ctx, "https://example.com"))
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("block example.com\n"), 0644))
+	evenLater := later.Add(time.Second)
+	assert.NoError(t, os.Chtimes(file, evenLater, evenLater))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, p.Check(ctx, "https://example.com"), "should keep the last lists if reload fails")
+
+	_, err = New(lookupOf(nil), zap.NewNop(), Config{ListFile: filepath.Join(dir, "missing.txt")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package warmup
+
+import (
+	"context"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBatchSize = 100
+	defaultRate      = 1000
+)
+
+const (
+	StateIdle    = "idle"
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// Primer is implemented by the cache, see cache.New().
+type Primer interface {
+	// Prime caches the link with its real TTL.
+	Prime(link *models.Url)
+	// Mark leaves a marker after warming up, and Marked reports whether the
+	// marker still exists, i.e. the cache has not been flushed.
+	Mark() error
+	Marked() (bool, error)
+}
+
+type Config struct {
+	// Size is the number of links to preload.
+	Size int
+	// OrderBy selects which links to preload, repository.OrderByRecent or
+	// repository.OrderByClicks.
+	OrderBy string
+	// Rate limits how many links are loaded from database per second.
+	Rate      int
+	BatchSize int
+	// WatchInterval is how often to check whether the cache is flushed, and
+	// warm it up again if so. Zero disables watching.
+	WatchInterval time.Duration
+}
+
+// Progress is reported through the health endpoint.
+type Progress struct {
+	State      string     `json:"state"`
+	Total      int        `json:"total"`
+	Loaded     int        `json:"loaded"`
+	Runs       int        `json:"runs"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Warmer preloads the popular links into the cache in background.
+type Warmer interface {
+	// Start starts warming up, it returns false if it is already running.
+	Start() bool
+	Progress() Progress
+	// Close stops warming up and watching.
+	Close()
+}
+
+func New(db repository.Repository, primer Primer, logger *zap.Logger, config Config) Warmer {
+	if config.Rate <= 0 {
+		config.Rate = defaultRate
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &warmer{
+		db:       db,
+		primer:   primer,
+		logger:   logger,
+		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		progress: Progress{State: StateIdle},
+	}
+	if config.WatchInterval > 0 {
+		w.wg.Add(1)
+		go w.watch()
+	}
+	return w
+}
+
+type warmer struct {
+	db     repository.Repository
+	primer Primer
+	logger *zap.Logger
+	config Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	progress Progress
+}
+
+func (w *warmer) Start() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.progress.State == StateRunning || w.ctx.Err() != nil {
+		return false
+	}
+	now := time.Now()
+	w.progress = Progress{
+		State:     StateRunning,
+		Total:     w.config.Size,
+		Runs:      w.progress.Runs + 1,
+		StartedAt: &now,
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.finish(w.run(w.ctx))
+	}()
+	return true
+}
+
+func (w *warmer) Progress() Progress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.progress
+}
+
+func (w *warmer) Close() {
+	// hold the lock, so that Start() never adds to wg after waiting
+	w.mu.Lock()
+	w.cancel()
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// run loads the links page by page, and waits between pages to keep the
+// rate of loading.
+func (w *warmer) run(ctx context.Context) error {
+	w.logger.Info("warm up cache", zap.Int("size", w.config.Size), zap.String("orderBy", w.config.OrderBy))
+	for offset := 0; offset < w.config.Size; {
+		limit := w.config.BatchSize
+		if rest := w.config.Size - offset; rest < limit {
+			limit = rest
+		}
+		start := time.Now()
+		links, err := w.db.SelectPopular(ctx, w.config.OrderBy, offset, limit)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			w.primer.Prime(link)
+		}
+		offset += len(links)
+		w.mu.Lock()
+		w.progress.Loaded = offset
+		w.mu.Unlock()
+		if len(links) < limit {
+			// no more live links
+			break
+		}
+
+		wait := time.Duration(len(links))*time.Second/time.Duration(w.config.Rate) - time.Since(start)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return w.primer.Mark()
+}
+
+func (w *warmer) finish(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	w.progress.FinishedAt = &now
+	if err != nil {
+		w.progress.State = StateFailed
+		w.progress.Error = err.Error()
+		w.logger.Warn("warm up cache error", zap.Error(err), zap.Int("loaded", w.progress.Loaded))
+		return
+	}
+	w.progress.State = StateDone
+	// there may be fewer live links than expected
+	w.progress.Total = w.progress.Loaded
+	w.logger.Info("warm up cache done", zap.Int("loaded", w.progress.Loaded),
+		zap.Duration("elapsed", now.Sub(*w.progress.StartedAt)))
+}
+
+// watch warms up the cache again once the marker disappears, e.g. Redis is
+// flushed or failed over to an empty replica.
+func (w *warmer) watch() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.config.WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if w.Progress().State == StateRunning {
+			continue
+		}
+		marked, err := w.primer.Marked()
+		if err != nil {
+			w.logger.Warn("check warm-up marker error", zap.Error(err))
+			continue
+		}
+		if !marked {
+			w.logger.Info("cache seems flushed, warm it up again")
+			w.Start()
+		}
+	}
+}
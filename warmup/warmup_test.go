@@ -0,0 +1,145 @@
+package warmup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goshorturl/models"
+	"goshorturl/repository"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rShetty/asyncwait"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type popularDB struct {
+	repository.UnimplementedRepository
+	live    int
+	err     error
+	mu      sync.Mutex
+	queries int
+}
+
+func (p *popularDB) SelectPopular(ctx context.Context, orderBy string, offset, limit int) ([]*models.Url, error) {
+	p.mu.Lock()
+	p.queries++
+	p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	var links []*models.Url
+	for i := offset; i < offset+limit && i < p.live; i++ {
+		expiredAt := time.Now().Add(time.Hour)
+		links = append(links, &models.Url{Id: fmt.Sprintf("%06d", i), ExpiredAt: &expiredAt})
+	}
+	return links, nil
+}
+
+type fakePrimer struct {
+	mu     sync.Mutex
+	primed map[string]bool
+	marked bool
+}
+
+func newFakePrimer() *fakePrimer {
+	return &fakePrimer{primed: make(map[string]bool)}
+}
+
+func (f *fakePrimer) Prime(link *models.Url) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.primed[link.Id] = true
+}
+
+func (f *fakePrimer) Mark() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.marked = true
+	return nil
+}
+
+func (f *fakePrimer) Marked() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.marked, nil
+}
+
+func (f *fakePrimer) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.primed = make(map[string]bool)
+	f.marked = false
+}
+
+func (f *fakePrimer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.primed)
+}
+
+func waitState(w Warmer, state string) bool {
+	return asyncwait.NewAsyncWait(2000, 10).Check(func() bool {
+		return w.Progress().State == state
+	})
+}
+
+func TestWarmer(t *testing.T) {
+	db := &popularDB{live: 250}
+	primer := newFakePrimer()
+	w := New(db, primer, zap.NewNop(), Config{Size: 300, BatchSize: 100, Rate: 10000})
+	defer w.Close()
+	assert.Equal(t, StateIdle, w.Progress().State)
+
+	assert.True(t, w.Start())
+	assert.True(t, waitState(w, StateDone))
+	progress := w.Progress()
+	assert.Equal(t, 250, progress.Loaded)
+	assert.Equal(t, 250, progress.Total)
+	assert.Equal(t, 1, progress.Runs)
+	assert.Equal(t, 250, primer.count())
+	marked, _ := primer.Marked()
+	assert.True(t, marked)
+}
+
+func TestWarmer_rate_limited(t *testing.T) {
+	db := &popularDB{live: 1000}
+	w := New(db, newFakePrimer(), zap.NewNop(), Config{Size: 30, BatchSize: 10, Rate: 200})
+	defer w.Close()
+
+	start := time.Now()
+	assert.True(t, w.Start())
+	assert.False(t, w.Start(), "only one run at a time")
+	assert.True(t, waitState(w, StateDone))
+	// 30 links at 200 per second
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(150*time.Millisecond))
+}
+
+func TestWarmer_failed(t *testing.T) {
+	db := &popularDB{err: errors.New("db down")}
+	w := New(db, newFakePrimer(), zap.NewNop(), Config{Size: 10})
+	defer w.Close()
+
+	assert.True(t, w.Start())
+	assert.True(t, waitState(w, StateFailed))
+	assert.Equal(t, "db down", w.Progress().Error)
+}
+
+func TestWarmer_rewarm_after_flush(t *testing.T) {
+	db := &popularDB{live: 10}
+	primer := newFakePrimer()
+	w := New(db, primer, zap.NewNop(), Config{Size: 10, WatchInterval: 10 * time.Millisecond})
+	defer w.Close()
+
+	w.Start() // the watcher may have started it already
+	assert.True(t, waitState(w, StateDone))
+
+	primer.flush()
+	rewarmed := asyncwait.NewAsyncWait(2000, 10).Check(func() bool {
+		return w.Progress().Runs == 2 && w.Progress().State == StateDone
+	})
+	assert.True(t, rewarmed)
+	assert.Equal(t, 10, primer.count())
+}